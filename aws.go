@@ -0,0 +1,175 @@
+package ibk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+var ErrAWSCredentials = errors.New("error while resolving AWS credentials")
+
+// AWSUploadConfig configures uploading of the image to an S3 bucket and registering it as
+// an AMI. It is supported by both ContainerBootCommand and ContainerCliCommand.
+type AWSUploadConfig struct {
+	// AWSAccessKeyID credential. Maps to the AWS_ACCESS_KEY_ID environment variable which is
+	// passed to the container via CredentialStore.
+	AWSAccessKeyID string
+
+	// AWSSecretAccessKey credential. Maps to the AWS_SECRET_ACCESS_KEY environment variable
+	// which is passed to the container via CredentialStore.
+	AWSSecretAccessKey string
+
+	// AWSSessionToken credential for temporary credentials. Optional. Maps to the
+	// AWS_SESSION_TOKEN environment variable which is passed to the container via
+	// CredentialStore.
+	AWSSessionToken string
+
+	// Profile is the shared config profile used by Resolve. Optional.
+	Profile string
+
+	// AMIName is the name of the AMI to register.
+	AMIName string
+
+	// S3Bucket is the name of a temporary S3 bucket to upload the image to.
+	S3Bucket string
+
+	// Region is the region of the S3 bucket and the resulting AMI. It is also passed to the
+	// container as the AWS_REGION environment variable.
+	Region string
+
+	// BootMode is the AMI boot mode: uefi, legacy-bios or uefi-preferred. Optional, only
+	// supported by image-builder-cli.
+	BootMode string
+
+	// Tags are applied to the AMI and the snapshot. Optional, only supported by
+	// image-builder-cli.
+	Tags map[string]string
+
+	// ShareWith is a list of AWS account IDs the AMI is shared with. Optional, only
+	// supported by image-builder-cli.
+	ShareWith []string
+}
+
+// Validate checks that the required fields are set and the image type can be uploaded
+// to AWS.
+func (c *AWSUploadConfig) Validate(imageType string) error {
+	if imageType != "ami" {
+		return errors.New("aws upload requires type ami")
+	}
+
+	if c.AMIName == "" || c.S3Bucket == "" || c.Region == "" {
+		return errors.New("aws ami name, s3 bucket and region are required")
+	}
+
+	return nil
+}
+
+// cliArgs returns upload arguments of image-builder-cli.
+func (c *AWSUploadConfig) cliArgs() []string {
+	args := []string{
+		"--aws-ami-name", c.AMIName,
+		"--aws-bucket", c.S3Bucket,
+		"--aws-region", c.Region,
+	}
+
+	if c.BootMode != "" {
+		args = append(args, "--aws-boot-mode", c.BootMode)
+	}
+
+	keys := make([]string, 0, len(c.Tags))
+	for k := range c.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--aws-tag", k+"="+c.Tags[k])
+	}
+
+	for _, id := range c.ShareWith {
+		args = append(args, "--aws-share-with", id)
+	}
+
+	return args
+}
+
+// Resolve fills credentials and region from the standard AWS sources when they are not set
+// explicitly: environment variables (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+// AWS_SESSION_TOKEN, AWS_REGION), shared credentials and config files with the Profile
+// (or AWS_PROFILE), including SSO and assume role profiles, and the instance metadata.
+// Roles are assumed locally, the build container only receives the resulting temporary
+// credentials with the session token.
+func (c *AWSUploadConfig) Resolve(ctx context.Context) error {
+	var opts []func(*config.LoadOptions) error
+	if c.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(c.Profile))
+	}
+
+	if c.AWSAccessKeyID != "" {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(c.AWSAccessKeyID, c.AWSSecretAccessKey, c.AWSSessionToken)))
+	}
+
+	if c.Region != "" {
+		opts = append(opts, config.WithRegion(c.Region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAWSCredentials, err)
+	}
+
+	value, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAWSCredentials, err)
+	}
+	log.Printf("[DEBUG] Resolved AWS credentials %q from %s", value.AccessKeyID, value.Source)
+
+	c.AWSAccessKeyID = value.AccessKeyID
+	c.AWSSecretAccessKey = value.SecretAccessKey
+	c.AWSSessionToken = value.SessionToken
+	c.Region = cfg.Region
+
+	return nil
+}
+
+// credentials returns credentials passed to the build container.
+func (c *AWSUploadConfig) credentials() []Credential {
+	creds := []Credential{
+		{Env: "AWS_ACCESS_KEY_ID", Value: c.AWSAccessKeyID},
+		{Env: "AWS_SECRET_ACCESS_KEY", Value: c.AWSSecretAccessKey},
+	}
+
+	if c.AWSSessionToken != "" {
+		creds = append(creds, Credential{Env: "AWS_SESSION_TOKEN", Value: c.AWSSessionToken})
+	}
+
+	return creds
+}
+
+var (
+	amiRegexp      = regexp.MustCompile(`\bami-[0-9a-f]{8,17}\b`)
+	snapshotRegexp = regexp.MustCompile(`\bsnap-[0-9a-f]{8,17}\b`)
+)
+
+// amiScanner finds the last AMI and snapshot IDs in the build output.
+type amiScanner struct {
+	ami      lastMatch
+	snapshot lastMatch
+}
+
+func (s *amiScanner) scan(line string) {
+	s.ami.scan(amiRegexp, line)
+	s.snapshot.scan(snapshotRegexp, line)
+}
+
+// collect appends the registered image to the result or emits a warning when no AMI ID was
+// found in the build output.
+func (s *amiScanner) collect(ctx context.Context, region string, res *Result) {
+	collectImage(ctx, CloudImage{Provider: "aws", Region: region, ID: s.ami.String(), SnapshotID: s.snapshot.String()}, res)
+}
@@ -0,0 +1,123 @@
+package ibk_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+func TestAWSUploadConfigResolve(t *testing.T) {
+	dir := t.TempDir()
+	credsFile := filepath.Join(dir, "credentials")
+	configFile := filepath.Join(dir, "config")
+
+	err := os.WriteFile(credsFile, []byte(`[default]
+aws_access_key_id = DEFAULTKEY
+aws_secret_access_key = default-secret
+
+[build]
+aws_access_key_id = PROFILEKEY
+aws_secret_access_key = profile-secret
+aws_session_token = profile-token
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(configFile, []byte(`[profile build]
+region = eu-west-1
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		in   ibk.AWSUploadConfig
+		want ibk.AWSUploadConfig
+	}{
+		{
+			name: "static",
+			in: ibk.AWSUploadConfig{
+				AWSAccessKeyID:     "STATICKEY",
+				AWSSecretAccessKey: "static-secret",
+				Region:             "us-east-1",
+			},
+			want: ibk.AWSUploadConfig{
+				AWSAccessKeyID:     "STATICKEY",
+				AWSSecretAccessKey: "static-secret",
+				Region:             "us-east-1",
+			},
+		},
+		{
+			name: "environment",
+			env: map[string]string{
+				"AWS_ACCESS_KEY_ID":     "ENVKEY",
+				"AWS_SECRET_ACCESS_KEY": "env-secret",
+				"AWS_SESSION_TOKEN":     "env-token",
+				"AWS_REGION":            "us-west-2",
+			},
+			want: ibk.AWSUploadConfig{
+				AWSAccessKeyID:     "ENVKEY",
+				AWSSecretAccessKey: "env-secret",
+				AWSSessionToken:    "env-token",
+				Region:             "us-west-2",
+			},
+		},
+		{
+			name: "default-profile",
+			want: ibk.AWSUploadConfig{
+				AWSAccessKeyID:     "DEFAULTKEY",
+				AWSSecretAccessKey: "default-secret",
+			},
+		},
+		{
+			name: "profile",
+			in:   ibk.AWSUploadConfig{Profile: "build"},
+			want: ibk.AWSUploadConfig{
+				AWSAccessKeyID:     "PROFILEKEY",
+				AWSSecretAccessKey: "profile-secret",
+				AWSSessionToken:    "profile-token",
+				Profile:            "build",
+				Region:             "eu-west-1",
+			},
+		},
+		{
+			name: "profile-from-environment-explicit-region",
+			env:  map[string]string{"AWS_PROFILE": "build"},
+			in:   ibk.AWSUploadConfig{Region: "ap-south-1"},
+			want: ibk.AWSUploadConfig{
+				AWSAccessKeyID:     "PROFILEKEY",
+				AWSSecretAccessKey: "profile-secret",
+				AWSSessionToken:    "profile-token",
+				Region:             "ap-south-1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+				"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_PROFILE", "AWS_DEFAULT_PROFILE"} {
+				t.Setenv(name, tt.env[name])
+			}
+			t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credsFile)
+			t.Setenv("AWS_CONFIG_FILE", configFile)
+			t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+			cfg := tt.in
+			if err := cfg.Resolve(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.want, cfg); diff != "" {
+				t.Errorf("unexpected config: %s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package ibk
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// AzureUploadConfig configures uploading of the image to an Azure storage account and
+// creating a managed image from it. It is supported by ContainerCliCommand.
+type AzureUploadConfig struct {
+	// TenantID credential. Maps to the AZURE_TENANT_ID environment variable.
+	TenantID string
+
+	// SubscriptionID credential. Maps to the AZURE_SUBSCRIPTION_ID environment variable.
+	SubscriptionID string
+
+	// ClientID credential. Maps to the AZURE_CLIENT_ID environment variable.
+	ClientID string
+
+	// ClientSecret credential. Maps to the AZURE_CLIENT_SECRET environment variable.
+	ClientSecret string
+
+	// ResourceGroup is the resource group of the image.
+	ResourceGroup string
+
+	// Location is the Azure location of the image.
+	Location string
+
+	// ImageName is the name of the image to create.
+	ImageName string
+}
+
+var azureImageRegexp = regexp.MustCompile(`(?i)/subscriptions/[^/\s]+/resourceGroups/[^/\s]+/providers/Microsoft\.Compute/images/[^/\s"']+`)
+
+// Validate checks that the required fields are set and the image type can be uploaded
+// to Azure.
+func (c *AzureUploadConfig) Validate(imageType string) error {
+	if imageType != "vhd" && !strings.HasPrefix(imageType, "azure") {
+		return errors.New("azure upload requires a vhd or azure image type")
+	}
+
+	if c.TenantID == "" || c.SubscriptionID == "" || c.ClientID == "" || c.ClientSecret == "" {
+		return errors.New("azure tenant id, subscription id, client id and client secret are required")
+	}
+
+	if c.ResourceGroup == "" || c.Location == "" || c.ImageName == "" {
+		return errors.New("azure resource group, location and image name are required")
+	}
+
+	return nil
+}
+
+// credentials returns credentials passed to the build container.
+func (c *AzureUploadConfig) credentials() []Credential {
+	return []Credential{
+		{Env: "AZURE_TENANT_ID", Value: c.TenantID},
+		{Env: "AZURE_SUBSCRIPTION_ID", Value: c.SubscriptionID},
+		{Env: "AZURE_CLIENT_ID", Value: c.ClientID},
+		{Env: "AZURE_CLIENT_SECRET", Value: c.ClientSecret},
+	}
+}
+
+// cliArgs returns upload arguments of image-builder-cli.
+func (c *AzureUploadConfig) cliArgs() []string {
+	return []string{
+		"--azure-resource-group", c.ResourceGroup,
+		"--azure-location", c.Location,
+		"--azure-image-name", c.ImageName,
+	}
+}
+
+// azureScanner finds the last managed image resource ID in the build output.
+type azureScanner struct {
+	image lastMatch
+}
+
+func (s *azureScanner) scan(line string) {
+	s.image.scan(azureImageRegexp, line)
+}
+
+func (s *azureScanner) cloudImage(location string) CloudImage {
+	return CloudImage{Provider: "azure", Region: location, ID: s.image.String()}
+}
@@ -0,0 +1,269 @@
+package ibk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ErrBootstrap is returned when bootstrapping of the build host fails.
+var ErrBootstrap = errors.New("error while bootstrapping build host")
+
+// DefaultBootstrapTools are tools installed by Bootstrap in addition to DefaultPreflightTools
+// and the container runtime: sudo.
+var DefaultBootstrapTools = []string{"sudo"}
+
+// bootstrapRuntimes are the supported container runtimes, the first one is installed when none
+// of them is found.
+var bootstrapRuntimes = []string{"podman", "docker"}
+
+// bootstrapPackages are package names of tools by OS family, the tool name is the package name
+// when not listed.
+var bootstrapPackages = map[string]map[string]string{
+	"fedora": {
+		"scp":       "openssh-clients",
+		"find":      "findutils",
+		"flock":     "util-linux",
+		"tee":       "coreutils",
+		"sha256sum": "coreutils",
+		"sha512sum": "coreutils",
+	},
+	"debian": {
+		"scp":       "openssh-client",
+		"find":      "findutils",
+		"flock":     "util-linux",
+		"tee":       "coreutils",
+		"sha256sum": "coreutils",
+		"sha512sum": "coreutils",
+		"xz":        "xz-utils",
+		"qemu-img":  "qemu-utils",
+	},
+	"suse": {
+		"scp":       "openssh-clients",
+		"find":      "findutils",
+		"flock":     "util-linux",
+		"tee":       "coreutils",
+		"sha256sum": "coreutils",
+		"sha512sum": "coreutils",
+		"qemu-img":  "qemu-tools",
+	},
+	"arch": {
+		"scp":       "openssh",
+		"find":      "findutils",
+		"flock":     "util-linux",
+		"tee":       "coreutils",
+		"sha256sum": "coreutils",
+		"sha512sum": "coreutils",
+	},
+}
+
+// bootstrapInstall are package manager invocations by OS family, packages are appended.
+var bootstrapInstall = map[string]Invocation{
+	"fedora": {Args: []string{"dnf", "install", "-y"}},
+	"debian": {Env: []string{"DEBIAN_FRONTEND=noninteractive"}, Args: []string{"apt-get", "install", "-y", "--no-install-recommends"}},
+	"suse":   {Args: []string{"zypper", "--non-interactive", "install"}},
+	"arch":   {Args: []string{"pacman", "-S", "--noconfirm", "--needed"}},
+}
+
+// bootstrapUpdate are package index updates run before installing by OS family.
+var bootstrapUpdate = map[string]Invocation{
+	"debian": {Args: []string{"apt-get", "update"}, Idempotent: true},
+}
+
+// BootstrapConfig configures bootstrapping of the build host.
+type BootstrapConfig struct {
+	// User is the build user granted password-less sudo via a drop-in in /etc/sudoers.d,
+	// nothing is configured when empty or root.
+	User string
+
+	// Tools are required tools in addition to DefaultPreflightTools and
+	// DefaultBootstrapTools, missing tools are installed. A container runtime listed here is
+	// installed even when the other one is present.
+	Tools []string
+}
+
+// BootstrapReport describes changes made by Bootstrap.
+type BootstrapReport struct {
+	// Family is the OS family: fedora, debian, suse or arch.
+	Family string
+
+	// Installed are the installed packages, empty when all tools were present.
+	Installed []string
+
+	// Sudoers is the path of the sudoers drop-in when it was written.
+	Sudoers string
+}
+
+var sudoUserRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_.-]*$`)
+
+// Bootstrap prepares the build host: packages of missing tools are installed with the native
+// package manager, podman only when neither podman nor docker is found, and the build user is
+// granted password-less sudo. It only changes what is missing so it can run before every
+// build. The connected user must be root or allowed to run sudo without a password.
+func Bootstrap(ctx context.Context, exec Executor, cfg BootstrapConfig) (*BootstrapReport, error) {
+	if cfg.User != "" && !sudoUserRegexp.MatchString(cfg.User) {
+		return nil, fmt.Errorf("%w: invalid user name %q", ErrBootstrap, cfg.User)
+	}
+
+	// sudo may be missing when connected as root
+	uid, err := tail1(ctx, exec, Invocation{Args: []string{"id", "-u"}, Idempotent: true})
+	if err != nil {
+		return nil, fmt.Errorf("%w: id: %w", ErrBootstrap, err)
+	}
+	privileged := uid != "0"
+
+	osRelease, err := output(ctx, exec, Invocation{Args: []string{"cat", "/etc/os-release"}, Idempotent: true})
+	if err != nil {
+		return nil, fmt.Errorf("%w: os-release: %w", ErrBootstrap, err)
+	}
+
+	r := &BootstrapReport{Family: osFamily(osRelease)}
+	if r.Family == "" {
+		return nil, fmt.Errorf("%w: unsupported operating system", ErrBootstrap)
+	}
+	log.Printf("[DEBUG] Found OS family %s", r.Family)
+
+	// install packages of missing tools
+	var tools []string
+	for _, t := range slices.Concat(DefaultPreflightTools, bootstrapRuntimes, DefaultBootstrapTools, cfg.Tools) {
+		if !slices.Contains(tools, t) {
+			tools = append(tools, t)
+		}
+	}
+
+	missing, err := missingTools(ctx, exec, tools)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBootstrap, err)
+	}
+
+	// a container runtime is only installed when none is found
+	found := slices.ContainsFunc(bootstrapRuntimes, func(t string) bool { return !slices.Contains(missing, t) })
+	missing = slices.DeleteFunc(missing, func(t string) bool {
+		return slices.Contains(bootstrapRuntimes, t) && (found || t != bootstrapRuntimes[0]) && !slices.Contains(cfg.Tools, t)
+	})
+
+	for _, t := range missing {
+		pkg, ok := bootstrapPackages[r.Family][t]
+		if !ok {
+			pkg = t
+		}
+		if !slices.Contains(r.Installed, pkg) {
+			r.Installed = append(r.Installed, pkg)
+		}
+	}
+
+	if len(r.Installed) > 0 {
+		var invs []Invocation
+		if inv, ok := bootstrapUpdate[r.Family]; ok {
+			invs = append(invs, inv)
+		}
+		inv := bootstrapInstall[r.Family]
+		inv.Args = slices.Concat(inv.Args, r.Installed)
+		invs = append(invs, inv)
+
+		for _, inv := range invs {
+			inv.Privileged = privileged
+			stderr := &SyncedBuffer{}
+			err = exec.Execute(ctx, inv, WithInputOutput(nil, nil, stderr))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %w: %s", ErrBootstrap, inv.Args[0], err, stderr.String())
+			}
+		}
+
+		msg := fmt.Sprintf("installed %s", strings.Join(r.Installed, ", "))
+		log.Printf("[DEBUG] Bootstrap %s", msg)
+		emit(ctx, Event{Type: EventBootstrap, Message: msg})
+	}
+
+	// configure sudo for the build user
+	if cfg.User != "" && cfg.User != "root" {
+		path, changed, err := writeSudoers(ctx, exec, privileged, cfg.User)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBootstrap, err)
+		}
+
+		if changed {
+			r.Sudoers = path
+			emit(ctx, Event{Type: EventBootstrap, Message: "configured " + path})
+		}
+	}
+
+	return r, nil
+}
+
+// osFamily returns the family of the operating system from the os-release file.
+func osFamily(osRelease string) string {
+	var ids []string
+	for _, line := range strings.Split(osRelease, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok && (key == "ID" || key == "ID_LIKE") {
+			ids = append(ids, strings.Fields(strings.Trim(value, `"'`))...)
+		}
+	}
+
+	for _, id := range ids {
+		switch id {
+		case "fedora", "rhel", "centos":
+			return "fedora"
+		case "debian", "ubuntu":
+			return "debian"
+		case "suse", "opensuse", "sles":
+			return "suse"
+		case "arch":
+			return "arch"
+		}
+	}
+
+	return ""
+}
+
+// writeSudoers writes the sudoers drop-in of the user when its contents differ. The file is
+// validated with visudo before it is moved into place.
+func writeSudoers(ctx context.Context, exec Executor, privileged bool, user string) (string, bool, error) {
+	// files with a dot are ignored by sudo
+	path := "/etc/sudoers.d/ibpacker-" + strings.ReplaceAll(user, ".", "_")
+	contents := user + " ALL=(ALL) NOPASSWD: ALL\n"
+
+	current, err := output(ctx, exec, Invocation{
+		Privileged: privileged,
+		Idempotent: true,
+		Args:       []string{"sh", "-c", `cat "$1" 2>/dev/null || true`, "sh", path},
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("read %s: %w", path, err)
+	}
+	if current == contents {
+		log.Printf("[DEBUG] Sudoers drop-in %s is up to date", path)
+		return path, false, nil
+	}
+
+	stderr := &SyncedBuffer{}
+	err = exec.Execute(ctx, Invocation{
+		Privileged: privileged,
+		Args: []string{
+			"sh", "-c", `cat > "$1.tmp" && chmod 0440 "$1.tmp" && visudo -cqf "$1.tmp" && mv "$1.tmp" "$1"`,
+			"sh", path,
+		},
+	}, WithInputOutput(strings.NewReader(contents), nil, stderr))
+	if err != nil {
+		return "", false, fmt.Errorf("write %s: %w: %s", path, err, stderr.String())
+	}
+
+	log.Printf("[DEBUG] Wrote sudoers drop-in %s", path)
+	return path, true, nil
+}
+
+// output returns the standard output of the invocation.
+func output(ctx context.Context, exec Executor, inv Invocation) (string, error) {
+	stdout := &SyncedBuffer{}
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, inv, WithInputOutput(nil, stdout, stderr))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, stderr.String())
+	}
+	return stdout.String(), nil
+}
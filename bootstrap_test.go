@@ -0,0 +1,139 @@
+package ibk_test
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+	"github.com/osbuild/packer-plugin-image-builder/internal/sshtest"
+)
+
+const fedoraRelease = `NAME="Fedora Linux"
+VERSION="41 (Server Edition)"
+ID=fedora
+VERSION_ID=41
+`
+
+const ubuntuRelease = `NAME="Ubuntu"
+VERSION="24.04.1 LTS (Noble Numbat)"
+ID=ubuntu
+ID_LIKE=debian
+`
+
+const toolsCheck = `sh -c 'for t; do command -v "$t" >/dev/null || echo "$t"; done' sh scp bash tee find podman docker sudo`
+
+func TestBootstrap(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ibk.BootstrapConfig
+		session []sshtest.RequestReply
+		want    *ibk.BootstrapReport
+	}{
+		{
+			name: "fedora",
+			cfg:  ibk.BootstrapConfig{User: "builder", Tools: []string{"flock", "sha256sum"}},
+			session: []sshtest.RequestReply{
+				{Request: "id -u", Reply: "1000"},
+				{Request: "cat /etc/os-release", Reply: fedoraRelease},
+				{Request: regexp.QuoteMeta(toolsCheck + " flock sha256sum"), Reply: "scp\npodman\ndocker\nflock\n"},
+				{Request: regexp.QuoteMeta("sudo dnf install -y openssh-clients podman util-linux")},
+				{Request: regexp.QuoteMeta(`sudo sh -c 'cat "$1" 2>/dev/null || true' sh /etc/sudoers.d/ibpacker-builder`)},
+				{
+					Request: regexp.QuoteMeta(`sudo sh -c 'cat > "$1.tmp" && chmod 0440 "$1.tmp" && visudo -cqf "$1.tmp" && mv "$1.tmp" "$1"' sh /etc/sudoers.d/ibpacker-builder`),
+					Stdin:   regexp.QuoteMeta("builder ALL=(ALL) NOPASSWD: ALL\n"),
+				},
+			},
+			want: &ibk.BootstrapReport{
+				Family:    "fedora",
+				Installed: []string{"openssh-clients", "podman", "util-linux"},
+				Sudoers:   "/etc/sudoers.d/ibpacker-builder",
+			},
+		},
+		{
+			name: "ubuntu as root",
+			cfg:  ibk.BootstrapConfig{User: "root", Tools: []string{"xz"}},
+			session: []sshtest.RequestReply{
+				{Request: "id -u", Reply: "0"},
+				{Request: "cat /etc/os-release", Reply: ubuntuRelease},
+				{Request: regexp.QuoteMeta(toolsCheck + " xz"), Reply: "sudo\nxz\n"},
+				{Request: "^apt-get update$"},
+				{Request: "^env DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends sudo xz-utils$"},
+			},
+			want: &ibk.BootstrapReport{
+				Family:    "debian",
+				Installed: []string{"sudo", "xz-utils"},
+			},
+		},
+		{
+			name: "docker present",
+			cfg:  ibk.BootstrapConfig{},
+			session: []sshtest.RequestReply{
+				{Request: "id -u", Reply: "1000"},
+				{Request: "cat /etc/os-release", Reply: fedoraRelease},
+				{Request: regexp.QuoteMeta(toolsCheck), Reply: "scp\npodman\n"},
+				{Request: regexp.QuoteMeta("sudo dnf install -y openssh-clients") + "$"},
+			},
+			want: &ibk.BootstrapReport{
+				Family:    "fedora",
+				Installed: []string{"openssh-clients"},
+			},
+		},
+		{
+			name: "podman required",
+			cfg:  ibk.BootstrapConfig{Tools: []string{"podman"}},
+			session: []sshtest.RequestReply{
+				{Request: "id -u", Reply: "1000"},
+				{Request: "cat /etc/os-release", Reply: fedoraRelease},
+				{Request: regexp.QuoteMeta(toolsCheck), Reply: "podman\n"},
+				{Request: regexp.QuoteMeta("sudo dnf install -y podman") + "$"},
+			},
+			want: &ibk.BootstrapReport{
+				Family:    "fedora",
+				Installed: []string{"podman"},
+			},
+		},
+		{
+			name: "up to date",
+			cfg:  ibk.BootstrapConfig{User: "john.doe"},
+			session: []sshtest.RequestReply{
+				{Request: "id -u", Reply: "1000"},
+				{Request: "cat /etc/os-release", Reply: `ID="centos"` + "\n" + `ID_LIKE="rhel fedora"`},
+				{Request: regexp.QuoteMeta(toolsCheck)},
+				{Request: "sudoers.d/ibpacker-john_doe", Reply: "john.doe ALL=(ALL) NOPASSWD: ALL\n"},
+			},
+			want: &ibk.BootstrapReport{Family: "fedora"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := ibk.Bootstrap(context.Background(), sessionClient(t, tt.session), tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.want, report); diff != "" {
+				t.Errorf("unexpected report: %s", diff)
+			}
+		})
+	}
+}
+
+func TestBootstrapErrors(t *testing.T) {
+	_, err := ibk.Bootstrap(context.Background(), nil, ibk.BootstrapConfig{User: "bad user"})
+	if !errors.Is(err, ibk.ErrBootstrap) {
+		t.Errorf("expected ErrBootstrap, got %v", err)
+	}
+
+	session := []sshtest.RequestReply{
+		{Request: "id -u", Reply: "0"},
+		{Request: "cat /etc/os-release", Reply: "ID=gentoo\n"},
+	}
+	_, err = ibk.Bootstrap(context.Background(), sessionClient(t, session), ibk.BootstrapConfig{})
+	if !errors.Is(err, ibk.ErrBootstrap) {
+		t.Errorf("expected ErrBootstrap, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package ibk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// ErrChecksum is returned when computing, signing or verifying checksums fails.
+var ErrChecksum = errors.New("error while checksumming")
+
+// ChecksumConfig configures computing of output file checksums on the build host. A SHA256SUMS
+// file (and optionally SHA512SUMS) in the format of sha256sum is written into the output
+// directory and signed when a signer is set.
+type ChecksumConfig struct {
+	// SHA512 additionally computes SHA-512 checksums into SHA512SUMS.
+	SHA512 bool
+
+	// Signer signs SHA256SUMS, the detached signature is written next to it. Optional.
+	Signer Signer
+}
+
+var checksumLineRegexp = regexp.MustCompile(`^([0-9a-f]{64}|[0-9a-f]{128})\s+\*?(.+)$`)
+
+// computeChecksums computes checksums of all files of the result on the build host, writes
+// the sums files with an optional signature into the output directory and appends them to
+// Result.Manifests.
+func computeChecksums(ctx context.Context, exec Executor, cfg *ChecksumConfig, outputDir string, res *Result) error {
+	if len(res.Files) == 0 {
+		return nil
+	}
+
+	rels := make([]string, 0, len(res.Files))
+	for _, f := range res.Files {
+		rels = append(rels, relPath(outputDir, f.Path))
+	}
+
+	sums256, err := checksums(ctx, exec, "sha256sum", outputDir, rels)
+	if err != nil {
+		return err
+	}
+
+	var sums512 map[string]string
+	if cfg.SHA512 {
+		sums512, err = checksums(ctx, exec, "sha512sum", outputDir, rels)
+		if err != nil {
+			return err
+		}
+	}
+
+	var manifest256, manifest512 strings.Builder
+	for i := range res.Files {
+		rel := rels[i]
+		res.Files[i].SHA256 = sums256[rel]
+		manifest256.WriteString(sums256[rel] + "  " + rel + "\n")
+
+		if cfg.SHA512 {
+			res.Files[i].SHA512 = sums512[rel]
+			manifest512.WriteString(sums512[rel] + "  " + rel + "\n")
+		}
+	}
+
+	err = writeManifest(ctx, exec, outputPath(outputDir, "SHA256SUMS"), []byte(manifest256.String()), res)
+	if err != nil {
+		return err
+	}
+
+	if cfg.SHA512 {
+		err = writeManifest(ctx, exec, outputPath(outputDir, "SHA512SUMS"), []byte(manifest512.String()), res)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cfg.Signer != nil {
+		sig, err := cfg.Signer.Sign([]byte(manifest256.String()))
+		if err != nil {
+			return fmt.Errorf("%w: sign: %w", ErrChecksum, err)
+		}
+
+		err = writeManifest(ctx, exec, outputPath(outputDir, "SHA256SUMS"+cfg.Signer.Extension()), sig, res)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checksums runs the checksum tool in the directory and returns sums by relative paths.
+func checksums(ctx context.Context, exec Executor, tool, dir string, rels []string) (map[string]string, error) {
+	stdout := &SyncedBuffer{}
+	stderr := &SyncedBuffer{}
+	args := append([]string{tool, "--"}, rels...)
+	err := exec.Execute(ctx, Invocation{
+		Privileged: true,
+		Idempotent: true,
+		Dir:        dir,
+		Args:       args,
+	}, WithInputOutput(nil, stdout, stderr))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w: %s", ErrChecksum, tool, err, stderr.String())
+	}
+
+	sums := make(map[string]string)
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line == "" {
+			continue
+		}
+
+		m := checksumLineRegexp.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("%w: unexpected %s output: %q", ErrChecksum, tool, line)
+		}
+		sums[m[2]] = m[1]
+	}
+
+	for _, rel := range rels {
+		if sums[rel] == "" {
+			return nil, fmt.Errorf("%w: %s: no checksum of %s", ErrChecksum, tool, rel)
+		}
+	}
+
+	log.Printf("[DEBUG] Computed %d checksums via %s", len(sums), tool)
+	return sums, nil
+}
+
+// writeManifest writes a file into the output directory and appends it to Result.Manifests.
+func writeManifest(ctx context.Context, exec Executor, path string, contents []byte, res *Result) error {
+	err := writeOutputFile(ctx, exec, path, contents)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrChecksum, err)
+	}
+
+	res.Manifests = append(res.Manifests, File{Path: path, Size: int64(len(contents))})
+	return nil
+}
+
+// writeOutputFile writes a file owned by root into the output directory.
+func writeOutputFile(ctx context.Context, exec Executor, path string, contents []byte) error {
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, Invocation{
+		Privileged: true,
+		Args:       []string{"sh", "-c", `cat > "$1"`, "sh", path},
+	}, WithInputOutput(strings.NewReader(string(contents)), nil, stderr))
+	if err != nil {
+		return fmt.Errorf("write %s: %w: %s", path, err, stderr.String())
+	}
+
+	log.Printf("[DEBUG] Wrote %s (%d bytes)", path, len(contents))
+	return nil
+}
+
+// outputPath returns the path of a file in the output directory in the same form as find prints it,
+// path.Join would drop the leading "./".
+func outputPath(dir, name string) string {
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
+
+// relPath returns the path relative to the directory.
+func relPath(dir, p string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(p, dir), "/")
+}
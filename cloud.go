@@ -0,0 +1,44 @@
+package ibk
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"sync"
+)
+
+// lastMatch keeps the last match of a regular expression in scanned lines. It is safe for
+// concurrent use.
+type lastMatch struct {
+	mu    sync.Mutex
+	value string
+}
+
+func (m *lastMatch) scan(re *regexp.Regexp, line string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v := re.FindString(line); v != "" {
+		m.value = v
+	}
+}
+
+func (m *lastMatch) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.value
+}
+
+// collectImage appends the image to the result and emits an event. When the image ID is
+// empty, i.e. it was not found in the build output, a warning is emitted instead.
+func collectImage(ctx context.Context, img CloudImage, res *Result) {
+	if img.ID == "" {
+		emit(ctx, Event{Type: EventWarning, Phase: PhaseCollect, Message: "no " + img.Provider + " image ID found in the build output"})
+		return
+	}
+
+	log.Printf("[DEBUG] Found %s image %q (snapshot %q)", img.Provider, img.ID, img.SnapshotID)
+	emit(ctx, Event{Type: EventCloudImage, Phase: PhaseCollect, Message: img.String()})
+	res.Images = append(res.Images, img)
+}
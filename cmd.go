@@ -3,7 +3,9 @@ package ibk
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"time"
 )
 
 // ErrConfigure is returned when an error occurs during configuration.
@@ -12,6 +14,15 @@ var ErrConfigure = errors.New("error while configuring")
 // ErrPush is returned when an error occurs during pushing.
 var ErrPush = errors.New("error while pushing")
 
+// ErrExecute is returned when an error occurs during execution of the command.
+var ErrExecute = errors.New("error while executing")
+
+// ErrCollect is returned when an error occurs during collecting of results.
+var ErrCollect = errors.New("error while collecting results")
+
+// ErrCleanup is returned when an error occurs during cleanup.
+var ErrCleanup = errors.New("error while cleaning up")
+
 // Command is an interface for a command that can be executed.
 type Command interface {
 	// Configure configures the command and prepares the environment.
@@ -21,10 +32,23 @@ type Command interface {
 	// files and are automatically cleaned up after the command is executed.
 	Push(ctx context.Context, pusher Pusher) error
 
-	// Build returns the command to execute. This command is executed in the remote environment.
-	// The command should be a single string that can be passed to a shell. The command should
-	// not include the shell invocation and must be protected against shell injection.
-	Build() string
+	// Build returns the invocation to execute in the remote environment. Transports render
+	// the invocation into a shell command via Invocation.String or execute it directly.
+	Build() Invocation
+
+	// Collect gathers results after a successful execution, e.g. the list of produced files.
+	Collect(ctx context.Context, exec Executor, res *Result) error
+
+	// Cleanup removes resources created by the command on the remote host. It is called
+	// regardless of the result, also when Configure fails after creating some of them.
+	Cleanup(ctx context.Context, exec Executor) error
+}
+
+// OutputScanner is an optional interface of a command which extracts information from the
+// build output, e.g. IDs of uploaded images. ScanLine is called for every line of the build
+// output before Collect is called.
+type OutputScanner interface {
+	ScanLine(line string)
 }
 
 type CommonArgs struct {
@@ -40,39 +64,127 @@ type CommonArgs struct {
 
 	// TeeLog is a flag to tee the output of the command to a file named build.log for later use.
 	TeeLog bool
+
+	// Provenance is a flag to write an in-toto statement with a SLSA provenance predicate
+	// named provenance.json into the output directory after a successful build.
+	Provenance bool
 }
 
 type PrintFunc func(string)
 
-var noopPrintFunc = func(string) {}
+// ApplyCommand configures, pushes, executes a command, collects results and cleans up.
+func ApplyCommand(ctx context.Context, c Command, t Transport) (*Result, error) {
+	return ApplyCommandObserve(ctx, c, t, noopObserver)
+}
 
-// ApplyCommand configures, pushes, and executes a command.
-func ApplyCommand(ctx context.Context, c Command, t Transport) error {
-	return ApplyCommandPrint(ctx, c, t, noopPrintFunc)
+// ApplyCommandPrint configures, pushes, executes a command, collects results and cleans up.
+// It logs the phases to the provided PrintFunc.
+func ApplyCommandPrint(ctx context.Context, c Command, t Transport, log PrintFunc) (*Result, error) {
+	return ApplyCommandObserve(ctx, c, t, printObserver(log))
 }
 
-// ApplyCommand configures, pushes, and executes a command. It logs the command to the provided PrintFunc.
-func ApplyCommandPrint(ctx context.Context, c Command, t Transport, log PrintFunc) error {
+var phaseMessages = map[Phase]string{
+	PhaseConfigure: "Configuring environment",
+	PhasePush:      "Uploading configuration files",
+	PhaseBuild:     "Executing the build command",
+	PhaseCollect:   "Collecting results",
+	PhaseCleanup:   "Cleaning up",
+}
+
+// ApplyCommandObserve configures, pushes, executes a command, collects results and cleans up.
+// Events are sent to the provided observer. The result is returned even when an error occurs,
+// it contains data of the phases that were executed.
+func ApplyCommandObserve(ctx context.Context, c Command, t Transport, obs Observer) (res *Result, err error) {
+	ctx = WithObserver(ctx, obs)
+	started := time.Now()
+	res = &Result{
+		Durations: make(map[Phase]time.Duration),
+	}
+
+	phase := func(p Phase, f func() error) error {
+		emit(ctx, Event{Type: EventPhaseStarted, Phase: p, Message: phaseMessages[p]})
+		start := time.Now()
+
+		err := f()
+
+		res.Durations[p] = time.Since(start)
+		e := Event{Type: EventPhaseFinished, Phase: p, Message: phaseMessages[p], Duration: res.Durations[p]}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		emit(ctx, e)
 
-	log("Configuring environment")
-	err := c.Configure(ctx, t)
-	if err != nil {
 		return err
 	}
 
-	log("Uploading configuration files")
-	err = c.Push(ctx, t)
+	// cleanup also runs when configuration fails, it removes what was created until then
+	defer func() {
+		cerr := phase(PhaseCleanup, func() error {
+			return c.Cleanup(ctx, t)
+		})
+		if cerr != nil && err == nil {
+			err = fmt.Errorf("%w: %w", ErrCleanup, cerr)
+		}
+	}()
+
+	err = phase(PhaseConfigure, func() error {
+		return c.Configure(ctx, t)
+	})
+	if err != nil {
+		return res, err
+	}
+
+	err = phase(PhasePush, func() error {
+		return c.Push(ctx, observedPusher{t})
+	})
 	if err != nil {
+		return res, err
+	}
+
+	inv := c.Build()
+	res.LogFile = inv.LogFile
+	taps := []*LineTap{NewLineTap(stageLine(ctx))}
+	if s, ok := c.(OutputScanner); ok {
+		taps = append(taps, NewLineTap(s.ScanLine))
+	}
+	opts := make([]ExecuteOpt, len(taps))
+	for i, tap := range taps {
+		opts[i] = WithLineTap(tap)
+	}
+	err = phase(PhaseBuild, func() error {
+		err := t.Execute(ctx, inv, opts...)
+
+		// the last line may be unterminated when the build dies, it is scanned before
+		// the results are collected
+		for _, tap := range taps {
+			tap.Flush()
+		}
 		return err
+	})
+	if err != nil {
+		var ee *ExitError
+		if errors.As(err, &ee) {
+			res.ExitCode = ee.Status
+		}
+
+		if inv.LogFile != "" {
+			return res, fmt.Errorf("%w: %w (log: %s)", ErrExecute, err, inv.LogFile)
+		}
+		return res, fmt.Errorf("%w: %w", ErrExecute, err)
 	}
 
-	log("Executing the build command")
-	err = t.Execute(ctx, c)
+	err = phase(PhaseCollect, func() error {
+		err := c.Collect(ctx, t, res)
+		if err != nil {
+			return err
+		}
+		return recordProvenance(ctx, c, t, started, res)
+	})
 	if err != nil {
-		return err
+		return res, fmt.Errorf("%w: %w", ErrCollect, err)
 	}
 
-	return nil
+	return res, nil
 }
 
 var ErrNoContainerRuntime = errors.New("no container runtime found")
@@ -80,8 +192,8 @@ var ErrNoContainerRuntime = errors.New("no container runtime found")
 func which(ctx context.Context, exec Executor, name ...string) (string, error) {
 	buf := &SyncedBuffer{}
 	for _, n := range name {
-		cmd := "which " + n
-		err := exec.Execute(ctx, StringCommand(cmd), WithCombinedWriter(buf))
+		inv := Invocation{Args: []string{"which", n}, Idempotent: true}
+		err := exec.Execute(ctx, inv, WithCombinedWriter(buf))
 		if err != nil {
 			buf.Reset()
 			continue
@@ -94,12 +206,17 @@ func which(ctx context.Context, exec Executor, name ...string) (string, error) {
 	return "", ErrNoContainerRuntime
 }
 
-func tail1(ctx context.Context, exec Executor, cmd string) (string, error) {
+func tail1(ctx context.Context, exec Executor, inv Invocation) (string, error) {
 	buf := &SyncedBuffer{}
-	log.Printf("[DEBUG] Running command %q", cmd)
-	err := exec.Execute(ctx, StringCommand(cmd), WithCombinedWriter(buf))
+	log.Printf("[DEBUG] Running command %q", inv.String())
+	err := exec.Execute(ctx, inv, WithCombinedWriter(buf))
 	if err != nil {
 		return "", err
 	}
 	return buf.FirstLine(), nil
 }
+
+// detectArch returns the architecture of the remote host as reported by arch(1).
+func detectArch(ctx context.Context, exec Executor) (string, error) {
+	return tail1(ctx, exec, Invocation{Args: []string{"arch"}, Idempotent: true})
+}
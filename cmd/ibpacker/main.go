@@ -17,9 +17,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/logutils"
@@ -27,33 +32,42 @@ import (
 )
 
 func cli(ctx context.Context, args []string) {
-	flag := flag.NewFlagSet("ibpacker cli", flag.ExitOnError)
+	flag := flag.NewFlagSet("ibpacker cli", flag.ContinueOnError)
 	var (
 		distro        = flag.String("distro", "fedora", "distribution name (fedora, centos, rhel, ...)")
 		imageType     = flag.String("type", "minimal-raw", "image type (minimal-raw, qcow2, ...)")
 		arch          = flag.String("arch", "", "architecture")
 		blueprintFile = flag.String("blueprint", "", "path to blueprint file")
+		awsUpload     = awsFlags(flag)
+		objectStorage = objectStorageFlags(flag)
+		registryRef   = flag.String("registry-push", "", "push the container archive output to the registry reference")
+		registryUser  = flag.String("registry-username", "", "registry username")
+		registryPass  = flag.String("registry-password", "", "registry password")
+		registryTLS   = flag.Bool("registry-insecure", false, "disable TLS verification of the registry")
 	)
-	flag.Parse(args)
+	parseFlags(flag, args)
 
-	// open SSH connection
-	cfg := ibk.SSHTransportConfig{
-		Host:     *hostname,
-		Username: *username,
-		Timeout:  *connTimeout,
-		Stderr:   os.Stdout,
-	}
-	c, err := ibk.NewSSHTransport(cfg)
-	if err != nil {
-		log.Panic(err)
+	var registryPush *ibk.RegistryPushConfig
+	if *registryRef != "" {
+		registryPush = &ibk.RegistryPushConfig{
+			Reference: *registryRef,
+			Username:  *registryUser,
+			Password:  *registryPass,
+			Insecure:  *registryTLS,
+		}
+		ibk.Secrets.Add(*registryPass)
 	}
-	defer c.Close(ctx)
 
 	// load blueprint into a string
 	blueprint, err := os.ReadFile(*blueprintFile)
 	if err != nil {
 		log.Panic(err)
 	}
+	ibk.Secrets.Add(ibk.BlueprintSecrets(string(blueprint))...)
+
+	// open SSH connection
+	c := connect(ctx)
+	defer c.Close(ctx)
 
 	// configure the command
 	cmd := &ibk.ContainerCliCommand{
@@ -66,52 +80,43 @@ func cli(ctx context.Context, args []string) {
 			Interactive: *interactive,
 			TTY:         *tty,
 			TeeLog:      *teeLog,
+			Provenance:  *provenance,
 		},
+		AWSUploadConfig:     awsUpload(ctx),
+		RegistryPushConfig:  registryPush,
+		ObjectStorageConfig: objectStorage(),
+		CompressionConfig:   compressionConfig(),
+		ChecksumConfig:      checksumConfig(),
+		WithSBOM:            *withSBOM,
 	}
 
 	// apply the command
-	err = ibk.ApplyCommand(ctx, cmd, c)
-	if err != nil {
-		log.Panic(err)
-	}
+	apply(ctx, cmd, c)
 }
 
 func bootc(ctx context.Context, args []string) {
-	flag := flag.NewFlagSet("ibpacker bootc", flag.ExitOnError)
+	flag := flag.NewFlagSet("ibpacker bootc", flag.ContinueOnError)
 	var (
 		repository    = flag.String("repository", "", "bootable container OCI/docker repository URL")
 		imageType     = flag.String("type", "raw", "image type (ami, anaconda-iso, gce, iso, qcow2, raw, vhd, vmdk)")
 		arch          = flag.String("arch", "", "architecture")
 		blueprintFile = flag.String("blueprint", "", "path to blueprint file")
 		rootFS        = flag.String("rootfs", "", "root file system (ext4, xfs, btrfs)")
-
-		// ami specific
-		awsAccessKeyID     = flag.String("aws-access-key-id", "", "AWS access key ID (required for ami type)")
-		awsSecretAccessKey = flag.String("aws-secret-access-key", "", "AWS secret access key (required for ami type)")
-		awsAmiName         = flag.String("aws-ami-name", "", "destination AMI name (required for ami type)")
-		awsS3Bucket        = flag.String("aws-s3-bucket", "", "S3 bucket (required for ami type)")
-		awsRegion          = flag.String("aws-region", "", "AWS region (required for ami type)")
+		awsUpload     = awsFlags(flag)
+		objectStorage = objectStorageFlags(flag)
 	)
-	flag.Parse(args)
-
-	// open SSH connection
-	cfg := ibk.SSHTransportConfig{
-		Host:     *hostname,
-		Username: *username,
-		Timeout:  *connTimeout,
-		Stderr:   os.Stdout,
-	}
-	c, err := ibk.NewSSHTransport(cfg)
-	if err != nil {
-		log.Panic(err)
-	}
-	defer c.Close(ctx)
+	parseFlags(flag, args)
 
 	// load blueprint into a string
 	blueprint, err := os.ReadFile(*blueprintFile)
 	if err != nil {
 		log.Panic(err)
 	}
+	ibk.Secrets.Add(ibk.BlueprintSecrets(string(blueprint))...)
+
+	// open SSH connection
+	c := connect(ctx)
+	defer c.Close(ctx)
 
 	// configure the command
 	cmd := &ibk.ContainerBootCommand{
@@ -125,42 +130,375 @@ func bootc(ctx context.Context, args []string) {
 			Interactive: *interactive,
 			TTY:         *tty,
 			TeeLog:      *teeLog,
+			Provenance:  *provenance,
 		},
+		AWSUploadConfig:     awsUpload(ctx),
+		ObjectStorageConfig: objectStorage(),
+		CompressionConfig:   compressionConfig(),
+		ChecksumConfig:      checksumConfig(),
+		WithSBOM:            *withSBOM,
+	}
+
+	// apply the command
+	apply(ctx, cmd, c)
+}
+
+// awsFlags registers AWS upload flags (ami type). The returned function must be called after
+// the flags are parsed, it returns the configuration with resolved credentials or nil when
+// no AMI name was set.
+func awsFlags(flag *flag.FlagSet) func(context.Context) *ibk.AWSUploadConfig {
+	var (
+		accessKeyID     = flag.String("aws-access-key-id", "", "AWS access key ID (resolved from the environment or shared files when empty)")
+		secretAccessKey = flag.String("aws-secret-access-key", "", "AWS secret access key")
+		sessionToken    = flag.String("aws-session-token", "", "AWS session token for temporary credentials")
+		profile         = flag.String("aws-profile", "", "AWS shared config profile used to resolve credentials")
+		amiName         = flag.String("aws-ami-name", "", "destination AMI name (enables the upload)")
+		s3Bucket        = flag.String("aws-s3-bucket", "", "S3 bucket (required for upload)")
+		region          = flag.String("aws-region", "", "AWS region (required for upload)")
+		bootMode        = flag.String("aws-boot-mode", "", "AMI boot mode (uefi, legacy-bios, uefi-preferred), cli only")
+		tags            = flag.String("aws-tags", "", "comma-separated KEY=VALUE AMI tags, cli only")
+		shareWith       = flag.String("aws-share-with", "", "comma-separated account IDs to share the AMI with, cli only")
+	)
+
+	return func(ctx context.Context) *ibk.AWSUploadConfig {
+		if *amiName == "" {
+			return nil
+		}
+
+		cfg := &ibk.AWSUploadConfig{
+			AMIName:            *amiName,
+			S3Bucket:           *s3Bucket,
+			Region:             *region,
+			AWSAccessKeyID:     *accessKeyID,
+			AWSSecretAccessKey: *secretAccessKey,
+			AWSSessionToken:    *sessionToken,
+			Profile:            *profile,
+			BootMode:           *bootMode,
+		}
+
+		if *tags != "" {
+			cfg.Tags = make(map[string]string)
+			for _, tag := range strings.Split(*tags, ",") {
+				k, v, _ := strings.Cut(tag, "=")
+				cfg.Tags[k] = v
+			}
+		}
+
+		if *shareWith != "" {
+			cfg.ShareWith = strings.Split(*shareWith, ",")
+		}
+
+		err := cfg.Resolve(ctx)
+		if err != nil {
+			log.Panic(ibk.Secrets.RedactError(err))
+		}
+		ibk.Secrets.Add(cfg.AWSSecretAccessKey, cfg.AWSSessionToken)
+
+		return cfg
+	}
+}
+
+// compressionConfig returns the compression configuration or nil when compression is not enabled.
+func compressionConfig() *ibk.CompressionConfig {
+	if *compress == "" {
+		return nil
 	}
-	if *imageType == "ami" {
-		cmd.AWSUploadConfig = &ibk.AWSUploadConfig{
-			AMIName:            *awsAmiName,
-			S3Bucket:           *awsS3Bucket,
-			Region:             *awsRegion,
-			AWSAccessKeyID:     *awsAccessKeyID,
-			AWSSecretAccessKey: *awsSecretAccessKey,
+
+	return &ibk.CompressionConfig{Format: *compress, Level: *compressLevel, Threads: *compressThreads}
+}
+
+// checksumConfig returns the checksum configuration or nil when checksums are not enabled.
+func checksumConfig() *ibk.ChecksumConfig {
+	if !*checksums && !*sha512 {
+		return nil
+	}
+
+	return &ibk.ChecksumConfig{SHA512: *sha512}
+}
+
+// objectStorageFlags registers flags of the upload to S3-compatible object storage. The
+// returned function must be called after the flags are parsed, it returns nil when no bucket
+// was set.
+func objectStorageFlags(flag *flag.FlagSet) func() *ibk.ObjectStorageConfig {
+	var (
+		endpoint        = flag.String("s3-endpoint", "", "S3-compatible endpoint URL (AWS S3 when empty)")
+		bucket          = flag.String("s3-upload-bucket", "", "bucket to upload output files to (enables the upload)")
+		prefix          = flag.String("s3-upload-prefix", "", "object key prefix")
+		region          = flag.String("s3-region", "", "bucket region")
+		accessKeyID     = flag.String("s3-access-key-id", "", "object storage access key ID")
+		secretAccessKey = flag.String("s3-secret-access-key", "", "object storage secret access key")
+		pathStyle       = flag.Bool("s3-path-style", false, "use path-style addressing")
+	)
+
+	return func() *ibk.ObjectStorageConfig {
+		if *bucket == "" {
+			return nil
+		}
+
+		ibk.Secrets.Add(*secretAccessKey)
+		return &ibk.ObjectStorageConfig{
+			Endpoint:        *endpoint,
+			Bucket:          *bucket,
+			Prefix:          *prefix,
+			Region:          *region,
+			AccessKeyID:     *accessKeyID,
+			SecretAccessKey: *secretAccessKey,
+			PathStyle:       *pathStyle,
 		}
 	}
+}
 
-	// apply the command
-	err = ibk.ApplyCommand(ctx, cmd, c)
+var (
+	metrics  = &ibk.Metrics{}
+	recorder = &ibk.Recorder{}
+	output   = ibk.Secrets.Writer(os.Stdout)
+	logOut   = ibk.Secrets.Writer(os.Stderr)
+)
+
+// flush writes output held back by the redacting writers, it must run on every exit path
+// including panics.
+func flush() {
+	output.Flush()
+	logOut.Flush()
+}
+
+// parseFlags parses the arguments, the flag set must continue on errors so the output is
+// flushed before exiting.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	fs.SetOutput(logOut)
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		flush()
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Panic(err)
+		fatalf("Invalid arguments: %s", err)
+	}
+}
+
+// fatalf logs the message, flushes the output and exits.
+func fatalf(format string, v ...any) {
+	log.Printf(format, v...)
+	flush()
+	os.Exit(1)
+}
+
+// connect opens the SSH connection, or runs commands through the exec prefix when set,
+// decorated with logging, retries, metrics and recording of a dry run. The host is
+// bootstrapped, checked and the build lock is acquired when enabled, containers are run via
+// the podman API when its socket is set. Registered secrets are redacted from the log.
+func connect(ctx context.Context) ibk.Transport {
+	var c ibk.Transport
+	var err error
+	if *execPrefix != "" {
+		c, err = ibk.NewExecTransport(ibk.ExecTransportConfig{
+			Prefix: strings.Fields(*execPrefix),
+			Stderr: output,
+		})
+	} else {
+		c, err = ibk.NewSSHTransport(ibk.SSHTransportConfig{
+			Host:     *hostname,
+			Username: *username,
+			Timeout:  *connTimeout,
+			Stderr:   output,
+		})
+	}
+	if err != nil {
+		log.Panic(ibk.Secrets.RedactError(err))
+	}
+
+	var tools []string
+	if *lock {
+		tools = append(tools, "flock")
+	}
+	if *compress != "" {
+		tools = append(tools, *compress)
+	}
+	if *downloadDir != "" {
+		tools = append(tools, "sha256sum")
+	}
+	if *downloadSparse {
+		tools = append(tools, "qemu-img")
+	}
+
+	if *bootstrap {
+		_, err = ibk.Bootstrap(ibk.WithObserver(ctx, ibk.Secrets.Observer(observer())), c, ibk.BootstrapConfig{
+			User:  *username,
+			Tools: tools,
+		})
+		if err != nil {
+			log.Panic(ibk.Secrets.RedactError(err))
+		}
+	}
+
+	if *preflight {
+		_, err = ibk.Preflight(ibk.WithObserver(ctx, ibk.Secrets.Observer(observer())), c, ibk.PreflightConfig{Tools: tools})
+		if err != nil {
+			log.Panic(ibk.Secrets.RedactError(err))
+		}
+	}
+
+	// the SSH connection forwards the podman API socket
+	d, _ := c.(ibk.Dialer)
+
+	if *lock {
+		c, err = ibk.AcquireLock(ibk.WithObserver(ctx, ibk.Secrets.Observer(observer())), c, ibk.LockConfig{
+			MaxConcurrency: *lockConcurrency,
+			Timeout:        *lockTimeout,
+		})
+		if err != nil {
+			log.Panic(ibk.Secrets.RedactError(err))
+		}
+	}
+
+	if *podmanSocket != "" {
+		if d == nil {
+			log.Panic("-podman-socket requires SSH")
+		}
+		c, err = ibk.NewPodmanAPITransport(ctx, c, d, ibk.PodmanAPITransportConfig{
+			Socket: *podmanSocket,
+			Stderr: output,
+		})
+		if err != nil {
+			log.Panic(ibk.Secrets.RedactError(err))
+		}
+	}
+
+	mws := []ibk.Middleware{
+		ibk.WithRetry(ibk.RetryConfig{}),
+		ibk.WithLogging(ibk.Secrets.Redact),
+		ibk.WithMetrics(metrics),
 	}
+	if *dryRun {
+		mws = append(mws, ibk.WithRecorder(recorder))
+	}
+
+	return ibk.Wrap(c, mws...)
+}
+
+// apply applies the command and prints the result
+func apply(ctx context.Context, cmd ibk.Command, t ibk.Transport) {
+	res, err := ibk.ApplyCommandObserve(ctx, cmd, t, ibk.Secrets.Observer(observer()))
+	output.Flush()
+	log.Printf("[DEBUG] Transport metrics: %s", metrics)
+	if err != nil {
+		log.Panic(ibk.Secrets.RedactError(err))
+	}
+
+	if *downloadDir != "" && !*dryRun {
+		err = ibk.DownloadResult(ibk.WithObserver(ctx, ibk.Secrets.Observer(observer())), t, res, ibk.DownloadConfig{
+			Dir:            *downloadDir,
+			Decompress:     *decompress,
+			Sparse:         *downloadSparse,
+			BandwidthLimit: *downloadLimit,
+		})
+		if err != nil {
+			log.Panic(ibk.Secrets.RedactError(err))
+		}
+	}
+
+	if *dryRun {
+		fmt.Println("Dry run transcript:")
+		for _, entry := range recorder.Entries() {
+			fmt.Println(ibk.Secrets.Redact(entry))
+		}
+	}
+	printResult(res)
+}
+
+// observer prints events to the standard error in the format set via the events flag.
+func observer() ibk.Observer {
+	var mu sync.Mutex
+	enc := json.NewEncoder(os.Stderr)
+
+	return ibk.ObserverFunc(func(e ibk.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if *events == "json" {
+			enc.Encode(e)
+			return
+		}
+
+		msg := e.Message
+		switch {
+		case e.Path != "":
+			msg = fmt.Sprintf("%s (%d bytes)", e.Path, e.Size)
+		case e.Type == ibk.EventPhaseFinished && e.Error != "":
+			msg = fmt.Sprintf("%s failed after %s: %s", e.Phase, e.Duration.Round(time.Millisecond), e.Error)
+		case e.Type == ibk.EventPhaseFinished:
+			msg = fmt.Sprintf("%s finished in %s", e.Phase, e.Duration.Round(time.Millisecond))
+		}
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", e.Time.Format(time.TimeOnly), e.Type, msg)
+	})
+}
+
+func printResult(res *ibk.Result) {
+	for _, f := range res.Files {
+		fmt.Printf("%s (%d bytes)\n", f.Path, f.Size)
+		if f.SHA256 != "" {
+			fmt.Printf("  sha256 %s\n", f.SHA256)
+		}
+		if f.LocalPath != "" {
+			fmt.Printf("  downloaded to %s\n", f.LocalPath)
+		}
+	}
+	for _, f := range res.SBOMs {
+		fmt.Printf("sbom %s\n", f.Path)
+	}
+	if res.Provenance.Path != "" {
+		fmt.Printf("provenance %s\n", res.Provenance.Path)
+	}
+	for _, img := range res.Images {
+		fmt.Printf("%s image %s\n", img.Provider, img)
+	}
+	for _, img := range res.Pushes {
+		fmt.Printf("pushed image %s\n", img)
+	}
+	for _, obj := range res.Objects {
+		fmt.Printf("uploaded object %s\n", obj.URL)
+	}
+	fmt.Printf("Finished in %s\n", res.Duration().Round(time.Second))
 }
 
 var (
-	hostname    = flag.String("hostname", "", "SSH hostname or IP with optional port (e.g. example.com:22)")
-	username    = flag.String("username", "", "SSH username")
-	dryRun      = flag.Bool("dry-run", false, "dry run")
-	debug       = flag.Bool("debug", false, "debug logging")
-	interactive = flag.Bool("interactive", false, "pass --interactive mode to the container tool")
-	tty         = flag.Bool("tty", false, "pass --tty mode to the container tool")
-	connTimeout = flag.Duration("conn-timeout", 10*time.Second, "SSH connection timeout")
-	timeout     = flag.Duration("timeout", 9999*time.Hour, "transaction timeout (overall build timeout)")
-	teeLog      = flag.Bool("tee-log", true, "tee the output log to a file named build.log")
+	hostname        = flag.String("hostname", "", "SSH hostname or IP with optional port (e.g. example.com:22)")
+	username        = flag.String("username", "", "SSH username")
+	execPrefix      = flag.String("exec", "", "run commands through the local command instead of SSH (e.g. \"kubectl exec -i pod --\")")
+	dryRun          = flag.Bool("dry-run", false, "dry run")
+	debug           = flag.Bool("debug", false, "debug logging")
+	interactive     = flag.Bool("interactive", false, "pass --interactive mode to the container tool")
+	tty             = flag.Bool("tty", false, "pass --tty mode to the container tool")
+	connTimeout     = flag.Duration("conn-timeout", 10*time.Second, "SSH connection timeout")
+	timeout         = flag.Duration("timeout", 9999*time.Hour, "transaction timeout (overall build timeout)")
+	teeLog          = flag.Bool("tee-log", true, "tee the output log to a file named build.log")
+	events          = flag.String("events", "text", "format of build events printed to stderr (text, json)")
+	checksums       = flag.Bool("checksums", false, "compute SHA256SUMS of output files on the build host")
+	sha512          = flag.Bool("sha512", false, "compute SHA512SUMS too (implies -checksums)")
+	downloadDir     = flag.String("download-dir", "", "download output files into the local directory")
+	downloadSparse  = flag.Bool("download-sparse", false, "download only data extents of sparse files (requires qemu-img on the build host)")
+	downloadLimit   = flag.Int64("download-bandwidth-limit", 0, "download rate limit in bytes per second")
+	decompress      = flag.Bool("decompress", false, "decompress compressed output files when downloading")
+	compress        = flag.String("compress", "", "compress output files on the build host (xz, zstd, gzip)")
+	compressLevel   = flag.Int("compress-level", 0, "compression level (default of the tool when zero)")
+	compressThreads = flag.Int("compress-threads", 0, "compression threads (all cores when zero)")
+	withSBOM        = flag.Bool("with-sbom", false, "collect SPDX SBOM documents of the image")
+	provenance      = flag.Bool("provenance", false, "write a provenance record (provenance.json) into the output directory")
+	bootstrap       = flag.Bool("bootstrap", false, "install missing packages and grant the user password-less sudo (requires root or sudo)")
+	preflight       = flag.Bool("preflight", false, "check the build host before the build and report all problems")
+	lock            = flag.Bool("lock", false, "hold a build lock on the build host to limit concurrent builds")
+	lockConcurrency = flag.Int("lock-max-concurrency", 1, "number of builds allowed to run on the build host at once")
+	lockTimeout     = flag.Duration("lock-timeout", 0, "how long to wait for the build lock (forever when zero)")
+	podmanSocket    = flag.String("podman-socket", "", "run containers via the podman API socket of the build host (e.g. /run/podman/podman.sock)")
 )
 
 func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 	defer cancel()
+	defer flush()
 
-	flag.Parse()
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	parseFlags(flag.CommandLine, os.Args[1:])
 	if *interactive || *tty {
 		*teeLog = false
 	}
@@ -172,14 +510,18 @@ func main() {
 	filter := &logutils.LevelFilter{
 		Levels:   []logutils.LogLevel{"DEBUG", "WARN", "ERROR"},
 		MinLevel: level,
-		Writer:   os.Stderr,
+		Writer:   logOut,
 	}
 	log.SetOutput(filter)
 	log.SetFlags(0)
 
+	if *events != "text" && *events != "json" {
+		fatalf("Unrecognized events format %q. Format must be one of: text, json", *events)
+	}
+
 	args := flag.Args()
 	if len(args) == 0 {
-		log.Fatal("Please specify a subcommand.")
+		fatalf("Please specify a subcommand.")
 	}
 	cmd, args := args[0], args[1:]
 
@@ -189,6 +531,6 @@ func main() {
 	case "bootc":
 		bootc(ctx, args)
 	default:
-		log.Fatalf("Unrecognized command %q. Command must be one of: cli, bootc", cmd)
+		fatalf("Unrecognized command %q. Command must be one of: cli, bootc", cmd)
 	}
 }
@@ -1,35 +1,276 @@
 package main
 
-import "strings"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	registryimage "github.com/hashicorp/packer-plugin-sdk/packer/registry/image"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
 
 type StringArtifact struct {
-	sb strings.Builder
+	sb     strings.Builder
+	result *ibk.Result
+
+	// ui reports removed resources, optional
+	ui packer.Ui
+
+	// host is the name of the selected build host, hostArch its detected architecture
+	// (empty when not probed)
+	host     string
+	hostArch string
+
+	// destroy configures Destroy, connect opens a connection to the build host to remove
+	// remote files (optional)
+	destroy ibk.DestroyConfig
+	connect func() (ibk.Transport, error)
 }
 
 func (sa *StringArtifact) BuilderId() string {
 	return "osbuild.image-builder"
 }
 
+// Files returns local paths of downloaded output files, checksum manifests, SBOM documents
+// and the provenance record.
 func (sa *StringArtifact) Files() []string {
-	return []string{}
+	files := []string{}
+	if sa.result == nil {
+		return files
+	}
+
+	var all []ibk.File
+	all = append(all, sa.result.Files...)
+	all = append(all, sa.result.Manifests...)
+	all = append(all, sa.result.SBOMs...)
+	all = append(all, sa.result.Provenance)
+	for _, f := range all {
+		if f.LocalPath != "" {
+			files = append(files, f.LocalPath)
+		}
+	}
+
+	return files
 }
 
+// Id returns registered cloud images in the region:id form used by other builders, multiple
+// images are separated by a comma. Empty string is returned when no image was registered.
 func (sa *StringArtifact) Id() string {
-	return ""
+	if sa.result == nil {
+		return ""
+	}
+
+	ids := make([]string, 0, len(sa.result.Images))
+	for _, img := range sa.result.Images {
+		ids = append(ids, img.String())
+	}
+
+	return strings.Join(ids, ",")
 }
 
+// String returns the artifact description with sensitive values redacted.
 func (sa *StringArtifact) String() string {
-	return sa.sb.String()
+	return ibk.Secrets.Redact(sa.sb.String())
 }
 
+// State returns the remote files ("remote_files"), the remote build log path ("build_log"),
+// the build duration ("duration"), AMI and snapshot IDs by region ("amis", "snapshots"),
+// images pushed to container registries in the reference@digest form ("pushed_images"),
+// URLs of files uploaded to object storage ("object_urls"), checksums of remote files by path
+// ("sha256_checksums", "sha512_checksums"), remote checksum manifests and signatures
+// ("checksum_files"), remote SPDX documents ("sboms"), the provenance record path, local when
+// downloaded ("provenance"), the selected build host and its detected architecture
+// ("build_host", "build_host_arch") and registered images for HCP Packer
+// (registryimage.ArtifactStateURI).
 func (sa *StringArtifact) State(name string) interface{} {
+	if sa.result == nil {
+		return nil
+	}
+
+	switch name {
+	case "remote_files":
+		return sa.result.Paths()
+	case "build_log":
+		return sa.result.LogFile
+	case "duration":
+		return sa.result.Duration().String()
+	case "amis":
+		return sa.imagesByRegion("aws", func(img ibk.CloudImage) string { return img.ID })
+	case "snapshots":
+		return sa.imagesByRegion("aws", func(img ibk.CloudImage) string { return img.SnapshotID })
+	case "pushed_images":
+		images := make([]string, 0, len(sa.result.Pushes))
+		for _, img := range sa.result.Pushes {
+			images = append(images, img.String())
+		}
+		return images
+	case "sha256_checksums":
+		return sa.checksums(func(f ibk.File) string { return f.SHA256 })
+	case "sha512_checksums":
+		return sa.checksums(func(f ibk.File) string { return f.SHA512 })
+	case "checksum_files":
+		paths := make([]string, 0, len(sa.result.Manifests))
+		for _, f := range sa.result.Manifests {
+			paths = append(paths, f.Path)
+		}
+		return paths
+	case "sboms":
+		paths := make([]string, 0, len(sa.result.SBOMs))
+		for _, f := range sa.result.SBOMs {
+			paths = append(paths, f.Path)
+		}
+		return paths
+	case "provenance":
+		if sa.result.Provenance.LocalPath != "" {
+			return sa.result.Provenance.LocalPath
+		}
+		return sa.result.Provenance.Path
+	case "build_host":
+		return sa.host
+	case "build_host_arch":
+		return sa.hostArch
+	case "object_urls":
+		urls := make([]string, 0, len(sa.result.Objects))
+		for _, obj := range sa.result.Objects {
+			urls = append(urls, obj.URL)
+		}
+		return urls
+	case registryimage.ArtifactStateURI:
+		return sa.registryImages()
+	}
+
 	return nil
 }
 
+func (sa *StringArtifact) checksums(value func(ibk.File) string) map[string]string {
+	m := make(map[string]string)
+	for _, f := range sa.result.Files {
+		if value(f) != "" {
+			m[f.Path] = value(f)
+		}
+	}
+	return m
+}
+
+func (sa *StringArtifact) imagesByRegion(provider string, value func(ibk.CloudImage) string) map[string]string {
+	m := make(map[string]string)
+	for _, img := range sa.result.Images {
+		if img.Provider == provider && value(img) != "" {
+			m[img.Region] = value(img)
+		}
+	}
+	return m
+}
+
+func (sa *StringArtifact) registryImages() []*registryimage.Image {
+	var images []*registryimage.Image
+	for _, img := range sa.result.Images {
+		labels := make(map[string]string)
+		if img.SnapshotID != "" {
+			labels["snapshot_id"] = img.SnapshotID
+		}
+
+		images = append(images, &registryimage.Image{
+			ImageID:        img.ID,
+			ProviderName:   img.Provider,
+			ProviderRegion: img.Region,
+			Labels:         labels,
+		})
+	}
+	return images
+}
+
+// Destroy removes the remote output directory, registered cloud images, pushed container
+// images and uploaded objects unless they are configured to be kept. Removed resources are
+// reported to the UI.
 func (sa *StringArtifact) Destroy() error {
-	return nil
+	if sa.result == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	if sa.ui != nil {
+		ctx = ibk.WithObserver(ctx, ibk.Secrets.Observer(uiObserver(sa.ui)))
+	}
+
+	// a build host which cannot be reached must not prevent removal of other resources
+	var connErr error
+	cfg := sa.destroy
+	if !cfg.KeepRemoteFiles && sa.result.OutputDir != "" && sa.connect != nil {
+		t, err := sa.connect()
+		if err != nil {
+			connErr = fmt.Errorf("%w: remote files: %w", ibk.ErrDestroy, err)
+		} else {
+			defer t.Close(ctx)
+			cfg.Transport = t
+		}
+	}
+
+	err := ibk.DestroyResult(ctx, sa.result, cfg)
+	return ibk.Secrets.RedactError(errors.Join(connErr, err))
 }
 
 func (sa *StringArtifact) WriteString(s string) {
 	sa.sb.WriteString(s)
 }
+
+// WriteResult writes a summary of the produced files.
+func (sa *StringArtifact) WriteResult(res *ibk.Result) {
+	sa.result = res
+
+	if sa.host != "" {
+		sa.sb.WriteString("Build host: " + sa.host)
+		if sa.hostArch != "" {
+			sa.sb.WriteString(" (" + sa.hostArch + ")")
+		}
+		sa.sb.WriteString("\n")
+	}
+
+	if len(res.Files) > 0 {
+		sa.sb.WriteString("Files on the build host:\n")
+		for _, f := range res.Files {
+			sa.sb.WriteString(fmt.Sprintf("  %s (%d bytes)\n", f.Path, f.Size))
+		}
+	}
+
+	if len(res.Manifests) > 0 {
+		sa.sb.WriteString("Checksum files:\n")
+		for _, f := range res.Manifests {
+			sa.sb.WriteString(fmt.Sprintf("  %s\n", f.Path))
+		}
+	}
+
+	if len(res.SBOMs) > 0 {
+		sa.sb.WriteString("SBOM documents:\n")
+		for _, f := range res.SBOMs {
+			sa.sb.WriteString(fmt.Sprintf("  %s (%d bytes)\n", f.Path, f.Size))
+		}
+	}
+
+	if res.Provenance.Path != "" {
+		sa.sb.WriteString(fmt.Sprintf("Provenance:\n  %s\n", res.Provenance.Path))
+	}
+
+	if len(res.Images) > 0 {
+		sa.sb.WriteString("Registered images:\n")
+		for _, img := range res.Images {
+			sa.sb.WriteString(fmt.Sprintf("  %s %s\n", img.Provider, img))
+		}
+	}
+
+	if len(res.Pushes) > 0 {
+		sa.sb.WriteString("Pushed images:\n")
+		for _, img := range res.Pushes {
+			sa.sb.WriteString(fmt.Sprintf("  %s\n", img))
+		}
+	}
+
+	if len(res.Objects) > 0 {
+		sa.sb.WriteString("Uploaded objects:\n")
+		for _, obj := range res.Objects {
+			sa.sb.WriteString(fmt.Sprintf("  %s (%d bytes)\n", obj.URL, obj.Size))
+		}
+	}
+}
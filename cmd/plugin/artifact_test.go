@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	registryimage "github.com/hashicorp/packer-plugin-sdk/packer/registry/image"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+func TestStringArtifactImages(t *testing.T) {
+	sa := &StringArtifact{}
+	if sa.Id() != "" {
+		t.Errorf("unexpected id of an empty artifact: %q", sa.Id())
+	}
+
+	sa.WriteResult(&ibk.Result{
+		Images: []ibk.CloudImage{
+			{Provider: "aws", Region: "us-east-1", ID: "ami-1", SnapshotID: "snap-1"},
+			{Provider: "aws", Region: "eu-west-1", ID: "ami-2"},
+		},
+	})
+
+	if sa.Id() != "us-east-1:ami-1,eu-west-1:ami-2" {
+		t.Errorf("unexpected id: %q", sa.Id())
+	}
+
+	wantAMIs := map[string]string{"us-east-1": "ami-1", "eu-west-1": "ami-2"}
+	if diff := cmp.Diff(wantAMIs, sa.State("amis")); diff != "" {
+		t.Errorf("unexpected amis: %s", diff)
+	}
+
+	wantSnapshots := map[string]string{"us-east-1": "snap-1"}
+	if diff := cmp.Diff(wantSnapshots, sa.State("snapshots")); diff != "" {
+		t.Errorf("unexpected snapshots: %s", diff)
+	}
+
+	wantImages := []*registryimage.Image{
+		{ImageID: "ami-1", ProviderName: "aws", ProviderRegion: "us-east-1", Labels: map[string]string{"snapshot_id": "snap-1"}},
+		{ImageID: "ami-2", ProviderName: "aws", ProviderRegion: "eu-west-1", Labels: map[string]string{}},
+	}
+	if diff := cmp.Diff(wantImages, sa.State(registryimage.ArtifactStateURI)); diff != "" {
+		t.Errorf("unexpected registry images: %s", diff)
+	}
+}
+
+func TestStringArtifactPushes(t *testing.T) {
+	sa := &StringArtifact{}
+	sa.WriteResult(&ibk.Result{
+		Pushes: []ibk.ContainerImage{
+			{Reference: "quay.io/org/fedora:latest", Digest: "sha256:0123"},
+		},
+	})
+
+	want := []string{"quay.io/org/fedora:latest@sha256:0123"}
+	if diff := cmp.Diff(want, sa.State("pushed_images")); diff != "" {
+		t.Errorf("unexpected pushed images: %s", diff)
+	}
+
+	if !strings.Contains(sa.String(), "Pushed images:\n  quay.io/org/fedora:latest@sha256:0123\n") {
+		t.Errorf("unexpected artifact description: %q", sa.String())
+	}
+}
+
+func TestStringArtifactObjects(t *testing.T) {
+	sa := &StringArtifact{}
+	sa.WriteResult(&ibk.Result{
+		Objects: []ibk.StorageObject{
+			{Bucket: "images", Key: "disk.qcow2", URL: "http://minio:9000/images/disk.qcow2", Size: 1024},
+		},
+	})
+
+	want := []string{"http://minio:9000/images/disk.qcow2"}
+	if diff := cmp.Diff(want, sa.State("object_urls")); diff != "" {
+		t.Errorf("unexpected object urls: %s", diff)
+	}
+}
+
+func TestStringArtifactProvenanceAndSBOMs(t *testing.T) {
+	sa := &StringArtifact{}
+	sa.WriteResult(&ibk.Result{
+		Files:      []ibk.File{{Path: "./output-abc/disk.raw", LocalPath: "out/disk.raw"}},
+		SBOMs:      []ibk.File{{Path: "./output-abc/source-container.spdx.json", Size: 10}},
+		Provenance: ibk.File{Path: "./output-abc/provenance.json", LocalPath: "out/provenance.json"},
+	})
+
+	if sa.State("provenance") != "out/provenance.json" {
+		t.Errorf("unexpected provenance: %v", sa.State("provenance"))
+	}
+
+	wantSBOMs := []string{"./output-abc/source-container.spdx.json"}
+	if diff := cmp.Diff(wantSBOMs, sa.State("sboms")); diff != "" {
+		t.Errorf("unexpected sboms: %s", diff)
+	}
+
+	want := []string{"out/disk.raw", "out/provenance.json"}
+	if diff := cmp.Diff(want, sa.Files()); diff != "" {
+		t.Errorf("unexpected files: %s", diff)
+	}
+
+	if !strings.Contains(sa.String(), "Provenance:\n  ./output-abc/provenance.json\n") {
+		t.Errorf("unexpected artifact description: %q", sa.String())
+	}
+}
+
+func TestStringArtifactBuildHost(t *testing.T) {
+	sa := &StringArtifact{host: "builder@arm.example.com", hostArch: "aarch64"}
+	sa.WriteResult(&ibk.Result{})
+
+	if sa.State("build_host") != "builder@arm.example.com" || sa.State("build_host_arch") != "aarch64" {
+		t.Errorf("unexpected build host: %v %v", sa.State("build_host"), sa.State("build_host_arch"))
+	}
+
+	if !strings.HasPrefix(sa.String(), "Build host: builder@arm.example.com (aarch64)\n") {
+		t.Errorf("unexpected artifact description: %q", sa.String())
+	}
+}
+
+type recordingTransport struct {
+	ibk.Transport
+	executed []string
+}
+
+func (t *recordingTransport) Execute(ctx context.Context, inv ibk.Invocation, opts ...ibk.ExecuteOpt) error {
+	t.executed = append(t.executed, inv.String())
+	return nil
+}
+
+func (t *recordingTransport) Close(ctx context.Context) error {
+	return nil
+}
+
+func TestStringArtifactDestroy(t *testing.T) {
+	rt := &recordingTransport{}
+	sa := &StringArtifact{
+		destroy: ibk.DestroyConfig{KeepCloudImages: true},
+		connect: func() (ibk.Transport, error) { return rt, nil },
+	}
+	if err := sa.Destroy(); err != nil {
+		t.Fatalf("unexpected error of an empty artifact: %v", err)
+	}
+
+	sa.WriteResult(&ibk.Result{
+		OutputDir: "./output-abc",
+		Images:    []ibk.CloudImage{{Provider: "aws", Region: "us-east-1", ID: "ami-1"}},
+	})
+	if err := sa.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"sudo rm -rf -- ./output-abc"}, rt.executed); diff != "" {
+		t.Errorf("unexpected executions: %s", diff)
+	}
+	if sa.Id() != "us-east-1:ami-1" {
+		t.Errorf("kept image expected, got: %q", sa.Id())
+	}
+}
+
+func TestStringArtifactDestroyConnectError(t *testing.T) {
+	errConnect := errors.New("connection refused")
+	sa := &StringArtifact{
+		connect: func() (ibk.Transport, error) { return nil, errConnect },
+	}
+	sa.WriteResult(&ibk.Result{
+		OutputDir: "./output-abc",
+		Images:    []ibk.CloudImage{{Provider: "aws", Region: "us-east-1", ID: "ami-1"}},
+	})
+
+	// removal of the image is attempted even though the build host is unreachable
+	err := sa.Destroy()
+	if !errors.Is(err, ibk.ErrDestroy) || !errors.Is(err, errConnect) {
+		t.Fatalf("expected connection error, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "no aws configuration") {
+		t.Errorf("expected image removal error, got: %v", err)
+	}
+}
@@ -1,11 +1,17 @@
-//go:generate go run github.com/hashicorp/packer-plugin-sdk/cmd/packer-sdc@latest mapstructure-to-hcl2 -type Config,BuildHost,AWSUpload
+//go:generate go run github.com/hashicorp/packer-plugin-sdk/cmd/packer-sdc@latest mapstructure-to-hcl2 -type Config,BuildHost,BuildLock,Preflight,Bootstrap,PodmanAPI,AWSUpload,GCPUpload,AzureUpload,RegistryPush,ObjectStorageUpload,Destroy,Checksums,Compression
 
 package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"log"
 	"os"
-	"regexp"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/packer-plugin-sdk/common"
@@ -14,11 +20,31 @@ import (
 	ibk "github.com/osbuild/packer-plugin-image-builder"
 )
 
+// Config is the builder configuration. String fields tagged `sensitive:"true"` are
+// registered in ibk.Secrets and masked in logs, UI messages, errors and the artifact.
 type Config struct {
 	common.PackerConfig `mapstructure:",squash"`
 
-	// BuildHost is the host where the image will be built
-	BuildHost BuildHost `mapstructure:"build_host,required"`
+	// BuildHosts are hosts where the image can be built, the first host matching the
+	// architecture and build_host_labels is used
+	BuildHosts []BuildHost `mapstructure:"build_host,required"`
+
+	// BuildHostLabels are labels a build host must have to be selected
+	BuildHostLabels []string `mapstructure:"build_host_labels"`
+
+	// BuildLock limits concurrent builds on the selected build host
+	BuildLock BuildLock `mapstructure:"build_lock"`
+
+	// Preflight checks build hosts before they are used, hosts failing a check are skipped
+	Preflight Preflight `mapstructure:"preflight"`
+
+	// Bootstrap installs missing packages and configures sudo on build hosts before they are
+	// checked and used
+	Bootstrap Bootstrap `mapstructure:"bootstrap"`
+
+	// PodmanAPI runs builder containers via the podman API socket of the build host forwarded
+	// over the SSH connection
+	PodmanAPI PodmanAPI `mapstructure:"podman_api"`
 
 	// Common configuration
 	ImageType    string `mapstructure:"image_type,required"`
@@ -32,25 +58,215 @@ type Config struct {
 	// Bootable container configuration
 	ContainerRepository string `mapstructure:"container_repository"`
 
-	AWSUpload AWSUpload `mapstructure:"aws_upload"`
+	AWSUpload   AWSUpload   `mapstructure:"aws_upload"`
+	GCPUpload   GCPUpload   `mapstructure:"gcp_upload"`
+	AzureUpload AzureUpload `mapstructure:"azure_upload"`
+
+	RegistryPush        RegistryPush        `mapstructure:"registry_push"`
+	ObjectStorageUpload ObjectStorageUpload `mapstructure:"object_storage_upload"`
+
+	// Compression of output files on the build host
+	Compression Compression `mapstructure:"compression"`
+
+	// Checksums of output files computed on the build host
+	Checksums Checksums `mapstructure:"checksums"`
+
+	// DownloadDir is a local directory the output files are downloaded to. Optional.
+	DownloadDir string `mapstructure:"download_dir"`
+
+	// DownloadSparse transfers only data extents of sparse files, failed transfers are retried
+	// from the transferred offset
+	DownloadSparse bool `mapstructure:"download_sparse"`
+
+	// DownloadBandwidth caps the download rate in bytes per second
+	DownloadBandwidth int64 `mapstructure:"download_bandwidth_limit"`
+
+	// SkipProvenance disables the provenance record (provenance.json) written into the output
+	// directory
+	SkipProvenance bool `mapstructure:"skip_provenance"`
+
+	// WithSBOM collects SPDX SBOM documents of the image, for bootable containers the SBOM is
+	// generated from the package list of the source container
+	WithSBOM bool `mapstructure:"with_sbom"`
+
+	// Destroy configures what is kept when Packer destroys the artifact
+	Destroy Destroy `mapstructure:"destroy"`
 }
 
+// BuildHost is a host of the build host pool. Arch is the declared architecture, hosts
+// declaring a different architecture than the build are skipped without connecting. Hosts
+// reachable only through a local command, e.g. `kubectl exec -i POD --` or `podman exec -i
+// CONTAINER`, set exec_prefix instead of hostname and username.
 type BuildHost struct {
-	Hostname string `mapstructure:"hostname,required"`
-	Username string `mapstructure:"username,required"`
-	Password string `mapstructure:"password"`
+	Hostname   string   `mapstructure:"hostname"`
+	Username   string   `mapstructure:"username"`
+	Password   string   `mapstructure:"password" sensitive:"true"`
+	ExecPrefix []string `mapstructure:"exec_prefix"`
+	Arch       string   `mapstructure:"arch"`
+	Labels     []string `mapstructure:"labels"`
+}
+
+// name returns the host in the user@hostname form or the exec prefix.
+func (h *BuildHost) name() string {
+	if len(h.ExecPrefix) > 0 {
+		return strings.Join(h.ExecPrefix, " ")
+	}
+	return h.Username + "@" + h.Hostname
+}
+
+// BuildLock configures a lock held on the build host from connecting until the build host is
+// released, builds sharing the host wait for a free slot. The lock is held when any field is
+// set.
+type BuildLock struct {
+	Enabled        bool          `mapstructure:"enabled"`
+	MaxConcurrency int           `mapstructure:"max_concurrency"`
+	Timeout        time.Duration `mapstructure:"timeout"`
+	Dir            string        `mapstructure:"dir"`
+}
+
+// Preflight configures checks of the build host after connecting: the container runtime,
+// sudo, the architecture, required tools, free space and loop devices. Tools needed by the
+// configured features are required automatically. Checks are run when any field is set.
+type Preflight struct {
+	Enabled         bool     `mapstructure:"enabled"`
+	MinFreeSpace    int64    `mapstructure:"min_free_space"`
+	Tools           []string `mapstructure:"tools"`
+	SkipLoopDevices bool     `mapstructure:"skip_loop_devices"`
+}
+
+// Bootstrap configures installing of the container runtime and tools needed by the configured
+// features with the native package manager and granting password-less sudo to the build
+// user. Username and password of an administrative user (root or allowed to run sudo without
+// a password) are used for bootstrapping when set, otherwise the build host credentials. The
+// build host is bootstrapped when any field is set.
+type Bootstrap struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password" sensitive:"true"`
+}
+
+// PodmanAPI configures running of containers via the libpod REST API instead of the podman
+// command line, giving exact exit codes and removal of containers when the build is cancelled.
+// The rootful API socket (podman.socket) must be enabled on the build host and accessible to
+// the SSH user. The API is used when any field is set.
+type PodmanAPI struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Socket  string `mapstructure:"socket"`
 }
 
+// AWSUpload configures the AMI upload. When access_key_id is not set, credentials are
+// resolved from the environment, shared credentials and config files (with the profile)
+// or the instance metadata.
 type AWSUpload struct {
 	AccessKeyID     string `mapstructure:"access_key_id"`
-	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SecretAccessKey string `mapstructure:"secret_access_key" sensitive:"true"`
+	SessionToken    string `mapstructure:"session_token" sensitive:"true"`
+	Profile         string `mapstructure:"profile"`
 	AmiName         string `mapstructure:"ami_name"`
 	S3Bucket        string `mapstructure:"s3_bucket"`
 	Region          string `mapstructure:"region"`
+
+	// The following fields are only supported by image-builder-cli builds.
+	BootMode  string            `mapstructure:"boot_mode"`
+	Tags      map[string]string `mapstructure:"tags"`
+	ShareWith []string          `mapstructure:"share_with"`
+}
+
+// configured returns true when any field of the block is set.
+func (a *AWSUpload) configured() bool {
+	return !reflect.DeepEqual(*a, AWSUpload{})
+}
+
+// GCPUpload configures the Google Cloud upload, supported by image-builder-cli builds of
+// gce image types. The credentials file is a service account JSON key on the machine
+// running Packer.
+type GCPUpload struct {
+	CredentialsFile string `mapstructure:"credentials_file"`
+	Bucket          string `mapstructure:"bucket"`
+	Region          string `mapstructure:"region"`
+	ImageName       string `mapstructure:"image_name"`
+}
+
+// AzureUpload configures the Azure upload, supported by image-builder-cli builds of vhd
+// and azure image types.
+type AzureUpload struct {
+	TenantID       string `mapstructure:"tenant_id"`
+	SubscriptionID string `mapstructure:"subscription_id"`
+	ClientID       string `mapstructure:"client_id"`
+	ClientSecret   string `mapstructure:"client_secret" sensitive:"true"`
+	ResourceGroup  string `mapstructure:"resource_group"`
+	Location       string `mapstructure:"location"`
+	ImageName      string `mapstructure:"image_name"`
+}
+
+// RegistryPush configures pushing of a container or OCI archive output to a registry after
+// a successful build, supported by image-builder-cli builds on podman build hosts.
+type RegistryPush struct {
+	Reference string `mapstructure:"reference"`
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password" sensitive:"true"`
+	Insecure  bool   `mapstructure:"insecure"`
+}
+
+// ObjectStorageUpload configures uploading of output files from the build host directly to
+// an S3-compatible object storage after a successful build.
+type ObjectStorageUpload struct {
+	Endpoint        string `mapstructure:"endpoint"`
+	Bucket          string `mapstructure:"bucket"`
+	Prefix          string `mapstructure:"prefix"`
+	Region          string `mapstructure:"region"`
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key" sensitive:"true"`
+	PathStyle       bool   `mapstructure:"path_style"`
+}
+
+// Checksums configures SHA256SUMS (and SHA512SUMS) written into the output directory. The
+// SHA256SUMS file is signed with a GPG or cosign private key file when set. Checksums are
+// computed when any field is set.
+type Checksums struct {
+	Enabled        bool   `mapstructure:"enabled"`
+	SHA512         bool   `mapstructure:"sha512"`
+	GPGKeyFile     string `mapstructure:"gpg_key_file"`
+	GPGPassphrase  string `mapstructure:"gpg_passphrase" sensitive:"true"`
+	CosignKeyFile  string `mapstructure:"cosign_key_file"`
+	CosignPassword string `mapstructure:"cosign_password" sensitive:"true"`
+}
+
+// Compression configures compressing of output files on the build host after a successful
+// build, the artifact lists the compressed files. Decompress decompresses the files when they
+// are downloaded into download_dir.
+type Compression struct {
+	Format     string `mapstructure:"format"`
+	Level      int    `mapstructure:"level"`
+	Threads    int    `mapstructure:"threads"`
+	Decompress bool   `mapstructure:"decompress"`
+}
+
+// Destroy configures removal of build results when Packer destroys the artifact, e.g. when
+// another build of a multi-build run fails. Everything is removed unless kept explicitly.
+// Only AWS images can be removed, GCP and Azure images are kept with a warning.
+type Destroy struct {
+	KeepRemoteFiles    bool `mapstructure:"keep_remote_files"`
+	KeepCloudImages    bool `mapstructure:"keep_cloud_images"`
+	KeepRegistryImages bool `mapstructure:"keep_registry_images"`
+	KeepObjects        bool `mapstructure:"keep_objects"`
 }
 
 type Builder struct {
 	config Config
+
+	// gcpUpload, azureUpload, registryPush and objectStorage are validated configurations,
+	// nil when not set
+	gcpUpload     *ibk.GCPUploadConfig
+	azureUpload   *ibk.AzureUploadConfig
+	registryPush  *ibk.RegistryPushConfig
+	objectStorage *ibk.ObjectStorageConfig
+	compression   *ibk.CompressionConfig
+	checksums     *ibk.ChecksumConfig
+	lock          *ibk.LockConfig
+	preflight     *ibk.PreflightConfig
+	bootstrap     bool
+	podmanAPI     *ibk.PodmanAPITransportConfig
 }
 
 func (b *Builder) ConfigSpec() hcldec.ObjectSpec {
@@ -66,35 +282,390 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, []string, error) {
 		return nil, nil, err
 	}
 
+	// register sensitive values before anything is logged
+	secrets := append(sensitiveValues(&b.config), ibk.BlueprintSecrets(b.config.Blueprint)...)
+	for _, name := range b.config.PackerSensitiveVars {
+		secrets = append(secrets, b.config.PackerUserVars[name])
+	}
+	ibk.Secrets.Add(secrets...)
+	packer.LogSecretFilter.Set(secrets...)
+
+	var errs *packer.MultiError
+	bootc := b.config.ContainerRepository != ""
+
+	if len(b.config.BuildHosts) == 0 {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("at least one build_host is required"))
+	}
+	for i, h := range b.config.BuildHosts {
+		switch {
+		case len(h.ExecPrefix) > 0 && h.Hostname != "":
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("build_host %d: only one of hostname and exec_prefix can be set", i))
+		case len(h.ExecPrefix) == 0 && (h.Hostname == "" || h.Username == ""):
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("build_host %d: hostname and username or exec_prefix are required", i))
+		}
+	}
+
+	if b.config.BuildLock != (BuildLock{}) {
+		b.lock = &ibk.LockConfig{
+			Dir:            b.config.BuildLock.Dir,
+			MaxConcurrency: b.config.BuildLock.MaxConcurrency,
+			Timeout:        b.config.BuildLock.Timeout,
+			Owner:          "packer build " + b.config.PackerBuildName,
+		}
+
+		err = b.lock.Validate()
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("build_lock: %w", err))
+		}
+	}
+
+	if b.config.AWSUpload.configured() && b.config.ImageType != "ami" {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("aws_upload requires image_type ami"))
+	}
+
+	if b.config.GCPUpload != (GCPUpload{}) {
+		b.gcpUpload, err = b.gcpUploadConfig()
+		if err == nil && bootc {
+			err = fmt.Errorf("not supported with container_repository")
+		}
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("gcp_upload: %w", err))
+		}
+	}
+
+	if b.config.AzureUpload != (AzureUpload{}) {
+		b.azureUpload = &ibk.AzureUploadConfig{
+			TenantID:       b.config.AzureUpload.TenantID,
+			SubscriptionID: b.config.AzureUpload.SubscriptionID,
+			ClientID:       b.config.AzureUpload.ClientID,
+			ClientSecret:   b.config.AzureUpload.ClientSecret,
+			ResourceGroup:  b.config.AzureUpload.ResourceGroup,
+			Location:       b.config.AzureUpload.Location,
+			ImageName:      b.config.AzureUpload.ImageName,
+		}
+
+		err = b.azureUpload.Validate(b.config.ImageType)
+		if err == nil && bootc {
+			err = fmt.Errorf("not supported with container_repository")
+		}
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("azure_upload: %w", err))
+		}
+	}
+
+	if b.config.RegistryPush != (RegistryPush{}) {
+		b.registryPush = &ibk.RegistryPushConfig{
+			Reference: b.config.RegistryPush.Reference,
+			Username:  b.config.RegistryPush.Username,
+			Password:  b.config.RegistryPush.Password,
+			Insecure:  b.config.RegistryPush.Insecure,
+		}
+
+		err = b.registryPush.Validate()
+		if err == nil && bootc {
+			err = fmt.Errorf("not supported with container_repository")
+		}
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("registry_push: %w", err))
+		}
+	}
+
+	if b.config.ObjectStorageUpload != (ObjectStorageUpload{}) {
+		b.objectStorage = &ibk.ObjectStorageConfig{
+			Endpoint:        b.config.ObjectStorageUpload.Endpoint,
+			Bucket:          b.config.ObjectStorageUpload.Bucket,
+			Prefix:          b.config.ObjectStorageUpload.Prefix,
+			Region:          b.config.ObjectStorageUpload.Region,
+			AccessKeyID:     b.config.ObjectStorageUpload.AccessKeyID,
+			SecretAccessKey: b.config.ObjectStorageUpload.SecretAccessKey,
+			PathStyle:       b.config.ObjectStorageUpload.PathStyle,
+		}
+
+		err = b.objectStorage.Validate()
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("object_storage_upload: %w", err))
+		}
+	}
+
+	if b.config.Compression != (Compression{}) {
+		b.compression = &ibk.CompressionConfig{
+			Format:  b.config.Compression.Format,
+			Level:   b.config.Compression.Level,
+			Threads: b.config.Compression.Threads,
+		}
+
+		err = b.compression.Validate()
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("compression: %w", err))
+		}
+	}
+
+	if b.config.Checksums != (Checksums{}) {
+		b.checksums, err = b.checksumConfig()
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("checksums: %w", err))
+		}
+	}
+
+	if !reflect.DeepEqual(b.config.Preflight, Preflight{}) {
+		b.preflight = &ibk.PreflightConfig{
+			Tools:           slices.Concat(b.config.Preflight.Tools, b.requiredTools()),
+			MinFreeSpace:    b.config.Preflight.MinFreeSpace,
+			SkipLoopDevices: b.config.Preflight.SkipLoopDevices,
+		}
+	}
+
+	b.bootstrap = b.config.Bootstrap != (Bootstrap{})
+
+	if b.config.PodmanAPI != (PodmanAPI{}) {
+		b.podmanAPI = &ibk.PodmanAPITransportConfig{Socket: b.config.PodmanAPI.Socket}
+		for i, h := range b.config.BuildHosts {
+			if len(h.ExecPrefix) > 0 {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("podman_api: build_host %d: not supported with exec_prefix", i))
+			}
+		}
+	}
+
+	if errs != nil {
+		return nil, nil, errs
+	}
+
 	return nil, nil, nil
 }
 
-func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (packer.Artifact, error) {
-	ui.Say("Connecting to the build host " + b.config.BuildHost.Username + "@" + b.config.BuildHost.Hostname)
+// requiredTools returns tools needed by the configured features.
+func (b *Builder) requiredTools() []string {
+	var tools []string
 
-	// create tail 4kB buffer
-	re := &RegexpCallback{
-		Regexp:   regexp.MustCompile(`org\.osbuild\.\w+`),
-		Prefix:   "Stage ",
-		Callback: ui.Say,
-	}
-	tail := NewTailWriterThrough(2<<11, os.Stderr, re)
-
-	// open SSH connection
-	cfg := ibk.SSHTransportConfig{
-		Host:     b.config.BuildHost.Hostname,
-		Username: b.config.BuildHost.Username,
-		Password: b.config.BuildHost.Password,
-		Stdout:   tail,
-		Stderr:   tail,
-	}
-	c, err := ibk.NewSSHTransport(cfg)
+	if b.lock != nil {
+		tools = append(tools, "flock")
+	}
+	if b.compression != nil {
+		tools = append(tools, b.compression.Format)
+	}
+	// downloads are verified with checksums computed on the build host
+	if b.checksums != nil || !b.config.SkipProvenance || b.config.DownloadDir != "" {
+		tools = append(tools, "sha256sum")
+	}
+	if b.checksums != nil && b.checksums.SHA512 {
+		tools = append(tools, "sha512sum")
+	}
+	if b.config.DownloadSparse {
+		tools = append(tools, "qemu-img")
+	}
+
+	return tools
+}
+
+// bootstrapHost bootstraps the build host over a separate connection, opened with the
+// bootstrap credentials for SSH hosts.
+func (b *Builder) bootstrapHost(ctx context.Context, h BuildHost, connect func() (ibk.Transport, error)) error {
+	conn, err := connect()
+	if err != nil {
+		return err
+	}
+	c := ibk.Wrap(conn, ibk.WithRetry(ibk.RetryConfig{}), ibk.WithLogging(ibk.Secrets.Redact))
+	defer c.Close(ctx)
+
+	_, err = ibk.Bootstrap(ctx, c, ibk.BootstrapConfig{User: h.Username, Tools: b.requiredTools()})
+	return err
+}
+
+// gcpUploadConfig reads the credentials file, registers the key as a secret and validates
+// the configuration.
+func (b *Builder) gcpUploadConfig() (*ibk.GCPUploadConfig, error) {
+	creds, err := os.ReadFile(b.config.GCPUpload.CredentialsFile)
 	if err != nil {
 		return nil, err
 	}
+
+	var key struct {
+		PrivateKey string `json:"private_key"`
+	}
+	err = json.Unmarshal(creds, &key)
+	if err != nil {
+		return nil, fmt.Errorf("credentials_file: %w", err)
+	}
+	ibk.Secrets.Add(string(creds), key.PrivateKey)
+	packer.LogSecretFilter.Set(string(creds), key.PrivateKey)
+
+	cfg := &ibk.GCPUploadConfig{
+		Credentials: string(creds),
+		Bucket:      b.config.GCPUpload.Bucket,
+		Region:      b.config.GCPUpload.Region,
+		ImageName:   b.config.GCPUpload.ImageName,
+	}
+
+	return cfg, cfg.Validate(b.config.ImageType)
+}
+
+// checksumConfig returns the checksum configuration with a signer created from the key file.
+func (b *Builder) checksumConfig() (*ibk.ChecksumConfig, error) {
+	cfg := &ibk.ChecksumConfig{SHA512: b.config.Checksums.SHA512}
+
+	switch {
+	case b.config.Checksums.GPGKeyFile != "" && b.config.Checksums.CosignKeyFile != "":
+		return nil, fmt.Errorf("only one of gpg_key_file and cosign_key_file can be set")
+	case b.config.Checksums.GPGKeyFile != "":
+		key, err := os.ReadFile(b.config.Checksums.GPGKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Signer = &ibk.GPGSigner{Key: key, Passphrase: b.config.Checksums.GPGPassphrase}
+	case b.config.Checksums.CosignKeyFile != "":
+		key, err := os.ReadFile(b.config.Checksums.CosignKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Signer = &ibk.CosignSigner{Key: key, Password: b.config.Checksums.CosignPassword}
+	}
+
+	return cfg, nil
+}
+
+func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (packer.Artifact, error) {
+	// create tail 4kB buffer
+	stderr := ibk.Secrets.Writer(os.Stderr)
+	defer stderr.Flush()
+	tail := NewTailWriterThrough(2<<11, stderr)
+
+	// connect to the first usable build host, the connect function is also used by the
+	// artifact to remove remote files
+	obs := ibk.Secrets.Observer(uiObserver(ui))
+	connects := make([]func() (ibk.Transport, error), len(b.config.BuildHosts))
+	bootstraps := make([]func() (ibk.Transport, error), len(b.config.BuildHosts))
+	hosts := make([]ibk.BuildHostCandidate, len(b.config.BuildHosts))
+	for i, h := range b.config.BuildHosts {
+		if len(h.ExecPrefix) > 0 {
+			connects[i] = func() (ibk.Transport, error) {
+				return ibk.NewExecTransport(ibk.ExecTransportConfig{
+					Prefix: h.ExecPrefix,
+					Stdout: tail,
+					Stderr: tail,
+				})
+			}
+		} else {
+			cfg := ibk.SSHTransportConfig{
+				Host:     h.Hostname,
+				Username: h.Username,
+				Password: h.Password,
+				Stdout:   tail,
+				Stderr:   tail,
+			}
+			connects[i] = func() (ibk.Transport, error) {
+				return ibk.NewSSHTransport(cfg)
+			}
+
+			if b.config.Bootstrap.Username != "" {
+				admin := cfg
+				admin.Username = b.config.Bootstrap.Username
+				admin.Password = b.config.Bootstrap.Password
+				bootstraps[i] = func() (ibk.Transport, error) {
+					return ibk.NewSSHTransport(admin)
+				}
+			}
+		}
+		if bootstraps[i] == nil {
+			bootstraps[i] = connects[i]
+		}
+
+		hosts[i] = ibk.BuildHostCandidate{
+			Name:   h.name(),
+			Arch:   h.Arch,
+			Labels: h.Labels,
+			Connect: func() (ibk.Transport, error) {
+				if b.bootstrap {
+					ui.Say("Bootstrapping the build host " + h.name())
+					err := b.bootstrapHost(ibk.WithObserver(ctx, obs), h, bootstraps[i])
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				ui.Say("Connecting to the build host " + h.name())
+				return connects[i]()
+			},
+		}
+	}
+
+	host, err := ibk.SelectBuildHost(ibk.WithObserver(ctx, obs), hosts, ibk.HostRequirements{
+		Arch:      b.config.Architecture,
+		Labels:    b.config.BuildHostLabels,
+		Preflight: b.preflight,
+	})
+	if err != nil {
+		return nil, ibk.Secrets.RedactError(err)
+	}
+	conn, connect := host.Transport, connects[host.Index]
+
+	// hold the build lock until the connection is closed
+	if b.lock != nil {
+		conn, err = ibk.AcquireLock(ibk.WithObserver(ctx, obs), conn, *b.lock)
+		if err != nil {
+			host.Transport.Close(ctx)
+			return nil, ibk.Secrets.RedactError(err)
+		}
+	}
+
+	// run containers via the podman API socket forwarded over the SSH connection, closing conn
+	// also releases the build lock
+	if b.podmanAPI != nil {
+		d, ok := host.Transport.(ibk.Dialer)
+		if !ok {
+			conn.Close(ctx)
+			return nil, ibk.Secrets.RedactError(fmt.Errorf("podman_api: build host %s does not support forwarding of the socket", host.Name))
+		}
+
+		cfg := *b.podmanAPI
+		cfg.Stdout = tail
+		cfg.Stderr = tail
+		api, err := ibk.NewPodmanAPITransport(ctx, conn, d, cfg)
+		if err != nil {
+			conn.Close(ctx)
+			return nil, ibk.Secrets.RedactError(err)
+		}
+		conn = api
+	}
+
+	dryRun := os.Getenv("IMAGE_BUILDER_DRY_RUN") != ""
+	metrics := &ibk.Metrics{}
+	recorder := &ibk.Recorder{}
+	mws := []ibk.Middleware{
+		ibk.WithRetry(ibk.RetryConfig{}),
+		ibk.WithLogging(ibk.Secrets.Redact),
+		ibk.WithMetrics(metrics),
+	}
+	if dryRun {
+		mws = append(mws, ibk.WithRecorder(recorder))
+	}
+	c := ibk.Wrap(conn, mws...)
 	defer c.Close(ctx)
 
-	// configure the command
+	// configure the command, destroy resolves credentials of the unresolved copy again
+	var awsUpload, awsDestroy *ibk.AWSUploadConfig
+	if b.config.AWSUpload.configured() {
+		awsUpload = &ibk.AWSUploadConfig{
+			AWSAccessKeyID:     b.config.AWSUpload.AccessKeyID,
+			AWSSecretAccessKey: b.config.AWSUpload.SecretAccessKey,
+			AWSSessionToken:    b.config.AWSUpload.SessionToken,
+			Profile:            b.config.AWSUpload.Profile,
+			AMIName:            b.config.AWSUpload.AmiName,
+			S3Bucket:           b.config.AWSUpload.S3Bucket,
+			Region:             b.config.AWSUpload.Region,
+			BootMode:           b.config.AWSUpload.BootMode,
+			Tags:               b.config.AWSUpload.Tags,
+			ShareWith:          b.config.AWSUpload.ShareWith,
+		}
+		cfg := *awsUpload
+		awsDestroy = &cfg
+
+		err := awsUpload.Resolve(ctx)
+		if err != nil {
+			return nil, ibk.Secrets.RedactError(err)
+		}
+		ibk.Secrets.Add(awsUpload.AWSSecretAccessKey, awsUpload.AWSSessionToken)
+	}
+
 	var cmd ibk.Command
 	if b.config.ContainerRepository == "" {
 		cmd = &ibk.ContainerCliCommand{
@@ -103,48 +674,164 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 			Arch:      b.config.Architecture,
 			Blueprint: b.config.Blueprint,
 			Common: ibk.CommonArgs{
-				DryRun: os.Getenv("IMAGE_BUILDER_DRY_RUN") != "",
-				TeeLog: true,
+				DryRun:     dryRun,
+				TeeLog:     true,
+				Provenance: !b.config.SkipProvenance,
 			},
+			AWSUploadConfig:     awsUpload,
+			GCPUploadConfig:     b.gcpUpload,
+			AzureUploadConfig:   b.azureUpload,
+			RegistryPushConfig:  b.registryPush,
+			ObjectStorageConfig: b.objectStorage,
+			CompressionConfig:   b.compression,
+			ChecksumConfig:      b.checksums,
+			WithSBOM:            b.config.WithSBOM,
 		}
 	} else {
-		cmdl := &ibk.ContainerBootCommand{
+		cmd = &ibk.ContainerBootCommand{
 			Repository: b.config.ContainerRepository,
 			Type:       b.config.ImageType,
 			RootFS:     b.config.RootFS,
 			Arch:       b.config.Architecture,
 			Blueprint:  b.config.Blueprint,
 			Common: ibk.CommonArgs{
-				DryRun: os.Getenv("IMAGE_BUILDER_DRY_RUN") != "",
-				TeeLog: true,
+				DryRun:     dryRun,
+				TeeLog:     true,
+				Provenance: !b.config.SkipProvenance,
 			},
+			AWSUploadConfig:     awsUpload,
+			ObjectStorageConfig: b.objectStorage,
+			CompressionConfig:   b.compression,
+			ChecksumConfig:      b.checksums,
+			WithSBOM:            b.config.WithSBOM,
 		}
-
-		if b.config.AWSUpload.AccessKeyID != "" {
-			cmdl.AWSUploadConfig = &ibk.AWSUploadConfig{
-				AWSAccessKeyID:     b.config.AWSUpload.AccessKeyID,
-				AWSSecretAccessKey: b.config.AWSUpload.SecretAccessKey,
-				AMIName:            b.config.AWSUpload.AmiName,
-				S3Bucket:           b.config.AWSUpload.S3Bucket,
-				Region:             b.config.AWSUpload.Region,
-			}
-		}
-
-		cmd = cmdl
 	}
 
 	// apply the command
-	err = ibk.ApplyCommandPrint(ctx, cmd, c, ui.Say)
+	res, err := ibk.ApplyCommandObserve(ctx, cmd, c, obs)
 	if err != nil {
-		return nil, err
+		log.Printf("[DEBUG] Transport metrics: %s", metrics)
+		return nil, ibk.Secrets.RedactError(err)
+	}
+
+	// download the output files
+	if b.config.DownloadDir != "" && !dryRun {
+		ui.Say("Downloading output files to " + b.config.DownloadDir)
+		err = ibk.DownloadResult(ibk.WithObserver(ctx, obs), c, res, ibk.DownloadConfig{
+			Dir:            b.config.DownloadDir,
+			Decompress:     b.config.Compression.Decompress,
+			Sparse:         b.config.DownloadSparse,
+			BandwidthLimit: b.config.DownloadBandwidth,
+		})
+		if err != nil {
+			return nil, ibk.Secrets.RedactError(err)
+		}
+	}
+	log.Printf("[DEBUG] Transport metrics: %s", metrics)
+
+	if dryRun {
+		ui.Message(ibk.Secrets.Redact("Dry run transcript:\n" + strings.Join(recorder.Entries(), "\n")))
 	}
 
 	// create artifact
-	sa := &StringArtifact{}
+	sa := &StringArtifact{
+		ui:       ui,
+		host:     host.Name,
+		hostArch: host.Arch,
+		destroy: ibk.DestroyConfig{
+			AWS:                awsDestroy,
+			Registry:           b.registryPush,
+			ObjectStorage:      b.objectStorage,
+			KeepRemoteFiles:    b.config.Destroy.KeepRemoteFiles,
+			KeepCloudImages:    b.config.Destroy.KeepCloudImages,
+			KeepRegistryPushes: b.config.Destroy.KeepRegistryImages,
+			KeepObjects:        b.config.Destroy.KeepObjects,
+		},
+		connect: func() (ibk.Transport, error) {
+			conn, err := connect()
+			if err != nil {
+				return nil, err
+			}
+			return ibk.Wrap(conn, ibk.WithLogging(ibk.Secrets.Redact)), nil
+		},
+	}
 	for _, line := range tail.LastLines(25) {
 		sa.WriteString(line)
 		sa.WriteString("\n")
 	}
+	sa.WriteResult(res)
 
 	return sa, nil
 }
+
+// uiObserver maps build events to the packer UI.
+func uiObserver(ui packer.Ui) ibk.Observer {
+	return ibk.ObserverFunc(func(e ibk.Event) {
+		switch e.Type {
+		case ibk.EventPhaseStarted:
+			ui.Say(e.Message)
+		case ibk.EventPullProgress:
+			ui.Message(e.Message)
+		case ibk.EventStageProgress:
+			ui.Say("Stage " + e.Message)
+		case ibk.EventOutputFile:
+			ui.Message(fmt.Sprintf("Output file %s (%d bytes)", e.Path, e.Size))
+		case ibk.EventFileDownloaded:
+			ui.Message(fmt.Sprintf("Downloaded %s (%d bytes)", e.Path, e.Size))
+		case ibk.EventCloudImage:
+			ui.Say("Registered image " + e.Message)
+		case ibk.EventRegistryPush:
+			ui.Say("Pushed image " + e.Message)
+		case ibk.EventObjectUploaded:
+			ui.Say(fmt.Sprintf("Uploaded %s to %s", e.Path, e.Message))
+		case ibk.EventDeleted:
+			ui.Say("Deleted " + e.Message)
+		case ibk.EventHostSelected:
+			ui.Say("Selected the build host " + e.Message)
+		case ibk.EventLockWaiting:
+			ui.Say("Waiting for the build lock held by " + e.Message)
+		case ibk.EventLockAcquired:
+			ui.Say("Acquired the build lock")
+		case ibk.EventBootstrap:
+			ui.Say("Bootstrap " + e.Message)
+		case ibk.EventPreflightCheck:
+			ui.Message("Preflight " + e.Message)
+		case ibk.EventContainerCreated:
+			ui.Message("Created container " + e.Message)
+		case ibk.EventWarning:
+			ui.Error("Warning: " + e.Message)
+		}
+	})
+}
+
+// sensitiveValues returns non-empty values of string fields tagged with `sensitive:"true"`,
+// nested structs and slices of structs are walked recursively.
+func sensitiveValues(v interface{}) []string {
+	var values []string
+
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		fv := rv.Field(i)
+		switch {
+		case fv.Kind() == reflect.Struct:
+			values = append(values, sensitiveValues(fv.Interface())...)
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < fv.Len(); j++ {
+				values = append(values, sensitiveValues(fv.Index(j).Interface())...)
+			}
+		case fv.Kind() == reflect.String && field.Tag.Get("sensitive") == "true" && fv.String() != "":
+			values = append(values, fv.String())
+		}
+	}
+
+	return values
+}
@@ -10,11 +10,16 @@ import (
 // FlatAWSUpload is an auto-generated flat version of AWSUpload.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatAWSUpload struct {
-	AccessKeyID     *string `mapstructure:"access_key_id" cty:"access_key_id" hcl:"access_key_id"`
-	SecretAccessKey *string `mapstructure:"secret_access_key" cty:"secret_access_key" hcl:"secret_access_key"`
-	AmiName         *string `mapstructure:"ami_name" cty:"ami_name" hcl:"ami_name"`
-	S3Bucket        *string `mapstructure:"s3_bucket" cty:"s3_bucket" hcl:"s3_bucket"`
-	Region          *string `mapstructure:"region" cty:"region" hcl:"region"`
+	AccessKeyID     *string           `mapstructure:"access_key_id" cty:"access_key_id" hcl:"access_key_id"`
+	SecretAccessKey *string           `mapstructure:"secret_access_key" cty:"secret_access_key" hcl:"secret_access_key"`
+	SessionToken    *string           `mapstructure:"session_token" cty:"session_token" hcl:"session_token"`
+	Profile         *string           `mapstructure:"profile" cty:"profile" hcl:"profile"`
+	AmiName         *string           `mapstructure:"ami_name" cty:"ami_name" hcl:"ami_name"`
+	S3Bucket        *string           `mapstructure:"s3_bucket" cty:"s3_bucket" hcl:"s3_bucket"`
+	Region          *string           `mapstructure:"region" cty:"region" hcl:"region"`
+	BootMode        *string           `mapstructure:"boot_mode" cty:"boot_mode" hcl:"boot_mode"`
+	Tags            map[string]string `mapstructure:"tags" cty:"tags" hcl:"tags"`
+	ShareWith       []string          `mapstructure:"share_with" cty:"share_with" hcl:"share_with"`
 }
 
 // FlatMapstructure returns a new FlatAWSUpload.
@@ -31,9 +36,76 @@ func (*FlatAWSUpload) HCL2Spec() map[string]hcldec.Spec {
 	s := map[string]hcldec.Spec{
 		"access_key_id":     &hcldec.AttrSpec{Name: "access_key_id", Type: cty.String, Required: false},
 		"secret_access_key": &hcldec.AttrSpec{Name: "secret_access_key", Type: cty.String, Required: false},
+		"session_token":     &hcldec.AttrSpec{Name: "session_token", Type: cty.String, Required: false},
+		"profile":           &hcldec.AttrSpec{Name: "profile", Type: cty.String, Required: false},
 		"ami_name":          &hcldec.AttrSpec{Name: "ami_name", Type: cty.String, Required: false},
 		"s3_bucket":         &hcldec.AttrSpec{Name: "s3_bucket", Type: cty.String, Required: false},
 		"region":            &hcldec.AttrSpec{Name: "region", Type: cty.String, Required: false},
+		"boot_mode":         &hcldec.AttrSpec{Name: "boot_mode", Type: cty.String, Required: false},
+		"tags":              &hcldec.AttrSpec{Name: "tags", Type: cty.Map(cty.String), Required: false},
+		"share_with":        &hcldec.AttrSpec{Name: "share_with", Type: cty.List(cty.String), Required: false},
+	}
+	return s
+}
+
+// FlatAzureUpload is an auto-generated flat version of AzureUpload.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatAzureUpload struct {
+	TenantID       *string `mapstructure:"tenant_id" cty:"tenant_id" hcl:"tenant_id"`
+	SubscriptionID *string `mapstructure:"subscription_id" cty:"subscription_id" hcl:"subscription_id"`
+	ClientID       *string `mapstructure:"client_id" cty:"client_id" hcl:"client_id"`
+	ClientSecret   *string `mapstructure:"client_secret" cty:"client_secret" hcl:"client_secret"`
+	ResourceGroup  *string `mapstructure:"resource_group" cty:"resource_group" hcl:"resource_group"`
+	Location       *string `mapstructure:"location" cty:"location" hcl:"location"`
+	ImageName      *string `mapstructure:"image_name" cty:"image_name" hcl:"image_name"`
+}
+
+// FlatMapstructure returns a new FlatAzureUpload.
+// FlatAzureUpload is an auto-generated flat version of AzureUpload.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*AzureUpload) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatAzureUpload)
+}
+
+// HCL2Spec returns the hcl spec of a AzureUpload.
+// This spec is used by HCL to read the fields of AzureUpload.
+// The decoded values from this spec will then be applied to a FlatAzureUpload.
+func (*FlatAzureUpload) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"tenant_id":       &hcldec.AttrSpec{Name: "tenant_id", Type: cty.String, Required: false},
+		"subscription_id": &hcldec.AttrSpec{Name: "subscription_id", Type: cty.String, Required: false},
+		"client_id":       &hcldec.AttrSpec{Name: "client_id", Type: cty.String, Required: false},
+		"client_secret":   &hcldec.AttrSpec{Name: "client_secret", Type: cty.String, Required: false},
+		"resource_group":  &hcldec.AttrSpec{Name: "resource_group", Type: cty.String, Required: false},
+		"location":        &hcldec.AttrSpec{Name: "location", Type: cty.String, Required: false},
+		"image_name":      &hcldec.AttrSpec{Name: "image_name", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatBootstrap is an auto-generated flat version of Bootstrap.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatBootstrap struct {
+	Enabled  *bool   `mapstructure:"enabled" cty:"enabled" hcl:"enabled"`
+	Username *string `mapstructure:"username" cty:"username" hcl:"username"`
+	Password *string `mapstructure:"password" cty:"password" hcl:"password"`
+}
+
+// FlatMapstructure returns a new FlatBootstrap.
+// FlatBootstrap is an auto-generated flat version of Bootstrap.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*Bootstrap) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatBootstrap)
+}
+
+// HCL2Spec returns the hcl spec of a Bootstrap.
+// This spec is used by HCL to read the fields of Bootstrap.
+// The decoded values from this spec will then be applied to a FlatBootstrap.
+func (*FlatBootstrap) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"enabled":  &hcldec.AttrSpec{Name: "enabled", Type: cty.Bool, Required: false},
+		"username": &hcldec.AttrSpec{Name: "username", Type: cty.String, Required: false},
+		"password": &hcldec.AttrSpec{Name: "password", Type: cty.String, Required: false},
 	}
 	return s
 }
@@ -41,9 +113,12 @@ func (*FlatAWSUpload) HCL2Spec() map[string]hcldec.Spec {
 // FlatBuildHost is an auto-generated flat version of BuildHost.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatBuildHost struct {
-	Hostname *string `mapstructure:"hostname,required" cty:"hostname" hcl:"hostname"`
-	Username *string `mapstructure:"username,required" cty:"username" hcl:"username"`
-	Password *string `mapstructure:"password" cty:"password" hcl:"password"`
+	Hostname   *string  `mapstructure:"hostname" cty:"hostname" hcl:"hostname"`
+	Username   *string  `mapstructure:"username" cty:"username" hcl:"username"`
+	Password   *string  `mapstructure:"password" cty:"password" hcl:"password"`
+	ExecPrefix []string `mapstructure:"exec_prefix" cty:"exec_prefix" hcl:"exec_prefix"`
+	Arch       *string  `mapstructure:"arch" cty:"arch" hcl:"arch"`
+	Labels     []string `mapstructure:"labels" cty:"labels" hcl:"labels"`
 }
 
 // FlatMapstructure returns a new FlatBuildHost.
@@ -58,9 +133,103 @@ func (*BuildHost) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spe
 // The decoded values from this spec will then be applied to a FlatBuildHost.
 func (*FlatBuildHost) HCL2Spec() map[string]hcldec.Spec {
 	s := map[string]hcldec.Spec{
-		"hostname": &hcldec.AttrSpec{Name: "hostname", Type: cty.String, Required: false},
-		"username": &hcldec.AttrSpec{Name: "username", Type: cty.String, Required: false},
-		"password": &hcldec.AttrSpec{Name: "password", Type: cty.String, Required: false},
+		"hostname":    &hcldec.AttrSpec{Name: "hostname", Type: cty.String, Required: false},
+		"username":    &hcldec.AttrSpec{Name: "username", Type: cty.String, Required: false},
+		"password":    &hcldec.AttrSpec{Name: "password", Type: cty.String, Required: false},
+		"exec_prefix": &hcldec.AttrSpec{Name: "exec_prefix", Type: cty.List(cty.String), Required: false},
+		"arch":        &hcldec.AttrSpec{Name: "arch", Type: cty.String, Required: false},
+		"labels":      &hcldec.AttrSpec{Name: "labels", Type: cty.List(cty.String), Required: false},
+	}
+	return s
+}
+
+// FlatBuildLock is an auto-generated flat version of BuildLock.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatBuildLock struct {
+	Enabled        *bool   `mapstructure:"enabled" cty:"enabled" hcl:"enabled"`
+	MaxConcurrency *int    `mapstructure:"max_concurrency" cty:"max_concurrency" hcl:"max_concurrency"`
+	Timeout        *string `mapstructure:"timeout" cty:"timeout" hcl:"timeout"`
+	Dir            *string `mapstructure:"dir" cty:"dir" hcl:"dir"`
+}
+
+// FlatMapstructure returns a new FlatBuildLock.
+// FlatBuildLock is an auto-generated flat version of BuildLock.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*BuildLock) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatBuildLock)
+}
+
+// HCL2Spec returns the hcl spec of a BuildLock.
+// This spec is used by HCL to read the fields of BuildLock.
+// The decoded values from this spec will then be applied to a FlatBuildLock.
+func (*FlatBuildLock) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"enabled":         &hcldec.AttrSpec{Name: "enabled", Type: cty.Bool, Required: false},
+		"max_concurrency": &hcldec.AttrSpec{Name: "max_concurrency", Type: cty.Number, Required: false},
+		"timeout":         &hcldec.AttrSpec{Name: "timeout", Type: cty.String, Required: false},
+		"dir":             &hcldec.AttrSpec{Name: "dir", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatChecksums is an auto-generated flat version of Checksums.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatChecksums struct {
+	Enabled        *bool   `mapstructure:"enabled" cty:"enabled" hcl:"enabled"`
+	SHA512         *bool   `mapstructure:"sha512" cty:"sha512" hcl:"sha512"`
+	GPGKeyFile     *string `mapstructure:"gpg_key_file" cty:"gpg_key_file" hcl:"gpg_key_file"`
+	GPGPassphrase  *string `mapstructure:"gpg_passphrase" cty:"gpg_passphrase" hcl:"gpg_passphrase"`
+	CosignKeyFile  *string `mapstructure:"cosign_key_file" cty:"cosign_key_file" hcl:"cosign_key_file"`
+	CosignPassword *string `mapstructure:"cosign_password" cty:"cosign_password" hcl:"cosign_password"`
+}
+
+// FlatMapstructure returns a new FlatChecksums.
+// FlatChecksums is an auto-generated flat version of Checksums.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*Checksums) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatChecksums)
+}
+
+// HCL2Spec returns the hcl spec of a Checksums.
+// This spec is used by HCL to read the fields of Checksums.
+// The decoded values from this spec will then be applied to a FlatChecksums.
+func (*FlatChecksums) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"enabled":         &hcldec.AttrSpec{Name: "enabled", Type: cty.Bool, Required: false},
+		"sha512":          &hcldec.AttrSpec{Name: "sha512", Type: cty.Bool, Required: false},
+		"gpg_key_file":    &hcldec.AttrSpec{Name: "gpg_key_file", Type: cty.String, Required: false},
+		"gpg_passphrase":  &hcldec.AttrSpec{Name: "gpg_passphrase", Type: cty.String, Required: false},
+		"cosign_key_file": &hcldec.AttrSpec{Name: "cosign_key_file", Type: cty.String, Required: false},
+		"cosign_password": &hcldec.AttrSpec{Name: "cosign_password", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatCompression is an auto-generated flat version of Compression.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatCompression struct {
+	Format     *string `mapstructure:"format" cty:"format" hcl:"format"`
+	Level      *int    `mapstructure:"level" cty:"level" hcl:"level"`
+	Threads    *int    `mapstructure:"threads" cty:"threads" hcl:"threads"`
+	Decompress *bool   `mapstructure:"decompress" cty:"decompress" hcl:"decompress"`
+}
+
+// FlatMapstructure returns a new FlatCompression.
+// FlatCompression is an auto-generated flat version of Compression.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*Compression) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatCompression)
+}
+
+// HCL2Spec returns the hcl spec of a Compression.
+// This spec is used by HCL to read the fields of Compression.
+// The decoded values from this spec will then be applied to a FlatCompression.
+func (*FlatCompression) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"format":     &hcldec.AttrSpec{Name: "format", Type: cty.String, Required: false},
+		"level":      &hcldec.AttrSpec{Name: "level", Type: cty.Number, Required: false},
+		"threads":    &hcldec.AttrSpec{Name: "threads", Type: cty.Number, Required: false},
+		"decompress": &hcldec.AttrSpec{Name: "decompress", Type: cty.Bool, Required: false},
 	}
 	return s
 }
@@ -68,22 +237,39 @@ func (*FlatBuildHost) HCL2Spec() map[string]hcldec.Spec {
 // FlatConfig is an auto-generated flat version of Config.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatConfig struct {
-	PackerBuildName     *string           `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
-	PackerBuilderType   *string           `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
-	PackerCoreVersion   *string           `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
-	PackerDebug         *bool             `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
-	PackerForce         *bool             `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
-	PackerOnError       *string           `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
-	PackerUserVars      map[string]string `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
-	PackerSensitiveVars []string          `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
-	BuildHost           *FlatBuildHost    `mapstructure:"build_host,required" cty:"build_host" hcl:"build_host"`
-	ImageType           *string           `mapstructure:"image_type,required" cty:"image_type" hcl:"image_type"`
-	Architecture        *string           `mapstructure:"architecture" cty:"architecture" hcl:"architecture"`
-	Blueprint           *string           `mapstructure:"blueprint" cty:"blueprint" hcl:"blueprint"`
-	Distro              *string           `mapstructure:"distro" cty:"distro" hcl:"distro"`
-	RootFS              *string           `mapstructure:"rootfs" cty:"rootfs" hcl:"rootfs"`
-	ContainerRepository *string           `mapstructure:"container_repository" cty:"container_repository" hcl:"container_repository"`
-	AWSUpload           *FlatAWSUpload    `mapstructure:"aws_upload" cty:"aws_upload" hcl:"aws_upload"`
+	PackerBuildName     *string                  `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
+	PackerBuilderType   *string                  `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
+	PackerCoreVersion   *string                  `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
+	PackerDebug         *bool                    `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
+	PackerForce         *bool                    `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
+	PackerOnError       *string                  `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
+	PackerUserVars      map[string]string        `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
+	PackerSensitiveVars []string                 `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
+	BuildHosts          []FlatBuildHost          `mapstructure:"build_host,required" cty:"build_host" hcl:"build_host"`
+	BuildHostLabels     []string                 `mapstructure:"build_host_labels" cty:"build_host_labels" hcl:"build_host_labels"`
+	BuildLock           *FlatBuildLock           `mapstructure:"build_lock" cty:"build_lock" hcl:"build_lock"`
+	Preflight           *FlatPreflight           `mapstructure:"preflight" cty:"preflight" hcl:"preflight"`
+	Bootstrap           *FlatBootstrap           `mapstructure:"bootstrap" cty:"bootstrap" hcl:"bootstrap"`
+	PodmanAPI           *FlatPodmanAPI           `mapstructure:"podman_api" cty:"podman_api" hcl:"podman_api"`
+	ImageType           *string                  `mapstructure:"image_type,required" cty:"image_type" hcl:"image_type"`
+	Architecture        *string                  `mapstructure:"architecture" cty:"architecture" hcl:"architecture"`
+	Blueprint           *string                  `mapstructure:"blueprint" cty:"blueprint" hcl:"blueprint"`
+	Distro              *string                  `mapstructure:"distro" cty:"distro" hcl:"distro"`
+	RootFS              *string                  `mapstructure:"rootfs" cty:"rootfs" hcl:"rootfs"`
+	ContainerRepository *string                  `mapstructure:"container_repository" cty:"container_repository" hcl:"container_repository"`
+	AWSUpload           *FlatAWSUpload           `mapstructure:"aws_upload" cty:"aws_upload" hcl:"aws_upload"`
+	GCPUpload           *FlatGCPUpload           `mapstructure:"gcp_upload" cty:"gcp_upload" hcl:"gcp_upload"`
+	AzureUpload         *FlatAzureUpload         `mapstructure:"azure_upload" cty:"azure_upload" hcl:"azure_upload"`
+	RegistryPush        *FlatRegistryPush        `mapstructure:"registry_push" cty:"registry_push" hcl:"registry_push"`
+	ObjectStorageUpload *FlatObjectStorageUpload `mapstructure:"object_storage_upload" cty:"object_storage_upload" hcl:"object_storage_upload"`
+	Compression         *FlatCompression         `mapstructure:"compression" cty:"compression" hcl:"compression"`
+	Checksums           *FlatChecksums           `mapstructure:"checksums" cty:"checksums" hcl:"checksums"`
+	DownloadDir         *string                  `mapstructure:"download_dir" cty:"download_dir" hcl:"download_dir"`
+	DownloadSparse      *bool                    `mapstructure:"download_sparse" cty:"download_sparse" hcl:"download_sparse"`
+	DownloadBandwidth   *int64                   `mapstructure:"download_bandwidth_limit" cty:"download_bandwidth_limit" hcl:"download_bandwidth_limit"`
+	SkipProvenance      *bool                    `mapstructure:"skip_provenance" cty:"skip_provenance" hcl:"skip_provenance"`
+	WithSBOM            *bool                    `mapstructure:"with_sbom" cty:"with_sbom" hcl:"with_sbom"`
+	Destroy             *FlatDestroy             `mapstructure:"destroy" cty:"destroy" hcl:"destroy"`
 }
 
 // FlatMapstructure returns a new FlatConfig.
@@ -106,7 +292,12 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"packer_on_error":            &hcldec.AttrSpec{Name: "packer_on_error", Type: cty.String, Required: false},
 		"packer_user_variables":      &hcldec.AttrSpec{Name: "packer_user_variables", Type: cty.Map(cty.String), Required: false},
 		"packer_sensitive_variables": &hcldec.AttrSpec{Name: "packer_sensitive_variables", Type: cty.List(cty.String), Required: false},
-		"build_host":                 &hcldec.BlockSpec{TypeName: "build_host", Nested: hcldec.ObjectSpec((*FlatBuildHost)(nil).HCL2Spec())},
+		"build_host":                 &hcldec.BlockListSpec{TypeName: "build_host", Nested: hcldec.ObjectSpec((*FlatBuildHost)(nil).HCL2Spec())},
+		"build_host_labels":          &hcldec.AttrSpec{Name: "build_host_labels", Type: cty.List(cty.String), Required: false},
+		"build_lock":                 &hcldec.BlockSpec{TypeName: "build_lock", Nested: hcldec.ObjectSpec((*FlatBuildLock)(nil).HCL2Spec())},
+		"preflight":                  &hcldec.BlockSpec{TypeName: "preflight", Nested: hcldec.ObjectSpec((*FlatPreflight)(nil).HCL2Spec())},
+		"bootstrap":                  &hcldec.BlockSpec{TypeName: "bootstrap", Nested: hcldec.ObjectSpec((*FlatBootstrap)(nil).HCL2Spec())},
+		"podman_api":                 &hcldec.BlockSpec{TypeName: "podman_api", Nested: hcldec.ObjectSpec((*FlatPodmanAPI)(nil).HCL2Spec())},
 		"image_type":                 &hcldec.AttrSpec{Name: "image_type", Type: cty.String, Required: false},
 		"architecture":               &hcldec.AttrSpec{Name: "architecture", Type: cty.String, Required: false},
 		"blueprint":                  &hcldec.AttrSpec{Name: "blueprint", Type: cty.String, Required: false},
@@ -114,6 +305,194 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"rootfs":                     &hcldec.AttrSpec{Name: "rootfs", Type: cty.String, Required: false},
 		"container_repository":       &hcldec.AttrSpec{Name: "container_repository", Type: cty.String, Required: false},
 		"aws_upload":                 &hcldec.BlockSpec{TypeName: "aws_upload", Nested: hcldec.ObjectSpec((*FlatAWSUpload)(nil).HCL2Spec())},
+		"gcp_upload":                 &hcldec.BlockSpec{TypeName: "gcp_upload", Nested: hcldec.ObjectSpec((*FlatGCPUpload)(nil).HCL2Spec())},
+		"azure_upload":               &hcldec.BlockSpec{TypeName: "azure_upload", Nested: hcldec.ObjectSpec((*FlatAzureUpload)(nil).HCL2Spec())},
+		"registry_push":              &hcldec.BlockSpec{TypeName: "registry_push", Nested: hcldec.ObjectSpec((*FlatRegistryPush)(nil).HCL2Spec())},
+		"object_storage_upload":      &hcldec.BlockSpec{TypeName: "object_storage_upload", Nested: hcldec.ObjectSpec((*FlatObjectStorageUpload)(nil).HCL2Spec())},
+		"compression":                &hcldec.BlockSpec{TypeName: "compression", Nested: hcldec.ObjectSpec((*FlatCompression)(nil).HCL2Spec())},
+		"checksums":                  &hcldec.BlockSpec{TypeName: "checksums", Nested: hcldec.ObjectSpec((*FlatChecksums)(nil).HCL2Spec())},
+		"download_dir":               &hcldec.AttrSpec{Name: "download_dir", Type: cty.String, Required: false},
+		"download_sparse":            &hcldec.AttrSpec{Name: "download_sparse", Type: cty.Bool, Required: false},
+		"download_bandwidth_limit":   &hcldec.AttrSpec{Name: "download_bandwidth_limit", Type: cty.Number, Required: false},
+		"skip_provenance":            &hcldec.AttrSpec{Name: "skip_provenance", Type: cty.Bool, Required: false},
+		"with_sbom":                  &hcldec.AttrSpec{Name: "with_sbom", Type: cty.Bool, Required: false},
+		"destroy":                    &hcldec.BlockSpec{TypeName: "destroy", Nested: hcldec.ObjectSpec((*FlatDestroy)(nil).HCL2Spec())},
+	}
+	return s
+}
+
+// FlatDestroy is an auto-generated flat version of Destroy.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatDestroy struct {
+	KeepRemoteFiles    *bool `mapstructure:"keep_remote_files" cty:"keep_remote_files" hcl:"keep_remote_files"`
+	KeepCloudImages    *bool `mapstructure:"keep_cloud_images" cty:"keep_cloud_images" hcl:"keep_cloud_images"`
+	KeepRegistryImages *bool `mapstructure:"keep_registry_images" cty:"keep_registry_images" hcl:"keep_registry_images"`
+	KeepObjects        *bool `mapstructure:"keep_objects" cty:"keep_objects" hcl:"keep_objects"`
+}
+
+// FlatMapstructure returns a new FlatDestroy.
+// FlatDestroy is an auto-generated flat version of Destroy.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*Destroy) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatDestroy)
+}
+
+// HCL2Spec returns the hcl spec of a Destroy.
+// This spec is used by HCL to read the fields of Destroy.
+// The decoded values from this spec will then be applied to a FlatDestroy.
+func (*FlatDestroy) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"keep_remote_files":    &hcldec.AttrSpec{Name: "keep_remote_files", Type: cty.Bool, Required: false},
+		"keep_cloud_images":    &hcldec.AttrSpec{Name: "keep_cloud_images", Type: cty.Bool, Required: false},
+		"keep_registry_images": &hcldec.AttrSpec{Name: "keep_registry_images", Type: cty.Bool, Required: false},
+		"keep_objects":         &hcldec.AttrSpec{Name: "keep_objects", Type: cty.Bool, Required: false},
+	}
+	return s
+}
+
+// FlatGCPUpload is an auto-generated flat version of GCPUpload.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatGCPUpload struct {
+	CredentialsFile *string `mapstructure:"credentials_file" cty:"credentials_file" hcl:"credentials_file"`
+	Bucket          *string `mapstructure:"bucket" cty:"bucket" hcl:"bucket"`
+	Region          *string `mapstructure:"region" cty:"region" hcl:"region"`
+	ImageName       *string `mapstructure:"image_name" cty:"image_name" hcl:"image_name"`
+}
+
+// FlatMapstructure returns a new FlatGCPUpload.
+// FlatGCPUpload is an auto-generated flat version of GCPUpload.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*GCPUpload) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatGCPUpload)
+}
+
+// HCL2Spec returns the hcl spec of a GCPUpload.
+// This spec is used by HCL to read the fields of GCPUpload.
+// The decoded values from this spec will then be applied to a FlatGCPUpload.
+func (*FlatGCPUpload) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"credentials_file": &hcldec.AttrSpec{Name: "credentials_file", Type: cty.String, Required: false},
+		"bucket":           &hcldec.AttrSpec{Name: "bucket", Type: cty.String, Required: false},
+		"region":           &hcldec.AttrSpec{Name: "region", Type: cty.String, Required: false},
+		"image_name":       &hcldec.AttrSpec{Name: "image_name", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatObjectStorageUpload is an auto-generated flat version of ObjectStorageUpload.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatObjectStorageUpload struct {
+	Endpoint        *string `mapstructure:"endpoint" cty:"endpoint" hcl:"endpoint"`
+	Bucket          *string `mapstructure:"bucket" cty:"bucket" hcl:"bucket"`
+	Prefix          *string `mapstructure:"prefix" cty:"prefix" hcl:"prefix"`
+	Region          *string `mapstructure:"region" cty:"region" hcl:"region"`
+	AccessKeyID     *string `mapstructure:"access_key_id" cty:"access_key_id" hcl:"access_key_id"`
+	SecretAccessKey *string `mapstructure:"secret_access_key" cty:"secret_access_key" hcl:"secret_access_key"`
+	PathStyle       *bool   `mapstructure:"path_style" cty:"path_style" hcl:"path_style"`
+}
+
+// FlatMapstructure returns a new FlatObjectStorageUpload.
+// FlatObjectStorageUpload is an auto-generated flat version of ObjectStorageUpload.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*ObjectStorageUpload) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatObjectStorageUpload)
+}
+
+// HCL2Spec returns the hcl spec of a ObjectStorageUpload.
+// This spec is used by HCL to read the fields of ObjectStorageUpload.
+// The decoded values from this spec will then be applied to a FlatObjectStorageUpload.
+func (*FlatObjectStorageUpload) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"endpoint":          &hcldec.AttrSpec{Name: "endpoint", Type: cty.String, Required: false},
+		"bucket":            &hcldec.AttrSpec{Name: "bucket", Type: cty.String, Required: false},
+		"prefix":            &hcldec.AttrSpec{Name: "prefix", Type: cty.String, Required: false},
+		"region":            &hcldec.AttrSpec{Name: "region", Type: cty.String, Required: false},
+		"access_key_id":     &hcldec.AttrSpec{Name: "access_key_id", Type: cty.String, Required: false},
+		"secret_access_key": &hcldec.AttrSpec{Name: "secret_access_key", Type: cty.String, Required: false},
+		"path_style":        &hcldec.AttrSpec{Name: "path_style", Type: cty.Bool, Required: false},
+	}
+	return s
+}
+
+// FlatPodmanAPI is an auto-generated flat version of PodmanAPI.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatPodmanAPI struct {
+	Enabled *bool   `mapstructure:"enabled" cty:"enabled" hcl:"enabled"`
+	Socket  *string `mapstructure:"socket" cty:"socket" hcl:"socket"`
+}
+
+// FlatMapstructure returns a new FlatPodmanAPI.
+// FlatPodmanAPI is an auto-generated flat version of PodmanAPI.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*PodmanAPI) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatPodmanAPI)
+}
+
+// HCL2Spec returns the hcl spec of a PodmanAPI.
+// This spec is used by HCL to read the fields of PodmanAPI.
+// The decoded values from this spec will then be applied to a FlatPodmanAPI.
+func (*FlatPodmanAPI) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"enabled": &hcldec.AttrSpec{Name: "enabled", Type: cty.Bool, Required: false},
+		"socket":  &hcldec.AttrSpec{Name: "socket", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatPreflight is an auto-generated flat version of Preflight.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatPreflight struct {
+	Enabled         *bool    `mapstructure:"enabled" cty:"enabled" hcl:"enabled"`
+	MinFreeSpace    *int64   `mapstructure:"min_free_space" cty:"min_free_space" hcl:"min_free_space"`
+	Tools           []string `mapstructure:"tools" cty:"tools" hcl:"tools"`
+	SkipLoopDevices *bool    `mapstructure:"skip_loop_devices" cty:"skip_loop_devices" hcl:"skip_loop_devices"`
+}
+
+// FlatMapstructure returns a new FlatPreflight.
+// FlatPreflight is an auto-generated flat version of Preflight.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*Preflight) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatPreflight)
+}
+
+// HCL2Spec returns the hcl spec of a Preflight.
+// This spec is used by HCL to read the fields of Preflight.
+// The decoded values from this spec will then be applied to a FlatPreflight.
+func (*FlatPreflight) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"enabled":           &hcldec.AttrSpec{Name: "enabled", Type: cty.Bool, Required: false},
+		"min_free_space":    &hcldec.AttrSpec{Name: "min_free_space", Type: cty.Number, Required: false},
+		"tools":             &hcldec.AttrSpec{Name: "tools", Type: cty.List(cty.String), Required: false},
+		"skip_loop_devices": &hcldec.AttrSpec{Name: "skip_loop_devices", Type: cty.Bool, Required: false},
+	}
+	return s
+}
+
+// FlatRegistryPush is an auto-generated flat version of RegistryPush.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatRegistryPush struct {
+	Reference *string `mapstructure:"reference" cty:"reference" hcl:"reference"`
+	Username  *string `mapstructure:"username" cty:"username" hcl:"username"`
+	Password  *string `mapstructure:"password" cty:"password" hcl:"password"`
+	Insecure  *bool   `mapstructure:"insecure" cty:"insecure" hcl:"insecure"`
+}
+
+// FlatMapstructure returns a new FlatRegistryPush.
+// FlatRegistryPush is an auto-generated flat version of RegistryPush.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*RegistryPush) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatRegistryPush)
+}
+
+// HCL2Spec returns the hcl spec of a RegistryPush.
+// This spec is used by HCL to read the fields of RegistryPush.
+// The decoded values from this spec will then be applied to a FlatRegistryPush.
+func (*FlatRegistryPush) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"reference": &hcldec.AttrSpec{Name: "reference", Type: cty.String, Required: false},
+		"username":  &hcldec.AttrSpec{Name: "username", Type: cty.String, Required: false},
+		"password":  &hcldec.AttrSpec{Name: "password", Type: cty.String, Required: false},
+		"insecure":  &hcldec.AttrSpec{Name: "insecure", Type: cty.Bool, Required: false},
 	}
 	return s
 }
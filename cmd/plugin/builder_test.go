@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSensitiveValues(t *testing.T) {
+	cfg := Config{
+		BuildHosts: []BuildHost{
+			{
+				Hostname: "example.com",
+				Username: "builder",
+				Password: "s3cr3t",
+			},
+			{
+				Hostname: "arm.example.com",
+				Username: "builder",
+				Password: "arm-s3cr3t",
+				Arch:     "aarch64",
+			},
+		},
+		Bootstrap: Bootstrap{
+			Username: "root",
+			Password: "root-s3cr3t",
+		},
+		ImageType: "ami",
+		AWSUpload: AWSUpload{
+			AccessKeyID:     "AKIA",
+			SecretAccessKey: "aws-s3cr3t",
+		},
+		AzureUpload: AzureUpload{
+			ClientID:     "client",
+			ClientSecret: "azure-s3cr3t",
+		},
+	}
+
+	want := []string{"s3cr3t", "arm-s3cr3t", "root-s3cr3t", "aws-s3cr3t", "azure-s3cr3t"}
+	if diff := cmp.Diff(want, sensitiveValues(&cfg)); diff != "" {
+		t.Errorf("unexpected sensitive values: %s", diff)
+	}
+}
@@ -1,15 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"io"
-	"regexp"
 	"strings"
 	"sync"
 )
 
 // TailWriter implements a byte ring buffer that keeps last N bytes of the
-// written data. It also supports writethrough writer and regexp callback.
+// written data. It also supports writethrough writer.
 type TailWriter struct {
 	buf    []byte
 	length int
@@ -19,14 +17,6 @@ type TailWriter struct {
 	mu sync.Mutex
 
 	writethrough io.Writer
-	rc           *RegexpCallback
-}
-
-type RegexpCallback struct {
-	Regexp   *regexp.Regexp
-	Prefix   string
-	Callback func(string)
-	m        *bytes.Buffer
 }
 
 // NewTailWriter creates a new TailWriter with the given size.
@@ -40,15 +30,11 @@ func NewTailWriter(size int) *TailWriter {
 	}
 }
 
-// NewTailWriterThrough creates a new TailWriter with the given size, the writethrough
-// writer and the regexp callback.
-func NewTailWriterThrough(size int, writethrough io.Writer, rc *RegexpCallback) *TailWriter {
+// NewTailWriterThrough creates a new TailWriter with the given size and the writethrough
+// writer.
+func NewTailWriterThrough(size int, writethrough io.Writer) *TailWriter {
 	tw := NewTailWriter(size)
 	tw.writethrough = writethrough
-	if rc != nil {
-		tw.rc = rc
-		tw.rc.m = &bytes.Buffer{}
-	}
 	return tw
 }
 
@@ -68,15 +54,6 @@ func (tw *TailWriter) Write(p []byte) (n int, err error) {
 		}
 	}
 
-	if tw.rc != nil && tw.rc.Regexp != nil && tw.rc.Callback != nil {
-		match := tw.rc.Regexp.Find(p)
-		if match != nil && !bytes.Equal(match, tw.rc.m.Bytes()) {
-			tw.rc.Callback(tw.rc.Prefix + string(match))
-			tw.rc.m.Reset()
-			tw.rc.m.Write(match)
-		}
-	}
-
 	if tw.writethrough != nil {
 		return tw.writethrough.Write(p)
 	}
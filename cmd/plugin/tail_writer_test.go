@@ -49,7 +49,7 @@ func TestTailWriterStringWritethough(t *testing.T) {
 			t.Errorf("unexpected tail: got %q, want %q", got, tt.want)
 		}
 
-		tw = NewTailWriterThrough(tt.size, io.Discard, nil)
+		tw = NewTailWriterThrough(tt.size, io.Discard)
 		for _, d := range tt.data {
 			tw.Write([]byte(d))
 		}
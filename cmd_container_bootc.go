@@ -5,9 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"strings"
-
-	"al.essio.dev/pkg/shellescape"
 )
 
 // ContainerBootCommand builds a bootc-image-builder command line via podman or docker
@@ -47,30 +44,34 @@ type ContainerBootCommand struct {
 	// Type is set to "ami".
 	AWSUploadConfig *AWSUploadConfig
 
-	containerCmd       string
-	blueprintTempfile  string
-	awsSecretsTempfile string
-}
+	// ObjectStorageConfig is the configuration for uploading output files from the build
+	// host to an S3-compatible object storage after a successful build. Optional.
+	ObjectStorageConfig *ObjectStorageConfig
 
-var _ Command = &ContainerBootCommand{}
+	// CompressionConfig is the configuration for compressing output files on the build host
+	// after a successful build. Optional.
+	CompressionConfig *CompressionConfig
 
-// AWSUploadCommand uploads the image to an S3 bucket and registers it as an AMI.
-type AWSUploadConfig struct {
-	// AWSAccessKeyID credential. Maps to the AWS_ACCESS_KEY_ID environment variable.
-	AWSAccessKeyID string
+	// ChecksumConfig is the configuration for computing checksums of output files on the
+	// build host. Optional.
+	ChecksumConfig *ChecksumConfig
 
-	// AWSSecretAccessKey credential. Maps to the AWS_SECRET_ACCESS_KEY environment variable.
-	AWSSecretAccessKey string
+	// WithSBOM generates an SPDX document from the package list of the source container into
+	// the output directory, it is collected into Result.SBOMs.
+	WithSBOM bool
 
-	// AMIName is the name of the AMI to register.
-	AMIName string
+	containerCmd      string
+	blueprintTempfile string
+	credentials       CredentialStore
+	amis              amiScanner
+	objectUpload      objectUpload
+}
 
-	// S3Bucket is the name of a temporary S3 bucket to upload the image to.
-	S3Bucket string
+var _ Command = &ContainerBootCommand{}
+var _ OutputScanner = &ContainerBootCommand{}
+var _ ProvenanceDescriber = &ContainerBootCommand{}
 
-	// S3Region is the region of the S3 bucket and the resulting AMI.
-	Region string
-}
+const bootcBuilderImage = "quay.io/centos-bootc/bootc-image-builder:latest"
 
 var ErrContainerPull = errors.New("error while pulling container")
 
@@ -90,6 +91,28 @@ func (c *ContainerBootCommand) Configure(ctx context.Context, t Executor) error
 		return fmt.Errorf("%w: aws upload config is required for type ami", ErrConfigure)
 	}
 
+	if c.AWSUploadConfig != nil {
+		if err := c.AWSUploadConfig.Validate(c.Type); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+
+		if c.AWSUploadConfig.BootMode != "" || len(c.AWSUploadConfig.Tags) > 0 || len(c.AWSUploadConfig.ShareWith) > 0 {
+			return fmt.Errorf("%w: aws boot mode, tags and share with are not supported by bootc-image-builder", ErrConfigure)
+		}
+	}
+
+	if c.ObjectStorageConfig != nil {
+		if err := c.ObjectStorageConfig.Validate(); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+	}
+
+	if c.CompressionConfig != nil {
+		if err := c.CompressionConfig.Validate(); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+	}
+
 	// detect container runtime
 	c.containerCmd, err = which(ctx, t, "podman", "docker")
 	if err != nil {
@@ -98,7 +121,7 @@ func (c *ContainerBootCommand) Configure(ctx context.Context, t Executor) error
 
 	// detect architecture
 	if c.Arch != "" {
-		arch, err := tail1(ctx, t, "arch")
+		arch, err := detectArch(ctx, t)
 		if err != nil {
 			return fmt.Errorf("%w: arch: %w", ErrConfigure, err)
 		}
@@ -112,7 +135,7 @@ func (c *ContainerBootCommand) Configure(ctx context.Context, t Executor) error
 	// create output dir if not set
 	if c.OutputDir == "" {
 		c.OutputDir = fmt.Sprintf("./output-%s", RandomString(13))
-		co, err := tail1(ctx, t, "mkdir "+c.OutputDir)
+		co, err := tail1(ctx, t, Cmd("mkdir", c.OutputDir))
 		if err != nil {
 			return fmt.Errorf("%w mktemp: %w, output: %s", ErrConfigure, err, co)
 		}
@@ -120,15 +143,37 @@ func (c *ContainerBootCommand) Configure(ctx context.Context, t Executor) error
 	}
 
 	// pull the container
-	cmd := "sudo " + c.containerCmd + " pull " + shellescape.Quote(c.Repository)
-	if c.Common.DryRun {
-		cmd = "echo " + cmd
-	}
-	err = t.Execute(ctx, StringCommand(cmd))
+	progress := NewLineTap(func(line string) {
+		emit(ctx, Event{Type: EventPullProgress, Phase: PhaseConfigure, Message: line})
+	})
+	err = t.Execute(ctx, Invocation{
+		Privileged: true,
+		DryRun:     c.Common.DryRun,
+		Idempotent: true,
+		Args:       []string{c.containerCmd, "pull", c.Repository},
+	}, WithLineTap(progress))
+	progress.Flush()
 	if err != nil {
 		return fmt.Errorf("%w: %w", ErrContainerPull, err)
 	}
 
+	// create credentials as the last step, they are removed in Cleanup
+	if c.AWSUploadConfig != nil {
+		c.credentials = CredentialStore{Runtime: c.containerCmd, DryRun: c.Common.DryRun}
+		err = c.credentials.Create(ctx, t, c.AWSUploadConfig.credentials()...)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+	}
+
+	if c.ObjectStorageConfig != nil {
+		c.objectUpload = objectUpload{cfg: c.ObjectStorageConfig, runtime: c.containerCmd}
+		err = c.objectUpload.create(ctx, t, c.Common.DryRun)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+	}
+
 	return nil
 }
 
@@ -142,87 +187,152 @@ func (c *ContainerBootCommand) Push(ctx context.Context, pusher Pusher) error {
 	}
 	log.Printf("[DEBUG] Pushed blueprint %q", c.blueprintTempfile)
 
-	// push aws.secrets env file
+	return nil
+}
+
+func (c *ContainerBootCommand) Build() Invocation {
+	ctr := &Container{
+		Runtime:     c.containerCmd,
+		Image:       bootcBuilderImage,
+		Privileged:  true,
+		Remove:      true,
+		Pull:        "newer",
+		Interactive: c.Common.Interactive,
+		TTY:         c.Common.TTY,
+		SecurityOpts: []string{
+			"label=type:unconfined_t",
+		},
+		Mounts: []Mount{
+			{Source: "/var/lib/containers/storage", Target: "/var/lib/containers/storage"},
+			{Source: c.OutputDir, Target: "/output"},
+			{Source: c.blueprintTempfile, Target: "/config.toml", ReadOnly: true},
+		},
+	}
+
+	args := []string{"--type", c.Type, "--local"}
+
+	if c.RootFS != "" {
+		args = append(args, "--rootfs", c.RootFS)
+	}
+
 	if c.AWSUploadConfig != nil {
-		awsSecrets := fmt.Sprintf("AWS_ACCESS_KEY_ID=%s\nAWS_SECRET_ACCESS_KEY=%s\n",
-			c.AWSUploadConfig.AWSAccessKeyID,
-			c.AWSUploadConfig.AWSSecretAccessKey,
-		)
-		c.awsSecretsTempfile, err = pusher.Push(ctx, awsSecrets, "env")
-		if err != nil {
-			return fmt.Errorf("%w: aws secrets: %w", ErrPush, err)
+		c.credentials.Attach(ctr)
+		if c.AWSUploadConfig.Region != "" {
+			ctr.Env = append(ctr.Env, "AWS_REGION="+c.AWSUploadConfig.Region)
 		}
+		args = append(args,
+			"--aws-ami-name", c.AWSUploadConfig.AMIName,
+			"--aws-s3-bucket", c.AWSUploadConfig.S3Bucket,
+			"--aws-s3-region", c.AWSUploadConfig.Region,
+		)
 	}
 
-	return nil
+	args = append(args, c.Repository)
+
+	inv := Invocation{
+		Privileged: true,
+		DryRun:     c.Common.DryRun,
+		Container:  ctr,
+		Args:       args,
+		LogFile:    c.LogFile(),
+		Cleanup:    c.credentials.Files(),
+	}
+
+	return inv
 }
 
-func (c *ContainerBootCommand) Build() string {
-	sb := strings.Builder{}
+func (c *ContainerBootCommand) Collect(ctx context.Context, exec Executor, res *Result) error {
+	res.OutputDir = c.OutputDir
+	err := collectFiles(ctx, exec, c.OutputDir, res)
+	if err != nil {
+		return err
+	}
+
+	if len(res.Files) == 0 && !c.Common.DryRun {
+		emit(ctx, Event{Type: EventWarning, Phase: PhaseCollect, Message: "no output files found in " + c.OutputDir})
+	}
 
 	if c.Common.DryRun {
-		sb.WriteString("echo")
-		sb.WriteRune(' ')
-	}
-
-	sb.WriteString("sudo")
-	sb.WriteRune(' ')
-	sb.WriteString(c.containerCmd)
-	sb.WriteRune(' ')
-	sb.WriteString("run --privileged --rm --pull=newer")
-	sb.WriteRune(' ')
-	if c.Common.Interactive {
-		sb.WriteString("-i")
-		sb.WriteRune(' ')
-	}
-	if c.Common.TTY {
-		sb.WriteString("-t")
-		sb.WriteRune(' ')
-	}
-	sb.WriteString("--security-opt label=type:unconfined_t")
-	sb.WriteRune(' ')
-	sb.WriteString("-v /var/lib/containers/storage:/var/lib/containers/storage")
-	sb.WriteRune(' ')
-	sb.WriteString("-v " + shellescape.Quote(c.OutputDir+":/output"))
-	sb.WriteRune(' ')
-	sb.WriteString("-v " + shellescape.Quote(c.blueprintTempfile+":/config.toml:ro"))
-	sb.WriteRune(' ')
+		return nil
+	}
 
-	if c.AWSUploadConfig != nil {
-		sb.WriteString("--env-file " + c.awsSecretsTempfile)
-		sb.WriteRune(' ')
+	if c.WithSBOM {
+		err = generateSourceSBOM(ctx, exec, c.containerCmd, c.Repository, c.OutputDir, res)
+		if err != nil {
+			return err
+		}
 	}
 
-	sb.WriteString("quay.io/centos-bootc/bootc-image-builder:latest")
-	sb.WriteRune(' ')
-	sb.WriteString("--type " + shellescape.Quote(c.Type))
-	sb.WriteRune(' ')
-	sb.WriteString("--local")
-	sb.WriteRune(' ')
+	if c.CompressionConfig != nil {
+		err = compressFiles(ctx, exec, c.CompressionConfig, c.OutputDir, res)
+		if err != nil {
+			return err
+		}
+	}
 
-	if c.RootFS != "" {
-		sb.WriteString("--rootfs " + shellescape.Quote(c.RootFS))
-		sb.WriteRune(' ')
+	if c.ChecksumConfig != nil {
+		err = computeChecksums(ctx, exec, c.ChecksumConfig, c.OutputDir, res)
+		if err != nil {
+			return err
+		}
 	}
 
 	if c.AWSUploadConfig != nil {
-		sb.WriteString("--aws-ami-name " + shellescape.Quote(c.AWSUploadConfig.AMIName))
-		sb.WriteRune(' ')
-		sb.WriteString("--aws-s3-bucket " + shellescape.Quote(c.AWSUploadConfig.S3Bucket))
-		sb.WriteRune(' ')
-		sb.WriteString("--aws-s3-region " + shellescape.Quote(c.AWSUploadConfig.Region))
-		sb.WriteRune(' ')
+		c.amis.collect(ctx, c.AWSUploadConfig.Region, res)
+	}
+
+	if c.ObjectStorageConfig != nil {
+		err = c.objectUpload.upload(ctx, exec, c.OutputDir, res)
+		if err != nil {
+			return err
+		}
 	}
 
-	sb.WriteString(shellescape.Quote(c.Repository))
+	return nil
+}
 
-	if c.Common.TeeLog {
-		sb.WriteRune(' ')
-		sb.WriteString("2>&1 | tee " + c.OutputDir + "/build.log")
+// ScanLine looks for the registered AMI and snapshot IDs in the build output.
+func (c *ContainerBootCommand) ScanLine(line string) {
+	c.amis.scan(line)
+}
+
+// DescribeBuild returns the builder and the source image digests, the blueprint digest and
+// the build parameters when provenance is enabled.
+func (c *ContainerBootCommand) DescribeBuild(ctx context.Context, exec Executor) (*BuildDescription, error) {
+	if !c.Common.Provenance || c.Common.DryRun {
+		return nil, nil
 	}
 
-	sb.WriteRune(' ')
-	sb.WriteString("&& find " + c.OutputDir + " -type f")
+	return &BuildDescription{
+		BuildType: "https://github.com/osbuild/bootc-image-builder",
+		Parameters: map[string]string{
+			"repository": c.Repository,
+			"type":       c.Type,
+			"arch":       c.Arch,
+			"rootfs":     c.RootFS,
+		},
+		Dependencies: []ResourceDescriptor{
+			imageDependency(ctx, exec, c.containerCmd, bootcBuilderImage),
+			imageDependency(ctx, exec, c.containerCmd, c.Repository),
+			blueprintDependency(c.Blueprint),
+		},
+	}, nil
+}
+
+func (c *ContainerBootCommand) Cleanup(ctx context.Context, exec Executor) error {
+	return errors.Join(
+		removeFiles(ctx, exec, c.blueprintTempfile),
+		c.credentials.Remove(ctx, exec),
+		c.objectUpload.remove(ctx, exec),
+	)
+}
+
+// LogFile returns the path to the build log on the remote host or an empty string when
+// the log is not kept.
+func (c *ContainerBootCommand) LogFile() string {
+	if !c.Common.TeeLog {
+		return ""
+	}
 
-	return sb.String()
+	return c.OutputDir + "/build.log"
 }
@@ -2,11 +2,10 @@ package ibk
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
-
-	"al.essio.dev/pkg/shellescape"
+	"path/filepath"
 )
 
 // ContainerCliCommand builds an image-builder-cli command line via podman or docker
@@ -36,28 +35,111 @@ type ContainerCliCommand struct {
 	// Common arguments for all container commands.
 	Common CommonArgs
 
+	// AWSUploadConfig is the configuration for uploading the image to AWS. Optional, the
+	// Type must be set to "ami".
+	AWSUploadConfig *AWSUploadConfig
+
+	// GCPUploadConfig is the configuration for uploading the image to Google Cloud.
+	// Optional, the Type must be a gce type.
+	GCPUploadConfig *GCPUploadConfig
+
+	// AzureUploadConfig is the configuration for uploading the image to Azure. Optional,
+	// the Type must be vhd or an azure type.
+	AzureUploadConfig *AzureUploadConfig
+
+	// RegistryPushConfig is the configuration for pushing a container or OCI archive output
+	// to a registry after a successful build. Optional, requires podman.
+	RegistryPushConfig *RegistryPushConfig
+
+	// ObjectStorageConfig is the configuration for uploading output files from the build
+	// host to an S3-compatible object storage after a successful build. Optional.
+	ObjectStorageConfig *ObjectStorageConfig
+
+	// CompressionConfig is the configuration for compressing output files on the build host
+	// after a successful build. Optional.
+	CompressionConfig *CompressionConfig
+
+	// ChecksumConfig is the configuration for computing checksums of output files on the
+	// build host. Optional.
+	ChecksumConfig *ChecksumConfig
+
+	// WithSBOM passes --with-sbom to image-builder-cli which writes SPDX documents into the
+	// output directory, they are collected into Result.SBOMs.
+	WithSBOM bool
+
 	containerCmd      string
 	blueprintTempfile string
+	credentials       CredentialStore
+	amis              amiScanner
+	gcpImages         gcpScanner
+	azureImages       azureScanner
+	registryPush      registryPush
+	objectUpload      objectUpload
 }
 
 var _ Command = &ContainerCliCommand{}
+var _ OutputScanner = &ContainerCliCommand{}
+var _ ProvenanceDescriber = &ContainerCliCommand{}
+
+const cliBuilderImage = "ghcr.io/osbuild/image-builder-cli:latest"
 
 func (c *ContainerCliCommand) Configure(ctx context.Context, t Executor) error {
 	var err error
 
+	// check configuration
+	if c.AWSUploadConfig != nil {
+		if err := c.AWSUploadConfig.Validate(c.Type); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+	}
+
+	if c.GCPUploadConfig != nil {
+		if err := c.GCPUploadConfig.Validate(c.Type); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+	}
+
+	if c.AzureUploadConfig != nil {
+		if err := c.AzureUploadConfig.Validate(c.Type); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+	}
+
+	if c.RegistryPushConfig != nil {
+		if err := c.RegistryPushConfig.Validate(); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+	}
+
+	if c.ObjectStorageConfig != nil {
+		if err := c.ObjectStorageConfig.Validate(); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+	}
+
+	if c.CompressionConfig != nil {
+		if err := c.CompressionConfig.Validate(); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+	}
+
 	// detect container runtime
 	c.containerCmd, err = which(ctx, t, "podman", "docker")
 	if err != nil {
 		return fmt.Errorf("%w: which: %w", ErrConfigure, err)
 	}
 
+	if c.RegistryPushConfig != nil && filepath.Base(c.containerCmd) != "podman" {
+		return fmt.Errorf("%w: registry push requires podman, found %s", ErrConfigure, c.containerCmd)
+	}
+
 	// detect architecture
 	if c.Arch != "" {
-		arch, err := tail1(ctx, t, "arch")
+		arch, err := detectArch(ctx, t)
 		if err != nil {
 			return fmt.Errorf("%w: arch: %w", ErrConfigure, err)
 		}
-		
+
 		log.Printf("Detected architecture %s", arch)
 		if c.Arch != arch {
 			return fmt.Errorf("%w architecture mismatch: %s", ErrConfigure, arch)
@@ -67,13 +149,39 @@ func (c *ContainerCliCommand) Configure(ctx context.Context, t Executor) error {
 	// create output dir if not set
 	if c.OutputDir == "" {
 		c.OutputDir = fmt.Sprintf("./output-%s", RandomString(13))
-		co, err := tail1(ctx, t, "mkdir "+c.OutputDir)
+		co, err := tail1(ctx, t, Cmd("mkdir", c.OutputDir))
 		if err != nil {
 			return fmt.Errorf("%w mktemp: %w, output: %s", ErrConfigure, err, co)
 		}
 		log.Printf("[DEBUG] Created output directory %s", c.OutputDir)
 	}
 
+	// create credentials as the last step, they are removed in Cleanup
+	var creds []Credential
+	if c.AWSUploadConfig != nil {
+		creds = append(creds, c.AWSUploadConfig.credentials()...)
+	}
+	if c.GCPUploadConfig != nil {
+		creds = append(creds, c.GCPUploadConfig.credentials()...)
+	}
+	if c.AzureUploadConfig != nil {
+		creds = append(creds, c.AzureUploadConfig.credentials()...)
+	}
+
+	c.credentials = CredentialStore{Runtime: c.containerCmd, DryRun: c.Common.DryRun}
+	err = c.credentials.Create(ctx, t, creds...)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrConfigure, err)
+	}
+
+	if c.ObjectStorageConfig != nil {
+		c.objectUpload = objectUpload{cfg: c.ObjectStorageConfig, runtime: c.containerCmd}
+		err = c.objectUpload.create(ctx, t, c.Common.DryRun)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrConfigure, err)
+		}
+	}
+
 	return nil
 }
 
@@ -82,54 +190,174 @@ func (c *ContainerCliCommand) Push(ctx context.Context, pusher Pusher) error {
 
 	// push blueprint
 	c.blueprintTempfile, err = pusher.Push(ctx, c.Blueprint, "toml")
+	if err != nil {
+		return fmt.Errorf("%w: blueprint: %w", ErrPush, err)
+	}
 	log.Printf("[DEBUG] Pushed blueprint %s", c.blueprintTempfile)
 
-	return err
+	return nil
+}
+
+func (c *ContainerCliCommand) Build() Invocation {
+	ctr := &Container{
+		Runtime:     c.containerCmd,
+		Image:       cliBuilderImage,
+		Privileged:  true,
+		Remove:      true,
+		Interactive: c.Common.Interactive,
+		TTY:         c.Common.TTY,
+		Mounts: []Mount{
+			{Source: c.OutputDir, Target: "/output"},
+			{Source: c.blueprintTempfile, Target: c.blueprintTempfile},
+		},
+	}
+
+	args := []string{
+		"build",
+		"--blueprint", c.blueprintTempfile,
+		"--distro", c.Distro,
+	}
+
+	c.credentials.Attach(ctr)
+
+	if c.AWSUploadConfig != nil {
+		if c.AWSUploadConfig.Region != "" {
+			ctr.Env = append(ctr.Env, "AWS_REGION="+c.AWSUploadConfig.Region)
+		}
+		args = append(args, c.AWSUploadConfig.cliArgs()...)
+	}
+
+	if c.GCPUploadConfig != nil {
+		ctr.Env = append(ctr.Env, "GOOGLE_APPLICATION_CREDENTIALS="+gcpCredentialsPath)
+		args = append(args, c.GCPUploadConfig.cliArgs()...)
+	}
+
+	if c.AzureUploadConfig != nil {
+		args = append(args, c.AzureUploadConfig.cliArgs()...)
+	}
+
+	if c.WithSBOM {
+		args = append(args, "--with-sbom")
+	}
+
+	args = append(args, c.Type)
+
+	return Invocation{
+		Privileged: true,
+		DryRun:     c.Common.DryRun,
+		Container:  ctr,
+		Args:       args,
+		LogFile:    c.LogFile(),
+		Cleanup:    c.credentials.Files(),
+	}
 }
 
-func (c *ContainerCliCommand) Build() string {
-	sb := strings.Builder{}
+func (c *ContainerCliCommand) Collect(ctx context.Context, exec Executor, res *Result) error {
+	res.OutputDir = c.OutputDir
+	err := collectFiles(ctx, exec, c.OutputDir, res)
+	if err != nil {
+		return err
+	}
+
+	if c.WithSBOM {
+		collectSBOMs(res)
+	}
+
+	if len(res.Files) == 0 && !c.Common.DryRun {
+		emit(ctx, Event{Type: EventWarning, Phase: PhaseCollect, Message: "no output files found in " + c.OutputDir})
+	}
 
 	if c.Common.DryRun {
-		sb.WriteString("echo")
-		sb.WriteRune(' ')
-	}
-
-	sb.WriteString("sudo")
-	sb.WriteRune(' ')
-	sb.WriteString(c.containerCmd)
-	sb.WriteRune(' ')
-	sb.WriteString("run --privileged --rm")
-	sb.WriteRune(' ')
-	if c.Common.Interactive {
-		sb.WriteString("-i")
-		sb.WriteRune(' ')
-	}
-	if c.Common.TTY {
-		sb.WriteString("-t")
-		sb.WriteRune(' ')
-	}
-	sb.WriteString("-v " + shellescape.Quote(c.OutputDir+":/output"))
-	sb.WriteRune(' ')
-	sb.WriteString("-v " + shellescape.Quote(c.blueprintTempfile+":"+c.blueprintTempfile))
-	sb.WriteRune(' ')
-	sb.WriteString("ghcr.io/osbuild/image-builder-cli:latest")
-	sb.WriteRune(' ')
-	sb.WriteString("build")
-	sb.WriteRune(' ')
-	sb.WriteString("--blueprint " + c.blueprintTempfile)
-	sb.WriteRune(' ')
-	sb.WriteString("--distro " + shellescape.Quote(c.Distro))
-	sb.WriteRune(' ')
-	sb.WriteString(shellescape.Quote(c.Type))
-
-	if c.Common.TeeLog {
-		sb.WriteRune(' ')
-		sb.WriteString("2>&1 | tee " + c.OutputDir + "/build.log")
-	}
-
-	sb.WriteRune(' ')
-	sb.WriteString("&& find " + c.OutputDir + " -type f")
-
-	return sb.String()
+		return nil
+	}
+
+	if c.CompressionConfig != nil {
+		err = compressFiles(ctx, exec, c.CompressionConfig, c.OutputDir, res)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ChecksumConfig != nil {
+		err = computeChecksums(ctx, exec, c.ChecksumConfig, c.OutputDir, res)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.AWSUploadConfig != nil {
+		c.amis.collect(ctx, c.AWSUploadConfig.Region, res)
+	}
+
+	if c.GCPUploadConfig != nil {
+		collectImage(ctx, c.gcpImages.cloudImage(c.GCPUploadConfig.Region), res)
+	}
+
+	if c.AzureUploadConfig != nil {
+		collectImage(ctx, c.azureImages.cloudImage(c.AzureUploadConfig.Location), res)
+	}
+
+	if c.RegistryPushConfig != nil {
+		c.registryPush = registryPush{cfg: c.RegistryPushConfig, runtime: c.containerCmd}
+		err = c.registryPush.push(ctx, exec, res)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ObjectStorageConfig != nil {
+		err = c.objectUpload.upload(ctx, exec, c.OutputDir, res)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ScanLine looks for IDs of registered cloud images in the build output.
+func (c *ContainerCliCommand) ScanLine(line string) {
+	c.amis.scan(line)
+	c.gcpImages.scan(line)
+	c.azureImages.scan(line)
+}
+
+// DescribeBuild returns the builder image digest, the blueprint digest and the build parameters
+// when provenance is enabled.
+func (c *ContainerCliCommand) DescribeBuild(ctx context.Context, exec Executor) (*BuildDescription, error) {
+	if !c.Common.Provenance || c.Common.DryRun {
+		return nil, nil
+	}
+
+	return &BuildDescription{
+		BuildType: "https://github.com/osbuild/image-builder-cli",
+		Parameters: map[string]string{
+			"distro": c.Distro,
+			"type":   c.Type,
+			"arch":   c.Arch,
+		},
+		Dependencies: []ResourceDescriptor{
+			imageDependency(ctx, exec, c.containerCmd, cliBuilderImage),
+			blueprintDependency(c.Blueprint),
+		},
+	}, nil
+}
+
+func (c *ContainerCliCommand) Cleanup(ctx context.Context, exec Executor) error {
+	return errors.Join(
+		removeFiles(ctx, exec, c.blueprintTempfile),
+		c.credentials.Remove(ctx, exec),
+		c.objectUpload.remove(ctx, exec),
+		c.registryPush.cleanup(ctx, exec),
+	)
+}
+
+// LogFile returns the path to the build log on the remote host or an empty string when
+// the log is not kept.
+func (c *ContainerCliCommand) LogFile() string {
+	if !c.Common.TeeLog {
+		return ""
+	}
+
+	return c.OutputDir + "/build.log"
 }
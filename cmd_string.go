@@ -16,6 +16,14 @@ func (c StringCommand) Push(ctx context.Context, pusher Pusher) error {
 	return nil
 }
 
-func (c StringCommand) Build() string {
-	return string(c)
+func (c StringCommand) Build() Invocation {
+	return Invocation{Shell: string(c)}
+}
+
+func (c StringCommand) Collect(ctx context.Context, exec Executor, res *Result) error {
+	return nil
+}
+
+func (c StringCommand) Cleanup(ctx context.Context, exec Executor) error {
+	return nil
 }
@@ -0,0 +1,174 @@
+package ibk
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// ErrCompression is returned when compressing or decompressing of output files fails.
+var ErrCompression = errors.New("error while compressing")
+
+// CompressionConfig configures compressing of output files on the build host after a
+// successful build. Compressed files replace the original files in the result, checksums,
+// uploads and downloads use the compressed files.
+type CompressionConfig struct {
+	// Format is the compression format: xz, zstd or gzip.
+	Format string
+
+	// Level is the compression level, zero uses the default level of the tool. Valid levels
+	// are 1-9 for xz and gzip and 1-19 for zstd.
+	Level int
+
+	// Threads is the number of compression threads, zero uses all cores. Not supported by
+	// gzip which is single-threaded.
+	Threads int
+}
+
+// compressionExts are file name extensions of compressed files by format.
+var compressionExts = map[string]string{
+	"xz":   ".xz",
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+// Validate checks the format, the level and the threads.
+func (c *CompressionConfig) Validate() error {
+	maxLevel := 9
+	switch c.Format {
+	case "xz", "gzip":
+	case "zstd":
+		maxLevel = 19
+	default:
+		return fmt.Errorf("unsupported compression format %q, use xz, zstd or gzip", c.Format)
+	}
+
+	if c.Level < 0 || c.Level > maxLevel {
+		return fmt.Errorf("%s compression level must be between 1 and %d", c.Format, maxLevel)
+	}
+
+	if c.Threads < 0 {
+		return errors.New("compression threads must not be negative")
+	}
+
+	if c.Threads > 0 && c.Format == "gzip" {
+		return errors.New("gzip compression does not support threads")
+	}
+
+	return nil
+}
+
+// args returns the compression tool command line, the originals are removed by the tool.
+func (c *CompressionConfig) args() []string {
+	var args []string
+
+	switch c.Format {
+	case "xz":
+		args = []string{"xz", "-T" + strconv.Itoa(c.Threads)}
+	case "zstd":
+		args = []string{"zstd", "-q", "--rm", "-T" + strconv.Itoa(c.Threads)}
+	case "gzip":
+		args = []string{"gzip"}
+	}
+
+	if c.Level > 0 {
+		args = append(args, "-"+strconv.Itoa(c.Level))
+	}
+
+	return append(args, "--")
+}
+
+// compressFiles compresses all files of the result in the output directory and replaces them
+// with the compressed files.
+func compressFiles(ctx context.Context, exec Executor, cfg *CompressionConfig, outputDir string, res *Result) error {
+	if len(res.Files) == 0 {
+		return nil
+	}
+
+	args := cfg.args()
+	for _, f := range res.Files {
+		args = append(args, relPath(outputDir, f.Path))
+	}
+
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, Invocation{
+		Privileged: true,
+		Dir:        outputDir,
+		Args:       args,
+	}, WithInputOutput(nil, nil, stderr))
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w: %s", ErrCompression, cfg.Format, err, stderr.String())
+	}
+
+	// list the compressed files for their sizes
+	stdout := &SyncedBuffer{}
+	stderr.Reset()
+	err = exec.Execute(ctx, listFiles(outputDir), WithInputOutput(nil, stdout, stderr))
+	if err != nil {
+		return fmt.Errorf("%w: find: %w: %s", ErrCompression, err, stderr.String())
+	}
+
+	files, err := parseFiles(stdout.String())
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrCompression, err)
+	}
+
+	sizes := make(map[string]int64)
+	for _, f := range files {
+		sizes[f.Path] = f.Size
+	}
+
+	ext := compressionExts[cfg.Format]
+	for i, f := range res.Files {
+		size, ok := sizes[f.Path+ext]
+		if !ok {
+			return fmt.Errorf("%w: %s not found after compression", ErrCompression, f.Path+ext)
+		}
+
+		log.Printf("[DEBUG] Compressed %q from %d to %d bytes", f.Path, f.Size, size)
+		emit(ctx, Event{Type: EventOutputFile, Phase: PhaseCollect, Path: f.Path + ext, Size: size})
+		res.Files[i] = File{Path: f.Path + ext, Size: size, Compression: cfg.Format}
+	}
+
+	return nil
+}
+
+// decompress copies the decompressed contents of r in the format to w.
+func decompress(format string, w io.Writer, r io.Reader) error {
+	var dr io.Reader
+
+	switch format {
+	case "xz":
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return err
+		}
+		dr = xr
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		dr = zr
+	case "gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		dr = gr
+	default:
+		return fmt.Errorf("unsupported compression format %q", format)
+	}
+
+	_, err := io.Copy(w, dr)
+	return err
+}
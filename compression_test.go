@@ -0,0 +1,57 @@
+package ibk_test
+
+import (
+	"testing"
+
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+func TestCompressionConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ibk.CompressionConfig
+		wantErr bool
+	}{
+		{
+			name: "xz",
+			cfg:  ibk.CompressionConfig{Format: "xz", Level: 9, Threads: 4},
+		},
+		{
+			name: "zstd-high-level",
+			cfg:  ibk.CompressionConfig{Format: "zstd", Level: 19},
+		},
+		{
+			name: "gzip-default",
+			cfg:  ibk.CompressionConfig{Format: "gzip"},
+		},
+		{
+			name:    "unknown-format",
+			cfg:     ibk.CompressionConfig{Format: "bzip2"},
+			wantErr: true,
+		},
+		{
+			name:    "xz-level",
+			cfg:     ibk.CompressionConfig{Format: "xz", Level: 12},
+			wantErr: true,
+		},
+		{
+			name:    "negative-threads",
+			cfg:     ibk.CompressionConfig{Format: "zstd", Threads: -1},
+			wantErr: true,
+		},
+		{
+			name:    "gzip-threads",
+			cfg:     ibk.CompressionConfig{Format: "gzip", Threads: 2},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
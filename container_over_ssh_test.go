@@ -3,11 +3,21 @@ package ibk_test
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
 	ibk "github.com/osbuild/packer-plugin-image-builder"
 	"github.com/osbuild/packer-plugin-image-builder/internal/sshtest"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/openpgp"
 )
 
 func TestContainerOverSSH(t *testing.T) {
@@ -54,20 +64,36 @@ func TestContainerOverSSH(t *testing.T) {
 					Status:  0,
 				},
 				{
-					Request: "echo sudo /usr/bin/podman run --privileged --rm -i -t " +
+					Request: "scp -t /tmp",
+					Stdin: regexp.QuoteMeta("echo sudo /usr/bin/podman run --privileged --rm -i -t " +
 						"-v ./output-hehwuXP6NyGIr:/output -v /tmp/ibpacker-o2rHJLEEkT68y.toml:/tmp/ibpacker-o2rHJLEEkT68y.toml " +
 						"ghcr.io/osbuild/image-builder-cli:latest build " +
 						"--blueprint /tmp/ibpacker-o2rHJLEEkT68y.toml " +
 						"--distro fedora minimal-raw " +
-						"2>&1 | tee ./output-hehwuXP6NyGIr/build.log && find ./output-hehwuXP6NyGIr -type f",
-					Reply:  "Building...\nDone.\n",
+						"2>&1 | tee ./output-hehwuXP6NyGIr/build.log || rc=$?\n"),
+					Reply:  "",
 					Status: 0,
 				},
+				{
+					Request: "bash /tmp/ibpacker-gPAxUwwNbUvx1.sh",
+					Reply:   "Building...\nDone.\n",
+					Status:  0,
+				},
+				{
+					Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+					Reply:   "1073741824 ./output-hehwuXP6NyGIr/image/disk.raw\n",
+					Status:  0,
+				},
 				{
 					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
 					Reply:   "",
 					Status:  0,
 				},
+				{
+					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml /tmp/ibpacker-gPAxUwwNbUvx1.sh",
+					Reply:   "",
+					Status:  0,
+				},
 			},
 		},
 		{
@@ -104,10 +130,20 @@ func TestContainerOverSSH(t *testing.T) {
 						"-v ./output-hehwuXP6NyGIr:/output -v /tmp/ibpacker-o2rHJLEEkT68y.toml:/tmp/ibpacker-o2rHJLEEkT68y.toml " +
 						"ghcr.io/osbuild/image-builder-cli:latest build " +
 						"--blueprint /tmp/ibpacker-o2rHJLEEkT68y.toml " +
-						"--distro fedora minimal-raw && find ./output-hehwuXP6NyGIr -type f",
+						"--distro fedora minimal-raw",
 					Reply:  "Building...\nDone.\n",
 					Status: 0,
 				},
+				{
+					Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+					Reply:   "1073741824 ./output-hehwuXP6NyGIr/image/disk.raw\n",
+					Status:  0,
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+					Reply:   "",
+					Status:  0,
+				},
 				{
 					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
 					Reply:   "",
@@ -162,22 +198,37 @@ func TestContainerOverSSH(t *testing.T) {
 					Status:  0,
 				},
 				{
-					Request: "echo sudo /usr/bin/docker run --privileged --rm --pull=newer -i -t " +
+					Request: "scp -t /tmp",
+					Stdin: regexp.QuoteMeta("echo sudo /usr/bin/docker run --privileged --rm --pull=newer -i -t " +
 						"--security-opt label=type:unconfined_t " +
 						"-v /var/lib/containers/storage:/var/lib/containers/storage " +
 						"-v ./output-hehwuXP6NyGIr:/output -v /tmp/ibpacker-o2rHJLEEkT68y.toml:/config.toml:ro " +
 						"quay.io/centos-bootc/bootc-image-builder:latest " +
 						"--type raw --local --rootfs btrfs " +
-						"quay.io/centos-bootc/centos-bootc:stream9 2>&1 | tee ./output-hehwuXP6NyGIr/build.log && " +
-						"find ./output-hehwuXP6NyGIr -type f",
-					Reply:  "Building...\nDone.\n",
+						"quay.io/centos-bootc/centos-bootc:stream9 2>&1 | tee ./output-hehwuXP6NyGIr/build.log || rc=$?\n"),
+					Reply:  "",
 					Status: 0,
 				},
+				{
+					Request: "bash /tmp/ibpacker-gPAxUwwNbUvx1.sh",
+					Reply:   "Building...\nDone.\n",
+					Status:  0,
+				},
+				{
+					Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+					Reply:   "1073741824 ./output-hehwuXP6NyGIr/image/disk.raw\n",
+					Status:  0,
+				},
 				{
 					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
 					Reply:   "",
 					Status:  0,
 				},
+				{
+					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml /tmp/ibpacker-gPAxUwwNbUvx1.sh",
+					Reply:   "",
+					Status:  0,
+				},
 			},
 		},
 		{
@@ -222,11 +273,20 @@ func TestContainerOverSSH(t *testing.T) {
 						"-v ./output-hehwuXP6NyGIr:/output -v /tmp/ibpacker-o2rHJLEEkT68y.toml:/config.toml:ro " +
 						"quay.io/centos-bootc/bootc-image-builder:latest " +
 						"--type raw --local --rootfs btrfs " +
-						"quay.io/centos-bootc/centos-bootc:stream9 && " +
-						"find ./output-hehwuXP6NyGIr -type f",
+						"quay.io/centos-bootc/centos-bootc:stream9",
 					Reply:  "Building...\nDone.\n",
 					Status: 0,
 				},
+				{
+					Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+					Reply:   "1073741824 ./output-hehwuXP6NyGIr/image/disk.raw\n",
+					Status:  0,
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+					Reply:   "",
+					Status:  0,
+				},
 				{
 					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
 					Reply:   "",
@@ -258,7 +318,7 @@ func TestContainerOverSSH(t *testing.T) {
 			}
 			defer client.Close(ctx)
 
-			err = ibk.ApplyCommand(context.Background(), tt.cmd, client)
+			res, err := ibk.ApplyCommand(context.Background(), tt.cmd, client)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -266,6 +326,1430 @@ func TestContainerOverSSH(t *testing.T) {
 			if !strings.Contains(buf.String(), "Building") {
 				t.Fatalf("unexpected output: %s", buf.String())
 			}
+
+			want := []ibk.File{{Path: "./output-hehwuXP6NyGIr/image/disk.raw", Size: 1073741824}}
+			if diff := cmp.Diff(want, res.Files); diff != "" {
+				t.Fatalf("unexpected files: %s", diff)
+			}
+		})
+	}
+}
+
+func TestContainerOverSSHExitStatus(t *testing.T) {
+	ctx := context.Background()
+	ibk.RandSource.Seed(0)
+
+	session := []sshtest.RequestReply{
+		{
+			Request: "which podman",
+			Reply:   "/usr/bin/podman\n",
+		},
+		{
+			Request: "mkdir ./output-hehwuXP6NyGIr",
+		},
+		{
+			Request: "scp -t /tmp",
+		},
+		{
+			Request: "scp -t /tmp",
+			Stdin:   regexp.QuoteMeta("--distro fedora minimal-raw 2>&1 | tee ./output-hehwuXP6NyGIr/build.log || rc=$?\n"),
+		},
+		{
+			Request: "bash /tmp/ibpacker-gPAxUwwNbUvx1.sh",
+			Reply:   "Error: image not known\n",
+			Status:  125,
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml /tmp/ibpacker-gPAxUwwNbUvx1.sh",
+		},
+	}
+
+	server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+	server.Handler = sshtest.RequestReplyHandler(t, session)
+	defer server.Close()
+
+	buf := &ibk.SyncedBuffer{}
+	client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+		Host:        server.Endpoint,
+		Username:    "test",
+		PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+		Stdout:      buf,
+		Stderr:      buf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(ctx)
+
+	cmd := &ibk.ContainerCliCommand{
+		Distro:    "fedora",
+		Type:      "minimal-raw",
+		Blueprint: "blueprint",
+		Common: ibk.CommonArgs{
+			TeeLog: true,
+		},
+	}
+	res, err := ibk.ApplyCommand(ctx, cmd, client)
+	if !errors.Is(err, ibk.ErrExecute) {
+		t.Fatalf("expected execute error, got: %v", err)
+	}
+
+	var ee *ibk.ExitError
+	if !errors.As(err, &ee) || ee.Status != 125 {
+		t.Fatalf("expected exit status 125, got: %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "./output-hehwuXP6NyGIr/build.log") {
+		t.Fatalf("expected log file in error, got: %v", err)
+	}
+
+	if res.ExitCode != 125 || res.LogFile != "./output-hehwuXP6NyGIr/build.log" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
+
+func TestContainerOverSSHCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	aws := &ibk.AWSUploadConfig{
+		AWSAccessKeyID:     "AKIA",
+		AWSSecretAccessKey: "s3cr3t",
+		AWSSessionToken:    "t0ken",
+		AMIName:            "ami",
+		S3Bucket:           "bucket",
+		Region:             "us-east-1",
+	}
+
+	tests := []struct {
+		name    string
+		session []sshtest.RequestReply
+	}{
+		{
+			name: "podman-secrets",
+			session: []sshtest.RequestReply{
+				{
+					Request: "which podman",
+					Reply:   "/usr/bin/podman\n",
+				},
+				{
+					Request: "mkdir ./output-hehwuXP6NyGIr",
+				},
+				{
+					Request: "sudo /usr/bin/podman pull quay.io/centos-bootc/centos-bootc:stream9",
+				},
+				{
+					Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-aws_access_key_id -",
+					Stdin:   "^AKIA$",
+				},
+				{
+					Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-aws_secret_access_key -",
+					Stdin:   "^s3cr3t$",
+				},
+				{
+					Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-aws_session_token -",
+					Stdin:   "^t0ken$",
+				},
+				{
+					Request: "scp -t /tmp",
+				},
+				{
+					Request: regexp.QuoteMeta("-v /tmp/ibpacker-gPAxUwwNbUvx1.toml:/config.toml:ro " +
+						"--secret ibpacker-o2rHJLEEkT68y-aws_access_key_id,type=env,target=AWS_ACCESS_KEY_ID " +
+						"--secret ibpacker-o2rHJLEEkT68y-aws_secret_access_key,type=env,target=AWS_SECRET_ACCESS_KEY " +
+						"--secret ibpacker-o2rHJLEEkT68y-aws_session_token,type=env,target=AWS_SESSION_TOKEN " +
+						"-e AWS_REGION=us-east-1 quay.io/centos-bootc/bootc-image-builder:latest --type ami --local"),
+					Reply: "Uploading disk.raw to bucket\nAMI registered: ami-0123456789abcdef0\n" +
+						"Snapshot ID: snap-0fedcba9876543210\n",
+				},
+				{
+					Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml",
+				},
+				{
+					Request: "sudo /usr/bin/podman secret rm " +
+						"ibpacker-o2rHJLEEkT68y-aws_access_key_id ibpacker-o2rHJLEEkT68y-aws_secret_access_key " +
+						"ibpacker-o2rHJLEEkT68y-aws_session_token",
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml",
+				},
+			},
+		},
+		{
+			name: "docker-tmpfs",
+			session: []sshtest.RequestReply{
+				{
+					Request: "which podman",
+					Status:  1,
+				},
+				{
+					Request: "which docker",
+					Reply:   "/usr/bin/docker\n",
+				},
+				{
+					Request: "mkdir ./output-hehwuXP6NyGIr",
+				},
+				{
+					Request: "sudo /usr/bin/docker pull quay.io/centos-bootc/centos-bootc:stream9",
+				},
+				{
+					Request: "stat -f -c %T /dev/shm",
+					Reply:   "tmpfs\n",
+				},
+				{
+					Request: regexp.QuoteMeta(`sh -c 'umask 077 && cat > "$1"' sh /dev/shm/ibpacker-o2rHJLEEkT68y.env`),
+					Stdin:   "^AWS_ACCESS_KEY_ID=AKIA\nAWS_SECRET_ACCESS_KEY=s3cr3t\nAWS_SESSION_TOKEN=t0ken\n$",
+				},
+				{
+					Request: "scp -t /tmp",
+				},
+				{
+					Request: "scp -t /tmp",
+					Stdin: regexp.QuoteMeta("trap 'rm -f -- /dev/shm/ibpacker-o2rHJLEEkT68y.env' EXIT\n") + "(?s:.*)" +
+						regexp.QuoteMeta("--env-file /dev/shm/ibpacker-o2rHJLEEkT68y.env -e AWS_REGION=us-east-1 quay.io/centos-bootc/bootc-image-builder:latest"),
+				},
+				{
+					Request: "bash /tmp/ibpacker-iIGI2QoNq1vhQ.sh",
+					Reply: "Uploading disk.raw to bucket\nAMI registered: ami-0123456789abcdef0\n" +
+						"Snapshot ID: snap-0fedcba9876543210\n",
+				},
+				{
+					Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml",
+				},
+				{
+					Request: "rm -f /dev/shm/ibpacker-o2rHJLEEkT68y.env",
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml /tmp/ibpacker-iIGI2QoNq1vhQ.sh",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ibk.RandSource.Seed(0)
+
+			server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+			server.Handler = sshtest.RequestReplyHandler(t, tt.session)
+			defer server.Close()
+
+			client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+				Host:        server.Endpoint,
+				Username:    "test",
+				PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close(ctx)
+
+			cmd := &ibk.ContainerBootCommand{
+				Repository:      "quay.io/centos-bootc/centos-bootc:stream9",
+				Type:            "ami",
+				Blueprint:       "blueprint",
+				AWSUploadConfig: aws,
+			}
+			res, err := ibk.ApplyCommand(ctx, cmd, client)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []ibk.CloudImage{{
+				Provider:   "aws",
+				Region:     "us-east-1",
+				ID:         "ami-0123456789abcdef0",
+				SnapshotID: "snap-0fedcba9876543210",
+			}}
+			if diff := cmp.Diff(want, res.Images); diff != "" {
+				t.Errorf("unexpected images: %s", diff)
+			}
+		})
+	}
+}
+
+func TestContainerOverSSHCliAWSUpload(t *testing.T) {
+	ctx := context.Background()
+	ibk.RandSource.Seed(0)
+
+	session := []sshtest.RequestReply{
+		{
+			Request: "which podman",
+			Reply:   "/usr/bin/podman\n",
+		},
+		{
+			Request: "mkdir ./output-hehwuXP6NyGIr",
+		},
+		{
+			Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-aws_access_key_id -",
+			Stdin:   "^AKIA$",
+		},
+		{
+			Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-aws_secret_access_key -",
+			Stdin:   "^s3cr3t$",
+		},
+		{
+			Request: "scp -t /tmp",
+		},
+		{
+			Request: regexp.QuoteMeta("ghcr.io/osbuild/image-builder-cli:latest build " +
+				"--blueprint /tmp/ibpacker-gPAxUwwNbUvx1.toml --distro fedora " +
+				"--aws-ami-name ami --aws-bucket bucket --aws-region us-east-1 --aws-boot-mode uefi " +
+				"--aws-tag Name=fedora --aws-tag Team=images --aws-share-with 123456789012 --aws-share-with 210987654321 ami"),
+			// the last line of the output is not terminated
+			Reply: "Uploading disk.raw to bucket\nAMI registered: ami-0123456789abcdef0",
+		},
+		{
+			Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+			Reply:   "1073741824 ./output-hehwuXP6NyGIr/image.raw\n",
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml",
+		},
+		{
+			Request: "sudo /usr/bin/podman secret rm " +
+				"ibpacker-o2rHJLEEkT68y-aws_access_key_id ibpacker-o2rHJLEEkT68y-aws_secret_access_key",
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml",
+		},
+	}
+
+	server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+	server.Handler = sshtest.RequestReplyHandler(t, session)
+	defer server.Close()
+
+	client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+		Host:        server.Endpoint,
+		Username:    "test",
+		PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(ctx)
+
+	cmd := &ibk.ContainerCliCommand{
+		Distro:    "fedora",
+		Type:      "ami",
+		Blueprint: "blueprint",
+		AWSUploadConfig: &ibk.AWSUploadConfig{
+			AWSAccessKeyID:     "AKIA",
+			AWSSecretAccessKey: "s3cr3t",
+			AMIName:            "ami",
+			S3Bucket:           "bucket",
+			Region:             "us-east-1",
+			BootMode:           "uefi",
+			Tags:               map[string]string{"Team": "images", "Name": "fedora"},
+			ShareWith:          []string{"123456789012", "210987654321"},
+		},
+	}
+	res, err := ibk.ApplyCommand(ctx, cmd, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ibk.CloudImage{{Provider: "aws", Region: "us-east-1", ID: "ami-0123456789abcdef0"}}
+	if diff := cmp.Diff(want, res.Images); diff != "" {
+		t.Errorf("unexpected images: %s", diff)
+	}
+}
+
+func TestContainerOverSSHCliCloudUpload(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		cmd     *ibk.ContainerCliCommand
+		session []sshtest.RequestReply
+		want    []ibk.CloudImage
+	}{
+		{
+			name: "gcp-docker",
+			cmd: &ibk.ContainerCliCommand{
+				Distro:    "fedora",
+				Type:      "gce",
+				Blueprint: "blueprint",
+				GCPUploadConfig: &ibk.GCPUploadConfig{
+					Credentials: `{"type":"service_account"}`,
+					Bucket:      "bucket",
+					Region:      "europe-west1",
+					ImageName:   "fedora",
+				},
+			},
+			session: []sshtest.RequestReply{
+				{
+					Request: "which podman",
+					Status:  1,
+				},
+				{
+					Request: "which docker",
+					Reply:   "/usr/bin/docker\n",
+				},
+				{
+					Request: "mkdir ./output-hehwuXP6NyGIr",
+				},
+				{
+					Request: "stat -f -c %T /dev/shm",
+					Reply:   "tmpfs\n",
+				},
+				{
+					Request: regexp.QuoteMeta(`sh -c 'umask 077 && cat > "$1"' sh /dev/shm/ibpacker-o2rHJLEEkT68y.json`),
+					Stdin:   regexp.QuoteMeta(`{"type":"service_account"}`),
+				},
+				{
+					Request: "scp -t /tmp",
+				},
+				{
+					Request: "scp -t /tmp",
+					Stdin: regexp.QuoteMeta("-v /dev/shm/ibpacker-o2rHJLEEkT68y.json:/run/secrets/gcp-credentials.json:ro " +
+						"-e GOOGLE_APPLICATION_CREDENTIALS=/run/secrets/gcp-credentials.json " +
+						"ghcr.io/osbuild/image-builder-cli:latest build --blueprint /tmp/ibpacker-gPAxUwwNbUvx1.toml --distro fedora " +
+						"--gcp-bucket bucket --gcp-image-name fedora --gcp-region europe-west1 gce"),
+				},
+				{
+					Request: "bash /tmp/ibpacker-iIGI2QoNq1vhQ.sh",
+					Reply:   "Image created: projects/images-123/global/images/fedora\n",
+				},
+				{
+					Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml",
+				},
+				{
+					Request: "rm -f /dev/shm/ibpacker-o2rHJLEEkT68y.json",
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml /tmp/ibpacker-iIGI2QoNq1vhQ.sh",
+				},
+			},
+			want: []ibk.CloudImage{{Provider: "gcp", Region: "europe-west1", ID: "fedora"}},
+		},
+		{
+			name: "azure-podman",
+			cmd: &ibk.ContainerCliCommand{
+				Distro:    "fedora",
+				Type:      "vhd",
+				Blueprint: "blueprint",
+				AzureUploadConfig: &ibk.AzureUploadConfig{
+					TenantID:       "tenant",
+					SubscriptionID: "sub",
+					ClientID:       "client",
+					ClientSecret:   "s3cr3t",
+					ResourceGroup:  "group",
+					Location:       "westeurope",
+					ImageName:      "fedora",
+				},
+			},
+			session: []sshtest.RequestReply{
+				{
+					Request: "which podman",
+					Reply:   "/usr/bin/podman\n",
+				},
+				{
+					Request: "mkdir ./output-hehwuXP6NyGIr",
+				},
+				{
+					Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-azure_tenant_id -",
+					Stdin:   "^tenant$",
+				},
+				{
+					Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-azure_subscription_id -",
+					Stdin:   "^sub$",
+				},
+				{
+					Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-azure_client_id -",
+					Stdin:   "^client$",
+				},
+				{
+					Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-azure_client_secret -",
+					Stdin:   "^s3cr3t$",
+				},
+				{
+					Request: "scp -t /tmp",
+				},
+				{
+					Request: regexp.QuoteMeta("--secret ibpacker-o2rHJLEEkT68y-azure_client_secret,type=env,target=AZURE_CLIENT_SECRET " +
+						"ghcr.io/osbuild/image-builder-cli:latest build --blueprint /tmp/ibpacker-gPAxUwwNbUvx1.toml --distro fedora " +
+						"--azure-resource-group group --azure-location westeurope --azure-image-name fedora vhd"),
+					Reply: "Image created: /subscriptions/sub/resourceGroups/group/providers/Microsoft.Compute/images/fedora\n",
+				},
+				{
+					Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml",
+				},
+				{
+					Request: "sudo /usr/bin/podman secret rm " +
+						"ibpacker-o2rHJLEEkT68y-azure_tenant_id ibpacker-o2rHJLEEkT68y-azure_subscription_id " +
+						"ibpacker-o2rHJLEEkT68y-azure_client_id ibpacker-o2rHJLEEkT68y-azure_client_secret",
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml",
+				},
+			},
+			want: []ibk.CloudImage{{
+				Provider: "azure",
+				Region:   "westeurope",
+				ID:       "/subscriptions/sub/resourceGroups/group/providers/Microsoft.Compute/images/fedora",
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ibk.RandSource.Seed(0)
+
+			server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+			server.Handler = sshtest.RequestReplyHandler(t, tt.session)
+			defer server.Close()
+
+			client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+				Host:        server.Endpoint,
+				Username:    "test",
+				PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close(ctx)
+
+			res, err := ibk.ApplyCommand(ctx, tt.cmd, client)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.want, res.Images); diff != "" {
+				t.Errorf("unexpected images: %s", diff)
+			}
+		})
+	}
+}
+
+func TestContainerOverSSHCliRegistryPush(t *testing.T) {
+	ctx := context.Background()
+	ibk.RandSource.Seed(0)
+
+	session := []sshtest.RequestReply{
+		{
+			Request: "which podman",
+			Reply:   "/usr/bin/podman\n",
+		},
+		{
+			Request: "mkdir ./output-hehwuXP6NyGIr",
+		},
+		{
+			Request: "scp -t /tmp",
+		},
+		{
+			Request: regexp.QuoteMeta("ghcr.io/osbuild/image-builder-cli:latest build " +
+				"--blueprint /tmp/ibpacker-o2rHJLEEkT68y.toml --distro fedora container"),
+		},
+		{
+			Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+			Reply:   "1048576 ./output-hehwuXP6NyGIr/container/container.tar\n",
+		},
+		{
+			Request: "sudo /usr/bin/podman load -i ./output-hehwuXP6NyGIr/container/container.tar",
+			Reply:   "Getting image source signatures\nLoaded image: sha256:4a5b6c\n",
+		},
+		{
+			Request: "sudo /usr/bin/podman login --authfile /dev/shm/ibpacker-gPAxUwwNbUvx1.json " +
+				"--username robot --password-stdin --tls-verify=false localhost:5000",
+			Stdin: "^s3cr3t$",
+		},
+		{
+			Request: "sudo /usr/bin/podman push --tls-verify=false --authfile /dev/shm/ibpacker-gPAxUwwNbUvx1.json " +
+				"--digestfile /dev/shm/ibpacker-gPAxUwwNbUvx1.digest sha256:4a5b6c docker://localhost:5000/fedora:latest",
+		},
+		{
+			Request: "sudo cat /dev/shm/ibpacker-gPAxUwwNbUvx1.digest",
+			Reply:   "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		},
+		{
+			Request: "sudo rm -f /dev/shm/ibpacker-gPAxUwwNbUvx1.json /dev/shm/ibpacker-gPAxUwwNbUvx1.digest",
+		},
+		{
+			Request: "sudo /usr/bin/podman rmi sha256:4a5b6c",
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		},
+	}
+
+	server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+	server.Handler = sshtest.RequestReplyHandler(t, session)
+	defer server.Close()
+
+	client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+		Host:        server.Endpoint,
+		Username:    "test",
+		PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(ctx)
+
+	cmd := &ibk.ContainerCliCommand{
+		Distro:    "fedora",
+		Type:      "container",
+		Blueprint: "blueprint",
+		RegistryPushConfig: &ibk.RegistryPushConfig{
+			Reference: "localhost:5000/fedora:latest",
+			Username:  "robot",
+			Password:  "s3cr3t",
+			Insecure:  true,
+		},
+	}
+	res, err := ibk.ApplyCommand(ctx, cmd, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ibk.ContainerImage{{Reference: "localhost:5000/fedora:latest", Digest: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}}
+	if diff := cmp.Diff(want, res.Pushes); diff != "" {
+		t.Errorf("unexpected pushes: %s", diff)
+	}
+}
+
+func TestContainerOverSSHConfigureFailureCleanup(t *testing.T) {
+	ctx := context.Background()
+	ibk.RandSource.Seed(0)
+
+	session := []sshtest.RequestReply{
+		{
+			Request: "which podman",
+			Reply:   "/usr/bin/podman\n",
+		},
+		{
+			Request: "mkdir ./output-hehwuXP6NyGIr",
+		},
+		{
+			Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-aws_access_key_id -",
+			Stdin:   "^AKIA$",
+		},
+		{
+			Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-aws_secret_access_key -",
+			Stdin:   "^s3cr3t$",
+		},
+		{
+			Request: "sudo /usr/bin/podman secret create ibpacker-gPAxUwwNbUvx1-rclone_config_s3_access_key_id -",
+			Stdin:   "^minio$",
+			Status:  125,
+		},
+		{
+			Request: "sudo /usr/bin/podman secret rm " +
+				"ibpacker-o2rHJLEEkT68y-aws_access_key_id ibpacker-o2rHJLEEkT68y-aws_secret_access_key",
+		},
+	}
+
+	server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+	server.Handler = sshtest.RequestReplyHandler(t, session)
+	defer server.Close()
+
+	client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+		Host:        server.Endpoint,
+		Username:    "test",
+		PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(ctx)
+
+	cmd := &ibk.ContainerCliCommand{
+		Distro:    "fedora",
+		Type:      "ami",
+		Blueprint: "blueprint",
+		AWSUploadConfig: &ibk.AWSUploadConfig{
+			AWSAccessKeyID:     "AKIA",
+			AWSSecretAccessKey: "s3cr3t",
+			AMIName:            "ami",
+			S3Bucket:           "bucket",
+			Region:             "us-east-1",
+		},
+		ObjectStorageConfig: &ibk.ObjectStorageConfig{
+			Endpoint:        "http://minio:9000",
+			Bucket:          "images",
+			AccessKeyID:     "minio",
+			SecretAccessKey: "minio-s3cr3t",
+		},
+	}
+	r := &ibk.Recorder{}
+	_, err = ibk.ApplyCommand(ctx, cmd, ibk.Wrap(client, ibk.WithRecorder(r)))
+	if !errors.Is(err, ibk.ErrConfigure) {
+		t.Fatalf("expected configure error, got: %v", err)
+	}
+
+	entries := r.Entries()
+	if last := entries[len(entries)-1]; !strings.Contains(last, "secret rm") {
+		t.Errorf("secrets were not removed, last execution: %s", last)
+	}
+}
+
+func TestContainerOverSSHObjectStorageUpload(t *testing.T) {
+	ctx := context.Background()
+	ibk.RandSource.Seed(0)
+
+	rclone := "--rm --security-opt label=disable -v ./output-hehwuXP6NyGIr:/data:ro " +
+		"--secret ibpacker-o2rHJLEEkT68y-rclone_config_s3_access_key_id,type=env,target=RCLONE_CONFIG_S3_ACCESS_KEY_ID " +
+		"--secret ibpacker-o2rHJLEEkT68y-rclone_config_s3_secret_access_key,type=env,target=RCLONE_CONFIG_S3_SECRET_ACCESS_KEY " +
+		"-e RCLONE_CONFIG_S3_TYPE=s3 -e RCLONE_CONFIG_S3_ENV_AUTH=false -e RCLONE_CONFIG_S3_FORCE_PATH_STYLE=true " +
+		"-e RCLONE_CONFIG_S3_PROVIDER=Other -e RCLONE_CONFIG_S3_ENDPOINT=http://minio:9000 " +
+		"docker.io/rclone/rclone:latest copyto --s3-no-check-bucket "
+
+	session := []sshtest.RequestReply{
+		{
+			Request: "which podman",
+			Reply:   "/usr/bin/podman\n",
+		},
+		{
+			Request: "mkdir ./output-hehwuXP6NyGIr",
+		},
+		{
+			Request: "sudo /usr/bin/podman pull quay.io/centos-bootc/centos-bootc:stream9",
+		},
+		{
+			Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-rclone_config_s3_access_key_id -",
+			Stdin:   "^minio$",
+		},
+		{
+			Request: "sudo /usr/bin/podman secret create ibpacker-o2rHJLEEkT68y-rclone_config_s3_secret_access_key -",
+			Stdin:   "^minio-s3cr3t$",
+		},
+		{
+			Request: "scp -t /tmp",
+		},
+		{
+			Request: regexp.QuoteMeta("quay.io/centos-bootc/bootc-image-builder:latest --type qcow2 --local"),
+		},
+		{
+			Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+			Reply: "10737418240 ./output-hehwuXP6NyGIr/qcow2/disk.qcow2\n" +
+				"1024 ./output-hehwuXP6NyGIr/manifest-qcow2.json\n",
+		},
+		{
+			Request: regexp.QuoteMeta("sudo /usr/bin/podman run " + rclone +
+				"/data/qcow2/disk.qcow2 s3:images/builds/qcow2/disk.qcow2"),
+		},
+		{
+			Request: regexp.QuoteMeta("sudo /usr/bin/podman run " + rclone +
+				"/data/manifest-qcow2.json s3:images/builds/manifest-qcow2.json"),
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml",
+		},
+		{
+			Request: "sudo /usr/bin/podman secret rm " +
+				"ibpacker-o2rHJLEEkT68y-rclone_config_s3_access_key_id ibpacker-o2rHJLEEkT68y-rclone_config_s3_secret_access_key",
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-gPAxUwwNbUvx1.toml",
+		},
+	}
+
+	server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+	server.Handler = sshtest.RequestReplyHandler(t, session)
+	defer server.Close()
+
+	client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+		Host:        server.Endpoint,
+		Username:    "test",
+		PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(ctx)
+
+	cmd := &ibk.ContainerBootCommand{
+		Repository: "quay.io/centos-bootc/centos-bootc:stream9",
+		Type:       "qcow2",
+		Blueprint:  "blueprint",
+		ObjectStorageConfig: &ibk.ObjectStorageConfig{
+			Endpoint:        "http://minio:9000",
+			Bucket:          "images",
+			Prefix:          "builds",
+			AccessKeyID:     "minio",
+			SecretAccessKey: "minio-s3cr3t",
+			PathStyle:       true,
+		},
+	}
+	res, err := ibk.ApplyCommand(ctx, cmd, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ibk.StorageObject{
+		{
+			Bucket: "images",
+			Key:    "builds/qcow2/disk.qcow2",
+			URL:    "http://minio:9000/images/builds/qcow2/disk.qcow2",
+			Size:   10737418240,
+		},
+		{
+			Bucket: "images",
+			Key:    "builds/manifest-qcow2.json",
+			URL:    "http://minio:9000/images/builds/manifest-qcow2.json",
+			Size:   1024,
+		},
+	}
+	if diff := cmp.Diff(want, res.Objects); diff != "" {
+		t.Errorf("unexpected objects: %s", diff)
+	}
+}
+
+func TestContainerOverSSHChecksumsAndDownload(t *testing.T) {
+	ctx := context.Background()
+	ibk.RandSource.Seed(0)
+
+	image := "raw image contents\n"
+	sum := sha256.Sum256([]byte(image))
+	imageSum := hex.EncodeToString(sum[:])
+	manifest := imageSum + "  image.raw\n"
+
+	session := []sshtest.RequestReply{
+		{
+			Request: "which podman",
+			Reply:   "/usr/bin/podman\n",
+		},
+		{
+			Request: "mkdir ./output-hehwuXP6NyGIr",
+		},
+		{
+			Request: "scp -t /tmp",
+		},
+		{
+			Request: regexp.QuoteMeta("ghcr.io/osbuild/image-builder-cli:latest build " +
+				"--blueprint /tmp/ibpacker-o2rHJLEEkT68y.toml --distro fedora raw"),
+		},
+		{
+			Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+			Reply:   fmt.Sprintf("%d ./output-hehwuXP6NyGIr/image.raw\n", len(image)),
+		},
+		{
+			Request: "cd ./output-hehwuXP6NyGIr && sudo sha256sum -- image.raw",
+			Reply:   manifest,
+		},
+		{
+			Request: regexp.QuoteMeta(`sudo sh -c 'cat > "$1"' sh ./output-hehwuXP6NyGIr/SHA256SUMS`),
+			Stdin:   "^" + manifest + "$",
+		},
+		{
+			Request: regexp.QuoteMeta(`sudo sh -c 'cat > "$1"' sh ./output-hehwuXP6NyGIr/SHA256SUMS.asc`),
+			Stdin:   "^-----BEGIN PGP SIGNATURE-----",
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		},
+		{
+			Request: "sudo stat -c '%s %Y' -- ./output-hehwuXP6NyGIr/image.raw",
+			Reply:   fmt.Sprintf("%d 1700000000", len(image)),
+		},
+		{
+			Request: "sudo cat -- ./output-hehwuXP6NyGIr/image.raw",
+			Reply:   image,
+		},
+		{
+			Request: "sudo stat -c '%s %Y' -- ./output-hehwuXP6NyGIr/SHA256SUMS",
+			Reply:   fmt.Sprintf("%d 1700000000", len(manifest)),
+		},
+		{
+			Request: "cd ./output-hehwuXP6NyGIr && sudo sha256sum -- SHA256SUMS",
+			Reply:   sha256Hex(manifest) + "  SHA256SUMS\n",
+		},
+		{
+			Request: "sudo cat -- ./output-hehwuXP6NyGIr/SHA256SUMS",
+			Reply:   manifest,
+		},
+		{
+			Request: "sudo stat -c '%s %Y' -- ./output-hehwuXP6NyGIr/SHA256SUMS.asc",
+			Reply:   "9 1700000000",
+		},
+		{
+			Request: "cd ./output-hehwuXP6NyGIr && sudo sha256sum -- SHA256SUMS.asc",
+			Reply:   sha256Hex("signature") + "  SHA256SUMS.asc\n",
+		},
+		{
+			Request: "sudo cat -- ./output-hehwuXP6NyGIr/SHA256SUMS.asc",
+			Reply:   "signature",
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		},
+	}
+
+	server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+	server.Handler = sshtest.RequestReplyHandler(t, session)
+	defer server.Close()
+
+	client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+		Host:        server.Endpoint,
+		Username:    "test",
+		PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(ctx)
+
+	entity, err := openpgp.NewEntity("builder", "", "builder@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &bytes.Buffer{}
+	err = entity.SerializePrivate(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &ibk.ContainerCliCommand{
+		Distro:         "fedora",
+		Type:           "raw",
+		Blueprint:      "blueprint",
+		ChecksumConfig: &ibk.ChecksumConfig{Signer: &ibk.GPGSigner{Key: key.Bytes()}},
+	}
+	res, err := ibk.ApplyCommand(ctx, cmd, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server replies with a fake signature
+	res.Manifests[1].Size = int64(len("signature"))
+
+	dir := t.TempDir()
+	err = ibk.DownloadResult(ctx, client, res, ibk.DownloadConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantFiles := []ibk.File{{
+		Path:      "./output-hehwuXP6NyGIr/image.raw",
+		Size:      int64(len(image)),
+		SHA256:    imageSum,
+		LocalPath: filepath.Join(dir, "image.raw"),
+	}}
+	if diff := cmp.Diff(wantFiles, res.Files); diff != "" {
+		t.Errorf("unexpected files: %s", diff)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(dir, "SHA256SUMS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != manifest {
+		t.Errorf("unexpected SHA256SUMS: %q", contents)
+	}
+
+	if len(res.Manifests) != 2 || res.Manifests[1].LocalPath != filepath.Join(dir, "SHA256SUMS.asc") {
+		t.Errorf("unexpected manifests: %+v", res.Manifests)
+	}
+}
+
+func TestContainerOverSSHBootcProvenance(t *testing.T) {
+	ctx := context.Background()
+	ibk.RandSource.Seed(0)
+
+	session := []sshtest.RequestReply{
+		{
+			Request: "which podman",
+			Reply:   "/usr/bin/podman\n",
+		},
+		{
+			Request: "mkdir ./output-hehwuXP6NyGIr",
+		},
+		{
+			Request: "sudo /usr/bin/podman pull localhost/bootc:latest",
+		},
+		{
+			Request: "scp -t /tmp",
+		},
+		{
+			Request: "sudo /usr/bin/podman run",
+		},
+		{
+			Request: "find ./output-hehwuXP6NyGIr -type f -printf '%s %p\\n'",
+			Reply:   "5 ./output-hehwuXP6NyGIr/image/disk.raw\n",
+		},
+		{
+			Request: regexp.QuoteMeta("sudo /usr/bin/podman image inspect --format '{{index .RepoDigests 0}}' quay.io/centos-bootc/bootc-image-builder:latest"),
+			Reply:   "quay.io/centos-bootc/bootc-image-builder@sha256:" + strings.Repeat("b", 64) + "\n",
+		},
+		{
+			Request: regexp.QuoteMeta("sudo /usr/bin/podman image inspect --format '{{index .RepoDigests 0}}' localhost/bootc:latest"),
+			Reply:   "Error: no digest\n",
+			Status:  125,
+		},
+		{
+			Request: "cd ./output-hehwuXP6NyGIr && sudo sha256sum -- image/disk.raw",
+			Reply:   strings.Repeat("a", 64) + "  image/disk.raw\n",
+		},
+		{
+			Request: "uname -n",
+			Reply:   "builder.example.com\n",
+		},
+		{
+			Request: regexp.QuoteMeta(`sudo sh -c 'cat > "$1"' sh ./output-hehwuXP6NyGIr/provenance.json`),
+			Stdin: `"_type": "https://in-toto.io/Statement/v1"(?s:.*)` +
+				`"name": "image/disk.raw",\s+"digest": \{\s+"sha256": "a{64}"(?s:.*)` +
+				`"buildType": "https://github.com/osbuild/bootc-image-builder"(?s:.*)` +
+				`"repository": "localhost/bootc:latest"(?s:.*)` +
+				`"host": "builder.example.com"(?s:.*)` +
+				`"uri": "docker://quay.io/centos-bootc/bootc-image-builder:latest",\s+"digest": \{\s+"sha256": "b{64}"(?s:.*)` +
+				`"uri": "docker://localhost/bootc:latest"\s+\}(?s:.*)` +
+				`"name": "blueprint.toml"(?s:.*)` +
+				`"id": "https://github.com/osbuild/packer-plugin-image-builder"`,
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		},
+	}
+
+	server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+	server.Handler = sshtest.RequestReplyHandler(t, session)
+	defer server.Close()
+
+	client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+		Host:        server.Endpoint,
+		Username:    "test",
+		PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(ctx)
+
+	cmd := &ibk.ContainerBootCommand{
+		Repository: "localhost/bootc:latest",
+		Type:       "raw",
+		Blueprint:  "blueprint",
+		Common:     ibk.CommonArgs{Provenance: true},
+	}
+
+	var warnings []string
+	obs := ibk.ObserverFunc(func(e ibk.Event) {
+		if e.Type == ibk.EventWarning {
+			warnings = append(warnings, e.Message)
+		}
+	})
+	res, err := ibk.ApplyCommandObserve(ctx, cmd, client, obs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Provenance.Path != "./output-hehwuXP6NyGIr/provenance.json" {
+		t.Errorf("unexpected provenance: %+v", res.Provenance)
+	}
+	if res.Files[0].SHA256 != strings.Repeat("a", 64) {
+		t.Errorf("unexpected checksum: %q", res.Files[0].SHA256)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "no digest of localhost/bootc:latest") {
+		t.Errorf("unexpected warnings: %q", warnings)
+	}
+}
+
+func TestContainerOverSSHSBOM(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		cmd      ibk.Command
+		session  []sshtest.RequestReply
+		wantFile []string
+		wantSBOM []string
+	}{
+		{
+			name: "cli",
+			cmd: &ibk.ContainerCliCommand{
+				Distro:    "fedora",
+				Type:      "raw",
+				Blueprint: "blueprint",
+				WithSBOM:  true,
+			},
+			session: []sshtest.RequestReply{
+				{
+					Request: "which podman",
+					Reply:   "/usr/bin/podman\n",
+				},
+				{
+					Request: "mkdir ./output-hehwuXP6NyGIr",
+				},
+				{
+					Request: "scp -t /tmp",
+				},
+				{
+					Request: regexp.QuoteMeta("--distro fedora --with-sbom raw"),
+				},
+				{
+					Request: "find ./output-hehwuXP6NyGIr -type f",
+					Reply: "5 ./output-hehwuXP6NyGIr/image.raw\n" +
+						"3 ./output-hehwuXP6NyGIr/image.buildroot-build.spdx.json\n" +
+						"4 ./output-hehwuXP6NyGIr/image.image-os.spdx.json\n",
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+				},
+			},
+			wantFile: []string{"./output-hehwuXP6NyGIr/image.raw"},
+			wantSBOM: []string{
+				"./output-hehwuXP6NyGIr/image.buildroot-build.spdx.json",
+				"./output-hehwuXP6NyGIr/image.image-os.spdx.json",
+			},
+		},
+		{
+			name: "bootc",
+			cmd: &ibk.ContainerBootCommand{
+				Repository: "quay.io/centos-bootc/centos-bootc:stream9",
+				Type:       "raw",
+				Blueprint:  "blueprint",
+				WithSBOM:   true,
+			},
+			session: []sshtest.RequestReply{
+				{
+					Request: "which podman",
+					Reply:   "/usr/bin/podman\n",
+				},
+				{
+					Request: "mkdir ./output-hehwuXP6NyGIr",
+				},
+				{
+					Request: "sudo /usr/bin/podman pull quay.io/centos-bootc/centos-bootc:stream9",
+				},
+				{
+					Request: "scp -t /tmp",
+				},
+				{
+					Request: "sudo /usr/bin/podman run --privileged",
+				},
+				{
+					Request: "find ./output-hehwuXP6NyGIr -type f",
+					Reply:   "5 ./output-hehwuXP6NyGIr/disk.raw\n",
+				},
+				{
+					Request: regexp.QuoteMeta(`sudo /usr/bin/podman run --rm --entrypoint rpm quay.io/centos-bootc/centos-bootc:stream9 -qa --queryformat '%{NAME}\t%{EPOCHNUM}\t%{VERSION}\t%{RELEASE}\t%{ARCH}\n'`),
+					Reply:   "bash\t0\t5.1.8\t9.el9\tx86_64\nkernel\t1\t5.14.0\t503.el9\tx86_64\n",
+				},
+				{
+					Request: regexp.QuoteMeta(`sudo sh -c 'cat > "$1"' sh ./output-hehwuXP6NyGIr/source-container.spdx.json`),
+					Stdin: `"spdxVersion": "SPDX-2.3"(?s:.*)` +
+						`"name": "bash",\s+"versionInfo": "5.1.8-9.el9"(?s:.*)` +
+						`"referenceLocator": "pkg:rpm/bash@5.1.8-9.el9\?arch=x86_64"(?s:.*)` +
+						`"versionInfo": "1:5.14.0-503.el9"(?s:.*)` +
+						`"referenceLocator": "pkg:rpm/kernel@5.14.0-503.el9\?arch=x86_64&epoch=1"`,
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+				},
+				{
+					Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+				},
+			},
+			wantFile: []string{"./output-hehwuXP6NyGIr/disk.raw"},
+			wantSBOM: []string{"./output-hehwuXP6NyGIr/source-container.spdx.json"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ibk.RandSource.Seed(0)
+
+			server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+			server.Handler = sshtest.RequestReplyHandler(t, tt.session)
+			defer server.Close()
+
+			client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+				Host:        server.Endpoint,
+				Username:    "test",
+				PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close(ctx)
+
+			res, err := ibk.ApplyCommand(ctx, tt.cmd, client)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(tt.wantFile, res.Paths()); diff != "" {
+				t.Errorf("unexpected files: %s", diff)
+			}
+
+			var sboms []string
+			for _, f := range res.SBOMs {
+				sboms = append(sboms, f.Path)
+			}
+			if diff := cmp.Diff(tt.wantSBOM, sboms); diff != "" {
+				t.Errorf("unexpected sboms: %s", diff)
+			}
+		})
+	}
+}
+
+func TestContainerOverSSHCompression(t *testing.T) {
+	ctx := context.Background()
+	ibk.RandSource.Seed(0)
+
+	image := strings.Repeat("\x00", 4096) + "data"
+	compressed := &bytes.Buffer{}
+	xw, err := xz.NewWriter(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = xw.Write([]byte(image))
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	session := []sshtest.RequestReply{
+		{
+			Request: "which podman",
+			Reply:   "/usr/bin/podman\n",
+		},
+		{
+			Request: "mkdir ./output-hehwuXP6NyGIr",
+		},
+		{
+			Request: "scp -t /tmp",
+		},
+		{
+			Request: "sudo /usr/bin/podman run",
+		},
+		{
+			Request: "find ./output-hehwuXP6NyGIr -type f",
+			Reply:   fmt.Sprintf("%d ./output-hehwuXP6NyGIr/image.raw\n", len(image)),
+		},
+		{
+			Request: "cd ./output-hehwuXP6NyGIr && sudo xz -T2 -6 -- image.raw",
+		},
+		{
+			Request: "find ./output-hehwuXP6NyGIr -type f",
+			Reply:   fmt.Sprintf("%d ./output-hehwuXP6NyGIr/image.raw.xz\n", compressed.Len()),
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		},
+		{
+			Request: "sudo stat -c '%s %Y' -- ./output-hehwuXP6NyGIr/image.raw.xz",
+			Reply:   fmt.Sprintf("%d 1700000000", compressed.Len()),
+		},
+		{
+			Request: "cd ./output-hehwuXP6NyGIr && sudo sha256sum -- image.raw.xz",
+			Reply:   sha256Hex(compressed.String()) + "  image.raw.xz\n",
+		},
+		{
+			Request: "sudo cat -- ./output-hehwuXP6NyGIr/image.raw.xz",
+			Reply:   compressed.String(),
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		},
+	}
+
+	server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+	server.Handler = sshtest.RequestReplyHandler(t, session)
+	defer server.Close()
+
+	client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+		Host:        server.Endpoint,
+		Username:    "test",
+		PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(ctx)
+
+	cmd := &ibk.ContainerCliCommand{
+		Distro:            "fedora",
+		Type:              "raw",
+		Blueprint:         "blueprint",
+		CompressionConfig: &ibk.CompressionConfig{Format: "xz", Level: 6, Threads: 2},
+	}
+	res, err := ibk.ApplyCommand(ctx, cmd, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantFiles := []ibk.File{{
+		Path:        "./output-hehwuXP6NyGIr/image.raw.xz",
+		Size:        int64(compressed.Len()),
+		Compression: "xz",
+	}}
+	if diff := cmp.Diff(wantFiles, res.Files); diff != "" {
+		t.Errorf("unexpected files: %s", diff)
+	}
+
+	dir := t.TempDir()
+	err = ibk.DownloadResult(ctx, client, res, ibk.DownloadConfig{Dir: dir, Decompress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Files[0].LocalPath != filepath.Join(dir, "image.raw") {
+		t.Errorf("unexpected local path: %q", res.Files[0].LocalPath)
+	}
+
+	contents, err := os.ReadFile(res.Files[0].LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != image {
+		t.Errorf("unexpected decompressed contents of %d bytes", len(contents))
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("unexpected files left: %v", entries)
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	session := []sshtest.RequestReply{
+		{
+			Request: "sudo stat -c '%s %Y' -- ./output/image.raw",
+			Reply:   "9 1700000000",
+		},
+		{
+			Request: "sudo cat -- ./output/image.raw",
+			Reply:   "corrupted",
+		},
+	}
+
+	server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+	server.Handler = sshtest.RequestReplyHandler(t, session)
+	defer server.Close()
+
+	client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+		Host:        server.Endpoint,
+		Username:    "test",
+		PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(ctx)
+
+	dir := t.TempDir()
+	res := &ibk.Result{
+		OutputDir: "./output",
+		Files:     []ibk.File{{Path: "./output/image.raw", Size: 9, SHA256: strings.Repeat("0", 64)}},
+	}
+	err = ibk.DownloadResult(ctx, client, res, ibk.DownloadConfig{Dir: dir})
+	if !errors.Is(err, ibk.ErrChecksum) {
+		t.Fatalf("expected checksum error, got: %v", err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("unexpected files left: %v", entries)
+	}
+}
+
+func TestAWSUploadValidation(t *testing.T) {
+	ctx := context.Background()
+	aws := &ibk.AWSUploadConfig{AMIName: "ami", S3Bucket: "bucket", Region: "us-east-1"}
+
+	tests := []struct {
+		name string
+		cmd  ibk.Command
+	}{
+		{
+			name: "cli-wrong-type",
+			cmd:  &ibk.ContainerCliCommand{Distro: "fedora", Type: "qcow2", AWSUploadConfig: aws},
+		},
+		{
+			name: "cli-missing-bucket",
+			cmd: &ibk.ContainerCliCommand{Distro: "fedora", Type: "ami", AWSUploadConfig: &ibk.AWSUploadConfig{
+				AMIName: "ami",
+				Region:  "us-east-1",
+			}},
+		},
+		{
+			name: "cli-gcp-wrong-type",
+			cmd: &ibk.ContainerCliCommand{Distro: "fedora", Type: "qcow2", GCPUploadConfig: &ibk.GCPUploadConfig{
+				Credentials: "{}",
+				Bucket:      "bucket",
+				ImageName:   "fedora",
+			}},
+		},
+		{
+			name: "cli-azure-missing-secret",
+			cmd: &ibk.ContainerCliCommand{Distro: "fedora", Type: "vhd", AzureUploadConfig: &ibk.AzureUploadConfig{
+				TenantID:       "tenant",
+				SubscriptionID: "sub",
+				ClientID:       "client",
+				ResourceGroup:  "group",
+				Location:       "westeurope",
+				ImageName:      "fedora",
+			}},
+		},
+		{
+			name: "cli-registry-missing-reference",
+			cmd: &ibk.ContainerCliCommand{Distro: "fedora", Type: "container", RegistryPushConfig: &ibk.RegistryPushConfig{
+				Username: "robot",
+				Password: "s3cr3t",
+			}},
+		},
+		{
+			name: "bootc-object-storage-missing-bucket",
+			cmd: &ibk.ContainerBootCommand{Repository: "quay.io/fedora/fedora-bootc", Type: "qcow2", ObjectStorageConfig: &ibk.ObjectStorageConfig{
+				AccessKeyID:     "minio",
+				SecretAccessKey: "minio-s3cr3t",
+			}},
+		},
+		{
+			name: "cli-compression-gzip-threads",
+			cmd:  &ibk.ContainerCliCommand{Distro: "fedora", Type: "raw", CompressionConfig: &ibk.CompressionConfig{Format: "gzip", Threads: 4}},
+		},
+		{
+			name: "bootc-compression-level",
+			cmd:  &ibk.ContainerBootCommand{Repository: "quay.io/fedora/fedora-bootc", Type: "raw", CompressionConfig: &ibk.CompressionConfig{Format: "xz", Level: 10}},
+		},
+		{
+			name: "bootc-tags",
+			cmd: &ibk.ContainerBootCommand{Repository: "quay.io/fedora/fedora-bootc", Type: "ami", AWSUploadConfig: &ibk.AWSUploadConfig{
+				AMIName:  "ami",
+				S3Bucket: "bucket",
+				Region:   "us-east-1",
+				Tags:     map[string]string{"Name": "fedora"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ft := &fakeTransport{}
+			_, err := ibk.ApplyCommand(ctx, tt.cmd, ft)
+			if !errors.Is(err, ibk.ErrConfigure) {
+				t.Fatalf("expected configure error, got: %v", err)
+			}
+			if len(ft.executed) != 0 {
+				t.Errorf("unexpected executions: %v", ft.executed)
+			}
 		})
 	}
 }
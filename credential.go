@@ -0,0 +1,214 @@
+package ibk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+var ErrCredentials = errors.New("error while creating credentials")
+
+// Credential is a sensitive value passed to a build container as an environment variable
+// or a file.
+type Credential struct {
+	// Env is the name of the environment variable in the container.
+	Env string
+
+	// Path is the absolute path of a file in the container. When set, the value is mounted
+	// as a file instead of an environment variable.
+	Path string
+
+	// Value is the sensitive value.
+	Value string
+}
+
+// name returns a short name of the credential used in remote names.
+func (c Credential) name() string {
+	if c.Path != "" {
+		return filepath.Base(c.Path)
+	}
+
+	return strings.ToLower(c.Env)
+}
+
+// CredentialStore passes credentials to build containers without writing them to the
+// regular filesystem of the remote host. With podman, a short-lived podman secret is
+// created for every credential. With docker, which only supports secrets in swarm mode,
+// credentials are written into an environment file or mounted files on the /dev/shm
+// tmpfs. Values are always sent via standard input so they never appear on a command line.
+//
+// Credentials must be removed via Remove once the build finishes.
+type CredentialStore struct {
+	// Runtime is the container runtime executable (e.g. /usr/bin/podman).
+	Runtime string
+
+	// DryRun prints the commands instead of executing them.
+	DryRun bool
+
+	secrets []ContainerSecret
+	envFile string
+	mounts  []Mount
+	files   []string
+}
+
+// tmpfsDir is a directory on a memory-backed filesystem used for docker credential files.
+const tmpfsDir = "/dev/shm"
+
+func (s *CredentialStore) podman() bool {
+	return filepath.Base(s.Runtime) == "podman"
+}
+
+// Create stores the credentials on the remote host. When creation fails, already created
+// credentials are removed.
+func (s *CredentialStore) Create(ctx context.Context, exec Executor, creds ...Credential) error {
+	if len(creds) == 0 {
+		return nil
+	}
+
+	var err error
+	if s.podman() {
+		err = s.createSecrets(ctx, exec, creds)
+	} else {
+		err = s.createFiles(ctx, exec, creds)
+	}
+
+	if err != nil {
+		return errors.Join(fmt.Errorf("%w: %w", ErrCredentials, err), s.Remove(ctx, exec))
+	}
+
+	return nil
+}
+
+func (s *CredentialStore) createSecrets(ctx context.Context, exec Executor, creds []Credential) error {
+	prefix := "ibpacker-" + RandomString(13)
+
+	for _, c := range creds {
+		name := prefix + "-" + c.name()
+		stderr := &SyncedBuffer{}
+		err := exec.Execute(ctx, Invocation{
+			Privileged: true,
+			DryRun:     s.DryRun,
+			Args:       []string{s.Runtime, "secret", "create", name, "-"},
+		}, WithInputOutput(strings.NewReader(c.Value), nil, stderr))
+		if err != nil {
+			return fmt.Errorf("secret %s: %w: %s", name, err, stderr.String())
+		}
+
+		log.Printf("[DEBUG] Created podman secret %q", name)
+		if c.Path != "" {
+			s.secrets = append(s.secrets, ContainerSecret{Name: name, Type: "mount", Target: c.Path})
+		} else {
+			s.secrets = append(s.secrets, ContainerSecret{Name: name, Type: "env", Target: c.Env})
+		}
+	}
+
+	return nil
+}
+
+func (s *CredentialStore) createFiles(ctx context.Context, exec Executor, creds []Credential) error {
+	if !s.DryRun {
+		fs, err := tail1(ctx, exec, Cmd("stat", "-f", "-c", "%T", tmpfsDir))
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", tmpfsDir, err)
+		}
+
+		if fs != "tmpfs" {
+			return fmt.Errorf("%s is not a tmpfs filesystem: %s", tmpfsDir, fs)
+		}
+	}
+
+	sb := strings.Builder{}
+	for _, c := range creds {
+		if c.Path != "" {
+			path, err := s.writeFile(ctx, exec, c.Value, filepath.Ext(c.Path))
+			if err != nil {
+				return err
+			}
+			s.mounts = append(s.mounts, Mount{Source: path, Target: c.Path, ReadOnly: true})
+			continue
+		}
+
+		sb.WriteString(c.Env + "=" + c.Value + "\n")
+	}
+
+	if sb.Len() > 0 {
+		path, err := s.writeFile(ctx, exec, sb.String(), ".env")
+		if err != nil {
+			return err
+		}
+		s.envFile = path
+	}
+
+	return nil
+}
+
+// writeFile writes the contents into a new file readable only by the owner in the tmpfs
+// directory and returns its path.
+func (s *CredentialStore) writeFile(ctx context.Context, exec Executor, contents, ext string) (string, error) {
+	if ext == "" {
+		ext = ".tmp"
+	}
+
+	path := fmt.Sprintf("%s/ibpacker-%s%s", tmpfsDir, RandomString(13), ext)
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, Invocation{
+		DryRun: s.DryRun,
+		Args:   []string{"sh", "-c", `umask 077 && cat > "$1"`, "sh", path},
+	}, WithInputOutput(strings.NewReader(contents), nil, stderr))
+	if err != nil {
+		return "", fmt.Errorf("file %s: %w: %s", path, err, stderr.String())
+	}
+
+	log.Printf("[DEBUG] Created credentials file %q", path)
+	s.files = append(s.files, path)
+	return path, nil
+}
+
+// Attach passes the stored credentials to the container.
+func (s *CredentialStore) Attach(ctr *Container) {
+	ctr.Secrets = append(ctr.Secrets, s.secrets...)
+	ctr.Mounts = append(ctr.Mounts, s.mounts...)
+
+	if s.envFile != "" {
+		ctr.EnvFiles = append(ctr.EnvFiles, s.envFile)
+	}
+}
+
+// Files returns remote files holding credentials, they should be deleted as soon as the
+// container exits (see Invocation.Cleanup).
+func (s *CredentialStore) Files() []string {
+	return s.files
+}
+
+// Remove deletes all stored credentials from the remote host.
+func (s *CredentialStore) Remove(ctx context.Context, exec Executor) error {
+	var errs []error
+
+	if len(s.secrets) > 0 {
+		args := []string{s.Runtime, "secret", "rm"}
+		for _, secret := range s.secrets {
+			args = append(args, secret.Name)
+		}
+
+		err := exec.Execute(ctx, Invocation{Privileged: true, DryRun: s.DryRun, Args: args})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("secret rm: %w", err))
+		} else {
+			s.secrets = nil
+		}
+	}
+
+	if len(s.files) > 0 {
+		err := removeFiles(ctx, exec, s.files...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("files: %w", err))
+		} else {
+			s.files = nil
+		}
+	}
+
+	return errors.Join(errs...)
+}
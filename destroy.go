@@ -0,0 +1,227 @@
+package ibk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ErrDestroy is returned when an error occurs during removal of build results.
+var ErrDestroy = errors.New("error while destroying")
+
+// DestroyConfig configures DestroyResult. Every kind of resource can be kept via its own
+// flag, everything is removed by default.
+type DestroyConfig struct {
+	// Transport is used to remove the remote output directory. When nil, remote files are
+	// kept.
+	Transport Transport
+
+	// AWS provides credentials for deregistration of AMIs and deletion of their snapshots.
+	// They are resolved again (see AWSUploadConfig.Resolve) so temporary credentials of the
+	// build which have expired since are not used.
+	AWS *AWSUploadConfig
+
+	// Registry provides credentials for deletion of pushed container images.
+	Registry *RegistryPushConfig
+
+	// ObjectStorage provides the endpoint and credentials for deletion of uploaded objects.
+	ObjectStorage *ObjectStorageConfig
+
+	// KeepRemoteFiles keeps the output directory on the build host.
+	KeepRemoteFiles bool
+
+	// KeepCloudImages keeps images registered in cloud providers.
+	KeepCloudImages bool
+
+	// KeepRegistryPushes keeps images pushed to container registries.
+	KeepRegistryPushes bool
+
+	// KeepObjects keeps files uploaded to object storage.
+	KeepObjects bool
+}
+
+// awsEndpoint overrides the EC2 endpoint, it is only used in tests.
+var awsEndpoint string
+
+// awsTransport overrides the HTTP transport of EC2 and S3 clients, it is only used in tests.
+var awsTransport http.RoundTripper
+
+// DestroyResult removes resources created by a build: the remote output directory, images
+// registered in cloud providers, images pushed to registries and uploaded objects. An
+// EventDeleted event is emitted for every removed resource. Only AWS images can be removed, a
+// warning is emitted for images of other providers which must be kept via KeepCloudImages or
+// removed manually. Removal continues on errors, removed resources are dropped from the result
+// so it is safe to call it again.
+func DestroyResult(ctx context.Context, res *Result, cfg DestroyConfig) error {
+	var errs []error
+
+	if !cfg.KeepRemoteFiles && cfg.Transport != nil && res.OutputDir != "" {
+		err := cfg.Transport.Execute(ctx, Invocation{Privileged: true, Args: []string{"rm", "-rf", "--", res.OutputDir}})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("remote files: %w", err))
+		} else {
+			deleted(ctx, "remote directory "+res.OutputDir)
+			res.Files = nil
+			res.Manifests = nil
+			res.SBOMs = nil
+			res.Provenance = File{}
+			res.LogFile = ""
+			res.OutputDir = ""
+		}
+	}
+
+	if !cfg.KeepCloudImages {
+		var kept []CloudImage
+		for _, img := range res.Images {
+			if img.Provider != "aws" {
+				emit(ctx, Event{Type: EventWarning, Message: fmt.Sprintf("deletion of %s images is not supported, remove %s manually", img.Provider, img.ID)})
+				kept = append(kept, img)
+				continue
+			}
+
+			err := destroyImage(ctx, img, cfg.AWS)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s image %s: %w", img.Provider, img, err))
+				kept = append(kept, img)
+			}
+		}
+		res.Images = kept
+	}
+
+	if !cfg.KeepRegistryPushes {
+		var kept []ContainerImage
+		for _, img := range res.Pushes {
+			err := destroyPush(ctx, img, cfg.Registry)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("container image %s: %w", img, err))
+				kept = append(kept, img)
+			}
+		}
+		res.Pushes = kept
+	}
+
+	if !cfg.KeepObjects {
+		var kept []StorageObject
+		for _, obj := range res.Objects {
+			err := destroyObject(ctx, obj, cfg.ObjectStorage)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("object %s: %w", obj.URL, err))
+				kept = append(kept, obj)
+			}
+		}
+		res.Objects = kept
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrDestroy, errors.Join(errs...))
+	}
+
+	return nil
+}
+
+func deleted(ctx context.Context, what string) {
+	log.Printf("[DEBUG] Deleted %s", what)
+	emit(ctx, Event{Type: EventDeleted, Message: what})
+}
+
+// destroyImage deregisters an AMI and deletes its snapshot with freshly resolved credentials,
+// they are registered with Secrets.
+func destroyImage(ctx context.Context, img CloudImage, cfg *AWSUploadConfig) error {
+	if cfg == nil {
+		return errors.New("no aws configuration")
+	}
+
+	creds := *cfg
+	creds.Region = img.Region
+	err := creds.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+	Secrets.Add(creds.AWSSecretAccessKey, creds.AWSSessionToken)
+
+	svc := ec2.New(ec2.Options{
+		Credentials: credentials.NewStaticCredentialsProvider(creds.AWSAccessKeyID, creds.AWSSecretAccessKey, creds.AWSSessionToken),
+		Region:      creds.Region,
+	}, func(o *ec2.Options) {
+		if awsEndpoint != "" {
+			o.BaseEndpoint = aws.String(awsEndpoint)
+		}
+		if awsTransport != nil {
+			o.HTTPClient = &http.Client{Transport: awsTransport}
+		}
+	})
+
+	_, err = svc.DeregisterImage(ctx, &ec2.DeregisterImageInput{ImageId: aws.String(img.ID)})
+	if err != nil {
+		return err
+	}
+	deleted(ctx, "aws image "+img.String())
+
+	if img.SnapshotID != "" {
+		_, err = svc.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{SnapshotId: aws.String(img.SnapshotID)})
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", img.SnapshotID, err)
+		}
+		deleted(ctx, "aws snapshot "+img.Region+":"+img.SnapshotID)
+	}
+
+	return nil
+}
+
+// destroyPush deletes the manifest of a pushed image from the registry.
+func destroyPush(ctx context.Context, img ContainerImage, cfg *RegistryPushConfig) error {
+	if cfg == nil {
+		cfg = &RegistryPushConfig{Reference: img.Reference}
+	}
+
+	err := cfg.deleteManifest(ctx, img)
+	if err != nil {
+		return err
+	}
+
+	deleted(ctx, "container image "+img.String())
+	return nil
+}
+
+// destroyObject deletes an uploaded object.
+func destroyObject(ctx context.Context, obj StorageObject, cfg *ObjectStorageConfig) error {
+	if cfg == nil {
+		return errors.New("no object storage configuration")
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	svc := s3.New(s3.Options{
+		Credentials:  credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		Region:       region,
+		UsePathStyle: cfg.PathStyle,
+	}, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		if awsTransport != nil {
+			o.HTTPClient = &http.Client{Transport: awsTransport}
+		}
+	})
+
+	_, err := svc.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(obj.Bucket),
+		Key:    aws.String(obj.Key),
+	})
+	if err != nil {
+		return err
+	}
+
+	deleted(ctx, "object "+obj.URL)
+	return nil
+}
@@ -0,0 +1,238 @@
+package ibk_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+// requestLog records requests of test HTTP servers standing in for EC2, S3 and a registry.
+type requestLog struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (l *requestLog) add(s string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requests = append(l.requests, s)
+}
+
+func TestDestroyResult(t *testing.T) {
+	ctx := context.Background()
+	reqs := &requestLog{}
+
+	ec2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		action := r.Form.Get("Action")
+		reqs.add(fmt.Sprintf("ec2 %s %s%s", action, r.Form.Get("ImageId"), r.Form.Get("SnapshotId")))
+		fmt.Fprintf(w, `<%sResponse><requestId>1</requestId><return>true</return></%sResponse>`, action, action)
+	}))
+	defer ec2.Close()
+	*ibk.AWSEndpoint = ec2.URL
+	defer func() { *ibk.AWSEndpoint = "" }()
+
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs.add("s3 " + r.Method + " " + r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s3.Close()
+
+	var registry *httptest.Server
+	registry = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			user, pass, _ := r.BasicAuth()
+			reqs.add(fmt.Sprintf("registry token %s:%s %s", user, pass, r.URL.Query().Get("scope")))
+			fmt.Fprint(w, `{"token":"t0ken"}`)
+		case r.Header.Get("Authorization") != "Bearer t0ken":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:org/fedora:delete"`, registry.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			reqs.add("registry " + r.Method + " " + r.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer registry.Close()
+	registryHost := strings.TrimPrefix(registry.URL, "https://")
+
+	ft := &fakeTransport{}
+	res := &ibk.Result{
+		OutputDir: "./output-abc",
+		Files:     []ibk.File{{Path: "./output-abc/image.raw", Size: 1}},
+		Images: []ibk.CloudImage{
+			{Provider: "aws", Region: "us-east-1", ID: "ami-0123456789abcdef0", SnapshotID: "snap-0fedcba9876543210"},
+			{Provider: "gcp", ID: "fedora"},
+		},
+		Pushes: []ibk.ContainerImage{
+			{Reference: registryHost + "/org/fedora:latest", Digest: "sha256:0123"},
+		},
+		Objects: []ibk.StorageObject{
+			{Bucket: "images", Key: "builds/image.raw", URL: s3.URL + "/images/builds/image.raw"},
+		},
+	}
+
+	var events []string
+	ctx = ibk.WithObserver(ctx, ibk.ObserverFunc(func(e ibk.Event) {
+		events = append(events, string(e.Type)+": "+e.Message)
+	}))
+
+	err := ibk.DestroyResult(ctx, res, ibk.DestroyConfig{
+		Transport: ft,
+		AWS:       &ibk.AWSUploadConfig{AWSAccessKeyID: "AKIA", AWSSecretAccessKey: "s3cr3t"},
+		Registry: &ibk.RegistryPushConfig{
+			Reference: registryHost + "/org/fedora:latest",
+			Username:  "robot",
+			Password:  "pass",
+			Insecure:  true,
+		},
+		ObjectStorage: &ibk.ObjectStorageConfig{
+			Endpoint:        s3.URL,
+			Bucket:          "images",
+			AccessKeyID:     "minio",
+			SecretAccessKey: "minio-s3cr3t",
+			PathStyle:       true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"sudo rm -rf -- ./output-abc"}, ft.executed); diff != "" {
+		t.Errorf("unexpected executions: %s", diff)
+	}
+
+	wantRequests := []string{
+		"ec2 DeregisterImage ami-0123456789abcdef0",
+		"ec2 DeleteSnapshot snap-0fedcba9876543210",
+		"registry token robot:pass repository:org/fedora:delete",
+		"registry DELETE /v2/org/fedora/manifests/sha256:0123",
+		"s3 DELETE /images/builds/image.raw",
+	}
+	if diff := cmp.Diff(wantRequests, reqs.requests); diff != "" {
+		t.Errorf("unexpected requests: %s", diff)
+	}
+
+	wantEvents := []string{
+		"deleted: remote directory ./output-abc",
+		"deleted: aws image us-east-1:ami-0123456789abcdef0",
+		"deleted: aws snapshot us-east-1:snap-0fedcba9876543210",
+		"warning: deletion of gcp images is not supported, remove fedora manually",
+		"deleted: container image " + registryHost + "/org/fedora:latest@sha256:0123",
+		"deleted: object " + s3.URL + "/images/builds/image.raw",
+	}
+	if diff := cmp.Diff(wantEvents, events); diff != "" {
+		t.Errorf("unexpected events: %s", diff)
+	}
+
+	wantImages := []ibk.CloudImage{{Provider: "gcp", ID: "fedora"}}
+	if diff := cmp.Diff(wantImages, res.Images); diff != "" {
+		t.Errorf("unexpected remaining images: %s", diff)
+	}
+	if len(res.Files) != 0 || len(res.Pushes) != 0 || len(res.Objects) != 0 {
+		t.Errorf("unexpected remaining resources: %+v", res)
+	}
+}
+
+func TestDestroyResultKeep(t *testing.T) {
+	ctx := context.Background()
+	ft := &fakeTransport{errs: []error{errFake}}
+	res := &ibk.Result{
+		OutputDir: "./output-abc",
+		Images:    []ibk.CloudImage{{Provider: "aws", Region: "us-east-1", ID: "ami-0123456789abcdef0"}},
+		Pushes:    []ibk.ContainerImage{{Reference: "quay.io/org/fedora", Digest: "sha256:0123"}},
+		Objects:   []ibk.StorageObject{{Bucket: "images", Key: "image.raw"}},
+	}
+
+	err := ibk.DestroyResult(ctx, res, ibk.DestroyConfig{
+		Transport:          ft,
+		KeepCloudImages:    true,
+		KeepRegistryPushes: true,
+		KeepObjects:        true,
+	})
+	if !errors.Is(err, ibk.ErrDestroy) || !errors.Is(err, errFake) {
+		t.Fatalf("expected destroy error, got: %v", err)
+	}
+
+	if res.OutputDir != "./output-abc" || len(res.Images) != 1 || len(res.Pushes) != 1 || len(res.Objects) != 1 {
+		t.Errorf("unexpected removed resources: %+v", res)
+	}
+}
+
+func TestDestroyResultResolvesAWSCredentials(t *testing.T) {
+	for _, name := range []string{"AWS_SESSION_TOKEN", "AWS_PROFILE", "AWS_DEFAULT_PROFILE"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "ROTATEDKEY")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "rotated-secret")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	reqs := &requestLog{}
+	ec2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		action := r.Form.Get("Action")
+		_, cred, _ := strings.Cut(r.Header.Get("Authorization"), "Credential=")
+		key, _, _ := strings.Cut(cred, "/")
+		reqs.add(fmt.Sprintf("ec2 %s %s", action, key))
+		fmt.Fprintf(w, `<%sResponse><requestId>1</requestId><return>true</return></%sResponse>`, action, action)
+	}))
+	defer ec2.Close()
+	*ibk.AWSEndpoint = ec2.URL
+	defer func() { *ibk.AWSEndpoint = "" }()
+
+	res := &ibk.Result{
+		Images: []ibk.CloudImage{{Provider: "aws", Region: "us-east-1", ID: "ami-0123456789abcdef0"}},
+	}
+	err := ibk.DestroyResult(context.Background(), res, ibk.DestroyConfig{AWS: &ibk.AWSUploadConfig{AMIName: "fedora"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"ec2 DeregisterImage ROTATEDKEY"}, reqs.requests); diff != "" {
+		t.Errorf("unexpected requests: %s", diff)
+	}
+}
+
+// roundTripFunc stands in for the HTTP transport of AWS clients.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestDestroyResultDefaultS3Endpoint(t *testing.T) {
+	reqs := &requestLog{}
+	*ibk.AWSTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		reqs.add(r.Method + " " + r.URL.Host + r.URL.Path)
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Header: http.Header{}, Request: r}, nil
+	})
+	defer func() { *ibk.AWSTransport = nil }()
+
+	res := &ibk.Result{
+		Objects: []ibk.StorageObject{{Bucket: "images", Key: "image.raw", URL: "s3://images/image.raw"}},
+	}
+	err := ibk.DestroyResult(context.Background(), res, ibk.DestroyConfig{
+		ObjectStorage: &ibk.ObjectStorageConfig{Bucket: "images", AccessKeyID: "AKIA", SecretAccessKey: "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"DELETE images.s3.us-east-1.amazonaws.com/image.raw"}, reqs.requests); diff != "" {
+		t.Errorf("unexpected requests: %s", diff)
+	}
+	if len(res.Objects) != 0 {
+		t.Errorf("unexpected kept objects: %+v", res.Objects)
+	}
+}
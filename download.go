@@ -0,0 +1,507 @@
+package ibk
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrDownload is returned when downloading of output files fails.
+var ErrDownload = errors.New("error while downloading")
+
+// DownloadConfig configures DownloadResult.
+type DownloadConfig struct {
+	// Dir is the local directory the files are downloaded to, paths relative to the remote
+	// output directory are kept. It is created when it does not exist.
+	Dir string
+
+	// Decompress decompresses files compressed on the build host (see CompressionConfig)
+	// after their checksums are verified, LocalPath is the decompressed file.
+	Decompress bool
+
+	// Sparse detects holes of remote files via qemu-img map and transfers only data extents,
+	// holes are recreated locally. Files are transferred completely when qemu-img is not
+	// available on the build host.
+	Sparse bool
+
+	// BandwidthLimit caps the transfer rate in bytes per second, zero means no limit.
+	BandwidthLimit int64
+
+	// Retry configures retries of failed transfers, which continue from the transferred
+	// offset. Defaults to 3 attempts with a delay of one second doubled for each next retry.
+	Retry RetryConfig
+}
+
+// DownloadResult downloads output files, checksum manifests, SBOM documents and the provenance
+// record of the result into a local directory and sets File.LocalPath.
+//
+// Files are downloaded into a .part file next to the target, the transferred offset is kept
+// in a .part.offset file together with the size, modification time and checksums of the
+// remote file. A failed transfer is retried from the offset (see DownloadConfig.Retry) as long
+// as the remote file does not change, the next call resumes it once the attempts are used up.
+// Files are verified once complete with the known checksums
+// (see ChecksumConfig) or the SHA256 checksum computed on the build host, a file which does
+// not match is removed and ErrChecksum is returned.
+func DownloadResult(ctx context.Context, exec Executor, res *Result, cfg DownloadConfig) error {
+	if cfg.Retry.Attempts <= 0 {
+		cfg.Retry.Attempts = 3
+	}
+
+	if cfg.Retry.Delay <= 0 {
+		cfg.Retry.Delay = time.Second
+	}
+
+	for _, files := range [][]File{res.Files, res.Manifests, res.SBOMs} {
+		for i := range files {
+			local, err := downloadFile(ctx, exec, res.OutputDir, files[i], cfg)
+			if err != nil {
+				return err
+			}
+			files[i].LocalPath = local
+		}
+	}
+
+	if res.Provenance.Path != "" {
+		local, err := downloadFile(ctx, exec, res.OutputDir, res.Provenance, cfg)
+		if err != nil {
+			return err
+		}
+		res.Provenance.LocalPath = local
+	}
+
+	return nil
+}
+
+// extent is a range of a file with data.
+type extent struct {
+	Start, Length int64
+}
+
+// progressInterval is the number of bytes after which the download offset is saved.
+const progressInterval = 8 << 20
+
+func downloadFile(ctx context.Context, exec Executor, outputDir string, f File, cfg DownloadConfig) (string, error) {
+	rel := filepath.FromSlash(relPath(outputDir, f.Path))
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: %s is outside of the output directory", ErrDownload, f.Path)
+	}
+
+	local := filepath.Join(cfg.Dir, rel)
+	err := os.MkdirAll(filepath.Dir(local), 0755)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrDownload, err)
+	}
+
+	remote, err := statRemote(ctx, exec, outputDir, f)
+	if err != nil {
+		return "", err
+	}
+	f.SHA256, f.SHA512 = remote.SHA256, remote.SHA512
+
+	partName := local + ".part"
+	progress := &downloadProgress{path: partName + ".offset", remote: remote}
+	offset := progress.load(partName)
+
+	part, err := os.OpenFile(partName, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrDownload, err)
+	}
+	defer part.Close()
+
+	if offset == 0 {
+		// holes which are not transferred are zeros in the truncated file
+		err = part.Truncate(0)
+		if err == nil {
+			err = part.Truncate(f.Size)
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", ErrDownload, err)
+		}
+	} else {
+		log.Printf("[DEBUG] Resuming download of %q at offset %d", f.Path, offset)
+	}
+
+	extents := []extent{{Start: 0, Length: f.Size}}
+	if cfg.Sparse && f.Compression == "" {
+		extents = remoteExtents(ctx, exec, f)
+	}
+
+	limit := newThrottle(cfg.BandwidthLimit)
+	for _, e := range extents {
+		if e.Start+e.Length <= offset {
+			continue
+		}
+
+		delay := cfg.Retry.Delay
+		for attempt := 1; ; attempt++ {
+			start := max(e.Start, offset)
+			offset, err = fetchRange(ctx, exec, f, start, e.Start+e.Length-start, part, progress, limit)
+			if err == nil {
+				break
+			}
+			if attempt >= cfg.Retry.Attempts || ctx.Err() != nil {
+				return "", err
+			}
+
+			log.Printf("[DEBUG] Retrying download of %q at offset %d in %s: %v", f.Path, offset, delay, err)
+			select {
+			case <-ctx.Done():
+				return "", fmt.Errorf("%w: %w", ErrDownload, ctx.Err())
+			case <-time.After(delay):
+			}
+			delay *= 2
+
+			// the transferred part is only kept when the remote file is still the same
+			current, err := statRemote(ctx, exec, outputDir, f)
+			if err != nil {
+				return "", err
+			}
+			if current != remote {
+				os.Remove(partName)
+				progress.remove()
+				return "", fmt.Errorf("%w: %s: the remote file changed during the download", ErrDownload, f.Path)
+			}
+		}
+	}
+
+	err = part.Close()
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrDownload, err)
+	}
+
+	err = verifyFile(f, partName)
+	if err != nil {
+		os.Remove(partName)
+		progress.remove()
+		return "", err
+	}
+
+	if cfg.Decompress && f.Compression != "" {
+		local = strings.TrimSuffix(local, compressionExts[f.Compression])
+		err = decompressFile(f.Compression, local, partName)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s: %w", ErrCompression, f.Path, err)
+		}
+	} else {
+		err = os.Rename(partName, local)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", ErrDownload, err)
+		}
+	}
+	progress.remove()
+
+	log.Printf("[DEBUG] Downloaded %q to %q", f.Path, local)
+	emit(ctx, Event{Type: EventFileDownloaded, Phase: PhaseCollect, Path: local, Size: f.Size})
+	return local, nil
+}
+
+// fetchRange transfers a range of the remote file into the same range of the local file. The
+// whole file is streamed via cat, ranges via dd. The transferred offset is returned also on
+// errors.
+func fetchRange(ctx context.Context, exec Executor, f File, start, length int64, part *os.File, progress *downloadProgress, limit *throttle) (int64, error) {
+	args := []string{"cat", "--", f.Path}
+	if start != 0 || length != f.Size {
+		args = []string{
+			"dd", "if=" + f.Path, "bs=1M", "iflag=skip_bytes,count_bytes",
+			"skip=" + strconv.FormatInt(start, 10), "count=" + strconv.FormatInt(length, 10), "status=none",
+		}
+	}
+
+	w := &rangeWriter{file: part, offset: start, progress: progress, limit: limit}
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, Invocation{
+		Privileged: true,
+		Args:       args,
+	}, WithInputOutput(nil, w, stderr))
+	if err == nil && w.offset != start+length {
+		err = fmt.Errorf("short read, %d of %d bytes", w.offset-start, length)
+	}
+	if err != nil {
+		// keep what was transferred for the next attempt
+		progress.save(w.offset)
+		return w.offset, fmt.Errorf("%w: %s: %w: %s", ErrDownload, f.Path, err, stderr.String())
+	}
+
+	return w.offset, progress.save(w.offset)
+}
+
+// rangeWriter writes into the local file from the offset and saves the progress.
+type rangeWriter struct {
+	file     *os.File
+	offset   int64
+	saved    int64
+	progress *downloadProgress
+	limit    *throttle
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if w.offset-w.saved >= progressInterval {
+		err = w.progress.save(w.offset)
+		w.saved = w.offset
+	}
+
+	w.limit.wait(n)
+	return n, err
+}
+
+// remoteFile identifies the contents of a remote file a partial download belongs to.
+type remoteFile struct {
+	Size   int64  `json:"size"`
+	MTime  int64  `json:"mtime"`
+	SHA256 string `json:"sha256,omitempty"`
+	SHA512 string `json:"sha512,omitempty"`
+}
+
+// statRemote returns the size and modification time of the remote file with its known
+// checksums, the SHA256 checksum is computed on the build host when none is known.
+func statRemote(ctx context.Context, exec Executor, outputDir string, f File) (remoteFile, error) {
+	stdout := &SyncedBuffer{}
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, Invocation{
+		Privileged: true,
+		Idempotent: true,
+		Args:       []string{"stat", "-c", "%s %Y", "--", f.Path},
+	}, WithInputOutput(nil, stdout, stderr))
+	if err != nil {
+		return remoteFile{}, fmt.Errorf("%w: %s: %w: %s", ErrDownload, f.Path, err, stderr.String())
+	}
+
+	r := remoteFile{SHA256: f.SHA256, SHA512: f.SHA512}
+	_, err = fmt.Sscan(stdout.String(), &r.Size, &r.MTime)
+	if err != nil {
+		return remoteFile{}, fmt.Errorf("%w: %s: unexpected stat output %q: %w", ErrDownload, f.Path, stdout.String(), err)
+	}
+	if r.Size != f.Size {
+		return remoteFile{}, fmt.Errorf("%w: %s: size changed from %d to %d bytes", ErrDownload, f.Path, f.Size, r.Size)
+	}
+
+	if r.SHA256 == "" && r.SHA512 == "" {
+		rel := relPath(outputDir, f.Path)
+		sums, err := checksums(ctx, exec, "sha256sum", outputDir, []string{rel})
+		if err != nil {
+			return remoteFile{}, err
+		}
+		r.SHA256 = sums[rel]
+	}
+
+	return r, nil
+}
+
+// downloadProgress stores the transferred offset of a partial download of the remote file.
+type downloadProgress struct {
+	path   string
+	remote remoteFile
+}
+
+// partState is the contents of the offset file.
+type partState struct {
+	Offset int64 `json:"offset"`
+	remoteFile
+}
+
+// load returns the saved offset, zero when the partial download does not exist or belongs to
+// a different remote file.
+func (p *downloadProgress) load(part string) int64 {
+	if _, err := os.Stat(part); err != nil {
+		return 0
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return 0
+	}
+
+	var state partState
+	err = json.Unmarshal(data, &state)
+	if err != nil || state.Offset < 0 {
+		return 0
+	}
+
+	if state.remoteFile != p.remote {
+		log.Printf("[DEBUG] Discarding partial download %q, the remote file changed", part)
+		return 0
+	}
+
+	return state.Offset
+}
+
+func (p *downloadProgress) save(offset int64) error {
+	data, err := json.Marshal(partState{Offset: offset, remoteFile: p.remote})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(p.path, data, 0644)
+}
+
+func (p *downloadProgress) remove() {
+	os.Remove(p.path)
+}
+
+// qemuImgExtent is an entry of qemu-img map JSON output.
+type qemuImgExtent struct {
+	Start  int64 `json:"start"`
+	Length int64 `json:"length"`
+	Data   bool  `json:"data"`
+	Zero   bool  `json:"zero"`
+}
+
+// remoteExtents returns data extents of the remote file via qemu-img map. The whole file is
+// returned as a single extent when the map is not available.
+func remoteExtents(ctx context.Context, exec Executor, f File) []extent {
+	whole := []extent{{Start: 0, Length: f.Size}}
+
+	stdout := &SyncedBuffer{}
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, Invocation{
+		Privileged: true,
+		Idempotent: true,
+		Args:       []string{"qemu-img", "map", "--output=json", "-f", "raw", f.Path},
+	}, WithInputOutput(nil, stdout, stderr))
+	if err != nil {
+		emit(ctx, Event{Type: EventWarning, Phase: PhaseCollect, Message: "sparse download not available, qemu-img map failed: " + stderr.String()})
+		return whole
+	}
+
+	var entries []qemuImgExtent
+	err = json.Unmarshal([]byte(stdout.String()), &entries)
+	if err != nil {
+		emit(ctx, Event{Type: EventWarning, Phase: PhaseCollect, Message: "sparse download not available, unexpected qemu-img map output: " + err.Error()})
+		return whole
+	}
+
+	var extents []extent
+	var data int64
+	for _, e := range entries {
+		if !e.Data || e.Zero || e.Length == 0 {
+			continue
+		}
+
+		// merge adjacent extents
+		if n := len(extents); n > 0 && extents[n-1].Start+extents[n-1].Length == e.Start {
+			extents[n-1].Length += e.Length
+		} else {
+			extents = append(extents, extent{Start: e.Start, Length: e.Length})
+		}
+		data += e.Length
+	}
+
+	log.Printf("[DEBUG] Found %d data extents (%d of %d bytes) in %q", len(extents), data, f.Size, f.Path)
+	return extents
+}
+
+// throttle limits the write rate, a nil throttle does not limit.
+type throttle struct {
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func newThrottle(rate int64) *throttle {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+// wait sleeps until the rate of written bytes is within the limit.
+func (t *throttle) wait(n int) {
+	if t == nil {
+		return
+	}
+
+	t.written += int64(n)
+	expected := time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second))
+	if d := expected - time.Since(t.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// verifyFile computes checksums of the downloaded file and compares them with the known ones.
+func verifyFile(f File, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDownload, err)
+	}
+	defer file.Close()
+
+	sum256 := sha256.New()
+	sum512 := sha512.New()
+	_, err = io.Copy(io.MultiWriter(sum256, sum512), file)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDownload, err)
+	}
+
+	err = verify(f.Path, f.SHA256, sum256)
+	if err == nil {
+		err = verify(f.Path, f.SHA512, sum512)
+	}
+	return err
+}
+
+// verify compares the expected checksum with the computed one, empty checksums are ignored.
+func verify(path, expected string, h hash.Hash) error {
+	if expected == "" {
+		return nil
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("%w: %s: checksum mismatch: expected %s, got %s", ErrChecksum, path, expected, actual)
+	}
+
+	log.Printf("[DEBUG] Verified checksum of %q", path)
+	return nil
+}
+
+// decompressFile decompresses the source file into the target file and removes the source.
+func decompressFile(format, target, source string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.Create(target + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = decompress(format, tmp, src)
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), target)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Decompressed %q into %q", source, target)
+	return os.Remove(source)
+}
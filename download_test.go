@@ -0,0 +1,382 @@
+package ibk_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+	"github.com/osbuild/packer-plugin-image-builder/internal/sshtest"
+)
+
+func sessionClient(t *testing.T, session []sshtest.RequestReply) ibk.Transport {
+	t.Helper()
+
+	server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+	server.Handler = sshtest.RequestReplyHandler(t, session)
+	t.Cleanup(server.Close)
+
+	client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+		Host:        server.Endpoint,
+		Username:    "test",
+		PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close(context.Background()) })
+
+	return client
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// statReply is the reply of stat of a remote file in the output directory.
+func statReply(path string, size int, mtime int64) sshtest.RequestReply {
+	return sshtest.RequestReply{
+		Request: regexp.QuoteMeta("sudo stat -c '%s %Y' -- " + path),
+		Reply:   fmt.Sprintf("%d %d\n", size, mtime),
+	}
+}
+
+// writePart writes the partial download and its offset file of the remote file.
+func writePart(t *testing.T, part, contents string, offset, size, mtime int64, sha string) {
+	t.Helper()
+
+	err := os.WriteFile(part, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := fmt.Sprintf(`{"offset":%d,"size":%d,"mtime":%d,"sha256":%q}`, offset, size, mtime, sha)
+	err = os.WriteFile(part+".offset", []byte(state), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadResultSparse(t *testing.T) {
+	ctx := context.Background()
+
+	// 3 MiB disk with data at the beginning and in the middle
+	image := "head" + strings.Repeat("\x00", 2<<20-4) + "data" + strings.Repeat("\x00", 1<<20-4)
+
+	session := []sshtest.RequestReply{
+		statReply("./output/disk.raw", len(image), 1700000000),
+		{
+			Request: regexp.QuoteMeta("sudo qemu-img map --output=json -f raw ./output/disk.raw"),
+			Reply: `[{"start": 0, "length": 4096, "depth": 0, "present": true, "zero": false, "data": true, "offset": 0},
+{"start": 4096, "length": 2093056, "depth": 0, "present": false, "zero": true, "data": false},
+{"start": 2097152, "length": 4096, "depth": 0, "present": true, "zero": false, "data": true, "offset": 2097152},
+{"start": 2101248, "length": 1044480, "depth": 0, "present": false, "zero": true, "data": false}]`,
+		},
+		{
+			Request: regexp.QuoteMeta("sudo dd if=./output/disk.raw bs=1M iflag=skip_bytes,count_bytes skip=0 count=4096 status=none"),
+			Reply:   image[:4096],
+		},
+		{
+			Request: regexp.QuoteMeta("sudo dd if=./output/disk.raw bs=1M iflag=skip_bytes,count_bytes skip=2097152 count=4096 status=none"),
+			Reply:   image[2097152 : 2097152+4096],
+		},
+	}
+	client := sessionClient(t, session)
+
+	dir := t.TempDir()
+	res := &ibk.Result{
+		OutputDir: "./output",
+		Files:     []ibk.File{{Path: "./output/disk.raw", Size: int64(len(image)), SHA256: sha256Hex(image)}},
+	}
+	err := ibk.DownloadResult(ctx, client, res, ibk.DownloadConfig{Dir: dir, Sparse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(dir, "disk.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != image {
+		t.Errorf("unexpected contents of %d bytes", len(contents))
+	}
+}
+
+func TestDownloadResultResume(t *testing.T) {
+	ctx := context.Background()
+	image := strings.Repeat("0123456789", 100)
+
+	// the first attempt is interrupted after 400 bytes
+	dir := t.TempDir()
+	part := filepath.Join(dir, "image.raw.part")
+	writePart(t, part, image[:400]+strings.Repeat("\x00", 600), 400, 1000, 1700000000, sha256Hex(image))
+
+	session := []sshtest.RequestReply{
+		statReply("./output/image.raw", len(image), 1700000000),
+		{
+			Request: regexp.QuoteMeta("sudo dd if=./output/image.raw bs=1M iflag=skip_bytes,count_bytes skip=400 count=600 status=none"),
+			Reply:   image[400:],
+		},
+	}
+	client := sessionClient(t, session)
+
+	res := &ibk.Result{
+		OutputDir: "./output",
+		Files:     []ibk.File{{Path: "./output/image.raw", Size: int64(len(image)), SHA256: sha256Hex(image)}},
+	}
+	err := ibk.DownloadResult(ctx, client, res, ibk.DownloadConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(res.Files[0].LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != image {
+		t.Errorf("unexpected contents: %q", contents)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("unexpected files left: %v", entries)
+	}
+}
+
+func TestDownloadResultResumeChanged(t *testing.T) {
+	ctx := context.Background()
+	old := strings.Repeat("0123456789", 100)
+	image := strings.Repeat("9876543210", 100)
+
+	tests := []struct {
+		name  string
+		mtime int64
+		sha   string
+	}{
+		{"mtime", 1700000000, sha256Hex(old)},
+		{"checksum", 1800000000, sha256Hex(old)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the interrupted download of the previous build of the same size
+			dir := t.TempDir()
+			part := filepath.Join(dir, "image.raw.part")
+			writePart(t, part, old[:400]+strings.Repeat("\x00", 600), 400, 1000, tt.mtime, tt.sha)
+
+			session := []sshtest.RequestReply{
+				statReply("./output/image.raw", len(image), 1800000000),
+				{
+					Request: regexp.QuoteMeta("cd ./output && sudo sha256sum -- image.raw"),
+					Reply:   sha256Hex(image) + "  image.raw\n",
+				},
+				{
+					Request: regexp.QuoteMeta("sudo cat -- ./output/image.raw"),
+					Reply:   image,
+				},
+			}
+			client := sessionClient(t, session)
+
+			res := &ibk.Result{
+				OutputDir: "./output",
+				Files:     []ibk.File{{Path: "./output/image.raw", Size: int64(len(image))}},
+			}
+			err := ibk.DownloadResult(ctx, client, res, ibk.DownloadConfig{Dir: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			contents, err := os.ReadFile(res.Files[0].LocalPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(contents) != image {
+				t.Errorf("unexpected contents: %q", contents)
+			}
+		})
+	}
+}
+
+func TestDownloadResultVerify(t *testing.T) {
+	ctx := context.Background()
+	image := strings.Repeat("x", 1000)
+
+	// the file is replaced on the build host during the transfer
+	session := []sshtest.RequestReply{
+		statReply("./output/image.raw", len(image), 1700000000),
+		{
+			Request: regexp.QuoteMeta("cd ./output && sudo sha256sum -- image.raw"),
+			Reply:   sha256Hex(image) + "  image.raw\n",
+		},
+		{
+			Request: regexp.QuoteMeta("sudo cat -- ./output/image.raw"),
+			Reply:   strings.Repeat("y", 1000),
+		},
+	}
+	client := sessionClient(t, session)
+
+	dir := t.TempDir()
+	res := &ibk.Result{
+		OutputDir: "./output",
+		Files:     []ibk.File{{Path: "./output/image.raw", Size: int64(len(image))}},
+	}
+	err := ibk.DownloadResult(ctx, client, res, ibk.DownloadConfig{Dir: dir})
+	if !errors.Is(err, ibk.ErrChecksum) {
+		t.Fatalf("expected checksum error, got: %v", err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("unexpected files left: %v", entries)
+	}
+}
+
+func TestDownloadResultInterrupted(t *testing.T) {
+	ctx := context.Background()
+	image := strings.Repeat("x", 1000)
+
+	session := []sshtest.RequestReply{
+		statReply("./output/image.raw", len(image), 1700000000),
+		{
+			Request: regexp.QuoteMeta("cd ./output && sudo sha256sum -- image.raw"),
+			Reply:   sha256Hex(image) + "  image.raw\n",
+		},
+		{
+			Request: regexp.QuoteMeta("sudo cat -- ./output/image.raw"),
+			Reply:   image[:300],
+			Status:  1,
+		},
+	}
+	client := sessionClient(t, session)
+
+	dir := t.TempDir()
+	res := &ibk.Result{
+		OutputDir: "./output",
+		Files:     []ibk.File{{Path: "./output/image.raw", Size: int64(len(image))}},
+	}
+	err := ibk.DownloadResult(ctx, client, res, ibk.DownloadConfig{Dir: dir, Retry: ibk.RetryConfig{Attempts: 1}})
+	if err == nil {
+		t.Fatal("expected download error")
+	}
+
+	offset, err := os.ReadFile(filepath.Join(dir, "image.raw.part.offset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf(`{"offset":300,"size":1000,"mtime":1700000000,"sha256":%q}`, sha256Hex(image))
+	if string(offset) != want {
+		t.Errorf("unexpected saved offset: %s", offset)
+	}
+}
+
+func TestDownloadResultRetry(t *testing.T) {
+	ctx := context.Background()
+	image := strings.Repeat("0123456789", 100)
+
+	// only the rest of the range interrupted after 300 bytes is transferred again
+	session := []sshtest.RequestReply{
+		statReply("./output/image.raw", len(image), 1700000000),
+		{
+			Request: regexp.QuoteMeta("sudo cat -- ./output/image.raw"),
+			Reply:   image[:300],
+			Status:  1,
+		},
+		statReply("./output/image.raw", len(image), 1700000000),
+		{
+			Request: regexp.QuoteMeta("sudo dd if=./output/image.raw bs=1M iflag=skip_bytes,count_bytes skip=300 count=700 status=none"),
+			Reply:   image[300:],
+		},
+	}
+	client := sessionClient(t, session)
+
+	dir := t.TempDir()
+	res := &ibk.Result{
+		OutputDir: "./output",
+		Files:     []ibk.File{{Path: "./output/image.raw", Size: int64(len(image)), SHA256: sha256Hex(image)}},
+	}
+	err := ibk.DownloadResult(ctx, client, res, ibk.DownloadConfig{Dir: dir, Retry: ibk.RetryConfig{Delay: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(res.Files[0].LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != image {
+		t.Errorf("unexpected contents: %q", contents)
+	}
+}
+
+func TestDownloadResultRetryChanged(t *testing.T) {
+	ctx := context.Background()
+	image := strings.Repeat("0123456789", 100)
+
+	session := []sshtest.RequestReply{
+		statReply("./output/image.raw", len(image), 1700000000),
+		{
+			Request: regexp.QuoteMeta("sudo cat -- ./output/image.raw"),
+			Reply:   image[:300],
+			Status:  1,
+		},
+		statReply("./output/image.raw", len(image), 1700000001),
+	}
+	client := sessionClient(t, session)
+
+	dir := t.TempDir()
+	res := &ibk.Result{
+		OutputDir: "./output",
+		Files:     []ibk.File{{Path: "./output/image.raw", Size: int64(len(image)), SHA256: sha256Hex(image)}},
+	}
+	err := ibk.DownloadResult(ctx, client, res, ibk.DownloadConfig{Dir: dir, Retry: ibk.RetryConfig{Delay: time.Millisecond}})
+	if !errors.Is(err, ibk.ErrDownload) || !strings.Contains(err.Error(), "changed") {
+		t.Fatalf("expected download error, got: %v", err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("unexpected files left: %v", entries)
+	}
+}
+
+func TestDownloadResultBandwidthLimit(t *testing.T) {
+	ctx := context.Background()
+	image := strings.Repeat("x", 20000)
+
+	session := []sshtest.RequestReply{
+		statReply("./output/image.raw", len(image), 1700000000),
+		{
+			Request: regexp.QuoteMeta("cd ./output && sudo sha256sum -- image.raw"),
+			Reply:   sha256Hex(image) + "  image.raw\n",
+		},
+		{
+			Request: regexp.QuoteMeta("sudo cat -- ./output/image.raw"),
+			Reply:   image,
+		},
+	}
+	client := sessionClient(t, session)
+
+	res := &ibk.Result{
+		OutputDir: "./output",
+		Files:     []ibk.File{{Path: "./output/image.raw", Size: int64(len(image))}},
+	}
+	start := time.Now()
+	err := ibk.DownloadResult(ctx, client, res, ibk.DownloadConfig{Dir: t.TempDir(), BandwidthLimit: 100000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("download was not limited, took %s", elapsed)
+	}
+}
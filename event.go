@@ -0,0 +1,228 @@
+package ibk
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// EventType is a type of an event emitted while applying a command.
+type EventType string
+
+const (
+	// EventPhaseStarted is emitted when a lifecycle phase starts.
+	EventPhaseStarted EventType = "phase_started"
+
+	// EventPhaseFinished is emitted when a lifecycle phase finishes, Duration and Error are set.
+	EventPhaseFinished EventType = "phase_finished"
+
+	// EventFilePushed is emitted when a file was pushed to the remote host, Path and Size are set.
+	EventFilePushed EventType = "file_pushed"
+
+	// EventPullProgress is emitted for every line of the container pull output.
+	EventPullProgress EventType = "pull_progress"
+
+	// EventStageProgress is emitted when osbuild starts a new stage, Message is the stage name.
+	EventStageProgress EventType = "stage_progress"
+
+	// EventOutputFile is emitted for every output file discovered, Path and Size are set.
+	EventOutputFile EventType = "output_file"
+
+	// EventFileDownloaded is emitted for every downloaded file, Path is the local path and
+	// Size is set.
+	EventFileDownloaded EventType = "file_downloaded"
+
+	// EventCloudImage is emitted for every image registered in a cloud provider, Message is
+	// the image in the region:id form.
+	EventCloudImage EventType = "cloud_image"
+
+	// EventRegistryPush is emitted for every image pushed to a container registry, Message is
+	// the image in the reference@digest form.
+	EventRegistryPush EventType = "registry_push"
+
+	// EventObjectUploaded is emitted for every file uploaded to object storage, Message is
+	// the object URL, Path and Size are set.
+	EventObjectUploaded EventType = "object_uploaded"
+
+	// EventDeleted is emitted for every resource removed by DestroyResult, Message describes
+	// the resource.
+	EventDeleted EventType = "deleted"
+
+	// EventHostSelected is emitted when a build host of a pool was selected, Message is the
+	// name of the host.
+	EventHostSelected EventType = "host_selected"
+
+	// EventLockWaiting is emitted when all slots of the build lock are held, Message lists the
+	// owners of the held slots.
+	EventLockWaiting EventType = "lock_waiting"
+
+	// EventLockAcquired is emitted when a slot of the build lock was acquired, Message is the
+	// slot number.
+	EventLockAcquired EventType = "lock_acquired"
+
+	// EventPreflightCheck is emitted for every preflight check of the build host, Message is
+	// the level, the name and the result of the check.
+	EventPreflightCheck EventType = "preflight_check"
+
+	// EventBootstrap is emitted for every change made while bootstrapping the build host,
+	// Message describes the change.
+	EventBootstrap EventType = "bootstrap"
+
+	// EventContainerCreated is emitted when a container was created via the podman API,
+	// Message is the container ID.
+	EventContainerCreated EventType = "container_created"
+
+	// EventWarning is emitted for non-fatal problems.
+	EventWarning EventType = "warning"
+)
+
+// Event is emitted while applying a command.
+type Event struct {
+	// Time is the time the event was emitted.
+	Time time.Time `json:"time"`
+
+	// Type is the event type.
+	Type EventType `json:"type"`
+
+	// Phase is the lifecycle phase the event belongs to.
+	Phase Phase `json:"phase,omitempty"`
+
+	// Message is a human readable message.
+	Message string `json:"message,omitempty"`
+
+	// Path is a remote file path.
+	Path string `json:"path,omitempty"`
+
+	// Size is a file size in bytes.
+	Size int64 `json:"size,omitempty"`
+
+	// Duration is the phase duration.
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Error is the phase error message.
+	Error string `json:"error,omitempty"`
+}
+
+// Observer receives events. It can be called concurrently.
+type Observer interface {
+	Observe(Event)
+}
+
+// ObserverFunc is an adapter to allow the use of ordinary functions as observers.
+type ObserverFunc func(Event)
+
+// Observe calls f(e).
+func (f ObserverFunc) Observe(e Event) {
+	f(e)
+}
+
+var noopObserver = ObserverFunc(func(Event) {})
+
+type observerKey struct{}
+
+// WithObserver returns a context with the observer which receives events emitted by commands
+// and transports using the context.
+func WithObserver(ctx context.Context, obs Observer) context.Context {
+	return context.WithValue(ctx, observerKey{}, obs)
+}
+
+func observerFrom(ctx context.Context) Observer {
+	if obs, ok := ctx.Value(observerKey{}).(Observer); ok && obs != nil {
+		return obs
+	}
+
+	return noopObserver
+}
+
+// emit sends the event to the observer from the context, the time is set when empty.
+func emit(ctx context.Context, e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	observerFrom(ctx).Observe(e)
+}
+
+// printObserver returns an observer which prints messages of started phases.
+func printObserver(log PrintFunc) Observer {
+	return ObserverFunc(func(e Event) {
+		if e.Type == EventPhaseStarted {
+			log(e.Message)
+		}
+	})
+}
+
+// observedPusher emits an event for every pushed file.
+type observedPusher struct {
+	Pusher
+}
+
+func (p observedPusher) Push(ctx context.Context, contents, extension string) (string, error) {
+	path, err := p.Pusher.Push(ctx, contents, extension)
+	if err == nil {
+		emit(ctx, Event{Type: EventFilePushed, Phase: PhasePush, Path: path, Size: int64(len(contents))})
+	}
+
+	return path, err
+}
+
+// lineWriter calls the function for every line written, both newline and carriage return
+// are treated as line separators and empty lines are skipped. It is safe for concurrent use.
+type lineWriter struct {
+	mu   sync.Mutex
+	buf  []byte
+	line func(string)
+}
+
+var _ io.Writer = (*lineWriter)(nil)
+
+func newLineWriter(line func(string)) *lineWriter {
+	return &lineWriter{line: line}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, b := range p {
+		if b == '\n' || b == '\r' {
+			if len(w.buf) > 0 {
+				w.line(string(w.buf))
+				w.buf = w.buf[:0]
+			}
+			continue
+		}
+		w.buf = append(w.buf, b)
+	}
+
+	return len(p), nil
+}
+
+// Flush calls the function for the unterminated last line.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.line(string(w.buf))
+		w.buf = w.buf[:0]
+	}
+}
+
+var stageRegexp = regexp.MustCompile(`org\.osbuild\.\w+`)
+
+// stageLine returns a line function which emits an event every time a new osbuild stage is
+// found in the output, see WithLineTap.
+func stageLine(ctx context.Context) func(string) {
+	var last string
+
+	return func(line string) {
+		stage := stageRegexp.FindString(line)
+		if stage != "" && stage != last {
+			last = stage
+			emit(ctx, Event{Type: EventStageProgress, Phase: PhaseBuild, Message: stage})
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package ibk_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+	"github.com/osbuild/packer-plugin-image-builder/internal/sshtest"
+)
+
+func TestApplyCommandObserve(t *testing.T) {
+	ctx := context.Background()
+	ibk.RandSource.Seed(0)
+
+	session := []sshtest.RequestReply{
+		{
+			Request: "which podman",
+			Reply:   "/usr/bin/podman\n",
+		},
+		{
+			Request: "mkdir ./output-hehwuXP6NyGIr",
+		},
+		{
+			Request: "echo sudo /usr/bin/podman pull quay.io/centos-bootc/centos-bootc:stream9",
+			Reply:   "Copying blob 1\nCopying blob 2\n",
+		},
+		{
+			Request: "scp -t /tmp",
+		},
+		{
+			Request: "echo sudo /usr/bin/podman run",
+			Reply:   "org.osbuild.rpm: installing\norg.osbuild.rpm: done\r\norg.osbuild.selinux\n",
+		},
+		{
+			Request: "find ./output-hehwuXP6NyGIr -type f",
+			Reply:   "5 ./output-hehwuXP6NyGIr/disk.raw\n",
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		},
+		{
+			Request: "rm -f /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		},
+	}
+
+	server := sshtest.NewServerT(t, sshtest.TestSigner(t))
+	server.Handler = sshtest.RequestReplyHandler(t, session)
+	defer server.Close()
+
+	buf := &ibk.SyncedBuffer{}
+	client, err := ibk.NewSSHTransport(ibk.SSHTransportConfig{
+		Host:        server.Endpoint,
+		Username:    "test",
+		PrivateKeys: []*bytes.Buffer{bytes.NewBufferString(sshtest.PrivateKey)},
+		Stdout:      buf,
+		Stderr:      buf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close(ctx)
+
+	cmd := &ibk.ContainerBootCommand{
+		Repository: "quay.io/centos-bootc/centos-bootc:stream9",
+		Type:       "raw",
+		Blueprint:  "blueprint",
+		Common: ibk.CommonArgs{
+			DryRun: true,
+		},
+	}
+
+	var mu sync.Mutex
+	var got []string
+	obs := ibk.ObserverFunc(func(e ibk.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if e.Time.IsZero() {
+			t.Errorf("event without time: %+v", e)
+		}
+
+		switch e.Type {
+		case ibk.EventPhaseStarted, ibk.EventPhaseFinished:
+			got = append(got, string(e.Type)+" "+string(e.Phase))
+		case ibk.EventFilePushed, ibk.EventOutputFile:
+			got = append(got, string(e.Type)+" "+e.Path)
+		default:
+			got = append(got, string(e.Type)+" "+e.Message)
+		}
+	})
+
+	_, err = ibk.ApplyCommandObserve(ctx, cmd, client, obs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"phase_started configure",
+		"pull_progress Copying blob 1",
+		"pull_progress Copying blob 2",
+		"phase_finished configure",
+		"phase_started push",
+		"file_pushed /tmp/ibpacker-o2rHJLEEkT68y.toml",
+		"phase_finished push",
+		"phase_started build",
+		"stage_progress org.osbuild.rpm",
+		"stage_progress org.osbuild.selinux",
+		"phase_finished build",
+		"phase_started collect",
+		"output_file ./output-hehwuXP6NyGIr/disk.raw",
+		"phase_finished collect",
+		"phase_started cleanup",
+		"phase_finished cleanup",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected events: %s", diff)
+	}
+}
+
+// failingCommand fails Configure after creating a resource and records its removal.
+type failingCommand struct {
+	cleaned bool
+}
+
+func (c *failingCommand) Configure(ctx context.Context, exec ibk.Executor) error {
+	return fmt.Errorf("%w: %w", ibk.ErrConfigure, errFake)
+}
+
+func (c *failingCommand) Push(ctx context.Context, pusher ibk.Pusher) error {
+	return nil
+}
+
+func (c *failingCommand) Build() ibk.Invocation {
+	return ibk.Invocation{Args: []string{"true"}}
+}
+
+func (c *failingCommand) Collect(ctx context.Context, exec ibk.Executor, res *ibk.Result) error {
+	return nil
+}
+
+func (c *failingCommand) Cleanup(ctx context.Context, exec ibk.Executor) error {
+	c.cleaned = true
+	return nil
+}
+
+func TestApplyCommandConfigureFailureCleanup(t *testing.T) {
+	cmd := &failingCommand{}
+	_, err := ibk.ApplyCommand(context.Background(), cmd, &fakeTransport{})
+	if !errors.Is(err, ibk.ErrConfigure) {
+		t.Fatalf("expected configure error, got: %v", err)
+	}
+
+	if !cmd.cleaned {
+		t.Error("resources created before the configure error were not removed")
+	}
+}
+
+func TestWithLineTap(t *testing.T) {
+	var lines []string
+	tap := ibk.NewLineTap(func(line string) {
+		lines = append(lines, line)
+	})
+	o := ibk.ExecuteOptions{}
+	ibk.WithLineTap(tap)(&o)
+
+	// partial lines of both streams are interleaved, the last line is not terminated
+	o.Stdout.Write([]byte("Starting org.osbuild."))
+	o.Stderr.Write([]byte("warning: "))
+	o.Stdout.Write([]byte("rpm\n"))
+	o.Stderr.Write([]byte("slow mirror\n"))
+	o.Stderr.Write([]byte("Killed"))
+
+	expected := []string{"Starting org.osbuild.rpm", "warning: slow mirror"}
+	if diff := cmp.Diff(expected, lines); diff != "" {
+		t.Errorf("unexpected lines (-want +got):\n%s", diff)
+	}
+
+	tap.Flush()
+	tap.Flush()
+	expected = append(expected, "Killed")
+	if diff := cmp.Diff(expected, lines); diff != "" {
+		t.Errorf("unexpected lines after flush (-want +got):\n%s", diff)
+	}
+}
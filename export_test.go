@@ -2,3 +2,12 @@ package ibk
 
 // Export internal types and functions for testing
 var RandSource = randSource
+var AWSEndpoint = &awsEndpoint
+var AWSTransport = &awsTransport
+
+func RegistryHosts(reference string) (login, api, name string) {
+	c := &RegistryPushConfig{Reference: reference}
+	login = c.registry()
+	api, name = c.repository()
+	return login, api, name
+}
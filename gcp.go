@@ -0,0 +1,83 @@
+package ibk
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// GCPUploadConfig configures uploading of the image to Google Cloud Storage and creating
+// a Compute Engine image from it. It is supported by ContainerCliCommand.
+type GCPUploadConfig struct {
+	// Credentials is the content of a service account JSON key file. It is mounted into
+	// the container via CredentialStore and referenced by the GOOGLE_APPLICATION_CREDENTIALS
+	// environment variable.
+	Credentials string
+
+	// Bucket is the name of a Cloud Storage bucket to upload the image to.
+	Bucket string
+
+	// Region is the storage location of the image. Optional.
+	Region string
+
+	// ImageName is the name of the image to create.
+	ImageName string
+}
+
+// gcpCredentialsPath is the path of the credentials file in the container.
+const gcpCredentialsPath = "/run/secrets/gcp-credentials.json"
+
+var gcpImageRegexp = regexp.MustCompile(`projects/[a-z][-a-z0-9]*/global/images/[a-z][-a-z0-9]*`)
+
+// Validate checks that the required fields are set and the image type can be uploaded
+// to Google Cloud.
+func (c *GCPUploadConfig) Validate(imageType string) error {
+	if !strings.HasPrefix(imageType, "gce") {
+		return errors.New("gcp upload requires a gce image type")
+	}
+
+	if c.Credentials == "" || c.Bucket == "" || c.ImageName == "" {
+		return errors.New("gcp credentials, bucket and image name are required")
+	}
+
+	return nil
+}
+
+// credentials returns credentials passed to the build container.
+func (c *GCPUploadConfig) credentials() []Credential {
+	return []Credential{{Path: gcpCredentialsPath, Value: c.Credentials}}
+}
+
+// cliArgs returns upload arguments of image-builder-cli.
+func (c *GCPUploadConfig) cliArgs() []string {
+	args := []string{
+		"--gcp-bucket", c.Bucket,
+		"--gcp-image-name", c.ImageName,
+	}
+
+	if c.Region != "" {
+		args = append(args, "--gcp-region", c.Region)
+	}
+
+	return args
+}
+
+// gcpScanner finds the last image in the projects/PROJECT/global/images/NAME form in the
+// build output.
+type gcpScanner struct {
+	image lastMatch
+}
+
+func (s *gcpScanner) scan(line string) {
+	s.image.scan(gcpImageRegexp, line)
+}
+
+// cloudImage returns the image with the name as the ID, like other Google Cloud builders do.
+func (s *gcpScanner) cloudImage(region string) CloudImage {
+	id := s.image.String()
+	if i := strings.LastIndex(id, "/"); i >= 0 {
+		id = id[i+1:]
+	}
+
+	return CloudImage{Provider: "gcp", Region: region, ID: id}
+}
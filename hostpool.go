@@ -0,0 +1,151 @@
+package ibk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// ErrNoBuildHost is returned when no build host of a pool can be used.
+var ErrNoBuildHost = errors.New("no usable build host")
+
+// BuildHostCandidate is a build host of a pool.
+type BuildHostCandidate struct {
+	// Name identifies the host in messages, e.g. user@hostname.
+	Name string
+
+	// Arch is the declared architecture of the host, optional. Hosts with a different
+	// declared architecture are skipped without connecting.
+	Arch string
+
+	// Labels are arbitrary labels of the host matched against HostRequirements.Labels.
+	Labels []string
+
+	// Connect opens a connection to the host.
+	Connect func() (Transport, error)
+}
+
+// HostRequirements are requirements a build host of a pool must meet.
+type HostRequirements struct {
+	// Arch is the required architecture as reported by arch(1), optional.
+	Arch string
+
+	// Labels must all be present on the host, optional.
+	Labels []string
+
+	// Preflight runs preflight checks on every connected host instead of the probes, a host
+	// failing a check is skipped. Arch is checked when the preflight Arch is empty.
+	Preflight *PreflightConfig
+}
+
+// SelectedHost is the build host selected from a pool.
+type SelectedHost struct {
+	// Index is the index of the host in the pool.
+	Index int
+
+	// Name is the name of the host.
+	Name string
+
+	// Arch is the detected architecture of the host, empty when it was not probed.
+	Arch string
+
+	// Transport is the open connection to the host, the caller closes it.
+	Transport Transport
+}
+
+// SelectBuildHost returns the first host of the pool which meets the requirements. Hosts
+// with a non-matching declared architecture or missing labels are skipped. When the pool has
+// more than one host, the container runtime and the architecture of every connected host are
+// probed and the next host is tried when a probe fails, the same probes are done again by
+// Command.Configure. A single host is only connected to unless preflight checks are
+// configured. Skipped hosts are reported as warnings.
+func SelectBuildHost(ctx context.Context, hosts []BuildHostCandidate, req HostRequirements) (*SelectedHost, error) {
+	var reasons []string
+	skip := func(h BuildHostCandidate, reason string) {
+		msg := fmt.Sprintf("skipping build host %s: %s", h.Name, reason)
+		log.Printf("[DEBUG] %s", msg)
+		emit(ctx, Event{Type: EventWarning, Message: msg})
+		reasons = append(reasons, h.Name+": "+reason)
+	}
+
+	for i, h := range hosts {
+		if req.Arch != "" && h.Arch != "" && req.Arch != h.Arch {
+			skip(h, "architecture "+h.Arch)
+			continue
+		}
+
+		if missing := missingLabels(h.Labels, req.Labels); len(missing) > 0 {
+			skip(h, "missing labels "+strings.Join(missing, ", "))
+			continue
+		}
+
+		t, err := h.Connect()
+		if err != nil {
+			skip(h, err.Error())
+			continue
+		}
+
+		sel := &SelectedHost{Index: i, Name: h.Name, Transport: t}
+		switch {
+		case req.Preflight != nil:
+			cfg := *req.Preflight
+			if cfg.Arch == "" {
+				cfg.Arch = req.Arch
+			}
+
+			var report *PreflightReport
+			report, err = Preflight(ctx, t, cfg)
+			sel.Arch = report.Arch
+		case len(hosts) > 1:
+			sel.Arch, err = probeBuildHost(ctx, t, req.Arch)
+		}
+		if err != nil {
+			t.Close(ctx)
+			skip(h, err.Error())
+			continue
+		}
+
+		emit(ctx, Event{Type: EventHostSelected, Message: h.Name})
+		return sel, nil
+	}
+
+	if len(reasons) == 0 {
+		return nil, fmt.Errorf("%w: empty pool", ErrNoBuildHost)
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrNoBuildHost, strings.Join(reasons, "; "))
+}
+
+// probeBuildHost checks the container runtime is available and returns the detected
+// architecture, an error is returned when it does not match the required one.
+func probeBuildHost(ctx context.Context, exec Executor, required string) (string, error) {
+	_, err := which(ctx, exec, "podman", "docker")
+	if err != nil {
+		return "", err
+	}
+
+	arch, err := detectArch(ctx, exec)
+	if err != nil {
+		return "", fmt.Errorf("arch: %w", err)
+	}
+
+	if required != "" && arch != required {
+		return arch, fmt.Errorf("architecture mismatch: %s", arch)
+	}
+
+	return arch, nil
+}
+
+// missingLabels returns the required labels not present in labels.
+func missingLabels(labels, required []string) []string {
+	var missing []string
+	for _, l := range required {
+		if !slices.Contains(labels, l) {
+			missing = append(missing, l)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,147 @@
+package ibk_test
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+	"github.com/osbuild/packer-plugin-image-builder/internal/sshtest"
+)
+
+func TestSelectBuildHost(t *testing.T) {
+	var events []ibk.Event
+	obs := ibk.ObserverFunc(func(e ibk.Event) {
+		events = append(events, ibk.Event{Type: e.Type, Message: e.Message})
+	})
+	ctx := ibk.WithObserver(context.Background(), obs)
+
+	connect := func(session []sshtest.RequestReply) func() (ibk.Transport, error) {
+		return func() (ibk.Transport, error) {
+			return sessionClient(t, session), nil
+		}
+	}
+	probe := func(arch string) []sshtest.RequestReply {
+		return []sshtest.RequestReply{
+			{Request: regexp.QuoteMeta("which podman"), Reply: "/usr/bin/podman"},
+			{Request: regexp.QuoteMeta("arch"), Reply: arch},
+		}
+	}
+
+	hosts := []ibk.BuildHostCandidate{
+		{
+			Name:    "unreachable",
+			Labels:  []string{"fast"},
+			Connect: func() (ibk.Transport, error) { return nil, errors.New("connection refused") },
+		},
+		{
+			Name: "declared-arm",
+			Arch: "aarch64",
+			Connect: func() (ibk.Transport, error) {
+				t.Fatal("host with a different declared architecture was connected")
+				return nil, nil
+			},
+		},
+		{
+			Name:    "unlabeled",
+			Connect: connect(probe("x86_64")),
+		},
+		{
+			Name:    "detected-arm",
+			Labels:  []string{"fast"},
+			Connect: connect(probe("aarch64")),
+		},
+		{
+			Name:    "x86",
+			Labels:  []string{"fast", "big"},
+			Connect: connect(probe("x86_64")),
+		},
+	}
+
+	host, err := ibk.SelectBuildHost(ctx, hosts, ibk.HostRequirements{Arch: "x86_64", Labels: []string{"fast"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Transport.Close(ctx)
+
+	if host.Index != 4 || host.Name != "x86" || host.Arch != "x86_64" {
+		t.Errorf("unexpected host: %+v", host)
+	}
+
+	want := []ibk.Event{
+		{Type: ibk.EventWarning, Message: "skipping build host unreachable: connection refused"},
+		{Type: ibk.EventWarning, Message: "skipping build host declared-arm: architecture aarch64"},
+		{Type: ibk.EventWarning, Message: "skipping build host unlabeled: missing labels fast"},
+		{Type: ibk.EventWarning, Message: "skipping build host detected-arm: architecture mismatch: aarch64"},
+		{Type: ibk.EventHostSelected, Message: "x86"},
+	}
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Errorf("unexpected events: %s", diff)
+	}
+}
+
+func TestSelectBuildHostSingle(t *testing.T) {
+	ctx := context.Background()
+
+	// a single host is not probed, Configure does the same checks
+	hosts := []ibk.BuildHostCandidate{{
+		Name: "only",
+		Connect: func() (ibk.Transport, error) {
+			return sessionClient(t, nil), nil
+		},
+	}}
+
+	host, err := ibk.SelectBuildHost(ctx, hosts, ibk.HostRequirements{Arch: "x86_64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Transport.Close(ctx)
+
+	if host.Name != "only" || host.Arch != "" {
+		t.Errorf("unexpected host: %+v", host)
+	}
+}
+
+func TestSelectBuildHostNone(t *testing.T) {
+	hosts := []ibk.BuildHostCandidate{
+		{Name: "a", Connect: func() (ibk.Transport, error) { return nil, errors.New("timeout") }},
+		{Name: "b", Connect: func() (ibk.Transport, error) { return nil, errors.New("auth failed") }},
+	}
+
+	_, err := ibk.SelectBuildHost(context.Background(), hosts, ibk.HostRequirements{})
+	if !errors.Is(err, ibk.ErrNoBuildHost) {
+		t.Fatalf("expected ErrNoBuildHost, got %v", err)
+	}
+	if want := "no usable build host: a: timeout; b: auth failed"; err.Error() != want {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestSelectBuildHostPreflight(t *testing.T) {
+	session := []sshtest.RequestReply{
+		{Request: "which podman", Status: 1},
+		{Request: "which docker", Status: 1},
+		{Request: "sudo -n true"},
+		{Request: "arch", Reply: "x86_64"},
+		{Request: "command -v"},
+		{Request: regexp.QuoteMeta("df -Pk -- ."), Reply: dfHeader + "/dev/vda1 41152736 10532124 28506952 27% /home"},
+		{Request: "test -c /dev/loop-control"},
+	}
+	hosts := []ibk.BuildHostCandidate{{
+		Name: "only",
+		Connect: func() (ibk.Transport, error) {
+			return sessionClient(t, session), nil
+		},
+	}}
+
+	// a single host is checked when preflight checks are configured
+	_, err := ibk.SelectBuildHost(context.Background(), hosts, ibk.HostRequirements{Preflight: &ibk.PreflightConfig{}})
+	if !errors.Is(err, ibk.ErrNoBuildHost) {
+		t.Fatalf("expected ErrNoBuildHost, got %v", err)
+	}
+	if want := "no usable build host: only: preflight checks failed: runtime: podman or docker is required"; err.Error() != want {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
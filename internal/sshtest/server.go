@@ -2,6 +2,7 @@ package sshtest
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"regexp"
 	"sync"
@@ -134,7 +135,12 @@ type RequestReply struct {
 	// Status is the ssh exit status code.
 	Status uint32 `yaml:"status,omitempty"`
 
+	// Stdin is an optional regular expression that matches the standard input of the
+	// request. When set, the whole input is read before the reply is sent.
+	Stdin string `yaml:"stdin,omitempty"`
+
 	rr *regexp.Regexp
+	ri *regexp.Regexp
 }
 
 // RequestReplyHandler returns a handler that replies to requests. It fails if
@@ -144,6 +150,9 @@ func RequestReplyHandler(t TestLogger, replies []RequestReply) func(ssh.Channel,
 
 	for i, r := range replies {
 		replies[i].rr = regexp.MustCompile(r.Request)
+		if r.Stdin != "" {
+			replies[i].ri = regexp.MustCompile(r.Stdin)
+		}
 	}
 
 	return func(ch ssh.Channel, in <-chan *ssh.Request) {
@@ -171,6 +180,18 @@ func RequestReplyHandler(t TestLogger, replies []RequestReply) func(ssh.Channel,
 			}
 
 			req.Reply(true, nil)
+
+			if replies[i].ri != nil {
+				stdin, err := io.ReadAll(ch)
+				if err != nil {
+					t.Fatalf("unable to read stdin: %s, payload: %s, error: %v", req.Type, payload.Value, err)
+				}
+
+				if !replies[i].ri.Match(stdin) {
+					t.Fatalf("unexpected ssh stdin: %s, payload: %s, stdin: %s", req.Type, payload.Value, stdin)
+				}
+			}
+
 			sendStatus(ch, replies[i].Status)
 
 			if replies[i].Reply != "" {
@@ -0,0 +1,250 @@
+package ibk
+
+import "al.essio.dev/pkg/shellescape"
+
+// Invocation is a structured representation of a command executed on the remote host.
+// Transports can execute simple invocations directly without a shell, String renders
+// the invocation into a shell command or a script.
+type Invocation struct {
+	// Args is the argument vector, the first element is the program to execute. When
+	// Container is set, these are the arguments passed to the container image instead.
+	Args []string
+
+	// Env is a list of environment variables in the KEY=VALUE form.
+	Env []string
+
+	// Dir is the working directory. When unset, the login directory is used.
+	Dir string
+
+	// Privileged executes the program via sudo.
+	Privileged bool
+
+	// DryRun prints the command instead of executing it.
+	DryRun bool
+
+	// Idempotent marks invocations which can be safely retried, e.g. queries or pulls.
+	Idempotent bool
+
+	// Container is set when the invocation runs a container.
+	Container *Container
+
+	// LogFile is the path of a file where the combined output is copied to. Optional.
+	LogFile string
+
+	// Cleanup is a list of files which are deleted after the invocation exits.
+	Cleanup []string
+
+	// Then is a list of invocations executed after the invocation succeeds.
+	Then []Invocation
+
+	// Shell is a raw shell command used instead of all other fields. The caller is
+	// responsible for escaping it properly.
+	Shell string
+}
+
+// Container describes a container run via podman or docker.
+type Container struct {
+	// Runtime is the container runtime executable (e.g. /usr/bin/podman).
+	Runtime string
+
+	// Image is the container image to run.
+	Image string
+
+	// Privileged passes the --privileged flag.
+	Privileged bool
+
+	// Remove passes the --rm flag.
+	Remove bool
+
+	// Pull is the pull policy passed via --pull flag. Optional.
+	Pull string
+
+	// Interactive passes the --interactive flag.
+	Interactive bool
+
+	// TTY passes the --tty flag.
+	TTY bool
+
+	// SecurityOpts is a list of --security-opt values.
+	SecurityOpts []string
+
+	// Mounts is a list of bind mounts.
+	Mounts []Mount
+
+	// Secrets is a list of podman secrets exposed as environment variables or files.
+	Secrets []ContainerSecret
+
+	// EnvFiles is a list of files with environment variables for the container.
+	EnvFiles []string
+
+	// Env is a list of environment variables in the KEY=VALUE form for the container.
+	Env []string
+
+	// Entrypoint overrides the entrypoint of the image. Optional.
+	Entrypoint string
+}
+
+// Mount is a bind mount of a host path into a container.
+type Mount struct {
+	// Source is the path on the host.
+	Source string
+
+	// Target is the path in the container.
+	Target string
+
+	// ReadOnly mounts the path read-only.
+	ReadOnly bool
+}
+
+// String returns the mount in the source:target[:ro] form.
+func (m Mount) String() string {
+	if m.ReadOnly {
+		return m.Source + ":" + m.Target + ":ro"
+	}
+
+	return m.Source + ":" + m.Target
+}
+
+// ContainerSecret is a podman secret exposed to a container as an environment variable
+// or a file.
+type ContainerSecret struct {
+	// Name is the secret name.
+	Name string
+
+	// Type is either "env" or "mount". Defaults to "env".
+	Type string
+
+	// Target is the environment variable name or the file path.
+	Target string
+}
+
+// String returns the secret in the name,type=TYPE,target=TARGET form.
+func (s ContainerSecret) String() string {
+	typ := s.Type
+	if typ == "" {
+		typ = "env"
+	}
+
+	return s.Name + ",type=" + typ + ",target=" + s.Target
+}
+
+// Args returns arguments of the container runtime including the runtime executable.
+func (c *Container) Args() []string {
+	args := []string{c.Runtime, "run"}
+
+	if c.Privileged {
+		args = append(args, "--privileged")
+	}
+	if c.Remove {
+		args = append(args, "--rm")
+	}
+	if c.Pull != "" {
+		args = append(args, "--pull="+c.Pull)
+	}
+	if c.Interactive {
+		args = append(args, "-i")
+	}
+	if c.TTY {
+		args = append(args, "-t")
+	}
+	for _, so := range c.SecurityOpts {
+		args = append(args, "--security-opt", so)
+	}
+	for _, m := range c.Mounts {
+		args = append(args, "-v", m.String())
+	}
+	for _, s := range c.Secrets {
+		args = append(args, "--secret", s.String())
+	}
+	for _, ef := range c.EnvFiles {
+		args = append(args, "--env-file", ef)
+	}
+	for _, e := range c.Env {
+		args = append(args, "-e", e)
+	}
+	if c.Entrypoint != "" {
+		args = append(args, "--entrypoint", c.Entrypoint)
+	}
+
+	return append(args, c.Image)
+}
+
+// Argv returns the full argument vector including sudo, environment and container
+// runtime arguments. The working directory and log file are not part of it.
+func (i Invocation) Argv() []string {
+	var argv []string
+
+	if i.DryRun {
+		argv = append(argv, "echo")
+	}
+
+	if i.Privileged {
+		argv = append(argv, "sudo")
+	}
+
+	if len(i.Env) > 0 {
+		argv = append(argv, "env")
+		argv = append(argv, i.Env...)
+	}
+
+	if i.Container != nil {
+		argv = append(argv, i.Container.Args()...)
+	}
+
+	return append(argv, i.Args...)
+}
+
+// Simple returns true when the invocation can be executed without a shell, e.g. it is
+// not a raw shell command and it does not need a script.
+func (i Invocation) Simple() bool {
+	return i.Shell == "" && !i.Scripted()
+}
+
+// Scripted returns true when the invocation must be executed as a script because it
+// needs a log file, cleanup or follow-up invocations.
+func (i Invocation) Scripted() bool {
+	return i.Shell == "" && (i.LogFile != "" || len(i.Cleanup) > 0 || len(i.Then) > 0)
+}
+
+// String renders the invocation as a shell command. Simple invocations are rendered
+// as a single line, others as a script (see Script).
+func (i Invocation) String() string {
+	if i.Shell != "" {
+		return i.Shell
+	}
+
+	if i.Scripted() {
+		return i.Script().String()
+	}
+
+	if i.Dir != "" {
+		return "cd " + shellescape.Quote(i.Dir) + " && " + i.command()
+	}
+
+	return i.command()
+}
+
+// Script returns a script which executes the invocation.
+func (i Invocation) Script() Script {
+	s := Script{
+		Dir:     i.Dir,
+		Command: i.command(),
+		LogFile: i.LogFile,
+		Cleanup: i.Cleanup,
+	}
+
+	for _, t := range i.Then {
+		s.Then = append(s.Then, t.String())
+	}
+
+	return s
+}
+
+func (i Invocation) command() string {
+	return shellescape.QuoteCommand(i.Argv())
+}
+
+// Cmd returns a simple invocation of the given arguments.
+func Cmd(args ...string) Invocation {
+	return Invocation{Args: args}
+}
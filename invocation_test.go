@@ -0,0 +1,170 @@
+package ibk_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+func TestInvocationString(t *testing.T) {
+	tests := []struct {
+		name string
+		inv  ibk.Invocation
+		argv []string
+		want string
+	}{
+		{
+			name: "simple",
+			inv:  ibk.Cmd("which", "podman"),
+			argv: []string{"which", "podman"},
+			want: "which podman",
+		},
+		{
+			name: "quoting",
+			inv:  ibk.Cmd("mkdir", "./output dir", "$HOME"),
+			argv: []string{"mkdir", "./output dir", "$HOME"},
+			want: "mkdir './output dir' '$HOME'",
+		},
+		{
+			name: "privileged-dry-run-env-dir",
+			inv: ibk.Invocation{
+				Args:       []string{"podman", "pull", "quay.io/fedora/fedora"},
+				Env:        []string{"REGISTRY_AUTH_FILE=/tmp/auth file.json"},
+				Dir:        "/var/tmp",
+				Privileged: true,
+				DryRun:     true,
+			},
+			argv: []string{"echo", "sudo", "env", "REGISTRY_AUTH_FILE=/tmp/auth file.json", "podman", "pull", "quay.io/fedora/fedora"},
+			want: "cd /var/tmp && echo sudo env 'REGISTRY_AUTH_FILE=/tmp/auth file.json' podman pull quay.io/fedora/fedora",
+		},
+		{
+			name: "container",
+			inv: ibk.Invocation{
+				Privileged: true,
+				Container: &ibk.Container{
+					Runtime:      "/usr/bin/podman",
+					Image:        "quay.io/centos-bootc/bootc-image-builder:latest",
+					Privileged:   true,
+					Remove:       true,
+					Pull:         "newer",
+					Interactive:  true,
+					TTY:          true,
+					SecurityOpts: []string{"label=type:unconfined_t"},
+					Mounts: []ibk.Mount{
+						{Source: "./output", Target: "/output"},
+						{Source: "/tmp/bp.toml", Target: "/config.toml", ReadOnly: true},
+					},
+					Secrets:  []ibk.ContainerSecret{{Name: "key", Target: "AWS_ACCESS_KEY_ID"}},
+					EnvFiles: []string{"/tmp/aws.env"},
+					Env:      []string{"A=b"},
+				},
+				Args: []string{"--type", "raw", "quay.io/centos-bootc/centos-bootc:stream9"},
+			},
+			argv: []string{
+				"sudo", "/usr/bin/podman", "run", "--privileged", "--rm", "--pull=newer", "-i", "-t",
+				"--security-opt", "label=type:unconfined_t",
+				"-v", "./output:/output", "-v", "/tmp/bp.toml:/config.toml:ro",
+				"--secret", "key,type=env,target=AWS_ACCESS_KEY_ID",
+				"--env-file", "/tmp/aws.env", "-e", "A=b",
+				"quay.io/centos-bootc/bootc-image-builder:latest",
+				"--type", "raw", "quay.io/centos-bootc/centos-bootc:stream9",
+			},
+			want: "sudo /usr/bin/podman run --privileged --rm --pull=newer -i -t " +
+				"--security-opt label=type:unconfined_t -v ./output:/output -v /tmp/bp.toml:/config.toml:ro " +
+				"--secret key,type=env,target=AWS_ACCESS_KEY_ID " +
+				"--env-file /tmp/aws.env -e A=b quay.io/centos-bootc/bootc-image-builder:latest " +
+				"--type raw quay.io/centos-bootc/centos-bootc:stream9",
+		},
+		{
+			name: "shell",
+			inv:  ibk.StringCommand("echo a && echo b").Build(),
+			argv: nil,
+			want: "echo a && echo b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.inv.Simple() && tt.inv.Shell == "" {
+				t.Errorf("expected simple invocation")
+			}
+
+			if diff := cmp.Diff(tt.argv, tt.inv.Argv()); tt.inv.Shell == "" && diff != "" {
+				t.Errorf("unexpected argv: %s", diff)
+			}
+
+			if diff := cmp.Diff(tt.want, tt.inv.String()); diff != "" {
+				t.Errorf("unexpected string: %s", diff)
+			}
+		})
+	}
+}
+
+func TestInvocationScript(t *testing.T) {
+	inv := ibk.Invocation{
+		Args:    []string{"build"},
+		LogFile: "./output/build.log",
+		Cleanup: []string{"/tmp/a.env"},
+		Then:    []ibk.Invocation{ibk.Cmd("find", "./output", "-type", "f")},
+	}
+
+	if inv.Simple() || !inv.Scripted() {
+		t.Fatalf("expected scripted invocation")
+	}
+
+	got := inv.String()
+	for _, want := range []string{
+		"set -euo pipefail\n",
+		"trap 'rm -f -- /tmp/a.env' EXIT\n",
+		"build 2>&1 | tee ./output/build.log || rc=$?\n",
+		"fi\nfind ./output -type f\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("script does not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestContainerCommandArgs(t *testing.T) {
+	cli := &ibk.ContainerCliCommand{
+		Distro:    "fedora",
+		Type:      "minimal-raw",
+		OutputDir: "./output with space",
+		Common:    ibk.CommonArgs{TeeLog: true},
+	}
+	inv := cli.Build()
+
+	if diff := cmp.Diff([]string{"build", "--blueprint", "", "--distro", "fedora", "minimal-raw"}, inv.Args); diff != "" {
+		t.Errorf("unexpected cli args: %s", diff)
+	}
+	if inv.LogFile != "./output with space/build.log" {
+		t.Errorf("unexpected log file: %q", inv.LogFile)
+	}
+
+	bootc := &ibk.ContainerBootCommand{
+		Repository: "quay.io/centos-bootc/centos-bootc:stream9",
+		Type:       "ami",
+		RootFS:     "xfs",
+		OutputDir:  "./output",
+		AWSUploadConfig: &ibk.AWSUploadConfig{
+			AMIName:  "my ami",
+			S3Bucket: "bucket",
+			Region:   "us-east-1",
+		},
+	}
+	inv = bootc.Build()
+
+	want := []string{
+		"--type", "ami", "--local", "--rootfs", "xfs",
+		"--aws-ami-name", "my ami", "--aws-s3-bucket", "bucket", "--aws-s3-region", "us-east-1",
+		"quay.io/centos-bootc/centos-bootc:stream9",
+	}
+	if diff := cmp.Diff(want, inv.Args); diff != "" {
+		t.Errorf("unexpected bootc args: %s", diff)
+	}
+	if diff := cmp.Diff(ibk.Mount{Source: "./output", Target: "/output"}, inv.Container.Mounts[1]); diff != "" {
+		t.Errorf("unexpected output mount: %s", diff)
+	}
+}
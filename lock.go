@@ -0,0 +1,190 @@
+package ibk
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrLock is returned when the build lock cannot be acquired.
+var ErrLock = errors.New("error while acquiring build lock")
+
+// ErrLockTimeout is returned when the build lock was not acquired within the timeout.
+var ErrLockTimeout = errors.New("timeout while waiting for build lock")
+
+// DefaultLockDir is the directory of lock files on the build host.
+const DefaultLockDir = "/var/lock/ibpacker"
+
+// LockConfig configures the exclusive build lock on the build host. Builds sharing the host
+// share the container storage and the runtime, the lock limits how many of them run at once.
+type LockConfig struct {
+	// Dir is the directory of lock files on the build host, DefaultLockDir when empty.
+	Dir string
+
+	// MaxConcurrency is the number of builds allowed to run on the host at once, one when
+	// zero.
+	MaxConcurrency int
+
+	// Timeout is how long to wait for a free slot, zero waits forever. The owners of the
+	// held slots are reported in the error.
+	Timeout time.Duration
+
+	// Owner describes the build holding the lock to others waiting for it, e.g. the build
+	// name. The local hostname, process ID and time are appended.
+	Owner string
+}
+
+// Validate checks the concurrency and the timeout.
+func (c *LockConfig) Validate() error {
+	if c.MaxConcurrency < 0 {
+		return errors.New("lock max concurrency must not be negative")
+	}
+
+	if c.Timeout < 0 {
+		return errors.New("lock timeout must not be negative")
+	}
+
+	return nil
+}
+
+// lockTimeoutStatus is the exit status of lockScript when the timeout expires.
+const lockTimeoutStatus = 75
+
+// lockScript holds one of the flock(1) slot files while its standard input is open. It
+// prints "waiting" with owners of the held slots when all slots are taken and "acquired"
+// with the slot number once a slot is locked. The lock is released when the process exits.
+const lockScript = `dir=$1 slots=$2 timeout=$3 owner=$4
+mkdir -p "$dir" || exit 1
+start=$(date +%s)
+waiting=
+while :; do
+  held=
+  i=1
+  while [ "$i" -le "$slots" ]; do
+    exec 9>>"$dir/slot-$i.lock" || exit 1
+    if flock -n 9; then
+      printf '%s\n' "$owner" > "$dir/slot-$i.owner"
+      echo "acquired $i"
+      cat > /dev/null
+      rm -f "$dir/slot-$i.owner"
+      exit 0
+    fi
+    held="$held$(cat "$dir/slot-$i.owner" 2>/dev/null); "
+    i=$((i+1))
+  done
+  if [ -z "$waiting" ]; then
+    echo "waiting ${held%; }"
+    waiting=1
+  fi
+  if [ "$timeout" -gt 0 ] && [ $(($(date +%s) - start)) -ge "$timeout" ]; then
+    echo "lock held by: ${held%; }" >&2
+    exit 75
+  fi
+  sleep 1
+done`
+
+// AcquireLock acquires a slot of the build lock on the host and returns a transport which
+// releases it on Close before closing the underlying transport. The lock is held by a
+// remote process running for the lifetime of the returned transport, it is released by the
+// host when the connection drops.
+func AcquireLock(ctx context.Context, t Transport, cfg LockConfig) (Transport, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrLock, err)
+	}
+
+	if cfg.Dir == "" {
+		cfg.Dir = DefaultLockDir
+	}
+	if cfg.MaxConcurrency == 0 {
+		cfg.MaxConcurrency = 1
+	}
+	owner := lockOwner(cfg.Owner)
+
+	timeout := int64(cfg.Timeout.Round(time.Second) / time.Second)
+	if cfg.Timeout > 0 && timeout == 0 {
+		timeout = 1
+	}
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	stderr := &SyncedBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		err := t.Execute(ctx, Invocation{
+			Privileged: true,
+			Args: []string{
+				"sh", "-c", lockScript, "sh",
+				cfg.Dir, strconv.Itoa(cfg.MaxConcurrency), strconv.FormatInt(timeout, 10), owner,
+			},
+		}, WithInputOutput(stdinR, stdoutW, stderr))
+		stdoutW.Close()
+		done <- err
+	}()
+
+	scanner := bufio.NewScanner(stdoutR)
+	for scanner.Scan() {
+		status, value, _ := strings.Cut(scanner.Text(), " ")
+		switch status {
+		case "waiting":
+			log.Printf("[DEBUG] Waiting for build lock held by %s", value)
+			emit(ctx, Event{Type: EventLockWaiting, Message: value})
+		case "acquired":
+			log.Printf("[DEBUG] Acquired build lock slot %s in %s", value, cfg.Dir)
+			emit(ctx, Event{Type: EventLockAcquired, Message: value})
+			go io.Copy(io.Discard, stdoutR)
+			return &lockedTransport{Transport: t, stdin: stdinW, done: done}, nil
+		}
+	}
+
+	stdinW.Close()
+	err := <-done
+	var ee *ExitError
+	if errors.As(err, &ee) && ee.Status == lockTimeoutStatus {
+		return nil, fmt.Errorf("%w after %s: %s", ErrLockTimeout, cfg.Timeout, strings.TrimSpace(stderr.String()))
+	}
+	if err == nil {
+		err = errors.New("lock process exited")
+	}
+
+	return nil, fmt.Errorf("%w: %w: %s", ErrLock, err, stderr.String())
+}
+
+// lockOwner appends the local hostname, the process ID and the current time to the owner.
+func lockOwner(owner string) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	s := fmt.Sprintf("%s pid %d since %s", host, os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+	if owner != "" {
+		s = owner + " on " + s
+	}
+	return s
+}
+
+// lockedTransport releases the build lock on Close.
+type lockedTransport struct {
+	Transport
+	stdin io.Closer
+	done  <-chan error
+}
+
+func (t *lockedTransport) Close(ctx context.Context) error {
+	// closing the standard input ends the remote process holding the lock
+	t.stdin.Close()
+	if err := Wait(ctx, func() error { return <-t.done }); err != nil {
+		log.Printf("[DEBUG] Build lock process failed: %v", err)
+	} else {
+		log.Printf("[DEBUG] Released build lock")
+	}
+
+	return t.Transport.Close(ctx)
+}
@@ -0,0 +1,75 @@
+package ibk_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+	"github.com/osbuild/packer-plugin-image-builder/internal/sshtest"
+)
+
+func TestAcquireLock(t *testing.T) {
+	var events []ibk.Event
+	obs := ibk.ObserverFunc(func(e ibk.Event) {
+		events = append(events, ibk.Event{Type: e.Type, Message: e.Message})
+	})
+	ctx := ibk.WithObserver(context.Background(), obs)
+
+	session := []sshtest.RequestReply{
+		{
+			Request: `(?s)^sudo sh -c 'dir=\$1 .*flock -n 9.*' sh /var/lock/ibpacker 2 30 'packer build a on .* pid \d+ since .*'$`,
+			Reply:   "waiting packer build b; packer build c\nacquired 2\n",
+		},
+	}
+	client := sessionClient(t, session)
+
+	locked, err := ibk.AcquireLock(ctx, client, ibk.LockConfig{
+		MaxConcurrency: 2,
+		Timeout:        30 * time.Second,
+		Owner:          "packer build a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = locked.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ibk.Event{
+		{Type: ibk.EventLockWaiting, Message: "packer build b; packer build c"},
+		{Type: ibk.EventLockAcquired, Message: "2"},
+	}
+	if diff := cmp.Diff(want, events); diff != "" {
+		t.Errorf("unexpected events: %s", diff)
+	}
+}
+
+func TestAcquireLockTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	session := []sshtest.RequestReply{
+		{
+			Request: `(?s)^sudo sh -c .* sh /tmp/locks 1 1 `,
+			Reply:   "waiting packer build b\n",
+			Status:  75,
+		},
+	}
+	client := sessionClient(t, session)
+
+	_, err := ibk.AcquireLock(ctx, client, ibk.LockConfig{Dir: "/tmp/locks", Timeout: 100 * time.Millisecond})
+	if !errors.Is(err, ibk.ErrLockTimeout) {
+		t.Fatalf("expected ErrLockTimeout, got %v", err)
+	}
+}
+
+func TestAcquireLockInvalid(t *testing.T) {
+	_, err := ibk.AcquireLock(context.Background(), nil, ibk.LockConfig{MaxConcurrency: -1})
+	if !errors.Is(err, ibk.ErrLock) {
+		t.Fatalf("expected ErrLock, got %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+package ibk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Middleware decorates a transport with additional behavior.
+type Middleware func(Transport) Transport
+
+// Wrap decorates the transport with middlewares. The first middleware is the outermost one,
+// for example Wrap(t, WithRetry(cfg), WithLogging(nil)) logs every retry attempt.
+func Wrap(t Transport, mws ...Middleware) Transport {
+	for i := len(mws) - 1; i >= 0; i-- {
+		t = mws[i](t)
+	}
+	return t
+}
+
+// WithLogging logs every executed invocation and pushed file at the DEBUG level. Logged
+// messages are passed through the redact function when provided.
+func WithLogging(redact func(string) string) Middleware {
+	if redact == nil {
+		redact = func(s string) string { return s }
+	}
+
+	return func(t Transport) Transport {
+		return &loggingTransport{Transport: t, redact: redact}
+	}
+}
+
+type loggingTransport struct {
+	Transport
+	redact func(string) string
+}
+
+func (t *loggingTransport) Execute(ctx context.Context, inv Invocation, opts ...ExecuteOpt) error {
+	log.Printf("[DEBUG] Executing command %q", t.redact(inv.String()))
+	err := t.Transport.Execute(ctx, inv, opts...)
+	if err != nil {
+		log.Printf("[DEBUG] Command failed: %s", t.redact(err.Error()))
+	}
+	return err
+}
+
+func (t *loggingTransport) Push(ctx context.Context, contents, extension string) (string, error) {
+	path, err := t.Transport.Push(ctx, contents, extension)
+	if err != nil {
+		log.Printf("[DEBUG] Push of %d bytes failed: %s", len(contents), t.redact(err.Error()))
+	} else {
+		log.Printf("[DEBUG] Pushed %d bytes to %q", len(contents), path)
+	}
+	return path, err
+}
+
+// RedactStrings returns a function which replaces all occurrences of the secrets with a mask.
+// Empty secrets are ignored. See SecretRegistry for a registry shared across the program.
+func RedactStrings(secrets ...string) func(string) string {
+	r := &SecretRegistry{}
+	r.Add(secrets...)
+
+	return r.Redact
+}
+
+const redactedMask = "<redacted>"
+
+// RetryConfig configures WithRetry middleware.
+type RetryConfig struct {
+	// Attempts is the maximum number of attempts including the first one. Defaults to 3.
+	Attempts int
+
+	// Delay is the delay before the first retry, it is doubled for each next retry. Defaults
+	// to one second.
+	Delay time.Duration
+}
+
+// WithRetry retries executions of idempotent invocations (see Invocation.Idempotent) failed
+// with transport errors, commands exiting with non-zero status are not retried. Output is
+// passed on live, writers which can be reset (e.g. SyncedBuffer) are cleared before a retry so
+// they only hold the output of the last attempt. Other invocations and pushes are never
+// retried.
+func WithRetry(cfg RetryConfig) Middleware {
+	if cfg.Attempts <= 0 {
+		cfg.Attempts = 3
+	}
+
+	if cfg.Delay <= 0 {
+		cfg.Delay = time.Second
+	}
+
+	return func(t Transport) Transport {
+		return &retryTransport{Transport: t, cfg: cfg}
+	}
+}
+
+type retryTransport struct {
+	Transport
+	cfg RetryConfig
+}
+
+func (t *retryTransport) Execute(ctx context.Context, inv Invocation, opts ...ExecuteOpt) error {
+	if !inv.Idempotent {
+		return t.Transport.Execute(ctx, inv, opts...)
+	}
+
+	delay := t.cfg.Delay
+	for attempt := 1; attempt < t.cfg.Attempts; attempt++ {
+		var out ExecuteOptions
+		err := t.Transport.Execute(ctx, inv, append(opts, func(o *ExecuteOptions) { out = *o })...)
+		if !retryable(ctx, err) {
+			return err
+		}
+
+		log.Printf("[DEBUG] Attempt %d of %d failed, retrying in %s: %s", attempt, t.cfg.Attempts, delay, err)
+		for _, w := range []io.Writer{out.Stdout, out.Stderr} {
+			if r, ok := w.(interface{ Reset() }); ok {
+				r.Reset()
+			}
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+
+	return t.Transport.Execute(ctx, inv, opts...)
+}
+
+// retryable returns true for transport and connection errors. Commands which ran and exited
+// with non-zero status are not retried, e.g. probes like "which podman" fail on purpose.
+func retryable(ctx context.Context, err error) bool {
+	var ee *ExitError
+	return err != nil && ctx.Err() == nil && !errors.As(err, &ee)
+}
+
+// Metrics are counters and timings collected by WithMetrics middleware. It is safe for
+// concurrent use.
+type Metrics struct {
+	mu sync.Mutex
+
+	executions  int
+	failures    int
+	executeTime time.Duration
+	pushes      int
+	pushedBytes int64
+	pushTime    time.Duration
+}
+
+// WithMetrics collects metrics of executions and pushes into the provided struct.
+func WithMetrics(m *Metrics) Middleware {
+	return func(t Transport) Transport {
+		return &metricsTransport{Transport: t, m: m}
+	}
+}
+
+type metricsTransport struct {
+	Transport
+	m *Metrics
+}
+
+func (t *metricsTransport) Execute(ctx context.Context, inv Invocation, opts ...ExecuteOpt) error {
+	start := time.Now()
+	err := t.Transport.Execute(ctx, inv, opts...)
+
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	t.m.executions++
+	t.m.executeTime += time.Since(start)
+	if err != nil {
+		t.m.failures++
+	}
+
+	return err
+}
+
+func (t *metricsTransport) Push(ctx context.Context, contents, extension string) (string, error) {
+	start := time.Now()
+	path, err := t.Transport.Push(ctx, contents, extension)
+
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	t.m.pushes++
+	t.m.pushTime += time.Since(start)
+	if err == nil {
+		t.m.pushedBytes += int64(len(contents))
+	}
+
+	return path, err
+}
+
+// Executions returns the number of executions and how many of them failed.
+func (m *Metrics) Executions() (total, failed int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.executions, m.failures
+}
+
+// ExecuteTime returns the total time spent in executions.
+func (m *Metrics) ExecuteTime() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.executeTime
+}
+
+// Pushes returns the number of pushes and the number of successfully pushed bytes.
+func (m *Metrics) Pushes() (total int, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.pushes, m.pushedBytes
+}
+
+// PushTime returns the total time spent in pushes.
+func (m *Metrics) PushTime() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.pushTime
+}
+
+// String returns a human readable summary.
+func (m *Metrics) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return fmt.Sprintf("%d commands (%d failed) in %s, %d files (%d bytes) pushed in %s",
+		m.executions, m.failures, m.executeTime.Round(time.Millisecond),
+		m.pushes, m.pushedBytes, m.pushTime.Round(time.Millisecond))
+}
+
+// Recorder keeps a transcript of all executed invocations and pushed files, it is used by
+// WithRecorder middleware. It is safe for concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+// WithRecorder records every invocation and push into the recorder. Calls are passed to the
+// decorated transport, use it together with CommonArgs.DryRun to get a transcript of
+// a dry run.
+func WithRecorder(r *Recorder) Middleware {
+	return func(t Transport) Transport {
+		return &recordingTransport{Transport: t, r: r}
+	}
+}
+
+type recordingTransport struct {
+	Transport
+	r *Recorder
+}
+
+func (t *recordingTransport) Execute(ctx context.Context, inv Invocation, opts ...ExecuteOpt) error {
+	err := t.Transport.Execute(ctx, inv, opts...)
+	t.r.record(inv.String(), err)
+	return err
+}
+
+func (t *recordingTransport) Push(ctx context.Context, contents, extension string) (string, error) {
+	path, err := t.Transport.Push(ctx, contents, extension)
+	t.r.record(fmt.Sprintf("# push %d bytes to %s", len(contents), path), err)
+	return path, err
+}
+
+func (r *Recorder) record(entry string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		entry += "\n# failed: " + err.Error()
+	}
+	r.entries = append(r.entries, entry)
+}
+
+// Entries returns recorded invocations and pushes in the order they were made.
+func (r *Recorder) Entries() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.entries...)
+}
@@ -0,0 +1,214 @@
+package ibk_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+// fakeTransport fails executions with errors from the list in order, then succeeds.
+type fakeTransport struct {
+	errs     []error
+	executed []string
+}
+
+func (t *fakeTransport) Execute(ctx context.Context, inv ibk.Invocation, opts ...ibk.ExecuteOpt) error {
+	t.executed = append(t.executed, inv.String())
+	o := ibk.ExecuteOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.Stdout != nil {
+		fmt.Fprintf(o.Stdout, "attempt %d\n", len(t.executed))
+	}
+	if len(t.errs) > 0 {
+		err := t.errs[0]
+		t.errs = t.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func (t *fakeTransport) Push(ctx context.Context, contents, extension string) (string, error) {
+	return "/tmp/file." + extension, nil
+}
+
+func (t *fakeTransport) Close(ctx context.Context) error {
+	return nil
+}
+
+var errFake = errors.New("connection reset")
+
+func TestRetryMiddleware(t *testing.T) {
+	ctx := context.Background()
+	ft := &fakeTransport{errs: []error{errFake, errFake}}
+	tr := ibk.Wrap(ft, ibk.WithRetry(ibk.RetryConfig{Attempts: 3, Delay: time.Millisecond}))
+
+	err := tr.Execute(ctx, ibk.Invocation{Args: []string{"arch"}, Idempotent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"arch", "arch", "arch"}, ft.executed); diff != "" {
+		t.Errorf("unexpected executions: %s", diff)
+	}
+
+	ft = &fakeTransport{errs: []error{errFake, errFake, errFake}}
+	tr = ibk.Wrap(ft, ibk.WithRetry(ibk.RetryConfig{Attempts: 2, Delay: time.Millisecond}))
+	err = tr.Execute(ctx, ibk.Invocation{Args: []string{"arch"}, Idempotent: true})
+	if !errors.Is(err, errFake) {
+		t.Fatalf("expected error, got: %v", err)
+	}
+	if len(ft.executed) != 2 {
+		t.Errorf("expected 2 attempts, got %d", len(ft.executed))
+	}
+
+	ft = &fakeTransport{errs: []error{errFake}}
+	tr = ibk.Wrap(ft, ibk.WithRetry(ibk.RetryConfig{Delay: time.Millisecond}))
+	err = tr.Execute(ctx, ibk.Cmd("mkdir", "output"))
+	if !errors.Is(err, errFake) {
+		t.Fatalf("expected error, got: %v", err)
+	}
+	if len(ft.executed) != 1 {
+		t.Errorf("non-idempotent invocation was retried: %v", ft.executed)
+	}
+
+	exitErr := fmt.Errorf("%w: %w", ibk.ErrCommand, &ibk.ExitError{Status: 1})
+	ft = &fakeTransport{errs: []error{exitErr}}
+	tr = ibk.Wrap(ft, ibk.WithRetry(ibk.RetryConfig{Delay: time.Millisecond}))
+	err = tr.Execute(ctx, ibk.Invocation{Args: []string{"which", "podman"}, Idempotent: true})
+	var ee *ibk.ExitError
+	if !errors.As(err, &ee) {
+		t.Fatalf("expected exit error, got: %v", err)
+	}
+	if len(ft.executed) != 1 {
+		t.Errorf("failed command was retried: %v", ft.executed)
+	}
+}
+
+func TestRetryMiddlewareOutput(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		errs []error
+		want string
+	}{
+		{"success", nil, "attempt 1\n"},
+		{"retried", []error{errFake, errFake}, "attempt 3\n"},
+		{"exhausted", []error{errFake, errFake, errFake}, "attempt 3\n"},
+		{"exit", []error{&ibk.ExitError{Status: 1}}, "attempt 1\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ft := &fakeTransport{errs: tt.errs}
+			tr := ibk.Wrap(ft, ibk.WithRetry(ibk.RetryConfig{Attempts: 3, Delay: time.Millisecond}))
+
+			buf := &ibk.SyncedBuffer{}
+			_ = tr.Execute(ctx, ibk.Invocation{Args: []string{"arch"}, Idempotent: true}, ibk.WithCombinedWriter(buf))
+			if diff := cmp.Diff(tt.want, buf.String()); diff != "" {
+				t.Errorf("unexpected output: %s", diff)
+			}
+		})
+	}
+}
+
+// streamingTransport writes a line and waits until it was seen before the execution ends.
+type streamingTransport struct {
+	fakeTransport
+	seen chan struct{}
+}
+
+func (t *streamingTransport) Execute(ctx context.Context, inv ibk.Invocation, opts ...ibk.ExecuteOpt) error {
+	o := ibk.ExecuteOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	fmt.Fprint(o.Stdout, "Copying blob 0123\n")
+
+	select {
+	case <-t.seen:
+		return nil
+	case <-time.After(time.Second):
+		// the output was not passed on during the execution, fail without retries
+		return fmt.Errorf("%w: %w", ibk.ErrCommand, &ibk.ExitError{Status: 1})
+	}
+}
+
+func TestRetryMiddlewareStreaming(t *testing.T) {
+	st := &streamingTransport{seen: make(chan struct{})}
+	tr := ibk.Wrap(st, ibk.WithRetry(ibk.RetryConfig{Attempts: 3, Delay: time.Millisecond}))
+
+	var lines []string
+	tap := ibk.NewLineTap(func(line string) {
+		lines = append(lines, line)
+		close(st.seen)
+	})
+	err := tr.Execute(context.Background(), ibk.Invocation{Args: []string{"podman", "pull"}, Idempotent: true}, ibk.WithLineTap(tap))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"Copying blob 0123"}, lines); diff != "" {
+		t.Errorf("unexpected lines: %s", diff)
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	ctx := context.Background()
+	buf := &bytes.Buffer{}
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(buf)
+
+	ft := &fakeTransport{errs: []error{errors.New("password s3cr3t rejected")}}
+	tr := ibk.Wrap(ft, ibk.WithLogging(ibk.RedactStrings("s3cr3t", "")))
+
+	_ = tr.Execute(ctx, ibk.Cmd("login", "--password", "s3cr3t"))
+	_, _ = tr.Push(ctx, "s3cr3t", "env")
+
+	if strings.Contains(buf.String(), "s3cr3t") {
+		t.Fatalf("secret was logged: %s", buf.String())
+	}
+	for _, want := range []string{"login --password <redacted>", "password <redacted> rejected", "Pushed 6 bytes"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log does not contain %q: %s", want, buf.String())
+		}
+	}
+}
+
+func TestMetricsAndRecorderMiddleware(t *testing.T) {
+	ctx := context.Background()
+	m := &ibk.Metrics{}
+	r := &ibk.Recorder{}
+	ft := &fakeTransport{errs: []error{errFake}}
+	tr := ibk.Wrap(ft, ibk.WithMetrics(m), ibk.WithRecorder(r))
+
+	_ = tr.Execute(ctx, ibk.Cmd("which", "podman"))
+	_ = tr.Execute(ctx, ibk.Cmd("which", "docker"))
+	_, _ = tr.Push(ctx, "blueprint", "toml")
+
+	total, failed := m.Executions()
+	if total != 2 || failed != 1 {
+		t.Errorf("unexpected executions: %d (%d failed)", total, failed)
+	}
+	pushes, bytes := m.Pushes()
+	if pushes != 1 || bytes != 9 {
+		t.Errorf("unexpected pushes: %d (%d bytes)", pushes, bytes)
+	}
+
+	want := []string{
+		"which podman\n# failed: connection reset",
+		"which docker",
+		"# push 9 bytes to /tmp/file.toml",
+	}
+	if diff := cmp.Diff(want, r.Entries()); diff != "" {
+		t.Errorf("unexpected transcript: %s", diff)
+	}
+}
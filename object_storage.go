@@ -0,0 +1,203 @@
+package ibk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ErrObjectStorageUpload is returned when uploading of output files to object storage fails.
+var ErrObjectStorageUpload = errors.New("error while uploading to object storage")
+
+// ObjectStorageConfig configures uploading of output files from the build host directly to
+// an S3-compatible object storage. Files are streamed by rclone running in a helper container
+// on the build host, nothing is transferred through the machine running the build.
+type ObjectStorageConfig struct {
+	// Endpoint is the URL of the S3 endpoint (e.g. https://s3.example.com). When empty,
+	// AWS S3 is used.
+	Endpoint string
+
+	// Bucket is the destination bucket, it must exist.
+	Bucket string
+
+	// Prefix is prepended to object keys. Optional.
+	Prefix string
+
+	// Region of the bucket. Optional.
+	Region string
+
+	// AccessKeyID credential, passed to the helper container via CredentialStore.
+	AccessKeyID string
+
+	// SecretAccessKey credential, passed to the helper container via CredentialStore.
+	SecretAccessKey string
+
+	// PathStyle uses path-style addressing (endpoint/bucket/key) instead of virtual-hosted
+	// style (bucket.endpoint/key), required by most S3-compatible servers.
+	PathStyle bool
+
+	// Image is the rclone container image. Defaults to docker.io/rclone/rclone:latest.
+	Image string
+}
+
+// Validate checks that the required fields are set.
+func (c *ObjectStorageConfig) Validate() error {
+	if c.Bucket == "" {
+		return errors.New("object storage bucket is required")
+	}
+
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return errors.New("object storage access key id and secret access key are required")
+	}
+
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("object storage endpoint must be an absolute URL: %s", c.Endpoint)
+		}
+	}
+
+	return nil
+}
+
+func (c *ObjectStorageConfig) image() string {
+	if c.Image == "" {
+		return "docker.io/rclone/rclone:latest"
+	}
+
+	return c.Image
+}
+
+// credentials returns credentials passed to the helper container.
+func (c *ObjectStorageConfig) credentials() []Credential {
+	return []Credential{
+		{Env: "RCLONE_CONFIG_S3_ACCESS_KEY_ID", Value: c.AccessKeyID},
+		{Env: "RCLONE_CONFIG_S3_SECRET_ACCESS_KEY", Value: c.SecretAccessKey},
+	}
+}
+
+// env returns the rclone remote configuration, the remote is named "s3".
+func (c *ObjectStorageConfig) env() []string {
+	env := []string{
+		"RCLONE_CONFIG_S3_TYPE=s3",
+		"RCLONE_CONFIG_S3_ENV_AUTH=false",
+		"RCLONE_CONFIG_S3_FORCE_PATH_STYLE=" + strconv.FormatBool(c.PathStyle),
+	}
+
+	if c.Endpoint != "" {
+		env = append(env, "RCLONE_CONFIG_S3_PROVIDER=Other", "RCLONE_CONFIG_S3_ENDPOINT="+c.Endpoint)
+	} else {
+		env = append(env, "RCLONE_CONFIG_S3_PROVIDER=AWS")
+	}
+
+	if c.Region != "" {
+		env = append(env, "RCLONE_CONFIG_S3_REGION="+c.Region)
+	}
+
+	return env
+}
+
+// Key returns the object key of a file relative to the output directory.
+func (c *ObjectStorageConfig) Key(rel string) string {
+	return strings.TrimPrefix(path.Join(c.Prefix, rel), "/")
+}
+
+// URL returns the URL of the object with the given key.
+func (c *ObjectStorageConfig) URL(key string) string {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+		if c.Region != "" {
+			endpoint = "https://s3." + c.Region + ".amazonaws.com"
+		}
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+
+	if c.PathStyle {
+		u.Path = path.Join("/", u.Path, c.Bucket, key)
+	} else {
+		u.Host = c.Bucket + "." + u.Host
+		u.Path = path.Join("/", u.Path, key)
+	}
+
+	return u.String()
+}
+
+// StorageObject is a file uploaded to object storage.
+type StorageObject struct {
+	// Bucket is the bucket name.
+	Bucket string
+
+	// Key is the object key.
+	Key string
+
+	// URL is the object URL.
+	URL string
+
+	// Size is the size in bytes.
+	Size int64
+}
+
+// objectUpload streams output files into object storage via a helper container.
+type objectUpload struct {
+	cfg         *ObjectStorageConfig
+	runtime     string
+	credentials CredentialStore
+}
+
+// create stores the credentials of the helper container on the remote host.
+func (u *objectUpload) create(ctx context.Context, exec Executor, dryRun bool) error {
+	u.credentials = CredentialStore{Runtime: u.runtime, DryRun: dryRun}
+	return u.credentials.Create(ctx, exec, u.cfg.credentials()...)
+}
+
+// upload copies every file of the result from the output directory to the bucket and appends
+// the objects to the result.
+func (u *objectUpload) upload(ctx context.Context, exec Executor, outputDir string, res *Result) error {
+	for _, f := range res.Files {
+		rel := relPath(outputDir, f.Path)
+		key := u.cfg.Key(rel)
+
+		ctr := &Container{
+			Runtime:      u.runtime,
+			Image:        u.cfg.image(),
+			Remove:       true,
+			SecurityOpts: []string{"label=disable"},
+			Mounts:       []Mount{{Source: outputDir, Target: "/data", ReadOnly: true}},
+			Env:          u.cfg.env(),
+		}
+		u.credentials.Attach(ctr)
+
+		stderr := &SyncedBuffer{}
+		err := exec.Execute(ctx, Invocation{
+			Privileged: true,
+			Idempotent: true,
+			Container:  ctr,
+			Args:       []string{"copyto", "--s3-no-check-bucket", "/data/" + rel, "s3:" + u.cfg.Bucket + "/" + key},
+		}, WithInputOutput(nil, nil, stderr))
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w: %s", ErrObjectStorageUpload, f.Path, err, stderr.String())
+		}
+
+		obj := StorageObject{Bucket: u.cfg.Bucket, Key: key, URL: u.cfg.URL(key), Size: f.Size}
+		log.Printf("[DEBUG] Uploaded %q to %s", f.Path, obj.URL)
+		emit(ctx, Event{Type: EventObjectUploaded, Phase: PhaseCollect, Message: obj.URL, Path: f.Path, Size: f.Size})
+		res.Objects = append(res.Objects, obj)
+	}
+
+	return nil
+}
+
+// remove deletes the credentials of the helper container.
+func (u *objectUpload) remove(ctx context.Context, exec Executor) error {
+	return u.credentials.Remove(ctx, exec)
+}
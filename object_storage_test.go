@@ -0,0 +1,44 @@
+package ibk_test
+
+import (
+	"testing"
+
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+func TestObjectStorageConfigURL(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ibk.ObjectStorageConfig
+		rel  string
+		want string
+	}{
+		{
+			name: "path-style",
+			cfg:  ibk.ObjectStorageConfig{Endpoint: "http://localhost:9000", Bucket: "images", Prefix: "/builds/1/", PathStyle: true},
+			rel:  "qcow2/disk.qcow2",
+			want: "http://localhost:9000/images/builds/1/qcow2/disk.qcow2",
+		},
+		{
+			name: "virtual-hosted",
+			cfg:  ibk.ObjectStorageConfig{Endpoint: "https://s3.example.com", Bucket: "images"},
+			rel:  "image.raw",
+			want: "https://images.s3.example.com/image.raw",
+		},
+		{
+			name: "aws-region",
+			cfg:  ibk.ObjectStorageConfig{Bucket: "images", Prefix: "fedora", Region: "eu-west-1"},
+			rel:  "image.raw",
+			want: "https://images.s3.eu-west-1.amazonaws.com/fedora/image.raw",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.cfg.URL(tt.cfg.Key(tt.rel))
+			if got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package ibk
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrPodmanAPI is returned when a request to the podman API fails.
+var ErrPodmanAPI = errors.New("podman API error")
+
+// DefaultPodmanSocket is the path of the rootful podman API socket, see podman.socket(5).
+const DefaultPodmanSocket = "/run/podman/podman.sock"
+
+// podmanAPIURL is the base URL of the libpod API, the host is ignored since every request
+// is sent over the socket.
+const podmanAPIURL = "http://podman/v4.0.0/libpod"
+
+// Dialer opens connections, e.g. net.Dialer or SSHTransport which opens them from the remote
+// host over the SSH connection.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// PodmanClient is a client of the libpod REST API served on a unix socket. It implements the
+// subset needed to run builder containers: pull, create, start, wait, logs, stop and remove.
+type PodmanClient struct {
+	http *http.Client
+}
+
+// NewPodmanClient creates a client of the API served on the unix socket reached via the dialer.
+func NewPodmanClient(d Dialer, socket string) *PodmanClient {
+	return &PodmanClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// PodmanSpec is the specification of a container created via the API, a subset of the libpod
+// SpecGenerator.
+type PodmanSpec struct {
+	Image              string            `json:"image"`
+	Command            []string          `json:"command,omitempty"`
+	Entrypoint         []string          `json:"entrypoint,omitempty"`
+	Env                map[string]string `json:"env,omitempty"`
+	Privileged         bool              `json:"privileged,omitempty"`
+	Mounts             []PodmanMount     `json:"mounts,omitempty"`
+	SecretEnv          map[string]string `json:"secret_env,omitempty"`
+	Secrets            []PodmanSecret    `json:"secrets,omitempty"`
+	SelinuxOpts        []string          `json:"selinux_opts,omitempty"`
+	SeccompProfilePath string            `json:"seccomp_profile_path,omitempty"`
+}
+
+// PodmanMount is a mount of a container.
+type PodmanMount struct {
+	Destination string   `json:"destination"`
+	Source      string   `json:"source"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// PodmanSecret is a podman secret mounted into a container.
+type PodmanSecret struct {
+	Source string `json:"Source"`
+	Target string `json:"Target"`
+}
+
+// Ping checks the API is reachable.
+func (c *PodmanClient) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/_ping", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Pull pulls the image according to the policy (always, missing, newer or never), progress
+// is called for every line of the pull output.
+func (c *PodmanClient) Pull(ctx context.Context, image, policy string, progress func(string)) error {
+	resp, err := c.do(ctx, http.MethodPost, "/images/pull", url.Values{
+		"reference": {image},
+		"policy":    {policy},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the report is a stream of JSON objects, errors are reported in the stream
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var r struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		err = dec.Decode(&r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: pull %s: %w", ErrPodmanAPI, image, err)
+		}
+		if r.Error != "" {
+			return fmt.Errorf("%w: pull %s: %s", ErrPodmanAPI, image, r.Error)
+		}
+		if line := strings.TrimSpace(r.Stream); line != "" && progress != nil {
+			progress(line)
+		}
+	}
+}
+
+// Create creates a container and returns its ID.
+func (c *PodmanClient) Create(ctx context.Context, spec PodmanSpec) (string, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/containers/create", nil, spec)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		ID       string   `json:"Id"`
+		Warnings []string `json:"Warnings"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return "", fmt.Errorf("%w: create: %w", ErrPodmanAPI, err)
+	}
+	for _, w := range r.Warnings {
+		log.Printf("[DEBUG] Podman create warning: %s", w)
+	}
+
+	return r.ID, nil
+}
+
+// Start starts the container.
+func (c *PodmanClient) Start(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Wait waits until the container exits and returns its exit code.
+func (c *PodmanClient) Wait(ctx context.Context, id string) (int, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/containers/"+id+"/wait", nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var code int
+	err = json.NewDecoder(resp.Body).Decode(&code)
+	if err != nil {
+		return 0, fmt.Errorf("%w: wait: %w", ErrPodmanAPI, err)
+	}
+
+	return code, nil
+}
+
+// Logs follows the standard output and error of the container until it exits.
+func (c *PodmanClient) Logs(ctx context.Context, id string, stdout, stderr io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, "/containers/"+id+"/logs", url.Values{
+		"follow": {"true"},
+		"stdout": {"true"},
+		"stderr": {"true"},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = demuxLogs(resp.Body, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%w: logs: %w", ErrPodmanAPI, err)
+	}
+
+	return nil
+}
+
+// Stop stops the container, it is killed when it does not stop within the timeout.
+func (c *PodmanClient) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	secs := strconv.Itoa(int(timeout.Round(time.Second) / time.Second))
+	resp, err := c.do(ctx, http.MethodPost, "/containers/"+id+"/stop", url.Values{"timeout": {secs}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Remove removes the container and its anonymous volumes, it is killed when running.
+func (c *PodmanClient) Remove(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/containers/"+id, url.Values{"force": {"true"}, "v": {"true"}}, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Close closes idle connections.
+func (c *PodmanClient) Close() {
+	c.http.CloseIdleConnections()
+}
+
+// do sends the request with the JSON encoded body, responses other than 2xx and 304 (not
+// modified, e.g. already started or stopped) are returned as errors.
+func (c *PodmanClient) do(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	u := podmanAPIURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrPodmanAPI, err)
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPodmanAPI, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	log.Printf("[DEBUG] Podman API %s %s", method, path)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %s %s: %w", ErrPodmanAPI, method, path, err)
+	}
+
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotModified {
+		defer resp.Body.Close()
+
+		var e struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+		if json.Unmarshal(data, &e) != nil || e.Message == "" {
+			e.Message = strings.TrimSpace(string(data))
+		}
+		return nil, fmt.Errorf("%w: %s %s: %s: %s", ErrPodmanAPI, method, path, resp.Status, e.Message)
+	}
+
+	return resp, nil
+}
+
+// demuxLogs copies the multiplexed log stream: every frame starts with an 8 byte header of
+// the stream type (1 stdout, 2 stderr) and the big endian payload size.
+func demuxLogs(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, header)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		if w == nil {
+			w = io.Discard
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		_, err = io.CopyN(w, r, size)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package ibk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrPreflight is returned when a preflight check of the build host fails.
+var ErrPreflight = errors.New("preflight checks failed")
+
+// CheckLevel is the outcome of a preflight check.
+type CheckLevel string
+
+const (
+	// CheckPass is a check which passed.
+	CheckPass CheckLevel = "pass"
+
+	// CheckWarn is a check which could not be performed or found a problem which may not
+	// break the build.
+	CheckWarn CheckLevel = "warn"
+
+	// CheckFail is a check which found a problem breaking the build.
+	CheckFail CheckLevel = "fail"
+)
+
+// DefaultPreflightTools are tools used by every build: scp pushes files, bash runs scripts,
+// tee writes the build log and find lists output files.
+var DefaultPreflightTools = []string{"scp", "bash", "tee", "find"}
+
+// DefaultMinFreeSpace is the default minimum of free space in bytes.
+const DefaultMinFreeSpace = 10 << 30
+
+// minRuntimeVersions are the oldest supported container runtime versions.
+var minRuntimeVersions = map[string][2]int{
+	"podman": {4, 0},
+	"docker": {20, 10},
+}
+
+// runtimeStorage are the container storage paths of rootful runtimes.
+var runtimeStorage = map[string]string{
+	"podman": "/var/lib/containers/storage",
+	"docker": "/var/lib/docker",
+}
+
+// PreflightConfig configures preflight checks of the build host.
+type PreflightConfig struct {
+	// Arch is the required architecture as reported by arch(1), optional.
+	Arch string
+
+	// Tools are required tools in addition to DefaultPreflightTools, e.g. qemu-img for
+	// sparse downloads or xz for compression.
+	Tools []string
+
+	// MinFreeSpace is the minimum of free space in bytes in the home directory, where the
+	// output directory is created, and in the container storage. DefaultMinFreeSpace when
+	// zero.
+	MinFreeSpace int64
+
+	// SkipLoopDevices skips the check of loop device availability, loop devices are needed
+	// to build disk images.
+	SkipLoopDevices bool
+}
+
+// PreflightCheck is the result of a single check.
+type PreflightCheck struct {
+	Name    string     `json:"name"`
+	Level   CheckLevel `json:"level"`
+	Message string     `json:"message"`
+}
+
+func (c PreflightCheck) String() string {
+	return fmt.Sprintf("%s %s: %s", c.Level, c.Name, c.Message)
+}
+
+// PreflightReport are results of all preflight checks.
+type PreflightReport struct {
+	// Runtime is the detected container runtime, empty when none was found.
+	Runtime string
+
+	// Arch is the detected architecture, empty when it was not detected.
+	Arch string
+
+	// Checks are results of all checks in the order they were performed.
+	Checks []PreflightCheck
+}
+
+// Err returns an error listing all failed checks, nil when no check failed.
+func (r *PreflightReport) Err() error {
+	var failed []string
+	for _, c := range r.Checks {
+		if c.Level == CheckFail {
+			failed = append(failed, c.Name+": "+c.Message)
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrPreflight, strings.Join(failed, "; "))
+}
+
+// Preflight checks the build host: container runtime presence and version, non-interactive
+// sudo, architecture, required tools, free space and loop devices. All checks are performed
+// and reported as events, the returned error lists all failed checks.
+func Preflight(ctx context.Context, exec Executor, cfg PreflightConfig) (*PreflightReport, error) {
+	r := &PreflightReport{}
+	add := func(name string, level CheckLevel, format string, args ...any) {
+		c := PreflightCheck{Name: name, Level: level, Message: fmt.Sprintf(format, args...)}
+		log.Printf("[DEBUG] Preflight %s", c)
+		emit(ctx, Event{Type: EventPreflightCheck, Message: c.String()})
+		r.Checks = append(r.Checks, c)
+	}
+
+	// container runtime and its version
+	runtime, err := which(ctx, exec, "podman", "docker")
+	if err != nil {
+		add("runtime", CheckFail, "podman or docker is required")
+	} else {
+		r.Runtime = runtime
+		name := filepath.Base(runtime)
+		version, err := tail1(ctx, exec, Invocation{Args: []string{runtime, "--version"}, Idempotent: true})
+		switch v, ok := parseVersion(version); {
+		case err != nil:
+			add("runtime", CheckWarn, "%s --version: %s", name, err)
+		case !ok:
+			add("runtime", CheckWarn, "unknown %s version %q", name, version)
+		case versionLess(v, minRuntimeVersions[name]):
+			want := minRuntimeVersions[name]
+			add("runtime", CheckFail, "%s %d.%d is older than %d.%d", name, v[0], v[1], want[0], want[1])
+		default:
+			add("runtime", CheckPass, "%s %d.%d", name, v[0], v[1])
+		}
+	}
+
+	// privileges are escalated via sudo which must not ask for a password
+	_, err = tail1(ctx, exec, Invocation{Args: []string{"sudo", "-n", "true"}, Idempotent: true})
+	if err != nil {
+		add("sudo", CheckFail, "sudo requires a password or is not allowed: %s", err)
+	} else {
+		add("sudo", CheckPass, "non-interactive")
+	}
+
+	// architecture
+	arch, err := detectArch(ctx, exec)
+	switch {
+	case err != nil:
+		add("arch", CheckWarn, "arch: %s", err)
+	case cfg.Arch != "" && cfg.Arch != arch:
+		r.Arch = arch
+		add("arch", CheckFail, "architecture mismatch: %s", arch)
+	default:
+		r.Arch = arch
+		add("arch", CheckPass, "%s", arch)
+	}
+
+	// required tools, missing ones are printed
+	tools := append(append([]string{}, DefaultPreflightTools...), cfg.Tools...)
+	missing, err := missingTools(ctx, exec, tools)
+	switch {
+	case err != nil:
+		add("tools", CheckWarn, "%s", err)
+	case len(missing) > 0:
+		add("tools", CheckFail, "missing %s", strings.Join(missing, ", "))
+	default:
+		add("tools", CheckPass, "%s", strings.Join(tools, ", "))
+	}
+
+	// free space in the home and the container storage
+	minFree := cfg.MinFreeSpace
+	if minFree == 0 {
+		minFree = DefaultMinFreeSpace
+	}
+	paths := []string{"."}
+	if storage, ok := runtimeStorage[filepath.Base(r.Runtime)]; ok {
+		paths = append(paths, storage)
+	}
+	for _, p := range paths {
+		free, err := freeSpace(ctx, exec, p)
+		switch {
+		case err != nil:
+			add("space", CheckWarn, "%s: %s", p, err)
+		case free < minFree:
+			add("space", CheckFail, "%s has %d MiB free, %d MiB required", p, free>>20, minFree>>20)
+		default:
+			add("space", CheckPass, "%s has %d MiB free", p, free>>20)
+		}
+	}
+
+	// loop devices
+	if !cfg.SkipLoopDevices {
+		_, err = tail1(ctx, exec, Invocation{Args: []string{"test", "-c", "/dev/loop-control"}, Idempotent: true})
+		if err != nil {
+			add("loop", CheckFail, "/dev/loop-control not found, load the loop kernel module")
+		} else {
+			add("loop", CheckPass, "/dev/loop-control")
+		}
+	}
+
+	return r, r.Err()
+}
+
+var versionRegexp = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// parseVersion returns the major and minor version of the first version in the output,
+// e.g. "podman version 5.2.1" or "Docker version 24.0.7, build afdd53b".
+func parseVersion(output string) ([2]int, bool) {
+	m := versionRegexp.FindStringSubmatch(output)
+	if m == nil {
+		return [2]int{}, false
+	}
+
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return [2]int{major, minor}, true
+}
+
+func versionLess(v, want [2]int) bool {
+	return v[0] < want[0] || v[0] == want[0] && v[1] < want[1]
+}
+
+// missingToolsScript prints the arguments not found in PATH.
+const missingToolsScript = `for t; do command -v "$t" >/dev/null || echo "$t"; done`
+
+func missingTools(ctx context.Context, exec Executor, tools []string) ([]string, error) {
+	stdout := &SyncedBuffer{}
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, Invocation{
+		Args:       append([]string{"sh", "-c", missingToolsScript, "sh"}, tools...),
+		Idempotent: true,
+	}, WithInputOutput(nil, stdout, stderr))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, stderr.String())
+	}
+
+	return strings.Fields(stdout.String()), nil
+}
+
+// freeSpace returns the available space in bytes on the file system of the path.
+func freeSpace(ctx context.Context, exec Executor, path string) (int64, error) {
+	stdout := &SyncedBuffer{}
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, Invocation{
+		Args:       []string{"df", "-Pk", "--", path},
+		Idempotent: true,
+	}, WithInputOutput(nil, stdout, stderr))
+	if err != nil {
+		return 0, fmt.Errorf("df: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// Filesystem 1024-blocks Used Available Capacity Mounted on
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(lines) < 2 || len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected df output: %q", stdout.String())
+	}
+
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected df output: %q", stdout.String())
+	}
+
+	return kb << 10, nil
+}
@@ -0,0 +1,105 @@
+package ibk_test
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+	"github.com/osbuild/packer-plugin-image-builder/internal/sshtest"
+)
+
+const dfHeader = "Filesystem     1024-blocks     Used Available Capacity Mounted on\n"
+
+func TestPreflight(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ibk.PreflightConfig
+		session []sshtest.RequestReply
+		want    []ibk.PreflightCheck
+		err     string
+	}{
+		{
+			name: "pass",
+			cfg:  ibk.PreflightConfig{Arch: "x86_64", Tools: []string{"qemu-img"}},
+			session: []sshtest.RequestReply{
+				{Request: "which podman", Reply: "/usr/bin/podman"},
+				{Request: "/usr/bin/podman --version", Reply: "podman version 5.2.1"},
+				{Request: "sudo -n true"},
+				{Request: "arch", Reply: "x86_64"},
+				{Request: regexp.QuoteMeta(`sh -c 'for t; do command -v "$t" >/dev/null || echo "$t"; done' sh scp bash tee find qemu-img`)},
+				{Request: regexp.QuoteMeta("df -Pk -- ."), Reply: dfHeader + "/dev/vda1 41152736 10532124 28506952 27% /home"},
+				{Request: regexp.QuoteMeta("df -Pk -- /var/lib/containers/storage"), Reply: dfHeader + "/dev/vdb1 104857600 0 104857600 0% /var"},
+				{Request: "test -c /dev/loop-control"},
+			},
+			want: []ibk.PreflightCheck{
+				{Name: "runtime", Level: ibk.CheckPass, Message: "podman 5.2"},
+				{Name: "sudo", Level: ibk.CheckPass, Message: "non-interactive"},
+				{Name: "arch", Level: ibk.CheckPass, Message: "x86_64"},
+				{Name: "tools", Level: ibk.CheckPass, Message: "scp, bash, tee, find, qemu-img"},
+				{Name: "space", Level: ibk.CheckPass, Message: ". has 27838 MiB free"},
+				{Name: "space", Level: ibk.CheckPass, Message: "/var/lib/containers/storage has 102400 MiB free"},
+				{Name: "loop", Level: ibk.CheckPass, Message: "/dev/loop-control"},
+			},
+		},
+		{
+			name: "fail",
+			cfg:  ibk.PreflightConfig{Arch: "aarch64", MinFreeSpace: 50 << 30},
+			session: []sshtest.RequestReply{
+				{Request: "which podman", Status: 1},
+				{Request: "which docker", Reply: "/usr/bin/docker"},
+				{Request: "/usr/bin/docker --version", Reply: "Docker version 19.03.8, build afacb8b"},
+				{Request: "sudo -n true", Reply: "sudo: a password is required", Status: 1},
+				{Request: "arch", Reply: "x86_64"},
+				{Request: "command -v", Reply: "scp\n"},
+				{Request: regexp.QuoteMeta("df -Pk -- ."), Reply: dfHeader + "/dev/vda1 41152736 10532124 28506952 27% /home"},
+				{Request: regexp.QuoteMeta("df -Pk -- /var/lib/docker"), Status: 1},
+				{Request: "test -c /dev/loop-control", Status: 1},
+			},
+			want: []ibk.PreflightCheck{
+				{Name: "runtime", Level: ibk.CheckFail, Message: "docker 19.3 is older than 20.10"},
+				{Name: "sudo", Level: ibk.CheckFail, Message: "sudo requires a password or is not allowed: command error: exit status 1"},
+				{Name: "arch", Level: ibk.CheckFail, Message: "architecture mismatch: x86_64"},
+				{Name: "tools", Level: ibk.CheckFail, Message: "missing scp"},
+				{Name: "space", Level: ibk.CheckFail, Message: ". has 27838 MiB free, 51200 MiB required"},
+				{Name: "space", Level: ibk.CheckWarn, Message: "/var/lib/docker: df: command error: exit status 1: "},
+				{Name: "loop", Level: ibk.CheckFail, Message: "/dev/loop-control not found, load the loop kernel module"},
+			},
+			err: "preflight checks failed: runtime: docker 19.3 is older than 20.10; sudo: sudo requires a password or is not allowed: command error: exit status 1; " +
+				"arch: architecture mismatch: x86_64; tools: missing scp; space: . has 27838 MiB free, 51200 MiB required; " +
+				"loop: /dev/loop-control not found, load the loop kernel module",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []string
+			obs := ibk.ObserverFunc(func(e ibk.Event) {
+				if e.Type == ibk.EventPreflightCheck {
+					events = append(events, e.Message)
+				}
+			})
+			ctx := ibk.WithObserver(context.Background(), obs)
+
+			report, err := ibk.Preflight(ctx, sessionClient(t, tt.session), tt.cfg)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" {
+				if !errors.Is(err, ibk.ErrPreflight) || err.Error() != tt.err {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+
+			if diff := cmp.Diff(tt.want, report.Checks); diff != "" {
+				t.Errorf("unexpected checks: %s", diff)
+			}
+
+			if len(events) != len(tt.want) {
+				t.Errorf("unexpected events: %q", events)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package ibk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ErrProvenance is returned when recording of the build provenance fails.
+var ErrProvenance = errors.New("error while recording provenance")
+
+// ProvenanceFile is the name of the provenance record in the output directory.
+const ProvenanceFile = "provenance.json"
+
+// ProvenanceBuilderID identifies this builder in provenance records.
+const ProvenanceBuilderID = "https://github.com/osbuild/packer-plugin-image-builder"
+
+// ProvenanceDescriber is an optional interface of a command which describes inputs of the
+// build. DescribeBuild is called after Collect, when it returns a description a provenance
+// record is written into the output directory and stored in Result.Provenance.
+type ProvenanceDescriber interface {
+	// DescribeBuild returns the description of the build or nil when no provenance is
+	// recorded, e.g. during a dry run.
+	DescribeBuild(ctx context.Context, exec Executor) (*BuildDescription, error)
+}
+
+// BuildDescription describes inputs of a build.
+type BuildDescription struct {
+	// BuildType is the URI of the tool which built the image.
+	BuildType string
+
+	// Parameters are the build parameters like distro or image type, empty values are
+	// omitted.
+	Parameters map[string]string
+
+	// Dependencies are the builder container image, the source container image and the
+	// blueprint.
+	Dependencies []ResourceDescriptor
+}
+
+// ResourceDescriptor is an in-toto resource descriptor: an artifact identified by a name or
+// URI and its digests.
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// provenanceStatement is an in-toto statement with a SLSA v1 provenance predicate.
+//
+// For more information see https://slsa.dev/spec/v1.0/provenance
+type provenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     slsaProvenance       `json:"predicate"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition slsaBuildDefinition `json:"buildDefinition"`
+	RunDetails      slsaRunDetails      `json:"runDetails"`
+}
+
+type slsaBuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   map[string]string    `json:"externalParameters"`
+	InternalParameters   map[string]string    `json:"internalParameters,omitempty"`
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+type slsaRunDetails struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	Metadata struct {
+		StartedOn  time.Time `json:"startedOn"`
+		FinishedOn time.Time `json:"finishedOn"`
+	} `json:"metadata"`
+}
+
+// recordProvenance writes the provenance record of a command implementing ProvenanceDescriber
+// into the output directory. Files without a SHA-256 checksum are checksummed first.
+func recordProvenance(ctx context.Context, c Command, exec Executor, started time.Time, res *Result) error {
+	d, ok := c.(ProvenanceDescriber)
+	if !ok {
+		return nil
+	}
+
+	desc, err := d.DescribeBuild(ctx, exec)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrProvenance, err)
+	}
+	if desc == nil {
+		return nil
+	}
+
+	var missing []string
+	for _, f := range res.Files {
+		if f.SHA256 == "" {
+			missing = append(missing, relPath(res.OutputDir, f.Path))
+		}
+	}
+
+	if len(missing) > 0 {
+		sums, err := checksums(ctx, exec, "sha256sum", res.OutputDir, missing)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrProvenance, err)
+		}
+
+		for i, f := range res.Files {
+			if f.SHA256 == "" {
+				res.Files[i].SHA256 = sums[relPath(res.OutputDir, f.Path)]
+			}
+		}
+	}
+
+	host, err := tail1(ctx, exec, Invocation{Args: []string{"uname", "-n"}, Idempotent: true})
+	if err != nil {
+		return fmt.Errorf("%w: uname: %w", ErrProvenance, err)
+	}
+
+	st := provenanceStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		Subject:       []ResourceDescriptor{},
+		PredicateType: "https://slsa.dev/provenance/v1",
+	}
+
+	for _, f := range res.Files {
+		st.Subject = append(st.Subject, ResourceDescriptor{
+			Name:   relPath(res.OutputDir, f.Path),
+			Digest: map[string]string{"sha256": f.SHA256},
+		})
+	}
+
+	params := make(map[string]string)
+	for k, v := range desc.Parameters {
+		if v != "" {
+			params[k] = v
+		}
+	}
+
+	internal := map[string]string{"host": host}
+	for p, d := range res.Durations {
+		internal[string(p)+"Duration"] = d.Round(time.Millisecond).String()
+	}
+
+	st.Predicate.BuildDefinition = slsaBuildDefinition{
+		BuildType:            desc.BuildType,
+		ExternalParameters:   params,
+		InternalParameters:   internal,
+		ResolvedDependencies: desc.Dependencies,
+	}
+	st.Predicate.RunDetails.Builder.ID = ProvenanceBuilderID
+	st.Predicate.RunDetails.Metadata.StartedOn = started.UTC().Truncate(time.Second)
+	st.Predicate.RunDetails.Metadata.FinishedOn = time.Now().UTC().Truncate(time.Second)
+
+	contents, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrProvenance, err)
+	}
+	contents = append(contents, '\n')
+
+	path := outputPath(res.OutputDir, ProvenanceFile)
+	err = writeOutputFile(ctx, exec, path, contents)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrProvenance, err)
+	}
+
+	res.Provenance = File{Path: path, Size: int64(len(contents))}
+	return nil
+}
+
+// imageDependency returns the descriptor of a container image on the build host with the
+// digest of the registry manifest. A warning is emitted and the digest is omitted when the
+// image has no registry digest, e.g. when it was built locally.
+func imageDependency(ctx context.Context, exec Executor, runtime, image string) ResourceDescriptor {
+	rd := ResourceDescriptor{URI: "docker://" + image}
+
+	stdout := &SyncedBuffer{}
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, Invocation{
+		Privileged: true,
+		Idempotent: true,
+		Args:       []string{runtime, "image", "inspect", "--format", "{{index .RepoDigests 0}}", image},
+	}, WithInputOutput(nil, stdout, stderr))
+
+	_, digest, ok := strings.Cut(stdout.FirstLine(), "@")
+	algo, value, hok := strings.Cut(digest, ":")
+	if err != nil || !ok || !hok {
+		msg := fmt.Sprintf("no digest of %s for the provenance record", image)
+		if err != nil {
+			msg += fmt.Sprintf(": %s: %s", err, stderr.String())
+		}
+		emit(ctx, Event{Type: EventWarning, Phase: PhaseCollect, Message: msg})
+		return rd
+	}
+
+	log.Printf("[DEBUG] Found digest %s of %s", digest, image)
+	rd.Digest = map[string]string{algo: value}
+	return rd
+}
+
+// blueprintDependency returns the descriptor of the blueprint, only its digest is recorded
+// since blueprints may contain secrets.
+func blueprintDependency(blueprint string) ResourceDescriptor {
+	sum := sha256.Sum256([]byte(blueprint))
+	return ResourceDescriptor{
+		Name:   "blueprint.toml",
+		Digest: map[string]string{"sha256": hex.EncodeToString(sum[:])},
+	}
+}
@@ -0,0 +1,389 @@
+package ibk
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ErrRegistryPush is returned when pushing of a container archive to a registry fails.
+var ErrRegistryPush = errors.New("error while pushing to registry")
+
+// RegistryPushConfig configures pushing of a container or OCI archive produced by the build
+// to a registry. The archive is loaded and pushed via podman on the build host.
+type RegistryPushConfig struct {
+	// Reference is the destination image reference (e.g. quay.io/org/image:tag).
+	Reference string
+
+	// Username for the registry login. Optional, when empty no login is made.
+	Username string
+
+	// Password for the registry login. It is sent via standard input.
+	Password string
+
+	// Insecure disables TLS verification, e.g. for a local registry.
+	Insecure bool
+}
+
+// Validate checks that the required fields are set.
+func (c *RegistryPushConfig) Validate() error {
+	if c.Reference == "" {
+		return errors.New("registry push reference is required")
+	}
+
+	if strings.Contains(c.Reference, "://") {
+		return fmt.Errorf("registry push reference must not contain a transport: %s", c.Reference)
+	}
+
+	if c.Username != "" && c.Password == "" {
+		return errors.New("registry push password is required with username")
+	}
+
+	return nil
+}
+
+// registry returns the registry host of the reference used for the login, references
+// without a registry host are resolved to docker.io.
+func (c *RegistryPushConfig) registry() string {
+	host, _ := c.normalize()
+	return host
+}
+
+func (c *RegistryPushConfig) tlsArgs() []string {
+	if c.Insecure {
+		return []string{"--tls-verify=false"}
+	}
+
+	return nil
+}
+
+// ContainerImage is an image pushed to a container registry.
+type ContainerImage struct {
+	// Reference is the image reference the image was pushed to.
+	Reference string
+
+	// Digest is the manifest digest of the pushed image.
+	Digest string
+}
+
+// String returns the image in the reference@digest form.
+func (i ContainerImage) String() string {
+	if i.Digest == "" {
+		return i.Reference
+	}
+
+	return i.Reference + "@" + i.Digest
+}
+
+var (
+	loadedImageRegexp = regexp.MustCompile(`Loaded image(?:\(s\))?: (\S+)`)
+	digestRegexp      = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+)
+
+// containerArchiveExts are extensions of container and OCI archives produced by the builders.
+var containerArchiveExts = []string{".tar", ".oci"}
+
+// registryPush loads a container archive and pushes it to a registry. Temporary files and
+// the loaded image are removed via cleanup.
+type registryPush struct {
+	cfg     *RegistryPushConfig
+	runtime string
+	image   string
+	files   []string
+}
+
+// archive returns the first container archive of the result.
+func (p *registryPush) archive(res *Result) (string, error) {
+	for _, f := range res.Files {
+		// compressed archives are loaded by the container runtime as well
+		name := strings.TrimSuffix(f.Path, compressionExts[f.Compression])
+		for _, ext := range containerArchiveExts {
+			if filepath.Ext(name) == ext {
+				return f.Path, nil
+			}
+		}
+	}
+
+	return "", errors.New("no container archive found in the output")
+}
+
+// push loads the container archive from the result, pushes it to the configured reference and
+// appends it with its digest to the result.
+func (p *registryPush) push(ctx context.Context, exec Executor, res *Result) error {
+	archive, err := p.archive(res)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRegistryPush, err)
+	}
+
+	stdout := &SyncedBuffer{}
+	stderr := &SyncedBuffer{}
+	err = exec.Execute(ctx, Invocation{
+		Privileged: true,
+		Args:       []string{p.runtime, "load", "-i", archive},
+	}, WithInputOutput(nil, stdout, stderr))
+	if err != nil {
+		return fmt.Errorf("%w: load: %w: %s", ErrRegistryPush, err, stderr.String())
+	}
+
+	m := loadedImageRegexp.FindStringSubmatch(stdout.String())
+	if m == nil {
+		return fmt.Errorf("%w: load: no image found in output: %s", ErrRegistryPush, stdout.String())
+	}
+	p.image = m[1]
+	log.Printf("[DEBUG] Loaded image %q from %s", p.image, archive)
+
+	prefix := fmt.Sprintf("%s/ibpacker-%s", tmpfsDir, RandomString(13))
+	args := []string{p.runtime, "push"}
+	args = append(args, p.cfg.tlsArgs()...)
+
+	if p.cfg.Username != "" {
+		authfile := prefix + ".json"
+		p.files = append(p.files, authfile)
+		args = append(args, "--authfile", authfile)
+
+		login := []string{p.runtime, "login", "--authfile", authfile, "--username", p.cfg.Username, "--password-stdin"}
+		login = append(login, p.cfg.tlsArgs()...)
+		login = append(login, p.cfg.registry())
+
+		stderr.Reset()
+		err = exec.Execute(ctx, Invocation{
+			Privileged: true,
+			Args:       login,
+		}, WithInputOutput(strings.NewReader(p.cfg.Password), nil, stderr))
+		if err != nil {
+			return fmt.Errorf("%w: login: %w: %s", ErrRegistryPush, err, stderr.String())
+		}
+	}
+
+	digestfile := prefix + ".digest"
+	p.files = append(p.files, digestfile)
+	args = append(args, "--digestfile", digestfile, p.image, "docker://"+p.cfg.Reference)
+
+	stderr.Reset()
+	err = exec.Execute(ctx, Invocation{
+		Privileged: true,
+		Idempotent: true,
+		Args:       args,
+	}, WithInputOutput(nil, nil, stderr))
+	if err != nil {
+		return fmt.Errorf("%w: push: %w: %s", ErrRegistryPush, err, stderr.String())
+	}
+
+	digest, err := tail1(ctx, exec, Invocation{Privileged: true, Args: []string{"cat", digestfile}})
+	if err != nil {
+		return fmt.Errorf("%w: digest: %w", ErrRegistryPush, err)
+	}
+
+	if !digestRegexp.MatchString(digest) {
+		return fmt.Errorf("%w: unexpected digest: %q", ErrRegistryPush, digest)
+	}
+
+	img := ContainerImage{Reference: p.cfg.Reference, Digest: digest}
+	log.Printf("[DEBUG] Pushed image %s", img)
+	emit(ctx, Event{Type: EventRegistryPush, Phase: PhaseCollect, Message: img.String()})
+	res.Pushes = append(res.Pushes, img)
+
+	return nil
+}
+
+// cleanup removes temporary files and the loaded image.
+func (p *registryPush) cleanup(ctx context.Context, exec Executor) error {
+	var errs []error
+
+	if len(p.files) > 0 {
+		args := append([]string{"rm", "-f"}, p.files...)
+		err := exec.Execute(ctx, Invocation{Privileged: true, Args: args})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("registry files: %w", err))
+		} else {
+			p.files = nil
+		}
+	}
+
+	if p.image != "" {
+		err := exec.Execute(ctx, Invocation{Privileged: true, Args: []string{p.runtime, "rmi", p.image}})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rmi: %w", err))
+		} else {
+			p.image = ""
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// normalize returns the registry host and the repository name of the reference without the
+// tag and digest. The first component is the host only when it contains a dot or a port or it
+// is localhost, other references are resolved to docker.io where official images are in the
+// library namespace.
+func (c *RegistryPushConfig) normalize() (host, name string) {
+	name = c.Reference
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+
+	host, rest, ok := strings.Cut(name, "/")
+	if ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		name = rest
+	} else {
+		host = "docker.io"
+	}
+
+	if host == "index.docker.io" {
+		host = "docker.io"
+	}
+	if host == "docker.io" && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+
+	return host, name
+}
+
+// repository returns the host of the registry HTTP API and the repository name of the
+// reference, the API of docker.io is served by registry-1.docker.io.
+func (c *RegistryPushConfig) repository() (host, name string) {
+	host, name = c.normalize()
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+
+	return host, name
+}
+
+var authParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// deleteManifest deletes the manifest of the image via the registry HTTP API. Basic and
+// bearer token authentication is supported, a missing manifest is not an error.
+func (c *RegistryPushConfig) deleteManifest(ctx context.Context, img ContainerImage) error {
+	host, name := c.repository()
+	u := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, name, img.Digest)
+
+	resp, err := c.do(ctx, http.MethodDelete, u, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		auth, err := c.authorization(ctx, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return err
+		}
+
+		resp, err = c.do(ctx, http.MethodDelete, u, auth)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		return nil
+	case http.StatusNotFound:
+		log.Printf("[DEBUG] Manifest %s not found, already deleted", img)
+		return nil
+	}
+
+	return fmt.Errorf("delete manifest: %s", resp.Status)
+}
+
+func (c *RegistryPushConfig) do(ctx context.Context, method, u, auth string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	return c.client().Do(req)
+}
+
+// client returns the HTTP client of the registry API, TLS verification is disabled when
+// Insecure is set.
+func (c *RegistryPushConfig) client() *http.Client {
+	if !c.Insecure {
+		return http.DefaultClient
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &http.Client{Transport: t}
+}
+
+// authorization returns the Authorization header value for the authentication challenge.
+func (c *RegistryPushConfig) authorization(ctx context.Context, challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.Username == "" {
+			return "", errors.New("registry requires authentication")
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(c.Username, c.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported authentication: %q", challenge)
+	}
+
+	p := make(map[string]string)
+	for _, m := range authParamRegexp.FindAllStringSubmatch(params, -1) {
+		p[m[1]] = m[2]
+	}
+
+	q := url.Values{}
+	if p["service"] != "" {
+		q.Set("service", p["service"])
+	}
+	if p["scope"] != "" {
+		q.Set("scope", p["scope"])
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", fmt.Errorf("token: %w", err)
+	}
+
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	return "Bearer " + token.Token, nil
+}
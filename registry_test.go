@@ -0,0 +1,35 @@
+package ibk_test
+
+import (
+	"testing"
+
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+func TestRegistryHosts(t *testing.T) {
+	tests := []struct {
+		reference string
+		login     string
+		api       string
+		name      string
+	}{
+		{"image", "docker.io", "registry-1.docker.io", "library/image"},
+		{"image:latest", "docker.io", "registry-1.docker.io", "library/image"},
+		{"user/image", "docker.io", "registry-1.docker.io", "user/image"},
+		{"user/image@sha256:0123", "docker.io", "registry-1.docker.io", "user/image"},
+		{"docker.io/image", "docker.io", "registry-1.docker.io", "library/image"},
+		{"index.docker.io/user/image", "docker.io", "registry-1.docker.io", "user/image"},
+		{"quay.io/org/image:tag", "quay.io", "quay.io", "org/image"},
+		{"localhost/image", "localhost", "localhost", "image"},
+		{"localhost:5000/org/sub/image:1.0", "localhost:5000", "localhost:5000", "org/sub/image"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reference, func(t *testing.T) {
+			login, api, name := ibk.RegistryHosts(tt.reference)
+			if login != tt.login || api != tt.api || name != tt.name {
+				t.Errorf("got %s %s %s, want %s %s %s", login, api, name, tt.login, tt.api, tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package ibk
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phase is a lifecycle phase of a command.
+type Phase string
+
+const (
+	PhaseConfigure Phase = "configure"
+	PhasePush      Phase = "push"
+	PhaseBuild     Phase = "build"
+	PhaseCollect   Phase = "collect"
+	PhaseCleanup   Phase = "cleanup"
+)
+
+// Result is the outcome of an applied command.
+type Result struct {
+	// Files is a list of files produced by the command on the remote host.
+	Files []File
+
+	// Durations is the time spent in each lifecycle phase.
+	Durations map[Phase]time.Duration
+
+	// ExitCode is the exit status of the build invocation, zero on success.
+	ExitCode int
+
+	// OutputDir is the remote directory with the produced files.
+	OutputDir string
+
+	// LogFile is the path to the build log on the remote host, empty when no log was kept.
+	LogFile string
+
+	// Images is a list of images registered in cloud providers.
+	Images []CloudImage
+
+	// Pushes is a list of images pushed to container registries.
+	Pushes []ContainerImage
+
+	// Objects is a list of files uploaded to object storage.
+	Objects []StorageObject
+
+	// Manifests is a list of checksum files (SHA256SUMS, SHA512SUMS) and their signatures
+	// written into the output directory.
+	Manifests []File
+
+	// SBOMs is a list of SPDX documents, written by the builder or generated from the source
+	// container.
+	SBOMs []File
+
+	// Provenance is the provenance record written into the output directory, the path is
+	// empty when no record was written.
+	Provenance File
+}
+
+// File is a file on the remote host.
+type File struct {
+	// Path is the path on the remote host.
+	Path string
+
+	// Size is the size in bytes.
+	Size int64
+
+	// SHA256 is the hex encoded SHA-256 checksum, set when checksums are computed.
+	SHA256 string
+
+	// SHA512 is the hex encoded SHA-512 checksum, set when SHA-512 checksums are computed.
+	SHA512 string
+
+	// LocalPath is the path of the downloaded file, set by DownloadResult.
+	LocalPath string
+
+	// Compression is the compression format when the file was compressed on the build host.
+	Compression string
+}
+
+// CloudImage is an image registered in a cloud provider.
+type CloudImage struct {
+	// Provider is the cloud provider name: aws, gcp or azure.
+	Provider string
+
+	// Region is the provider region or location. Optional.
+	Region string
+
+	// ID is the image ID, e.g. the AMI ID.
+	ID string
+
+	// SnapshotID is the ID of the snapshot backing the image. Optional.
+	SnapshotID string
+}
+
+// String returns the image in the region:id form used by Packer builders, or just the ID
+// when the region is not known.
+func (i CloudImage) String() string {
+	if i.Region == "" {
+		return i.ID
+	}
+
+	return i.Region + ":" + i.ID
+}
+
+// Paths returns paths of all files.
+func (r *Result) Paths() []string {
+	paths := make([]string, 0, len(r.Files))
+	for _, f := range r.Files {
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
+// Duration returns the total time spent in all phases.
+func (r *Result) Duration() time.Duration {
+	var total time.Duration
+	for _, d := range r.Durations {
+		total += d
+	}
+	return total
+}
+
+// collectFiles lists regular files in a remote directory and appends them to the result.
+// The log file of the result is not included.
+func collectFiles(ctx context.Context, exec Executor, dir string, res *Result) error {
+	stdout := &SyncedBuffer{}
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, listFiles(dir), WithInputOutput(nil, stdout, stderr))
+	if err != nil {
+		return fmt.Errorf("find: %w: %s", err, stderr.String())
+	}
+
+	files, err := parseFiles(stdout.String(), res.LogFile)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		log.Printf("[DEBUG] Found file %q (size %d)", f.Path, f.Size)
+		emit(ctx, Event{Type: EventOutputFile, Phase: PhaseCollect, Path: f.Path, Size: f.Size})
+	}
+	res.Files = append(res.Files, files...)
+
+	return nil
+}
+
+// removeFiles deletes remote files, empty names are ignored.
+func removeFiles(ctx context.Context, exec Executor, files ...string) error {
+	args := []string{"rm", "-f"}
+	for _, f := range files {
+		if f != "" {
+			args = append(args, f)
+		}
+	}
+
+	if len(args) == 2 {
+		return nil
+	}
+
+	return exec.Execute(ctx, Cmd(args...))
+}
+
+// listFiles returns the invocation which lists regular files in a directory with
+// their sizes in the format parsed by parseFiles.
+func listFiles(dir string) Invocation {
+	return Cmd("find", dir, "-type", "f", "-printf", `%s %p\n`)
+}
+
+// parseFiles parses output of listFiles skipping the ignored paths.
+func parseFiles(output string, ignore ...string) ([]File, error) {
+	var files []File
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		size, path, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("unexpected find output: %q", line)
+		}
+
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected find output: %q: %w", line, err)
+		}
+
+		skip := false
+		for _, i := range ignore {
+			if i == path {
+				skip = true
+			}
+		}
+		if !skip {
+			files = append(files, File{Path: path, Size: n})
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,188 @@
+package ibk
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrSBOM is returned when collecting or generating of SBOM documents fails.
+var ErrSBOM = errors.New("error while collecting SBOM")
+
+// SBOMSuffix is the file name suffix of SPDX SBOM documents.
+const SBOMSuffix = ".spdx.json"
+
+// SourceSBOMFile is the name of the SBOM document generated from the package list of the
+// source container of bootc builds.
+const SourceSBOMFile = "source-container" + SBOMSuffix
+
+// collectSBOMs moves SPDX documents written by the builder from Result.Files into
+// Result.SBOMs.
+func collectSBOMs(res *Result) {
+	files := res.Files[:0]
+	for _, f := range res.Files {
+		if strings.HasSuffix(f.Path, SBOMSuffix) {
+			log.Printf("[DEBUG] Found SBOM %q", f.Path)
+			res.SBOMs = append(res.SBOMs, f)
+			continue
+		}
+		files = append(files, f)
+	}
+	res.Files = files
+}
+
+// rpmQueryFormat is the rpm query format parsed by parsePackages.
+const rpmQueryFormat = `%{NAME}\t%{EPOCHNUM}\t%{VERSION}\t%{RELEASE}\t%{ARCH}\n`
+
+// rpmPackage is an installed package.
+type rpmPackage struct {
+	Name, Epoch, Version, Release, Arch string
+}
+
+// generateSourceSBOM lists packages of a container image via rpm, writes an SPDX document
+// into the output directory and appends it to Result.SBOMs.
+func generateSourceSBOM(ctx context.Context, exec Executor, runtime, image, outputDir string, res *Result) error {
+	stdout := &SyncedBuffer{}
+	stderr := &SyncedBuffer{}
+	err := exec.Execute(ctx, Invocation{
+		Privileged: true,
+		Idempotent: true,
+		Container: &Container{
+			Runtime:    runtime,
+			Image:      image,
+			Remove:     true,
+			Entrypoint: "rpm",
+		},
+		Args: []string{"-qa", "--queryformat", rpmQueryFormat},
+	}, WithInputOutput(nil, stdout, stderr))
+	if err != nil {
+		return fmt.Errorf("%w: rpm: %w: %s", ErrSBOM, err, stderr.String())
+	}
+
+	pkgs, err := parsePackages(stdout.String())
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSBOM, err)
+	}
+
+	contents, err := spdxDocument(image, pkgs, time.Now())
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSBOM, err)
+	}
+
+	path := outputPath(outputDir, SourceSBOMFile)
+	err = writeOutputFile(ctx, exec, path, contents)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSBOM, err)
+	}
+
+	log.Printf("[DEBUG] Generated SBOM of %s with %d packages", image, len(pkgs))
+	emit(ctx, Event{Type: EventOutputFile, Phase: PhaseCollect, Path: path, Size: int64(len(contents))})
+	res.SBOMs = append(res.SBOMs, File{Path: path, Size: int64(len(contents))})
+	return nil
+}
+
+// parsePackages parses the rpm output in the rpmQueryFormat format.
+func parsePackages(output string) ([]rpmPackage, error) {
+	var pkgs []rpmPackage
+
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		f := strings.Split(line, "\t")
+		if len(f) != 5 {
+			return nil, fmt.Errorf("unexpected rpm output: %q", line)
+		}
+		pkgs = append(pkgs, rpmPackage{Name: f[0], Epoch: f[1], Version: f[2], Release: f[3], Arch: f[4]})
+	}
+
+	if len(pkgs) == 0 {
+		return nil, errors.New("no packages found")
+	}
+
+	return pkgs, nil
+}
+
+type spdxDoc struct {
+	SPDXVersion       string `json:"spdxVersion"`
+	DataLicense       string `json:"dataLicense"`
+	SPDXID            string `json:"SPDXID"`
+	Name              string `json:"name"`
+	DocumentNamespace string `json:"documentNamespace"`
+	CreationInfo      struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	} `json:"creationInfo"`
+	Packages []spdxPackage `json:"packages"`
+}
+
+type spdxPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo"`
+	DownloadLocation string            `json:"downloadLocation"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+// spdxDocument returns an SPDX 2.3 JSON document with the packages identified by purls.
+func spdxDocument(image string, pkgs []rpmPackage, created time.Time) ([]byte, error) {
+	doc := spdxDoc{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        image,
+	}
+	doc.CreationInfo.Created = created.UTC().Format(time.RFC3339)
+	doc.CreationInfo.Creators = []string{"Tool: packer-plugin-image-builder"}
+
+	h := sha256.New()
+	for i, p := range pkgs {
+		version := p.Version + "-" + p.Release
+		purl := "pkg:rpm/" + url.PathEscape(p.Name) + "@" + url.PathEscape(version) + "?arch=" + url.QueryEscape(p.Arch)
+		if p.Epoch != "" && p.Epoch != "0" {
+			version = p.Epoch + ":" + version
+			purl += "&epoch=" + url.QueryEscape(p.Epoch)
+		}
+		fmt.Fprintln(h, purl)
+
+		doc.Packages = append(doc.Packages, spdxPackage{
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-%d", i+1),
+			Name:             p.Name,
+			VersionInfo:      version,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  purl,
+			}},
+		})
+	}
+	doc.DocumentNamespace = ProvenanceBuilderID + "/spdx/" + hex.EncodeToString(h.Sum(nil))
+
+	// purls contain "&" which is escaped by default
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,73 @@
+package ibk
+
+import (
+	"strings"
+
+	"al.essio.dev/pkg/shellescape"
+)
+
+// Script is a bash script which wraps a command executed on the remote host. The
+// script runs in strict mode (errexit, nounset and pipefail), so a failure of any
+// command in a pipeline is propagated to the caller, removes temporary files on
+// exit and reports the exit code together with the log file location.
+type Script struct {
+	// Dir is the working directory. Optional.
+	Dir string
+
+	// Command is the main command. It must be properly escaped.
+	Command string
+
+	// LogFile is the path of a file where the combined output of the main command is
+	// copied to via tee. Optional.
+	LogFile string
+
+	// Then is a list of commands executed after the main command succeeds. They must be
+	// properly escaped.
+	Then []string
+
+	// Cleanup is a list of files which are deleted when the script exits regardless of
+	// the exit status.
+	Cleanup []string
+}
+
+// String renders the script.
+func (s Script) String() string {
+	sb := strings.Builder{}
+
+	sb.WriteString("#!/bin/bash\n")
+	sb.WriteString("set -euo pipefail\n")
+
+	if len(s.Cleanup) > 0 {
+		files := make([]string, 0, len(s.Cleanup))
+		for _, f := range s.Cleanup {
+			files = append(files, shellescape.Quote(f))
+		}
+		sb.WriteString("trap " + shellescape.Quote("rm -f -- "+strings.Join(files, " ")) + " EXIT\n")
+	}
+
+	if s.Dir != "" {
+		sb.WriteString("cd " + shellescape.Quote(s.Dir) + "\n")
+	}
+
+	sb.WriteString("rc=0\n")
+	sb.WriteString(s.Command)
+	if s.LogFile != "" {
+		sb.WriteString(" 2>&1 | tee " + shellescape.Quote(s.LogFile))
+	}
+	sb.WriteString(" || rc=$?\n")
+
+	sb.WriteString("if [ \"$rc\" -ne 0 ]; then\n")
+	if s.LogFile != "" {
+		sb.WriteString("    echo \"command failed with exit code $rc, log: \"" + shellescape.Quote(s.LogFile) + " >&2\n")
+	} else {
+		sb.WriteString("    echo \"command failed with exit code $rc\" >&2\n")
+	}
+	sb.WriteString("    exit \"$rc\"\n")
+	sb.WriteString("fi\n")
+
+	for _, t := range s.Then {
+		sb.WriteString(t + "\n")
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,60 @@
+package ibk_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+func TestScript(t *testing.T) {
+	tests := []struct {
+		name   string
+		script ibk.Script
+		want   string
+	}{
+		{
+			name: "command-only",
+			script: ibk.Script{
+				Command: "sudo podman run image",
+			},
+			want: `#!/bin/bash
+set -euo pipefail
+rc=0
+sudo podman run image || rc=$?
+if [ "$rc" -ne 0 ]; then
+    echo "command failed with exit code $rc" >&2
+    exit "$rc"
+fi
+`,
+		},
+		{
+			name: "all-fields",
+			script: ibk.Script{
+				Command: "sudo podman run image",
+				LogFile: "./output dir/build.log",
+				Then:    []string{"find './output dir' -type f"},
+				Cleanup: []string{"/tmp/a.env", "/tmp/b c.env"},
+			},
+			want: `#!/bin/bash
+set -euo pipefail
+trap 'rm -f -- /tmp/a.env '"'"'/tmp/b c.env'"'"'' EXIT
+rc=0
+sudo podman run image 2>&1 | tee './output dir/build.log' || rc=$?
+if [ "$rc" -ne 0 ]; then
+    echo "command failed with exit code $rc, log: "'./output dir/build.log' >&2
+    exit "$rc"
+fi
+find './output dir' -type f
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, tt.script.String()); diff != "" {
+				t.Errorf("unexpected script: %s", diff)
+			}
+		})
+	}
+}
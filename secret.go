@@ -0,0 +1,197 @@
+package ibk
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SecretRegistry keeps sensitive values (passwords, access keys) and masks them in
+// strings, errors, writers and events. The zero value is ready to use and it is safe
+// for concurrent use.
+type SecretRegistry struct {
+	mu       sync.RWMutex
+	values   []string
+	replacer *strings.Replacer
+}
+
+// Secrets is the central registry used by the plugin and the CLI. Sensitive configuration
+// values are added when the configuration is loaded.
+var Secrets = &SecretRegistry{}
+
+// Add registers sensitive values, empty and already known values are ignored.
+func (r *SecretRegistry) Add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range values {
+		if v == "" || r.contains(v) {
+			continue
+		}
+		r.values = append(r.values, v)
+	}
+
+	// longer values first so a secret containing another one is masked as a whole
+	sort.SliceStable(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+
+	pairs := make([]string, 0, len(r.values)*2)
+	for _, v := range r.values {
+		pairs = append(pairs, v, redactedMask)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+func (r *SecretRegistry) contains(value string) bool {
+	for _, v := range r.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact replaces all registered values in the string with a mask.
+func (r *SecretRegistry) Redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.replacer == nil {
+		return s
+	}
+
+	return r.replacer.Replace(s)
+}
+
+// RedactError returns an error with the message redacted. The original error is still
+// available via errors.Is and errors.As. Nil is returned for nil errors.
+func (r *SecretRegistry) RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := r.Redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+
+	return &redactedError{msg: msg, err: err}
+}
+
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// Observer returns an observer which redacts messages and errors of events before they
+// are passed to the observer.
+func (r *SecretRegistry) Observer(obs Observer) Observer {
+	return ObserverFunc(func(e Event) {
+		e.Message = r.Redact(e.Message)
+		e.Error = r.Redact(e.Error)
+		obs.Observe(e)
+	})
+}
+
+// partial returns the length of the longest suffix of b which is a beginning of
+// a registered value.
+func (r *SecretRegistry) partial(b []byte) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	longest := 0
+	for _, v := range r.values {
+		for n := min(len(v)-1, len(b)); n > longest; n-- {
+			if bytes.HasSuffix(b, []byte(v[:n])) {
+				longest = n
+				break
+			}
+		}
+	}
+
+	return longest
+}
+
+// RedactWriter masks registered values in data written to the underlying writer. Values
+// split across multiple writes are masked too: the end of data which could be the
+// beginning of a value is held back until the next write or Flush.
+type RedactWriter struct {
+	mu      sync.Mutex
+	r       *SecretRegistry
+	w       io.Writer
+	pending []byte
+}
+
+var _ io.Writer = (*RedactWriter)(nil)
+
+// Writer returns a writer which masks registered values.
+func (r *SecretRegistry) Writer(w io.Writer) *RedactWriter {
+	return &RedactWriter{r: r, w: w}
+}
+
+// Write writes redacted p to the underlying writer.
+func (rw *RedactWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	buf := []byte(rw.r.Redact(string(rw.pending) + string(p)))
+	keep := rw.r.partial(buf)
+	rw.pending = append(rw.pending[:0], buf[len(buf)-keep:]...)
+
+	if _, err := rw.w.Write(buf[:len(buf)-keep]); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Flush writes data held back by the writer.
+func (rw *RedactWriter) Flush() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if len(rw.pending) == 0 {
+		return nil
+	}
+
+	_, err := rw.w.Write(rw.pending)
+	rw.pending = rw.pending[:0]
+	return err
+}
+
+var blueprintPasswordRegexp = regexp.MustCompile(`(?m)^\s*password\s*=\s*("(?:[^"\\]|\\.)*"|'[^']*')`)
+
+// BlueprintSecrets returns user passwords (plain or hashed) from a blueprint in the TOML
+// format.
+func BlueprintSecrets(blueprint string) []string {
+	var secrets []string
+
+	for _, m := range blueprintPasswordRegexp.FindAllStringSubmatch(blueprint, -1) {
+		value := m[1]
+		if strings.HasPrefix(value, "'") {
+			secrets = append(secrets, strings.Trim(value, "'"))
+			continue
+		}
+
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			unquoted = strings.Trim(value, `"`)
+		}
+		secrets = append(secrets, unquoted)
+	}
+
+	return secrets
+}
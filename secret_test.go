@@ -0,0 +1,128 @@
+package ibk_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+func TestSecretRegistryRedact(t *testing.T) {
+	r := &ibk.SecretRegistry{}
+	if got := r.Redact("nothing registered"); got != "nothing registered" {
+		t.Errorf("unexpected redaction: %q", got)
+	}
+
+	r.Add("pass", "", "password", "pass")
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"no secrets", "no secrets"},
+		{"login pass", "login <redacted>"},
+		{"login password", "login <redacted>"},
+		{"pass password pass", "<redacted> <redacted> <redacted>"},
+	}
+
+	for _, tt := range tests {
+		if got := r.Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSecretRegistryRedactError(t *testing.T) {
+	r := &ibk.SecretRegistry{}
+	r.Add("s3cr3t")
+
+	if r.RedactError(nil) != nil {
+		t.Error("expected nil error")
+	}
+
+	plain := errors.New("plain")
+	if r.RedactError(plain) != plain {
+		t.Error("expected the same error")
+	}
+
+	err := r.RedactError(fmt.Errorf("%w: key s3cr3t", ibk.ErrExecute))
+	if err.Error() != "error while executing: key <redacted>" {
+		t.Errorf("unexpected message: %q", err)
+	}
+	if !errors.Is(err, ibk.ErrExecute) {
+		t.Error("redacted error does not wrap the original error")
+	}
+}
+
+func TestSecretRegistryWriter(t *testing.T) {
+	r := &ibk.SecretRegistry{}
+	r.Add("s3cr3t")
+
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{
+			name:   "single",
+			writes: []string{"key s3cr3t\n"},
+			want:   "key <redacted>\n",
+		},
+		{
+			name:   "split",
+			writes: []string{"key s3", "cr", "3t\n"},
+			want:   "key <redacted>\n",
+		},
+		{
+			name:   "prefix only",
+			writes: []string{"key s3", "cr", "et\n"},
+			want:   "key s3cret\n",
+		},
+		{
+			name:   "flushed",
+			writes: []string{"key s3c"},
+			want:   "key s3c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := r.Writer(buf)
+			for _, s := range tt.writes {
+				n, err := w.Write([]byte(s))
+				if err != nil || n != len(s) {
+					t.Fatalf("unexpected write: %d, %v", n, err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if buf.String() != tt.want {
+				t.Errorf("got %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBlueprintSecrets(t *testing.T) {
+	bp := `name = "example"
+
+[[customizations.user]]
+name = "admin"
+password = "p@ss\"word"
+key = "ssh-ed25519 AAAA"
+
+[[customizations.user]]
+name = "operator"
+  password = '$6$salt$hash' # hashed
+`
+
+	want := []string{`p@ss"word`, "$6$salt$hash"}
+	if diff := cmp.Diff(want, ibk.BlueprintSecrets(bp)); diff != "" {
+		t.Errorf("unexpected secrets: %s", diff)
+	}
+}
@@ -0,0 +1,168 @@
+package ibk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Signer creates detached signatures of checksum manifests.
+type Signer interface {
+	// Sign returns a detached signature of the data.
+	Sign(data []byte) ([]byte, error)
+
+	// Extension returns the extension of the signature file including the dot.
+	Extension() string
+}
+
+// GPGSigner signs with an OpenPGP private key and creates an ASCII armored signature which
+// can be verified via gpg --verify.
+type GPGSigner struct {
+	// Key is the private key, armored or binary. The first key with a private key is used.
+	Key []byte
+
+	// Passphrase decrypts the private key. Optional.
+	Passphrase string
+}
+
+var _ Signer = &GPGSigner{}
+
+func (s *GPGSigner) Sign(data []byte) ([]byte, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(s.Key))
+	if err != nil {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(s.Key))
+		if err != nil {
+			return nil, fmt.Errorf("gpg key: %w", err)
+		}
+	}
+
+	for _, e := range entities {
+		if e.PrivateKey == nil {
+			continue
+		}
+
+		// the signature may be made by a signing subkey, decrypt all of them
+		err = e.DecryptPrivateKeys([]byte(s.Passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("gpg key: %w", err)
+		}
+
+		buf := &bytes.Buffer{}
+		err = openpgp.ArmoredDetachSign(buf, e, bytes.NewReader(data), nil)
+		if err != nil {
+			return nil, fmt.Errorf("gpg sign: %w", err)
+		}
+		return buf.Bytes(), nil
+	}
+
+	return nil, errors.New("gpg key: no private key found")
+}
+
+func (s *GPGSigner) Extension() string {
+	return ".asc"
+}
+
+// CosignSigner signs with a cosign key pair (cosign generate-key-pair) and creates a base64
+// encoded signature which can be verified via cosign verify-blob.
+type CosignSigner struct {
+	// Key is the encrypted private key in the PEM format (cosign.key).
+	Key []byte
+
+	// Password decrypts the private key.
+	Password string
+}
+
+var _ Signer = &CosignSigner{}
+
+// cosignKey is the payload of an encrypted cosign private key.
+type cosignKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func (s *CosignSigner) Sign(data []byte) ([]byte, error) {
+	key, err := s.privateKey()
+	if err != nil {
+		return nil, fmt.Errorf("cosign key: %w", err)
+	}
+
+	digest := sha256.Sum256(data)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("cosign sign: %w", err)
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+func (s *CosignSigner) privateKey() (crypto.Signer, error) {
+	block, _ := pem.Decode(s.Key)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var enc cosignKey
+	err := json.Unmarshal(block.Bytes, &enc)
+	if err != nil {
+		return nil, err
+	}
+
+	if enc.KDF.Name != "scrypt" || enc.Cipher.Name != "nacl/secretbox" || len(enc.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("unsupported encryption: %s, %s", enc.KDF.Name, enc.Cipher.Name)
+	}
+
+	secret, err := scrypt.Key([]byte(s.Password), enc.KDF.Salt, enc.KDF.Params.N, enc.KDF.Params.R, enc.KDF.Params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [24]byte
+	var secretKey [32]byte
+	copy(nonce[:], enc.Cipher.Nonce)
+	copy(secretKey[:], secret)
+
+	der, ok := secretbox.Open(nil, enc.Ciphertext, &nonce, &secretKey)
+	if !ok {
+		return nil, errors.New("decryption failed, wrong password?")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	return signer, nil
+}
+
+func (s *CosignSigner) Extension() string {
+	return ".sig"
+}
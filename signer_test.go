@@ -0,0 +1,146 @@
+package ibk_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+func TestGPGSigner(t *testing.T) {
+	entity, err := openpgp.NewEntity("builder", "", "builder@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := &bytes.Buffer{}
+	err = entity.SerializePrivate(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("0123  image.raw\n")
+	signer := &ibk.GPGSigner{Key: key.Bytes()}
+	sig, err := signer.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{entity}, bytes.NewReader(data), bytes.NewReader(sig), nil)
+	if err != nil {
+		t.Errorf("signature verification failed: %v", err)
+	}
+
+	if signer.Extension() != ".asc" {
+		t.Errorf("unexpected extension: %s", signer.Extension())
+	}
+}
+
+func TestGPGSignerPassphrase(t *testing.T) {
+	entity, err := openpgp.NewEntity("builder", "", "builder@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = entity.EncryptPrivateKeys([]byte("s3cr3t"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := &bytes.Buffer{}
+	err = entity.SerializePrivateWithoutSigning(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("0123  image.raw\n")
+	_, err = (&ibk.GPGSigner{Key: key.Bytes(), Passphrase: "wrong"}).Sign(data)
+	if err == nil {
+		t.Fatal("expected error with a wrong passphrase")
+	}
+
+	sig, err := (&ibk.GPGSigner{Key: key.Bytes(), Passphrase: "s3cr3t"}).Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{entity}, bytes.NewReader(data), bytes.NewReader(sig), nil)
+	if err != nil {
+		t.Errorf("signature verification failed: %v", err)
+	}
+}
+
+// cosignKey encrypts the key in the format of cosign generate-key-pair.
+func cosignKey(t *testing.T, key *ecdsa.PrivateKey, password string) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	salt := make([]byte, 32)
+	var nonce [24]byte
+	_, _ = rand.Read(salt)
+	_, _ = rand.Read(nonce[:])
+
+	secret, err := scrypt.Key([]byte(password), salt, 32768, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var secretKey [32]byte
+	copy(secretKey[:], secret)
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"kdf": map[string]interface{}{
+			"name":   "scrypt",
+			"params": map[string]int{"N": 32768, "r": 8, "p": 1},
+			"salt":   salt,
+		},
+		"cipher":     map[string]interface{}{"name": "nacl/secretbox", "nonce": nonce[:]},
+		"ciphertext": secretbox.Seal(nil, der, &nonce, &secretKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED SIGSTORE PRIVATE KEY", Bytes: payload})
+}
+
+func TestCosignSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("0123  image.raw\n")
+	signer := &ibk.CosignSigner{Key: cosignKey(t, key, "s3cr3t"), Password: "s3cr3t"}
+	sig, err := signer.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(string(sig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(&key.PublicKey, digest[:], raw) {
+		t.Error("signature verification failed")
+	}
+
+	signer.Password = "wrong"
+	if _, err := signer.Sign(data); err == nil {
+		t.Error("expected error with a wrong password")
+	}
+}
@@ -1,13 +1,113 @@
 package ibk
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ExecuteOptions are standard input, output and error of an executed command. Transports
+// initialize them from their configuration before applying ExecuteOpt functions.
+type ExecuteOptions struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ExecuteOpt is a function that configures a command execution.
+type ExecuteOpt func(*ExecuteOptions)
+
+// WithCombinedWriter configures the execution to use the specified buffer for both standard
+// output and error.
+func WithCombinedWriter(w *SyncedBuffer) ExecuteOpt {
+	return func(o *ExecuteOptions) {
+		o.Stdout = w
+		o.Stderr = w
+	}
+}
+
+// WithInputOutput configures the execution to use the specified reader and writers for standard
+// input, output, and error.
+func WithInputOutput(stdin io.Reader, stdout, stderr io.Writer) ExecuteOpt {
+	return func(o *ExecuteOptions) {
+		o.Stdin = stdin
+		o.Stdout = stdout
+		o.Stderr = stderr
+	}
+}
+
+// WithOutputTap configures the execution to copy standard output and error also to the
+// specified writer. The writer must be safe for concurrent use.
+func WithOutputTap(w io.Writer) ExecuteOpt {
+	return func(o *ExecuteOptions) {
+		o.Stdout = tee(o.Stdout, w)
+		o.Stderr = tee(o.Stderr, w)
+	}
+}
+
+// LineTap calls a function for every line of standard output and error of executions
+// configured via WithLineTap. Each stream is split into lines separately so partial lines of
+// both streams are never joined, calls of the function are serialized. Flush must be called
+// once the executions finished to pass on unterminated last lines.
+type LineTap struct {
+	mu      sync.Mutex
+	line    func(string)
+	writers []*lineWriter
+}
+
+// NewLineTap returns a tap calling the function for every line.
+func NewLineTap(line func(string)) *LineTap {
+	return &LineTap{line: line}
+}
+
+func (t *LineTap) serialized(s string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.line(s)
+}
+
+// Flush calls the function for unterminated last lines of the streams.
+func (t *LineTap) Flush() {
+	t.mu.Lock()
+	writers := t.writers
+	t.writers = nil
+	t.mu.Unlock()
+
+	for _, w := range writers {
+		w.Flush()
+	}
+}
+
+// WithLineTap configures the execution to pass standard output and error to the tap.
+func WithLineTap(tap *LineTap) ExecuteOpt {
+	return func(o *ExecuteOptions) {
+		stdout := newLineWriter(tap.serialized)
+		stderr := newLineWriter(tap.serialized)
+
+		tap.mu.Lock()
+		tap.writers = append(tap.writers, stdout, stderr)
+		tap.mu.Unlock()
+
+		o.Stdout = tee(o.Stdout, stdout)
+		o.Stderr = tee(o.Stderr, stderr)
+	}
+}
+
+// tee returns a writer copying writes to both writers, dst may be nil.
+func tee(dst, w io.Writer) io.Writer {
+	if dst == nil {
+		return w
+	}
+	return io.MultiWriter(dst, w)
+}
 
 type Pusher interface {
 	Push(ctx context.Context, contents, extension string) (string, error)
 }
 
 type Executor interface {
-	Execute(ctx context.Context, cmd Command, opts ...ExecuteOpt) error
+	Execute(ctx context.Context, inv Invocation, opts ...ExecuteOpt) error
 }
 
 type Closer interface {
@@ -19,3 +119,13 @@ type Transport interface {
 	Executor
 	Closer
 }
+
+// ExitError is returned by an Executor when the remote command exits with a non-zero status.
+type ExitError struct {
+	// Status is the exit status of the remote command.
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
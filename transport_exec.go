@@ -0,0 +1,173 @@
+package ibk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"al.essio.dev/pkg/shellescape"
+)
+
+// ExecTransportConfig is a configuration struct for creating a new ExecTransport.
+type ExecTransportConfig struct {
+	// Prefix is the local command which runs its arguments in the build environment, e.g.
+	// "kubectl exec -i POD --" or "podman exec -i CONTAINER". It must pass the standard
+	// input through. Commands are executed locally when empty.
+	Prefix []string
+
+	// TempDir is the directory of pushed files in the build environment. The default is /tmp.
+	TempDir string
+
+	// Stdin is the standard input of executed commands. The default is no input.
+	Stdin io.Reader
+
+	// Stdout is the standard output of executed commands. The default is os.Stdout.
+	Stdout io.Writer
+
+	// Stderr is the standard error of executed commands. The default is os.Stderr.
+	Stderr io.Writer
+}
+
+// ExecTransport runs commands in the build environment through a local command prefix.
+// Every invocation is rendered into a shell command and executed via "sh -c" appended to the
+// prefix, files are pushed by streaming them to cat through the same prefix.
+type ExecTransport struct {
+	prefix   []string
+	tempDir  string
+	stdin    io.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+	toDelete []string
+}
+
+var _ Transport = (*ExecTransport)(nil)
+
+// NewExecTransport creates a new ExecTransport with the given configuration. Unlike SSH, no
+// connection is established, the prefix is executed for every command.
+func NewExecTransport(cfg ExecTransportConfig) (*ExecTransport, error) {
+	if len(cfg.Prefix) > 0 {
+		if _, err := exec.LookPath(cfg.Prefix[0]); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCommand, err)
+		}
+	}
+
+	if cfg.TempDir == "" {
+		cfg.TempDir = "/tmp"
+	}
+
+	if cfg.Stdout == nil {
+		cfg.Stdout = os.Stdout
+	}
+
+	if cfg.Stderr == nil {
+		cfg.Stderr = os.Stderr
+	}
+
+	return &ExecTransport{
+		prefix:   cfg.Prefix,
+		tempDir:  cfg.TempDir,
+		stdin:    cfg.Stdin,
+		stdout:   cfg.Stdout,
+		stderr:   cfg.Stderr,
+		toDelete: make([]string, 0),
+	}, nil
+}
+
+// Execute runs the invocation through the prefix, invocations which need a script are pushed
+// as a temporary file first and executed via bash.
+func (t *ExecTransport) Execute(ctx context.Context, inv Invocation, opts ...ExecuteOpt) error {
+	command := inv.String()
+	if inv.Scripted() {
+		script, err := t.Push(ctx, command, "sh")
+		if err != nil {
+			return err
+		}
+		command = "bash " + shellescape.Quote(script)
+	}
+
+	o := ExecuteOptions{
+		Stdin:  t.stdin,
+		Stdout: t.stdout,
+		Stderr: t.stderr,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return t.run(ctx, command, o)
+}
+
+// execWaitDelay is how long to wait for the output to be closed after the prefix exits.
+const execWaitDelay = 5 * time.Second
+
+func (t *ExecTransport) run(ctx context.Context, command string, o ExecuteOptions) error {
+	argv := append(append([]string{}, t.prefix...), "sh", "-c", command)
+	log.Printf("[DEBUG] Executing %q", shellescape.QuoteCommand(argv))
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = o.Stdin
+	cmd.Stdout = o.Stdout
+	cmd.Stderr = o.Stderr
+
+	// processes started by the killed prefix may keep the output open
+	cmd.WaitDelay = execWaitDelay
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return fmt.Errorf("%w: %w", ErrCommand, &ExitError{Status: ee.ExitCode()})
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrCommand, err)
+	}
+
+	return nil
+}
+
+// Push streams the contents to a temporary file in the build environment through the prefix.
+// Returns the path of the temporary file. The file(s) will be deleted when the transport is
+// closed.
+func (t *ExecTransport) Push(ctx context.Context, contents, extension string) (string, error) {
+	if extension == "" {
+		extension = "tmp"
+	}
+	targetFile := path.Join(t.tempDir, fmt.Sprintf("ibpacker-%s.%s", RandomString(13), extension))
+	t.toDelete = append(t.toDelete, targetFile)
+
+	stderr := &SyncedBuffer{}
+	command := shellescape.QuoteCommand([]string{"sh", "-c", `umask 077 && cat > "$1"`, "sh", targetFile})
+	err := t.run(ctx, command, ExecuteOptions{Stdin: strings.NewReader(contents), Stderr: stderr})
+	if err != nil {
+		return "", fmt.Errorf("%w: %w: %s", ErrCopy, err, stderr.String())
+	}
+
+	return targetFile, nil
+}
+
+// Close deletes the temporary files created by Push.
+func (t *ExecTransport) Close(ctx context.Context) error {
+	if len(t.toDelete) == 0 {
+		return nil
+	}
+
+	log.Printf("[DEBUG] Deleting files %q", t.toDelete)
+	command := shellescape.QuoteCommand(append([]string{"rm", "-f"}, t.toDelete...))
+	err := t.run(ctx, command, ExecuteOptions{Stdout: io.Discard, Stderr: io.Discard})
+	if err != nil {
+		log.Printf("Failed to delete files %q: %v", t.toDelete, err)
+	}
+	t.toDelete = nil
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package ibk_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+// sudoStub puts a sudo executing its arguments first in PATH, privileged invocations run as
+// the current user.
+func sudoStub(t *testing.T) {
+	t.Helper()
+
+	bin := t.TempDir()
+	err := os.WriteFile(filepath.Join(bin, "sudo"), []byte("#!/bin/sh\nexec \"$@\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestExecTransport(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// env runs its arguments like kubectl exec or podman exec do in the container
+	et, err := ibk.NewExecTransport(ibk.ExecTransportConfig{Prefix: []string{"env", "IBK_TEST=1"}, TempDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := &ibk.SyncedBuffer{}
+	err = et.Execute(ctx, ibk.Invocation{Args: []string{"sh", "-c", `echo "$IBK_TEST $1"`, "sh", "it's quoted"}},
+		ibk.WithInputOutput(nil, stdout, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "1 it's quoted\n" {
+		t.Errorf("unexpected output: %q", stdout.String())
+	}
+
+	path, err := et.Push(ctx, "contents", "toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(path) != dir || filepath.Ext(path) != ".toml" || string(contents) != "contents" {
+		t.Errorf("unexpected pushed file %s: %q", path, contents)
+	}
+
+	// scripted invocations are pushed and executed via bash
+	stdout.Reset()
+	err = et.Execute(ctx, ibk.Invocation{
+		Args: []string{"echo", "first"},
+		Then: []ibk.Invocation{{Args: []string{"echo", "then"}}},
+	}, ibk.WithInputOutput(nil, stdout, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "first\nthen\n" {
+		t.Errorf("unexpected output: %q", stdout.String())
+	}
+
+	err = et.Execute(ctx, ibk.Invocation{Args: []string{"sh", "-c", "exit 3"}})
+	var ee *ibk.ExitError
+	if !errors.As(err, &ee) || ee.Status != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+
+	err = et.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("unexpected files left: %v", entries)
+	}
+}
+
+func TestExecTransportDownload(t *testing.T) {
+	ctx := context.Background()
+
+	sudoStub(t)
+
+	outputDir := t.TempDir()
+	image := "head" + strings.Repeat("\x00", 1<<20) + "tail"
+	err := os.WriteFile(filepath.Join(outputDir, "disk.raw"), []byte(image), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	et, err := ibk.NewExecTransport(ibk.ExecTransportConfig{Prefix: []string{"env"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	res := &ibk.Result{
+		OutputDir: outputDir,
+		Files:     []ibk.File{{Path: filepath.Join(outputDir, "disk.raw"), Size: int64(len(image)), SHA256: sha256Hex(image)}},
+	}
+	err = ibk.DownloadResult(ctx, et, res, ibk.DownloadConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(dir, "disk.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != image {
+		t.Errorf("downloaded file differs")
+	}
+}
+
+func TestExecTransportCancel(t *testing.T) {
+	et, err := ibk.NewExecTransport(ibk.ExecTransportConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = et.Execute(ctx, ibk.Invocation{Shell: "exec sleep 10"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("command was not cancelled")
+	}
+}
+
+func TestExecTransportMissingPrefix(t *testing.T) {
+	_, err := ibk.NewExecTransport(ibk.ExecTransportConfig{Prefix: []string{"ibk-no-such-command"}})
+	if !errors.Is(err, ibk.ErrCommand) {
+		t.Errorf("expected ErrCommand, got %v", err)
+	}
+}
@@ -0,0 +1,403 @@
+package ibk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultPodmanStopTimeout is how long a container is given to stop when the build is
+// cancelled before it is killed.
+const DefaultPodmanStopTimeout = 10 * time.Second
+
+// PodmanAPITransportConfig is a configuration struct for creating a new PodmanAPITransport.
+type PodmanAPITransportConfig struct {
+	// Socket is the path of the rootful podman API socket on the build host, it must be
+	// accessible to the connected user. DefaultPodmanSocket when empty.
+	Socket string
+
+	// StopTimeout is how long a container is given to stop when the context is cancelled
+	// before it is killed. DefaultPodmanStopTimeout when zero.
+	StopTimeout time.Duration
+
+	// Stdout is the standard output of containers. The default is os.Stdout.
+	Stdout io.Writer
+
+	// Stderr is the standard error of containers. The default is os.Stderr.
+	Stderr io.Writer
+}
+
+// PodmanAPITransport runs containers via the libpod REST API instead of the podman command
+// line. The API socket of the build host is reached through the dialer, e.g. forwarded over
+// the SSH connection. Exit codes are reported exactly, containers are stopped and removed when
+// the context is cancelled and the container ID is emitted as EventContainerCreated.
+//
+// Only privileged podman container invocations are executed via the API, everything else
+// including dry runs, interactive containers and pushes is passed to the underlying transport
+// which is also used to write log files, run follow-up invocations and delete cleanup files.
+type PodmanAPITransport struct {
+	Transport
+
+	client      *PodmanClient
+	stopTimeout time.Duration
+	stdout      io.Writer
+	stderr      io.Writer
+	home        string
+}
+
+var _ Transport = (*PodmanAPITransport)(nil)
+
+// NewPodmanAPITransport creates a new PodmanAPITransport wrapping the transport, the API is
+// pinged to check the socket is reachable.
+func NewPodmanAPITransport(ctx context.Context, t Transport, d Dialer, cfg PodmanAPITransportConfig) (*PodmanAPITransport, error) {
+	if cfg.Socket == "" {
+		cfg.Socket = DefaultPodmanSocket
+	}
+
+	if cfg.StopTimeout == 0 {
+		cfg.StopTimeout = DefaultPodmanStopTimeout
+	}
+
+	if cfg.Stdout == nil {
+		cfg.Stdout = os.Stdout
+	}
+
+	if cfg.Stderr == nil {
+		cfg.Stderr = os.Stderr
+	}
+
+	client := NewPodmanClient(d, cfg.Socket)
+	err := client.Ping(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w (socket %s)", err, cfg.Socket)
+	}
+	log.Printf("[DEBUG] Connected to podman API socket %s", cfg.Socket)
+
+	return &PodmanAPITransport{
+		Transport:   t,
+		client:      client,
+		stopTimeout: cfg.StopTimeout,
+		stdout:      cfg.Stdout,
+		stderr:      cfg.Stderr,
+	}, nil
+}
+
+// api returns true when the invocation is executed via the API.
+func (t *PodmanAPITransport) api(inv Invocation) bool {
+	ctr := inv.Container
+	return ctr != nil &&
+		filepath.Base(ctr.Runtime) == "podman" &&
+		inv.Privileged &&
+		!inv.DryRun &&
+		inv.Shell == "" &&
+		len(inv.Env) == 0 &&
+		!ctr.Interactive &&
+		!ctr.TTY
+}
+
+// Execute runs privileged podman containers via the API, other invocations are executed by
+// the underlying transport. The log file, cleanup files and follow-up invocations are handled
+// as in Script: the combined output is copied to the log file, cleanup files are deleted
+// regardless of the exit code and follow-up invocations run after the container succeeds.
+func (t *PodmanAPITransport) Execute(ctx context.Context, inv Invocation, opts ...ExecuteOpt) error {
+	if !t.api(inv) {
+		return t.Transport.Execute(ctx, inv, opts...)
+	}
+
+	o := ExecuteOptions{
+		Stdout: t.stdout,
+		Stderr: t.stderr,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if len(inv.Cleanup) > 0 {
+		defer t.cleanup(ctx, inv.Cleanup)
+	}
+
+	stdout, stderr := o.Stdout, o.Stderr
+	var logFile *remoteWriter
+	if inv.LogFile != "" {
+		logFile = t.createFile(ctx, inv.Dir, inv.LogFile)
+		stdout = multiWriter(o.Stdout, logFile)
+		stderr = stdout
+	}
+
+	code, err := t.run(ctx, inv, stdout, stderr)
+	if logFile != nil {
+		lerr := logFile.Close()
+		if err == nil && lerr != nil {
+			err = fmt.Errorf("%w: log %s: %w", ErrCommand, inv.LogFile, lerr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if code != 0 {
+		if o.Stderr != nil {
+			if inv.LogFile != "" {
+				fmt.Fprintf(o.Stderr, "command failed with exit code %d, log: %s\n", code, inv.LogFile)
+			} else {
+				fmt.Fprintf(o.Stderr, "command failed with exit code %d\n", code)
+			}
+		}
+		return fmt.Errorf("%w: %w", ErrCommand, &ExitError{Status: code})
+	}
+
+	for _, then := range inv.Then {
+		if then.Dir == "" {
+			then.Dir = inv.Dir
+		}
+		err = t.Execute(ctx, then, opts...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// run pulls the image, creates and starts the container, follows its output and returns
+// its exit code. The container is stopped when the context is cancelled and removed unless
+// Container.Remove is false.
+func (t *PodmanAPITransport) run(ctx context.Context, inv Invocation, stdout, stderr io.Writer) (int, error) {
+	ctr := inv.Container
+	spec, err := t.spec(ctx, inv)
+	if err != nil {
+		return 0, err
+	}
+
+	policy := ctr.Pull
+	if policy == "" {
+		policy = "missing"
+	}
+	err = t.client.Pull(ctx, ctr.Image, policy, func(line string) {
+		if stderr != nil {
+			fmt.Fprintln(stderr, line)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := t.client.Create(ctx, spec)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("[DEBUG] Created container %s of %s", id, ctr.Image)
+	emit(ctx, Event{Type: EventContainerCreated, Message: id})
+
+	// the container is stopped and removed even when the context is cancelled
+	bg := context.WithoutCancel(ctx)
+	if ctr.Remove {
+		defer func() {
+			err := t.client.Remove(bg, id)
+			if err != nil {
+				log.Printf("[DEBUG] Failed to remove container %s: %v", id, err)
+			}
+		}()
+	}
+
+	err = t.client.Start(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	// logs are followed until the container exits, they are kept after it exited
+	logsCtx, cancelLogs := context.WithCancel(bg)
+	defer cancelLogs()
+	logs := make(chan error, 1)
+	go func() {
+		logs <- t.client.Logs(logsCtx, id, stdout, stderr)
+	}()
+
+	code, err := t.client.Wait(ctx, id)
+	if ctx.Err() != nil {
+		log.Printf("[DEBUG] Stopping container %s", id)
+		serr := t.client.Stop(bg, id, t.stopTimeout)
+		if serr != nil {
+			log.Printf("[DEBUG] Failed to stop container %s: %v", id, serr)
+		}
+		cancelLogs()
+		<-logs
+		return 0, ctx.Err()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = <-logs
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("[DEBUG] Container %s exited with code %d", id, code)
+
+	return code, nil
+}
+
+// spec converts the container into the API specification. Relative mount sources are resolved
+// against the working directory or the home directory as by the command line, environment
+// files are read on the build host.
+func (t *PodmanAPITransport) spec(ctx context.Context, inv Invocation) (PodmanSpec, error) {
+	ctr := inv.Container
+	spec := PodmanSpec{
+		Image:      ctr.Image,
+		Command:    inv.Args,
+		Privileged: ctr.Privileged,
+	}
+
+	if ctr.Entrypoint != "" {
+		spec.Entrypoint = []string{ctr.Entrypoint}
+	}
+
+	for _, so := range ctr.SecurityOpts {
+		key, value, _ := strings.Cut(so, "=")
+		switch key {
+		case "label":
+			spec.SelinuxOpts = append(spec.SelinuxOpts, value)
+		case "seccomp":
+			spec.SeccompProfilePath = value
+		default:
+			return spec, fmt.Errorf("%w: unsupported security option %q", ErrPodmanAPI, so)
+		}
+	}
+
+	for _, m := range ctr.Mounts {
+		source := m.Source
+		if !path.IsAbs(source) {
+			dir, err := t.workDir(ctx, inv.Dir)
+			if err != nil {
+				return spec, err
+			}
+			source = path.Join(dir, source)
+		}
+
+		options := []string{"rbind"}
+		if m.ReadOnly {
+			options = append(options, "ro")
+		}
+		spec.Mounts = append(spec.Mounts, PodmanMount{Destination: m.Target, Source: source, Type: "bind", Options: options})
+	}
+
+	for _, s := range ctr.Secrets {
+		if s.Type == "mount" {
+			spec.Secrets = append(spec.Secrets, PodmanSecret{Source: s.Name, Target: s.Target})
+			continue
+		}
+		if spec.SecretEnv == nil {
+			spec.SecretEnv = make(map[string]string)
+		}
+		spec.SecretEnv[s.Target] = s.Name
+	}
+
+	env := make(map[string]string)
+	for _, ef := range ctr.EnvFiles {
+		contents, err := output(ctx, t.Transport, Invocation{Privileged: inv.Privileged, Dir: inv.Dir, Args: []string{"cat", "--", ef}})
+		if err != nil {
+			return spec, fmt.Errorf("%w: env file %s: %w", ErrPodmanAPI, ef, err)
+		}
+		for _, line := range strings.Split(contents, "\n") {
+			line = strings.TrimSpace(line)
+			if k, v, ok := strings.Cut(line, "="); ok && !strings.HasPrefix(line, "#") {
+				env[k] = v
+			}
+		}
+	}
+	for _, e := range ctr.Env {
+		k, v, _ := strings.Cut(e, "=")
+		env[k] = v
+	}
+	if len(env) > 0 {
+		spec.Env = env
+	}
+
+	return spec, nil
+}
+
+// workDir returns the absolute working directory of the invocation, the home directory of
+// the connected user is queried once.
+func (t *PodmanAPITransport) workDir(ctx context.Context, dir string) (string, error) {
+	if path.IsAbs(dir) {
+		return dir, nil
+	}
+
+	if t.home == "" {
+		home, err := tail1(ctx, t.Transport, Invocation{Args: []string{"pwd"}, Idempotent: true})
+		if err != nil || !path.IsAbs(home) {
+			return "", fmt.Errorf("%w: home directory: %v %s", ErrPodmanAPI, err, home)
+		}
+		t.home = home
+	}
+
+	return path.Join(t.home, dir), nil
+}
+
+// cleanup deletes the files via the underlying transport.
+func (t *PodmanAPITransport) cleanup(ctx context.Context, files []string) {
+	err := t.Transport.Execute(context.WithoutCancel(ctx), Invocation{Args: append([]string{"rm", "-f", "--"}, files...)})
+	if err != nil {
+		log.Printf("Failed to delete files %q: %v", files, err)
+	}
+}
+
+// createFile returns a writer streaming into the file on the build host via the underlying
+// transport.
+func (t *PodmanAPITransport) createFile(ctx context.Context, dir, name string) *remoteWriter {
+	r, w := io.Pipe()
+	stderr := &SyncedBuffer{}
+	done := make(chan error, 1)
+	go func() {
+		err := t.Transport.Execute(ctx, Invocation{
+			Dir:  dir,
+			Args: []string{"sh", "-c", `cat > "$1"`, "sh", name},
+		}, WithInputOutput(r, nil, stderr))
+		if err != nil {
+			err = fmt.Errorf("%w: %s", err, stderr.String())
+		}
+		r.CloseWithError(err)
+		done <- err
+	}()
+
+	return &remoteWriter{w: w, done: done}
+}
+
+// Close closes the API connections and the underlying transport.
+func (t *PodmanAPITransport) Close(ctx context.Context) error {
+	t.client.Close()
+	return t.Transport.Close(ctx)
+}
+
+// remoteWriter writes into a remote file, Close waits until the file was written.
+type remoteWriter struct {
+	w    *io.PipeWriter
+	done <-chan error
+}
+
+func (w *remoteWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (w *remoteWriter) Close() error {
+	w.w.Close()
+	return <-w.done
+}
+
+// multiWriter returns a writer duplicating writes to the writers, nil writers are skipped.
+func multiWriter(writers ...io.Writer) io.Writer {
+	var ws []io.Writer
+	for _, w := range writers {
+		if w != nil {
+			ws = append(ws, w)
+		}
+	}
+
+	return io.MultiWriter(ws...)
+}
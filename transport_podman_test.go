@@ -0,0 +1,351 @@
+package ibk_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	ibk "github.com/osbuild/packer-plugin-image-builder"
+)
+
+// fakePodman is a stand-in of the libpod API running a single container.
+type fakePodman struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+
+	// Block keeps the container running until it is stopped.
+	Block bool
+
+	mu      sync.Mutex
+	calls   []string
+	spec    ibk.PodmanSpec
+	waiting chan struct{}
+	stopped chan struct{}
+}
+
+func (f *fakePodman) call(r *http.Request) string {
+	path := strings.TrimPrefix(r.URL.Path, "/v4.0.0/libpod")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, r.Method+" "+path)
+	return path
+}
+
+func (f *fakePodman) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+func (f *fakePodman) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path := f.call(r); path {
+	case "/_ping":
+		fmt.Fprint(w, "OK")
+	case "/images/pull":
+		ref := r.URL.Query().Get("reference")
+		if ref == "example.com/missing" {
+			fmt.Fprintf(w, `{"error":"%s: manifest unknown"}`+"\n", ref)
+			return
+		}
+		fmt.Fprintf(w, `{"stream":"Trying to pull %s...\n"}`+"\n", ref)
+		fmt.Fprint(w, `{"id":"1234","images":["1234"]}`+"\n")
+	case "/containers/create":
+		f.mu.Lock()
+		err := json.NewDecoder(r.Body).Decode(&f.spec)
+		f.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"Id":"ctr1","Warnings":[]}`)
+	case "/containers/ctr1/start":
+		w.WriteHeader(http.StatusNoContent)
+	case "/containers/ctr1/logs":
+		writeFrame(w, 1, f.Stdout)
+		writeFrame(w, 2, f.Stderr)
+		w.(http.Flusher).Flush()
+		if f.Block {
+			<-f.stopped
+		}
+	case "/containers/ctr1/wait":
+		code := f.ExitCode
+		if f.Block {
+			close(f.waiting)
+			select {
+			case <-f.stopped:
+				code = 143
+			case <-r.Context().Done():
+				return
+			}
+		}
+		fmt.Fprint(w, code)
+	case "/containers/ctr1/stop":
+		close(f.stopped)
+		w.WriteHeader(http.StatusNoContent)
+	case "/containers/ctr1":
+		fmt.Fprint(w, `[{"Id":"ctr1"}]`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"cause":"no such container","message":"%s: no such container","response":404}`, path)
+	}
+}
+
+func writeFrame(w http.ResponseWriter, stream byte, data string) {
+	if data == "" {
+		return
+	}
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	w.Write(header)
+	w.Write([]byte(data))
+}
+
+// podmanTransport returns a PodmanAPITransport connected to the stand-in over a unix socket,
+// other invocations are executed locally.
+func podmanTransport(t *testing.T, f *fakePodman, stdout, stderr *ibk.SyncedBuffer) *ibk.PodmanAPITransport {
+	t.Helper()
+	sudoStub(t)
+	f.waiting = make(chan struct{})
+	f.stopped = make(chan struct{})
+
+	socket := filepath.Join(t.TempDir(), "podman.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(f)
+	server.Listener = l
+	server.Start()
+	t.Cleanup(server.Close)
+
+	local, err := ibk.NewExecTransport(ibk.ExecTransportConfig{TempDir: t.TempDir(), Stdout: stdout, Stderr: stderr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pt, err := ibk.NewPodmanAPITransport(context.Background(), local, &net.Dialer{}, ibk.PodmanAPITransportConfig{
+		Socket: socket,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pt.Close(context.Background()) })
+
+	return pt
+}
+
+func TestPodmanAPITransport(t *testing.T) {
+	f := &fakePodman{Stdout: "Building image...\n", Stderr: "warning\n"}
+	stdout := &ibk.SyncedBuffer{}
+	pt := podmanTransport(t, f, stdout, stdout)
+
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "creds.env")
+	err := os.WriteFile(envFile, []byte("# credentials\nAWS_SECRET_ACCESS_KEY=secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []ibk.Event
+	ctx := ibk.WithObserver(context.Background(), ibk.ObserverFunc(func(e ibk.Event) {
+		events = append(events, e)
+	}))
+
+	logFile := filepath.Join(dir, "build.log")
+	err = pt.Execute(ctx, ibk.Invocation{
+		Privileged: true,
+		Dir:        dir,
+		Container: &ibk.Container{
+			Runtime:      "/usr/bin/podman",
+			Image:        "ghcr.io/osbuild/image-builder-cli:latest",
+			Privileged:   true,
+			Remove:       true,
+			SecurityOpts: []string{"label=type:unconfined_t"},
+			Mounts: []ibk.Mount{
+				{Source: "./output", Target: "/output"},
+				{Source: "/tmp/bp.toml", Target: "/config.toml", ReadOnly: true},
+			},
+			Secrets:  []ibk.ContainerSecret{{Name: "ibpacker-key", Target: "AWS_ACCESS_KEY_ID"}},
+			EnvFiles: []string{envFile},
+			Env:      []string{"AWS_REGION=us-east-1"},
+		},
+		Args:    []string{"build", "minimal-raw"},
+		LogFile: logFile,
+		Cleanup: []string{envFile},
+		Then:    []ibk.Invocation{{Args: []string{"echo", "then"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedSpec := ibk.PodmanSpec{
+		Image:      "ghcr.io/osbuild/image-builder-cli:latest",
+		Command:    []string{"build", "minimal-raw"},
+		Privileged: true,
+		Env: map[string]string{
+			"AWS_SECRET_ACCESS_KEY": "secret",
+			"AWS_REGION":            "us-east-1",
+		},
+		Mounts: []ibk.PodmanMount{
+			{Destination: "/output", Source: filepath.Join(dir, "output"), Type: "bind", Options: []string{"rbind"}},
+			{Destination: "/config.toml", Source: "/tmp/bp.toml", Type: "bind", Options: []string{"rbind", "ro"}},
+		},
+		SecretEnv:   map[string]string{"AWS_ACCESS_KEY_ID": "ibpacker-key"},
+		SelinuxOpts: []string{"type:unconfined_t"},
+	}
+	if diff := cmp.Diff(expectedSpec, f.spec); diff != "" {
+		t.Errorf("unexpected spec (-want +got):\n%s", diff)
+	}
+
+	expectedCalls := []string{
+		"GET /_ping",
+		"POST /images/pull",
+		"POST /containers/create",
+		"POST /containers/ctr1/start",
+		"GET /containers/ctr1/logs",
+		"POST /containers/ctr1/wait",
+		"DELETE /containers/ctr1",
+	}
+	calls := f.Calls()
+	// logs and wait are requested concurrently
+	if len(calls) == len(expectedCalls) && calls[4] > calls[5] {
+		calls[4], calls[5] = calls[5], calls[4]
+	}
+	if diff := cmp.Diff(expectedCalls, calls); diff != "" {
+		t.Errorf("unexpected calls (-want +got):\n%s", diff)
+	}
+
+	expectedOutput := "Trying to pull ghcr.io/osbuild/image-builder-cli:latest...\nBuilding image...\nwarning\nthen\n"
+	if stdout.String() != expectedOutput {
+		t.Errorf("unexpected output: %q", stdout.String())
+	}
+
+	log, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(log), "Building image...\nwarning\n") {
+		t.Errorf("unexpected log: %q", log)
+	}
+
+	if _, err := os.Stat(envFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("cleanup file was not deleted: %v", err)
+	}
+
+	if len(events) != 1 || events[0].Type != ibk.EventContainerCreated || events[0].Message != "ctr1" {
+		t.Errorf("unexpected events: %v", events)
+	}
+}
+
+func TestPodmanAPITransportExitCode(t *testing.T) {
+	f := &fakePodman{Stderr: "error: unknown distro\n", ExitCode: 2}
+	stdout := &ibk.SyncedBuffer{}
+	stderr := &ibk.SyncedBuffer{}
+	pt := podmanTransport(t, f, stdout, stderr)
+
+	err := pt.Execute(context.Background(), ibk.Invocation{
+		Privileged: true,
+		Container:  &ibk.Container{Runtime: "podman", Image: "example.com/builder", Remove: true},
+		Args:       []string{"build"},
+		Then:       []ibk.Invocation{{Args: []string{"echo", "then"}}},
+	})
+
+	var ee *ibk.ExitError
+	if !errors.As(err, &ee) || ee.Status != 2 || !errors.Is(err, ibk.ErrCommand) {
+		t.Fatalf("expected exit status 2, got %v", err)
+	}
+	if stderr.String() != "Trying to pull example.com/builder...\nerror: unknown distro\ncommand failed with exit code 2\n" {
+		t.Errorf("unexpected stderr: %q", stderr.String())
+	}
+	if stdout.String() != "" {
+		t.Errorf("follow-up invocation executed: %q", stdout.String())
+	}
+}
+
+func TestPodmanAPITransportCancel(t *testing.T) {
+	f := &fakePodman{Stdout: "Building image...\n", Block: true}
+	stdout := &ibk.SyncedBuffer{}
+	pt := podmanTransport(t, f, stdout, stdout)
+
+	// cancel while the container is running
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-f.waiting
+		cancel()
+	}()
+
+	err := pt.Execute(ctx, ibk.Invocation{
+		Privileged: true,
+		Container:  &ibk.Container{Runtime: "podman", Image: "example.com/builder", Remove: true},
+		Args:       []string{"build"},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+
+	if stdout.String() != "Trying to pull example.com/builder...\nBuilding image...\n" {
+		t.Errorf("unexpected output: %q", stdout.String())
+	}
+
+	calls := f.Calls()
+	for _, call := range []string{"POST /containers/ctr1/stop", "DELETE /containers/ctr1"} {
+		if !strings.Contains(strings.Join(calls, "\n"), call) {
+			t.Errorf("expected %s, got %v", call, calls)
+		}
+	}
+}
+
+func TestPodmanAPITransportPullError(t *testing.T) {
+	f := &fakePodman{}
+	pt := podmanTransport(t, f, &ibk.SyncedBuffer{}, &ibk.SyncedBuffer{})
+
+	err := pt.Execute(context.Background(), ibk.Invocation{
+		Privileged: true,
+		Container:  &ibk.Container{Runtime: "podman", Image: "example.com/missing", Remove: true},
+	})
+	if !errors.Is(err, ibk.ErrPodmanAPI) || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Errorf("expected pull error, got %v", err)
+	}
+}
+
+func TestPodmanAPITransportPassthrough(t *testing.T) {
+	f := &fakePodman{}
+	stdout := &ibk.SyncedBuffer{}
+	pt := podmanTransport(t, f, stdout, stdout)
+
+	// dry runs and other commands are executed by the underlying transport
+	invs := []ibk.Invocation{
+		{Args: []string{"echo", "hello"}},
+		{Privileged: true, DryRun: true, Container: &ibk.Container{Runtime: "podman", Image: "example.com/builder"}},
+	}
+	for _, inv := range invs {
+		err := pt.Execute(context.Background(), inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stdout.String() != "hello\nsudo podman run example.com/builder\n" {
+		t.Errorf("unexpected output: %q", stdout.String())
+	}
+	if diff := cmp.Diff([]string{"GET /_ping"}, f.Calls()); diff != "" {
+		t.Errorf("unexpected calls (-want +got):\n%s", diff)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"strings"
 	"time"
 
+	"al.essio.dev/pkg/shellescape"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 )
@@ -193,56 +194,56 @@ var noopCallback ssh.HostKeyCallback = func(_ string, _ net.Addr, _ ssh.PublicKe
 	return nil
 }
 
-// ExecuteOpt is a function that configures the SSH session for a command execution
-type ExecuteOpt func(*ssh.Session)
-
-// WithStdinWriter configures the SSH session to use the specified writer for standard input.
-func WithCombinedWriter(w *SyncedBuffer) ExecuteOpt {
-	return func(s *ssh.Session) {
-		s.Stdout = w
-		s.Stderr = w
-	}
-}
-
-// WithInputOutput configures the SSH session to use the specified reader and writers for standard input, output, and error.
-func WithInputOutput(stdin io.Reader, stdout, stderr io.Writer) ExecuteOpt {
-	return func(s *ssh.Session) {
-		s.Stdin = stdin
-		s.Stdout = stdout
-		s.Stderr = stderr
-	}
-}
-
 // Execute performs a command remotely via SSH session with standard input, output, and error configured
-// as specified in the SSHTransportConfig. The command is executed in the remote machine.
+// as specified in the SSHTransportConfig. The command is executed in the remote machine, invocations
+// which need a script are pushed as a temporary file first and executed via bash.
 // An optional arguments can be provided to override Stdout and Stderr config.
-func (t *SSHTransport) Execute(ctx context.Context, cmd Command, opts ...ExecuteOpt) error {
+func (t *SSHTransport) Execute(ctx context.Context, inv Invocation, opts ...ExecuteOpt) error {
 	var err error
 
+	command := inv.String()
+	if inv.Scripted() {
+		script, err := t.Push(ctx, command, "sh")
+		if err != nil {
+			return err
+		}
+		command = "bash " + shellescape.Quote(script)
+	}
+
 	s, err := t.client.NewSession()
 	if err != nil {
 		return fmt.Errorf("%w: %w", ErrSSHNewSession, err)
 	}
 	defer s.Close()
 
-	s.Stdin = t.stdin
-	s.Stdout = t.stdout
-	s.Stderr = t.stderr
-
+	o := ExecuteOptions{
+		Stdin:  t.stdin,
+		Stdout: t.stdout,
+		Stderr: t.stderr,
+	}
 	for _, opt := range opts {
-		opt(s)
+		opt(&o)
 	}
 
-	command := cmd.Build()
-	log.Printf("[DEBUG] Executing command %q", command)
+	s.Stdin = o.Stdin
+	s.Stdout = o.Stdout
+	s.Stderr = o.Stderr
+
 	err = s.Start(command)
 	if err != nil {
 		return fmt.Errorf("%w: %w", ErrCommand, err)
 	}
 
-	return Wait(ctx, func() error {
+	err = Wait(ctx, func() error {
 		return s.Wait()
 	})
+
+	var ee *ssh.ExitError
+	if errors.As(err, &ee) {
+		return fmt.Errorf("%w: %w", ErrCommand, &ExitError{Status: ee.ExitStatus()})
+	}
+
+	return err
 }
 
 // Push copies the contents of a reader to a temporary file on the remote machine. Returns
@@ -273,7 +274,6 @@ func (t *SSHTransport) Push(ctx context.Context, contents, extension string) (st
 		return "", fmt.Errorf("%w: %w", ErrCopy, err)
 	}
 
-	log.Printf("[DEBUG] Copying to temp file %q (size %d)", targetFile, len(contents))
 	fmt.Fprintf(w, "C%#o %d %s\n", 0600, len(contents), targetBaseFile)
 	io.Copy(w, strings.NewReader(contents))
 	fmt.Fprint(w, "\x00")
@@ -286,19 +286,30 @@ func (t *SSHTransport) Push(ctx context.Context, contents, extension string) (st
 	return targetFile, err
 }
 
+// DialContext opens a connection from the remote machine over the SSH connection, e.g. to a
+// unix socket on the remote machine.
+func (t *SSHTransport) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return t.client.DialContext(ctx, network, address)
+}
+
 // Close closes the SSH connection. Additionally, it deletes the temporary files created during the session.
 func (t *SSHTransport) Close(ctx context.Context) error {
-	s, err := t.client.NewSession()
-	if err == nil {
-		for _, file := range t.toDelete {
-			log.Printf("[DEBUG] Deleting file %q", file)
-			err := s.Run(fmt.Sprintf("rm -f %s", file))
+	if len(t.toDelete) > 0 {
+		s, err := t.client.NewSession()
+		if err == nil {
+			files := make([]string, 0, len(t.toDelete))
+			for _, file := range t.toDelete {
+				files = append(files, shellescape.Quote(file))
+			}
+
+			log.Printf("[DEBUG] Deleting files %q", t.toDelete)
+			err := s.Run("rm -f " + strings.Join(files, " "))
 			if err != nil {
-				log.Printf("Failed to delete file %q: %v", file, err)
+				log.Printf("Failed to delete files %q: %v", t.toDelete, err)
 			}
-		}
 
-		s.Close()
+			s.Close()
+		}
 	}
 
 	if t.client != nil {